@@ -0,0 +1,112 @@
+package gproxy
+
+import (
+	"context"
+	"github.com/graphikDB/gproxy/ipfilter"
+	"github.com/graphikDB/gproxy/metrics"
+	"github.com/graphikDB/gproxy/proxyproto"
+	"github.com/graphikDB/gproxy/server"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"net"
+	"net/http"
+)
+
+// errIPDenied is returned when a requests client ip isn't allowed by its routes ip filter
+var errIPDenied = errors.New("client ip denied")
+
+// OverrideIPFilters replaces the listener & per-route ip filters(ex: when the config is reloaded). A nil listener filter allows all connections
+func (p *Proxy) OverrideIPFilters(listener *ipfilter.Filter, routes map[string]*ipfilter.Filter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.listenerFilter = listener
+	p.ipFilters = map[string]*ipfilter.Filter{}
+	for name, filter := range routes {
+		p.ipFilters[name] = filter
+	}
+}
+
+func (p *Proxy) getListenerFilter() *ipfilter.Filter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.listenerFilter
+}
+
+// filterListener closes connections that aren't allowed by the listener ip filter before they are served
+func (p *Proxy) filterListener(l net.Listener) net.Listener {
+	return ipfilter.Listener(l, p.getListenerFilter, func(addr net.Addr) {
+		metrics.IPDenied.WithLabelValues("listener", "").Inc()
+		p.logger.Debug("connection denied by listener ip filter", zap.String("address", addr.String()))
+	})
+}
+
+// filterPacketConn drops datagrams from addresses that aren't allowed by the listener ip filter
+func (p *Proxy) filterPacketConn(conn net.PacketConn) net.PacketConn {
+	return ipfilter.PacketConn(conn, p.getListenerFilter, func(addr net.Addr) {
+		metrics.IPDenied.WithLabelValues("listener", "").Inc()
+		p.logger.Debug("packet denied by listener ip filter", zap.String("address", addr.String()))
+	})
+}
+
+// limitListener closes connections that exceed the servers connection limits. name identifies the listener in metrics & logs
+func (p *Proxy) limitListener(l net.Listener, name string) net.Listener {
+	return server.Listener(l, p.serverConfig, func(addr net.Addr, reason string) {
+		metrics.ConnectionsRejected.WithLabelValues(name, reason).Inc()
+		p.logger.Debug("connection limit exceeded",
+			zap.String("listener", name),
+			zap.String("address", addr.String()),
+			zap.String("reason", reason),
+		)
+	})
+}
+
+// proxyProtocolListener reads PROXY protocol headers from trusted sources(if enabled) so the original client address is
+// used by ip filters, logs, routing & forwarded headers
+func (p *Proxy) proxyProtocolListener(l net.Listener) net.Listener {
+	if p.proxyProtocol == nil {
+		return l
+	}
+	return proxyproto.Listener(l, p.proxyProtocol, 0, func(addr net.Addr, err error) {
+		p.logger.Debug("invalid PROXY protocol header", zap.String("address", addr.String()), zap.Error(err))
+	})
+}
+
+// ipFilter returns the ip filter registered for the route, falling back to the default("*") filter
+func (p *Proxy) ipFilter(routeName string) *ipfilter.Filter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if filter, ok := p.ipFilters[routeName]; ok {
+		return filter
+	}
+	return p.ipFilters["*"]
+}
+
+// checkIP checks the requests client ip(this.client_ip) against the routes ip filter
+func (p *Proxy) checkIP(r *route, data map[string]interface{}) error {
+	filter := p.ipFilter(r.name)
+	if filter == nil {
+		return nil
+	}
+	clientIP, _ := data["client_ip"].(string)
+	if filter.Allowed(net.ParseIP(clientIP)) {
+		return nil
+	}
+	metrics.IPDenied.WithLabelValues("route", r.name).Inc()
+	return errIPDenied
+}
+
+// httpClientIP returns the client ip of the request, honoring X-Forwarded-For when the request was sent by a trusted proxy
+func (p *Proxy) httpClientIP(req *http.Request) string {
+	return ipfilter.ClientIP(req.RemoteAddr, req.Header.Values("X-Forwarded-For"), p.trustedProxies)
+}
+
+// grpcClientIP returns the client ip of the request, honoring x-forwarded-for metadata when the request was sent by a trusted proxy
+func (p *Proxy) grpcClientIP(ctx context.Context, md metadata.MD) string {
+	pr, ok := peer.FromContext(ctx)
+	if !ok || pr.Addr == nil {
+		return ""
+	}
+	return ipfilter.ClientIP(pr.Addr.String(), md.Get("x-forwarded-for"), p.trustedProxies)
+}
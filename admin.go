@@ -0,0 +1,60 @@
+package gproxy
+
+import (
+	"crypto/subtle"
+	"github.com/autom8ter/machine"
+	"github.com/graphikDB/gproxy/metrics"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// serveAdmin starts the admin server in the background
+func (p *Proxy) serveAdmin() (*http.Server, error) {
+	lis, err := net.Listen("tcp", p.adminAddr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/canary", p.adminAuth(p.canaryHandler()))
+	mux.Handle("/cache/purge", p.adminAuth(p.cachePurgeHandler()))
+	adminServer := &http.Server{
+		Handler: mux,
+	}
+	p.mach.Go(func(routine machine.Routine) {
+		p.logger.Debug("starting admin server", zap.String("address", lis.Addr().String()))
+		if err := adminServer.Serve(lis); err != nil && err != http.ErrServerClosed {
+			p.logger.Error("admin server failure", zap.Error(err))
+		}
+	})
+	return adminServer, nil
+}
+
+// adminAuth requires the admin token on requests that change the proxies state. GET & HEAD requests are passed through,
+// only POST requests are accepted otherwise
+func (p *Proxy) adminAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			handler.ServeHTTP(w, r)
+			return
+		case http.MethodPost:
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if p.adminToken == "" {
+			http.Error(w, "admin token required", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(p.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,32 @@
+package gproxy
+
+import (
+	"github.com/graphikDB/gproxy/affinity"
+	"net/http"
+)
+
+// affinityPolicy returns the session affinity policy registered for the route, falling back to the default("*") policy
+func (p *Proxy) affinityPolicy(routeName string) *affinity.Policy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if policy, ok := p.affinities[routeName]; ok {
+		return policy
+	}
+	return p.affinities["*"]
+}
+
+// setAffinity records the requests affinity(affinity cookie & hash key) on the route so targets are selected in order of preference
+func (p *Proxy) setAffinity(rt *route, header http.Header, clientIP string) {
+	if policy := p.affinityPolicy(rt.name); policy != nil {
+		rt.affinity = policy.Affinity(header, clientIP)
+	}
+}
+
+// affinityCookie returns the affinity cookie that should be issued to pin the client to the target or nil if the client is already pinned
+func (p *Proxy) affinityCookie(rt *route, target string) *http.Cookie {
+	policy := p.affinityPolicy(rt.name)
+	if policy == nil || policy.Cookie == "" || target == "" || rt.affinity.Target == affinity.ID(target) {
+		return nil
+	}
+	return policy.NewCookie(target)
+}
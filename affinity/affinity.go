@@ -0,0 +1,151 @@
+// Package affinity pins clients to one of a routes targets with affinity cookies or consistent hashing
+package affinity
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Source is the request attribute that is hashed to select a target
+type Source string
+
+const (
+	// Header hashes the value of a http header
+	Header Source = "header"
+	// Metadata hashes the value of a gRPC metadata key
+	Metadata Source = "metadata"
+	// Cookie hashes the value of a cookie
+	Cookie Source = "cookie"
+	// ClientIP hashes the clients ip(this.client_ip)
+	ClientIP Source = "client_ip"
+)
+
+// Policy configures session affinity for a route with multiple targets. Targets are selected by an affinity cookie(if
+// present), then by consistent(rendezvous) hashing of the hash source, & then round robin. When targets are added or
+// removed, only clients whose target was removed(or ~1/n of hashed clients when a target is added) are moved - clients
+// with an affinity cookie keep their target for as long as it exists
+type Policy struct {
+	// Cookie is the name of an affinity cookie issued by the proxy that records the clients target(http only)
+	Cookie string
+	// CookieTTL is the max age of the affinity cookie. If zero, a session cookie is issued
+	CookieTTL time.Duration
+	// Hash is the request attribute that is hashed to select a target(header, metadata, cookie or client_ip)
+	Hash Source
+	// Key is the name of the header, metadata key or cookie that is hashed
+	Key string
+}
+
+// Affinity is a requests affinity to a target
+type Affinity struct {
+	// Target is the id of the target recorded in the requests affinity cookie
+	Target string
+	// Key is the requests hash key
+	Key string
+}
+
+// Validate returns an error if the policy is invalid
+func (p *Policy) Validate() error {
+	if p.Cookie == "" && p.Hash == "" {
+		return errors.New("affinity: a cookie or hash source is required")
+	}
+	switch p.Hash {
+	case "", ClientIP:
+	case Header, Metadata, Cookie:
+		if p.Key == "" {
+			return errors.Errorf("affinity: empty %s key", p.Hash)
+		}
+	default:
+		return errors.Errorf("affinity: unsupported hash source: %s", p.Hash)
+	}
+	return nil
+}
+
+// Affinity returns the affinity of a request with the given headers(or gRPC metadata) & client ip
+func (p *Policy) Affinity(header http.Header, clientIP string) Affinity {
+	var (
+		a   Affinity
+		req = &http.Request{Header: header}
+	)
+	if p.Cookie != "" {
+		if c, err := req.Cookie(p.Cookie); err == nil {
+			a.Target = c.Value
+		}
+	}
+	switch p.Hash {
+	case Header, Metadata:
+		a.Key = header.Get(p.Key)
+	case Cookie:
+		if c, err := req.Cookie(p.Key); err == nil {
+			a.Key = c.Value
+		}
+	case ClientIP:
+		a.Key = clientIP
+	}
+	return a
+}
+
+// NewCookie returns the affinity cookie that pins the client to the target
+func (p *Policy) NewCookie(target string) *http.Cookie {
+	return &http.Cookie{
+		Name:     p.Cookie,
+		Value:    ID(target),
+		Path:     "/",
+		MaxAge:   int(p.CookieTTL.Seconds()),
+		HttpOnly: true,
+	}
+}
+
+// Order returns the targets in order of preference: the affinity cookies target followed by the targets ranked by
+// their rendezvous hash with the key. It returns nil if the request has no affinity
+func (a Affinity) Order(targets []string) []string {
+	if a.Target == "" && a.Key == "" {
+		return nil
+	}
+	ordered := make([]string, len(targets))
+	copy(ordered, targets)
+	if a.Key != "" {
+		scores := make(map[string]uint64, len(ordered))
+		for _, target := range ordered {
+			scores[target] = score(a.Key, target)
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return scores[ordered[i]] > scores[ordered[j]]
+		})
+	}
+	if a.Target != "" {
+		for i, target := range ordered {
+			if ID(target) == a.Target {
+				copy(ordered[1:i+1], ordered[:i])
+				ordered[0] = target
+				break
+			}
+		}
+	}
+	return ordered
+}
+
+// ID returns the opaque id of a target that is stored in affinity cookies so target addresses aren't exposed to clients
+func ID(target string) string {
+	h := fnv.New64a()
+	h.Write([]byte(target))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func score(key, target string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(target))
+	// fnv has poor avalanche on similar inputs, so the sum is mixed(splitmix64 finalizer) before comparing scores
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
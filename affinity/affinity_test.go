@@ -0,0 +1,80 @@
+package affinity_test
+
+import (
+	"fmt"
+	"github.com/graphikDB/gproxy/affinity"
+	"net/http"
+	"testing"
+)
+
+func TestOrder(t *testing.T) {
+	targets := []string{"http://a:8080", "http://b:8080", "http://c:8080", "http://d:8080"}
+	counts := map[string]int{}
+	selected := map[string]string{}
+	for i := 0; i < 4000; i++ {
+		key := fmt.Sprintf("session-%v", i)
+		ordered := affinity.Affinity{Key: key}.Order(targets)
+		if len(ordered) != len(targets) {
+			t.Fatalf("unexpected order: %v", ordered)
+		}
+		if again := (affinity.Affinity{Key: key}).Order(targets); again[0] != ordered[0] {
+			t.Fatal("expected consistent target")
+		}
+		counts[ordered[0]]++
+		selected[key] = ordered[0]
+	}
+	for target, count := range counts {
+		if count < 800 || count > 1200 {
+			t.Fatalf("expected keys to be spread evenly: %s %v", target, count)
+		}
+	}
+	// removing a target only moves the keys that were assigned to it
+	remaining := targets[:3]
+	for key, target := range selected {
+		next := affinity.Affinity{Key: key}.Order(remaining)[0]
+		if target != targets[3] && next != target {
+			t.Fatalf("%s: expected key to keep its target", key)
+		}
+	}
+	// the affinity cookies target is always preferred
+	ordered := affinity.Affinity{Target: affinity.ID("http://c:8080"), Key: "session-1"}.Order(targets)
+	if ordered[0] != "http://c:8080" || len(ordered) != len(targets) {
+		t.Fatalf("expected cookie target first: %v", ordered)
+	}
+	if ordered := (affinity.Affinity{}).Order(targets); ordered != nil {
+		t.Fatal("expected no affinity")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	policy := &affinity.Policy{Cookie: "gproxy_affinity", Hash: affinity.Header, Key: "X-Session-Id"}
+	if err := policy.Validate(); err != nil {
+		t.Fatal(err.Error())
+	}
+	header := http.Header{
+		"X-Session-Id": {"abc"},
+		"Cookie":       {"gproxy_affinity=" + affinity.ID("http://a:8080")},
+	}
+	a := policy.Affinity(header, "10.0.0.1")
+	if a.Key != "abc" || a.Target != affinity.ID("http://a:8080") {
+		t.Fatalf("unexpected affinity: %v", a)
+	}
+	if a := (&affinity.Policy{Hash: affinity.ClientIP}).Affinity(http.Header{}, "10.0.0.1"); a.Key != "10.0.0.1" {
+		t.Fatalf("unexpected affinity: %v", a)
+	}
+	if a := (&affinity.Policy{Hash: affinity.Cookie, Key: "session"}).Affinity(http.Header{"Cookie": {"session=xyz"}}, ""); a.Key != "xyz" {
+		t.Fatalf("unexpected affinity: %v", a)
+	}
+	if c := policy.NewCookie("http://a:8080"); c.Value != affinity.ID("http://a:8080") || c.Name != "gproxy_affinity" {
+		t.Fatalf("unexpected cookie: %v", c)
+	}
+	for _, invalid := range []*affinity.Policy{
+		{},
+		{Hash: affinity.Header},
+		{Hash: "body"},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Fatalf("expected invalid policy to be rejected: %v", invalid)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Package auth verifies bearer JSON Web Tokens signed by keys from JWKS urls, OIDC discovery, or static keys
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrMissingToken is returned when a request doesn't contain a bearer token
+	ErrMissingToken = errors.New("auth: missing bearer token")
+	// ErrInvalidToken is returned when a token is malformed, expired, or its signature cannot be verified
+	ErrInvalidToken = errors.New("auth: invalid token")
+)
+
+// DefaultAlgorithms are the signing algorithms accepted when a Config doesn't specify any
+var DefaultAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// Config configures a Verifier
+type Config struct {
+	// Issuer is the required iss claim(optional). If JWKSURLs & Keys are empty, the issuers OIDC discovery document is used to find its JWKS url
+	Issuer string
+	// Audiences are the accepted aud claims(optional). A token is accepted if it contains any of them
+	Audiences []string
+	// JWKSURLs are urls of JSON Web Key Sets used to verify tokens
+	JWKSURLs []string
+	// Keys are static verification keys
+	Keys []Key
+	// Algorithms are the accepted signing algorithms(default: DefaultAlgorithms). HMAC algorithms(HS256, HS384, HS512) must be enabled explicitly
+	Algorithms []string
+	// Leeway is the allowed clock skew when validating exp, nbf & iat(default: 0)
+	Leeway time.Duration
+	// RefreshInterval is how often JWKS are refreshed(default: 1h). Unknown key ids trigger a refresh at most once per minute
+	RefreshInterval time.Duration
+	// Client overrides the default http client used to fetch JWKS & discovery documents(optional)
+	Client *http.Client
+}
+
+// Key is a static verification key
+type Key struct {
+	// ID matches the kid header of tokens signed with the key(optional)
+	ID string
+	// Algorithm restricts the key to a single signing algorithm(optional)
+	Algorithm string
+	// Key is an *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey, or []byte(HMAC secret)
+	Key interface{}
+}
+
+// Verifier verifies bearer tokens
+type Verifier struct {
+	config     Config
+	algorithms map[string]struct{}
+	mu         sync.Mutex
+	jwksURLs   []string
+	remote     []Key
+	fetched    time.Time
+	lastForced time.Time
+}
+
+// NewVerifier creates a Verifier. JWKS are fetched lazily when the first token is verified
+func NewVerifier(config Config) (*Verifier, error) {
+	if len(config.JWKSURLs) == 0 && len(config.Keys) == 0 && config.Issuer == "" {
+		return nil, errors.New("auth: at least one of issuer, jwks url or key is required")
+	}
+	if len(config.Algorithms) == 0 {
+		config.Algorithms = DefaultAlgorithms
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = time.Hour
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	v := &Verifier{
+		config:     config,
+		algorithms: map[string]struct{}{},
+		jwksURLs:   config.JWKSURLs,
+	}
+	for _, alg := range config.Algorithms {
+		if _, ok := hashes[alg]; !ok {
+			return nil, errors.Errorf("auth: unsupported algorithm: %s", alg)
+		}
+		v.algorithms[alg] = struct{}{}
+	}
+	return v, nil
+}
+
+// FromHeader returns the bearer token of an Authorization header value
+func FromHeader(value string) (string, error) {
+	if value == "" {
+		return "", ErrMissingToken
+	}
+	parts := strings.SplitN(value, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") || strings.TrimSpace(parts[1]) == "" {
+		return "", errors.Wrap(ErrInvalidToken, "expected a bearer token")
+	}
+	return strings.TrimSpace(parts[1]), nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify verifies the tokens signature & registered claims, returning its claims
+func (v *Verifier) Verify(ctx context.Context, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.Wrap(ErrInvalidToken, "malformed token")
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, "malformed header")
+	}
+	if _, ok := v.algorithms[h.Alg]; !ok {
+		return nil, errors.Wrapf(ErrInvalidToken, "unsupported algorithm: %s", h.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, "malformed signature")
+	}
+	keys, err := v.keys(ctx, h.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	var verified bool
+	for _, k := range keys {
+		if (h.Kid != "" && k.ID != "" && k.ID != h.Kid) || (k.Algorithm != "" && k.Algorithm != h.Alg) {
+			continue
+		}
+		if verify(h.Alg, k.Key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.Wrap(ErrInvalidToken, "signature verification failed")
+	}
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, "malformed claims")
+	}
+	if err := v.validate(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *Verifier) validate(claims map[string]interface{}, now time.Time) error {
+	leeway := v.config.Leeway
+	if exp, ok := claims["exp"].(float64); ok && now.After(unix(exp).Add(leeway)) {
+		return errors.Wrap(ErrInvalidToken, "token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(unix(nbf)) {
+		return errors.Wrap(ErrInvalidToken, "token not yet valid")
+	}
+	if iat, ok := claims["iat"].(float64); ok && now.Add(leeway).Before(unix(iat)) {
+		return errors.Wrap(ErrInvalidToken, "token issued in the future")
+	}
+	if v.config.Issuer != "" && claims["iss"] != v.config.Issuer {
+		return errors.Wrapf(ErrInvalidToken, "unexpected issuer: %v", claims["iss"])
+	}
+	if len(v.config.Audiences) > 0 {
+		var audiences []string
+		switch aud := claims["aud"].(type) {
+		case string:
+			audiences = []string{aud}
+		case []interface{}:
+			for _, a := range aud {
+				audiences = append(audiences, fmt.Sprint(a))
+			}
+		}
+		var matched bool
+		for _, expected := range v.config.Audiences {
+			for _, a := range audiences {
+				if a == expected {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return errors.Wrapf(ErrInvalidToken, "unexpected audience: %v", claims["aud"])
+		}
+	}
+	return nil
+}
+
+func unix(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	bits, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bits, v)
+}
+
+var hashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"PS384": crypto.SHA384,
+	"PS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+	"HS256": crypto.SHA256,
+	"HS384": crypto.SHA384,
+	"HS512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// verify reports whether the signature of the signed content is valid for the algorithm & key
+func verify(alg string, key interface{}, signed, signature []byte) bool {
+	if alg == "EdDSA" {
+		k, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(k, signed, signature)
+	}
+	hash := hashes[alg]
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch alg[:2] {
+	case "RS":
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+	case "PS":
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(k, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+	return false
+}
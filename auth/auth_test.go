@@ -0,0 +1,172 @@
+package auth_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/graphikDB/gproxy/auth"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func b64(bits []byte) string {
+	return base64.RawURLEncoding.EncodeToString(bits)
+}
+
+// sign creates a compact JWS with the key(*rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey or []byte)
+func sign(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, serr := ecdsa.Sign(rand.Reader, k, digest[:])
+		err = serr
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, []byte(signed))
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return signed + "." + b64(signature)
+}
+
+func rsaJWK(kid string, k *rsa.PublicKey) map[string]interface{} {
+	return map[string]interface{}{"kty": "RSA", "kid": kid, "alg": "RS256", "use": "sig", "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+}
+
+func ecJWK(kid string, k *ecdsa.PublicKey) map[string]interface{} {
+	return map[string]interface{}{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(k.X.FillBytes(make([]byte, 32))), "y": b64(k.Y.FillBytes(make([]byte, 32)))}
+}
+
+func TestVerifier(t *testing.T) {
+	ctx := context.Background()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rotated, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var (
+		keys     atomic.Value
+		fetches  int64
+		issuer   string
+		jwksPath = "/keys"
+	)
+	keys.Store([]interface{}{rsaJWK("rsa-1", &rsaKey.PublicKey), ecJWK("ec-1", &ecKey.PublicKey)})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": issuer + jwksPath})
+		case jwksPath:
+			atomic.AddInt64(&fetches, 1)
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys.Load()})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	issuer = srv.URL
+	verifier, err := auth.NewVerifier(auth.Config{
+		Issuer:     issuer,
+		Audiences:  []string{"api"},
+		Keys:       []auth.Key{{ID: "ed-1", Key: edPub}, {ID: "hmac-1", Key: []byte("secret")}},
+		JWKSURLs:   []string{issuer + jwksPath},
+		Algorithms: []string{"RS256", "ES256", "EdDSA", "HS256"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	now := time.Now().Unix()
+	valid := map[string]interface{}{"iss": issuer, "aud": []string{"other", "api"}, "sub": "user-1", "exp": now + 60, "iat": now}
+	for name, token := range map[string]string{
+		"rsa":     sign(t, "RS256", "rsa-1", rsaKey, valid),
+		"ecdsa":   sign(t, "ES256", "ec-1", ecKey, valid),
+		"ed25519": sign(t, "EdDSA", "ed-1", edKey, valid),
+		"hmac":    sign(t, "HS256", "hmac-1", []byte("secret"), valid),
+	} {
+		claims, err := verifier.Verify(ctx, token)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		if claims["sub"] != "user-1" {
+			t.Fatalf("%s: unexpected claims: %v", name, claims)
+		}
+	}
+	for name, token := range map[string]string{
+		"expired":        sign(t, "RS256", "rsa-1", rsaKey, map[string]interface{}{"iss": issuer, "aud": "api", "exp": now - 60}),
+		"audience":       sign(t, "RS256", "rsa-1", rsaKey, map[string]interface{}{"iss": issuer, "aud": "other", "exp": now + 60}),
+		"issuer":         sign(t, "RS256", "rsa-1", rsaKey, map[string]interface{}{"iss": "https://evil.example.com", "aud": "api", "exp": now + 60}),
+		"signature":      sign(t, "RS256", "rsa-1", rotated, valid),
+		"hmac-confusion": sign(t, "HS256", "rsa-1", []byte("secret"), valid),
+		"none":           strings.TrimSuffix(sign(t, "none", "", []byte{}, valid), "."),
+		"malformed":      "not-a-token",
+	} {
+		if _, err := verifier.Verify(ctx, token); err == nil {
+			t.Fatalf("%s: expected token to be rejected", name)
+		}
+	}
+	// rotated keys are fetched when a token with an unknown key id is verified
+	keys.Store([]interface{}{rsaJWK("rsa-2", &rotated.PublicKey)})
+	before := atomic.LoadInt64(&fetches)
+	if _, err := verifier.Verify(ctx, sign(t, "RS256", "rsa-2", rotated, valid)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if atomic.LoadInt64(&fetches) != before+1 {
+		t.Fatal("expected jwks to be refreshed")
+	}
+
+	// keys are found via oidc discovery when only the issuer is configured
+	discovered, err := auth.NewVerifier(auth.Config{Issuer: issuer})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := discovered.Verify(ctx, sign(t, "RS256", "rsa-2", rotated, valid)); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestFromHeader(t *testing.T) {
+	if token, err := auth.FromHeader("Bearer abc.def.ghi"); err != nil || token != "abc.def.ghi" {
+		t.Fatalf("unexpected token: %s %v", token, err)
+	}
+	if _, err := auth.FromHeader(""); err != auth.ErrMissingToken {
+		t.Fatalf("expected missing token: %v", err)
+	}
+	if _, err := auth.FromHeader("Basic dXNlcjpwYXNz"); err == nil {
+		t.Fatal("expected basic auth to be rejected")
+	}
+}
@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// minForcedRefresh limits how often an unknown key id triggers a JWKS refresh
+const minForcedRefresh = time.Minute
+
+// keys returns the static & remote verification keys, refreshing remote keys when they are stale or the key id is unknown
+func (v *Verifier) keys(ctx context.Context, kid string) ([]Key, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.jwksURLs) == 0 && len(v.config.JWKSURLs) == 0 && len(v.config.Keys) == 0 {
+		jwksURL, err := v.discover(ctx)
+		if err != nil {
+			return nil, err
+		}
+		v.jwksURLs = []string{jwksURL}
+	}
+	if len(v.jwksURLs) > 0 {
+		now := time.Now()
+		stale := now.Sub(v.fetched) > v.config.RefreshInterval
+		unknown := !stale && kid != "" && !hasKey(v.config.Keys, kid) && !hasKey(v.remote, kid) && now.Sub(v.lastForced) > minForcedRefresh
+		if stale || unknown {
+			if unknown {
+				v.lastForced = now
+			}
+			remote, err := v.fetch(ctx)
+			if err != nil && v.remote == nil {
+				return nil, err
+			}
+			// keep serving the previous keys if the refresh failed
+			if err == nil {
+				v.remote = remote
+				v.fetched = now
+			}
+		}
+	}
+	keys := make([]Key, 0, len(v.config.Keys)+len(v.remote))
+	keys = append(keys, v.config.Keys...)
+	keys = append(keys, v.remote...)
+	return keys, nil
+}
+
+func hasKey(keys []Key, kid string) bool {
+	for _, k := range keys {
+		if k.ID == kid {
+			return true
+		}
+	}
+	return false
+}
+
+// discover returns the jwks_uri of the issuers OIDC discovery document
+func (v *Verifier) discover(ctx context.Context) (string, error) {
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := v.get(ctx, strings.TrimSuffix(v.config.Issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+		return "", errors.Wrap(err, "auth: oidc discovery")
+	}
+	if doc.JWKSURI == "" {
+		return "", errors.New("auth: oidc discovery: empty jwks_uri")
+	}
+	return doc.JWKSURI, nil
+}
+
+// fetch fetches & parses every JWKS. Keys that cannot be parsed(ex: unsupported key types) are skipped
+func (v *Verifier) fetch(ctx context.Context) ([]Key, error) {
+	var keys []Key
+	for _, u := range v.jwksURLs {
+		var set struct {
+			Keys []json.RawMessage `json:"keys"`
+		}
+		if err := v.get(ctx, u, &set); err != nil {
+			return nil, errors.Wrapf(err, "auth: fetch jwks %s", u)
+		}
+		for _, raw := range set.Keys {
+			k, err := ParseJWK(raw)
+			if err != nil {
+				continue
+			}
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func (v *Verifier) get(ctx context.Context, u string, into interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.config.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status %v", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// ParseJWK parses a JSON Web Key(RSA, EC, OKP/Ed25519 or oct)
+func ParseJWK(data []byte) (Key, error) {
+	var j jwk
+	if err := json.Unmarshal(data, &j); err != nil {
+		return Key{}, err
+	}
+	if j.Use != "" && j.Use != "sig" {
+		return Key{}, errors.Errorf("auth: unsupported key use: %s", j.Use)
+	}
+	key := Key{ID: j.Kid, Algorithm: j.Alg}
+	decode := base64.RawURLEncoding.DecodeString
+	switch j.Kty {
+	case "RSA":
+		n, err := decode(j.N)
+		if err != nil {
+			return Key{}, err
+		}
+		e, err := decode(j.E)
+		if err != nil {
+			return Key{}, err
+		}
+		key.Key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return Key{}, errors.Errorf("auth: unsupported curve: %s", j.Crv)
+		}
+		x, err := decode(j.X)
+		if err != nil {
+			return Key{}, err
+		}
+		y, err := decode(j.Y)
+		if err != nil {
+			return Key{}, err
+		}
+		key.Key = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return Key{}, errors.Errorf("auth: unsupported curve: %s", j.Crv)
+		}
+		x, err := decode(j.X)
+		if err != nil {
+			return Key{}, err
+		}
+		key.Key = ed25519.PublicKey(x)
+	case "oct":
+		k, err := decode(j.K)
+		if err != nil {
+			return Key{}, err
+		}
+		key.Key = k
+	default:
+		return Key{}, errors.Errorf("auth: unsupported key type: %s", j.Kty)
+	}
+	return key, nil
+}
+
+// ParsePublicKeyPEM parses a PEM encoded public key(PKIX) or certificate
+func ParsePublicKeyPEM(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("auth: invalid pem")
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "auth: unsupported pem block: %s", block.Type)
+		}
+		return key, nil
+	}
+}
@@ -0,0 +1,99 @@
+package gproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/graphikDB/gproxy/auth"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+	"net/http"
+)
+
+// errUnauthenticated is returned when a route requires authentication & the request doesn't contain a verified token
+var errUnauthenticated = errors.New("authentication required")
+
+type claimsCtxKey struct{}
+
+func claimsFromContext(ctx context.Context) (map[string]interface{}, bool) {
+	claims, ok := ctx.Value(claimsCtxKey{}).(map[string]interface{})
+	return claims, ok
+}
+
+// authenticateHTTP verifies the requests bearer token(if present) before it is routed, responding with a 401 if it is invalid.
+// The verified claims are exposed to routing expressions as this.claims
+func (p *Proxy) authenticateHTTP(next http.Handler) http.Handler {
+	if p.verifier == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := p.authenticate(r.Context(), r.Header.Get("Authorization"))
+		if err != nil {
+			p.logger.Debug("http authentication failure", zap.String("host", r.Host), zap.String("path", r.URL.Path), zap.Error(err))
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if claims != nil {
+			r = r.WithContext(context.WithValue(r.Context(), claimsCtxKey{}, claims))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticateGRPC verifies the bearer token in the authorization metadata(if present)
+func (p *Proxy) authenticateGRPC(ctx context.Context, md metadata.MD) (map[string]interface{}, error) {
+	if p.verifier == nil {
+		return nil, nil
+	}
+	var value string
+	if values := md.Get("authorization"); len(values) > 0 {
+		value = values[0]
+	}
+	return p.authenticate(ctx, value)
+}
+
+// authenticate returns the verified claims of the authorization header/metadata value. It returns nil claims if the value is empty
+func (p *Proxy) authenticate(ctx context.Context, authorization string) (map[string]interface{}, error) {
+	token, err := auth.FromHeader(authorization)
+	if err == auth.ErrMissingToken {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.verifier.Verify(ctx, token)
+}
+
+// authRequired reports whether the route requires a verified token, falling back to the default("*") setting
+func (p *Proxy) authRequired(routeName string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if required, ok := p.requireAuth[routeName]; ok {
+		return required
+	}
+	return p.requireAuth["*"]
+}
+
+// forwardClaims sets the configured claims as upstream headers/metadata. Non-string claims are json encoded
+func (p *Proxy) forwardClaims(h map[string][]string, claims map[string]interface{}, key func(string) string) {
+	for claim, name := range p.claimHeaders {
+		// never forward client supplied values for claim headers
+		delete(h, key(name))
+		value, ok := claims[claim]
+		if !ok {
+			continue
+		}
+		switch value := value.(type) {
+		case string:
+			h[key(name)] = []string{value}
+		default:
+			bits, err := json.Marshal(value)
+			if err != nil {
+				bits = []byte(fmt.Sprint(value))
+			}
+			h[key(name)] = []string{string(bits)}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package gproxy
+
+import (
+	"fmt"
+	"github.com/graphikDB/gproxy/authz"
+	"github.com/graphikDB/gproxy/metrics"
+	"go.uber.org/zap"
+)
+
+// authzError is returned when a request is denied by one of its routes authorization policies
+type authzError struct {
+	route  string
+	policy string
+}
+
+func (e *authzError) Error() string {
+	return fmt.Sprintf("permission denied by policy: %s", e.policy)
+}
+
+// authzPolicies returns the authorization policies attached to the route, falling back to the default("*") policies
+func (p *Proxy) authzPolicies(routeName string) []*authz.Policy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	names, ok := p.routeAuthz[routeName]
+	if !ok {
+		names = p.routeAuthz["*"]
+	}
+	policies := make([]*authz.Policy, 0, len(names))
+	for _, name := range names {
+		policies = append(policies, p.policies[name])
+	}
+	return policies
+}
+
+// authorize evaluates the routes authorization policies against the request. Would-be denials of dry-run policies are logged
+func (p *Proxy) authorize(r *route, data map[string]interface{}) error {
+	policies := p.authzPolicies(r.name)
+	if len(policies) == 0 {
+		return nil
+	}
+	result := authz.Authorize(data, policies...)
+	for _, policy := range result.Audited {
+		metrics.AuthzDenied.WithLabelValues(r.name, policy, "dry_run").Inc()
+		p.logger.Info("authorization policy would deny request",
+			zap.String("route", r.name),
+			zap.String("policy", policy),
+			zap.Any("host", data["host"]),
+			zap.Any("path", data["path"]),
+			zap.Any("method", data["method"]),
+			zap.Any("client_ip", data["client_ip"]),
+		)
+	}
+	if result.Allowed {
+		return nil
+	}
+	metrics.AuthzDenied.WithLabelValues(r.name, result.Denied, "enforced").Inc()
+	return &authzError{route: r.name, policy: result.Denied}
+}
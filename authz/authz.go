@@ -0,0 +1,73 @@
+// Package authz authorizes requests with named decision expressions
+package authz
+
+import (
+	"github.com/graphikDB/trigger"
+	"github.com/pkg/errors"
+)
+
+// Policy is a named decision expression that must evaluate to true for a request to be allowed
+type Policy struct {
+	name     string
+	decision *trigger.Decision
+	dryRun   bool
+}
+
+// NewPolicy compiles a named policy. Dry-run policies never deny requests - would-be denials are only reported(audit mode)
+// ex: this.claims.role == 'admin' || this.method == 'GET'
+// expression attributes: (this.http<bool>, this.grpc<bool>, this.host<string>, this.headers<map>, this.path<string>, this.method<string>, this.client_ip<string>, this.claims<map>, this.route<string>)
+func NewPolicy(name, decision string, dryRun bool) (*Policy, error) {
+	if name == "" {
+		return nil, errors.New("authz: empty policy name")
+	}
+	d, err := trigger.NewDecision(decision)
+	if err != nil {
+		return nil, errors.Wrapf(err, "authz: policy %s", name)
+	}
+	return &Policy{name: name, decision: d, dryRun: dryRun}, nil
+}
+
+// Name returns the policies name
+func (p *Policy) Name() string {
+	return p.name
+}
+
+// DryRun reports whether the policy only audits requests
+func (p *Policy) DryRun() bool {
+	return p.dryRun
+}
+
+// Allow reports whether the request is allowed by the policy. Requests are denied if the expression cannot be evaluated
+// (ex: it references a missing claim)
+func (p *Policy) Allow(data map[string]interface{}) bool {
+	return p.decision.Eval(data) == nil
+}
+
+// Result is the outcome of authorizing a request against a set of policies
+type Result struct {
+	// Allowed is false if any enforced policy denied the request
+	Allowed bool
+	// Denied is the name of the first enforced policy that denied the request
+	Denied string
+	// Audited are the names of dry-run policies that would have denied the request
+	Audited []string
+}
+
+// Authorize evaluates every policy against the request
+func Authorize(data map[string]interface{}, policies ...*Policy) Result {
+	result := Result{Allowed: true}
+	for _, p := range policies {
+		if p.Allow(data) {
+			continue
+		}
+		if p.dryRun {
+			result.Audited = append(result.Audited, p.name)
+			continue
+		}
+		if result.Allowed {
+			result.Allowed = false
+			result.Denied = p.name
+		}
+	}
+	return result
+}
@@ -0,0 +1,43 @@
+package authz_test
+
+import (
+	"github.com/graphikDB/gproxy/authz"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	admin, err := authz.NewPolicy("admin", `'role' in this.claims && this.claims.role == 'admin'`, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	readOnly, err := authz.NewPolicy("read-only", `this.method == 'GET'`, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	internal, err := authz.NewPolicy("internal", `this.client_ip.startsWith('10.')`, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data := map[string]interface{}{
+		"method":    "POST",
+		"client_ip": "10.0.0.1",
+		"claims":    map[string]interface{}{"role": "admin"},
+	}
+	result := authz.Authorize(data, admin, readOnly, internal)
+	if !result.Allowed || len(result.Audited) != 1 || result.Audited[0] != "read-only" {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+	data["claims"] = map[string]interface{}{}
+	data["client_ip"] = "192.168.0.1"
+	result = authz.Authorize(data, admin, readOnly, internal)
+	if result.Allowed || result.Denied != "admin" {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+	// evaluation errors(missing attributes) deny
+	if admin.Allow(map[string]interface{}{}) {
+		t.Fatal("expected missing claims to be denied")
+	}
+	if _, err := authz.NewPolicy("", "true", false); err == nil {
+		t.Fatal("expected empty name to be rejected")
+	}
+}
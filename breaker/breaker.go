@@ -0,0 +1,215 @@
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the state of a circuit breaker
+type State int
+
+const (
+	// Closed breakers allow all requests
+	Closed State = iota
+	// HalfOpen breakers allow a limited number of probe requests to test whether the target has recovered
+	HalfOpen
+	// Open breakers reject all requests until the open timeout has elapsed
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case HalfOpen:
+		return "half-open"
+	case Open:
+		return "open"
+	}
+	return "unknown"
+}
+
+// Outcome is the result of a request admitted by a breaker
+type Outcome int
+
+const (
+	// Success records a successful request
+	Success Outcome = iota
+	// Failure records a failed request
+	Failure
+	// Ignored releases the request without recording a result(ex: a cancelled hedge)
+	Ignored
+)
+
+const (
+	// DefaultOpenTimeout is the time an open breaker waits before probing the target
+	DefaultOpenTimeout = 10 * time.Second
+	// DefaultWindow is the window error rates are measured over
+	DefaultWindow = 10 * time.Second
+)
+
+// Config configures when a breaker trips & how it recovers
+type Config struct {
+	// ConsecutiveFailures trips the breaker after n consecutive failures(0 = disabled)
+	ConsecutiveFailures int
+	// ErrorRate trips the breaker when the ratio of failures to requests within the window exceeds it(0 = disabled)
+	ErrorRate float64
+	// MinRequests is the minimum number of requests within the window before the error rate is considered
+	MinRequests int
+	// Window is the period error rates are measured over(default: 10s)
+	Window time.Duration
+	// OpenTimeout is how long the breaker stays open before allowing probes(default: 10s)
+	OpenTimeout time.Duration
+	// HalfOpenProbes is the number of concurrent probes allowed while half-open. The breaker closes
+	// once that many probes have succeeded(default: 1)
+	HalfOpenProbes int
+}
+
+// Breaker is a circuit breaker for a single upstream target
+type Breaker struct {
+	mu          sync.Mutex
+	config      Config
+	state       State
+	failures    int
+	openedAt    time.Time
+	probes      int
+	successes   int
+	windowStart time.Time
+	requests    int
+	errors      int
+	onChange    func(from, to State)
+}
+
+// New creates a closed breaker. onChange(optional) is called whenever the breaker changes state
+func New(config Config, onChange func(from, to State)) *Breaker {
+	if config.Window <= 0 {
+		config.Window = DefaultWindow
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = DefaultOpenTimeout
+	}
+	if config.HalfOpenProbes <= 0 {
+		config.HalfOpenProbes = 1
+	}
+	return &Breaker{
+		config:      config,
+		windowStart: time.Now(),
+		onChange:    onChange,
+	}
+}
+
+// State returns the current state of the breaker
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refresh(time.Now())
+	return b.state
+}
+
+// Allow returns false if the request should be short-circuited. Otherwise the returned function must be called
+// with the requests outcome once it completes
+func (b *Breaker) Allow() (func(outcome Outcome), bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.refresh(now)
+	switch b.state {
+	case Open:
+		return nil, false
+	case HalfOpen:
+		if b.probes >= b.config.HalfOpenProbes {
+			return nil, false
+		}
+		b.probes++
+		return b.doneFunc(true), true
+	}
+	return b.doneFunc(false), true
+}
+
+func (b *Breaker) doneFunc(probe bool) func(outcome Outcome) {
+	var once sync.Once
+	return func(outcome Outcome) {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.record(time.Now(), probe, outcome)
+		})
+	}
+}
+
+// refresh moves an open breaker to half-open once the open timeout elapses & rolls the error rate window
+func (b *Breaker) refresh(now time.Time) {
+	if b.state == Open && now.Sub(b.openedAt) >= b.config.OpenTimeout {
+		b.setState(HalfOpen)
+	}
+	if now.Sub(b.windowStart) >= b.config.Window {
+		b.windowStart = now
+		b.requests = 0
+		b.errors = 0
+	}
+}
+
+func (b *Breaker) record(now time.Time, probe bool, outcome Outcome) {
+	b.refresh(now)
+	if probe && b.probes > 0 {
+		b.probes--
+	}
+	if outcome == Ignored {
+		return
+	}
+	b.requests++
+	if outcome == Failure {
+		b.errors++
+		b.failures++
+	} else {
+		b.failures = 0
+	}
+	switch b.state {
+	case HalfOpen:
+		if !probe {
+			return
+		}
+		if outcome == Failure {
+			b.trip(now)
+			return
+		}
+		b.successes++
+		if b.successes >= b.config.HalfOpenProbes {
+			b.setState(Closed)
+		}
+	case Closed:
+		if outcome != Failure {
+			return
+		}
+		if b.config.ConsecutiveFailures > 0 && b.failures >= b.config.ConsecutiveFailures {
+			b.trip(now)
+			return
+		}
+		if b.config.ErrorRate > 0 && b.requests >= b.config.MinRequests &&
+			float64(b.errors)/float64(b.requests) >= b.config.ErrorRate {
+			b.trip(now)
+		}
+	}
+}
+
+func (b *Breaker) trip(now time.Time) {
+	b.openedAt = now
+	b.setState(Open)
+}
+
+func (b *Breaker) setState(state State) {
+	if b.state == state {
+		return
+	}
+	from := b.state
+	b.state = state
+	b.failures = 0
+	b.successes = 0
+	b.probes = 0
+	b.requests = 0
+	b.errors = 0
+	b.windowStart = time.Now()
+	if b.onChange != nil {
+		b.onChange(from, state)
+	}
+}
@@ -0,0 +1,59 @@
+package breaker_test
+
+import (
+	"github.com/graphikDB/gproxy/breaker"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	var transitions []breaker.State
+	b := breaker.New(breaker.Config{
+		ConsecutiveFailures: 2,
+		OpenTimeout:         50 * time.Millisecond,
+	}, func(from, to breaker.State) {
+		transitions = append(transitions, to)
+	})
+	for i := 0; i < 2; i++ {
+		done, ok := b.Allow()
+		if !ok {
+			t.Fatal("expected closed breaker to allow request")
+		}
+		done(breaker.Failure)
+	}
+	if _, ok := b.Allow(); ok || b.State() != breaker.Open {
+		t.Fatal("expected breaker to trip after consecutive failures")
+	}
+	time.Sleep(60 * time.Millisecond)
+	probe, ok := b.Allow()
+	if !ok || b.State() != breaker.HalfOpen {
+		t.Fatal("expected half-open breaker to allow a probe")
+	}
+	if _, ok := b.Allow(); ok {
+		t.Fatal("expected half-open breaker to limit concurrent probes")
+	}
+	probe(breaker.Success)
+	if b.State() != breaker.Closed {
+		t.Fatal("expected successful probe to close the breaker")
+	}
+	if len(transitions) != 3 {
+		t.Fatalf("expected 3 state transitions, got %v", transitions)
+	}
+}
+
+func TestBreakerErrorRate(t *testing.T) {
+	b := breaker.New(breaker.Config{
+		ErrorRate:   0.5,
+		MinRequests: 4,
+	}, nil)
+	for _, outcome := range []breaker.Outcome{breaker.Success, breaker.Failure, breaker.Success, breaker.Failure} {
+		done, ok := b.Allow()
+		if !ok {
+			t.Fatal("expected closed breaker to allow request")
+		}
+		done(outcome)
+	}
+	if b.State() != breaker.Open {
+		t.Fatal("expected breaker to trip once the error rate is exceeded")
+	}
+}
@@ -0,0 +1,64 @@
+package gproxy
+
+import (
+	"encoding/json"
+	"github.com/graphikDB/gproxy/cache"
+	"github.com/graphikDB/gproxy/metrics"
+	"net/http"
+)
+
+// responseCache returns the response cache registered for the route, falling back to the default("*") cache
+func (p *Proxy) responseCache(routeName string) *cache.Cache {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if c, ok := p.caches[routeName]; ok {
+		return c
+	}
+	return p.caches["*"]
+}
+
+// PurgeCache deletes the cached responses whose key(host + request uri, ex: example.com/users?id=1) starts with the prefix
+// from the named routes cache(or every cache if the route name is empty) & returns the number of purged entries
+func (p *Proxy) PurgeCache(routeName, prefix string) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var purged int
+	for name, c := range p.caches {
+		if routeName == "" || name == routeName {
+			purged += c.Purge(prefix)
+		}
+	}
+	return purged
+}
+
+// cachePurgeHandler purges cached responses(POST ?route=api&prefix=example.com/users with the admin token)
+func (p *Proxy) cachePurgeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		purged := p.PurgeCache(r.URL.Query().Get("route"), r.URL.Query().Get("prefix"))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+	})
+}
+
+// fetch sends the request through the routes response cache(if enabled)
+func (t *upstreamTransport) fetch(req *http.Request, call *httpCall) (*http.Response, error) {
+	c := t.proxy.responseCache(call.route.name)
+	if c == nil {
+		return t.send(req, call)
+	}
+	resp, status, err := c.Do(req, func(r *http.Request) (*http.Response, error) {
+		if r == req {
+			return t.send(r, call)
+		}
+		// background revalidations get their own call state so they don't race with the client request
+		revalidation := *call
+		revalidation.attempted = map[string]bool{}
+		return t.send(r, &revalidation)
+	})
+	metrics.CacheRequests.WithLabelValues(call.route.name, string(status)).Inc()
+	return resp, err
+}
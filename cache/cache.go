@@ -0,0 +1,378 @@
+// Package cache caches http GET/HEAD responses according to their Cache-Control, Expires & Vary headers, revalidating
+// stale responses with ETag/Last-Modified validators
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status describes how a request was served by the cache
+type Status string
+
+const (
+	// Hit responses were served from the cache
+	Hit Status = "hit"
+	// Stale responses were served from the cache while they are revalidated in the background(stale-while-revalidate)
+	Stale Status = "stale"
+	// Revalidated responses were served from the cache after the upstream confirmed they are unchanged(304)
+	Revalidated Status = "revalidated"
+	// Miss responses were fetched from the upstream
+	Miss Status = "miss"
+	// Bypass requests can't be served from the cache(ex: POST requests or Cache-Control: no-store)
+	Bypass Status = "bypass"
+)
+
+// StatusHeader is the response header that reports how a request was served by the cache(RFC 9211)
+const StatusHeader = "Cache-Status"
+
+// Fetch sends a request to the upstream
+type Fetch func(req *http.Request) (*http.Response, error)
+
+// Cache is a shared http cache
+type Cache struct {
+	store         Store
+	maxEntryBytes int
+	pending       sync.Map
+}
+
+// New returns a cache that stores responses up to maxEntryBytes(default: 1MB) in the store
+func New(store Store, maxEntryBytes int) *Cache {
+	if maxEntryBytes <= 0 {
+		maxEntryBytes = 1 << 20
+	}
+	return &Cache{store: store, maxEntryBytes: maxEntryBytes}
+}
+
+// Purge deletes every entry whose key(host + request uri, ex: example.com/users?id=1) starts with the prefix
+func (c *Cache) Purge(prefix string) int {
+	return c.store.Purge(prefix)
+}
+
+// Key returns the cache key of the request
+func Key(req *http.Request) string {
+	return req.Host + req.URL.RequestURI()
+}
+
+// Do serves the request from the cache or fetches it from the upstream, storing cacheable responses.
+// fetch is called with req in the foreground & with a copy of req when a stale response is revalidated in the background.
+// The request is keyed before it is fetched so fetch may change its url(ex: to point it at a target)
+func (c *Cache) Do(req *http.Request, fetch Fetch) (*http.Response, Status, error) {
+	reqCC := parseCacheControl(req.Header)
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || reqCC.has("no-store") || req.Header.Get("Range") != "" {
+		resp, err := fetch(req)
+		if err == nil {
+			resp.Header.Set(StatusHeader, "gproxy; fwd=bypass")
+		}
+		return resp, Bypass, err
+	}
+	key := Key(req)
+	ifNoneMatch := req.Header.Get("If-None-Match")
+	entry := c.lookup(key, req.Header)
+	var conditional bool
+	if entry != nil {
+		age := time.Since(entry.Stored)
+		fresh, swr := lifetime(entry)
+		revalidate := reqCC.has("no-cache") || reqCC.has("max-age") && age > reqCC.duration("max-age")
+		if age < fresh && !revalidate {
+			return c.respond(req, entry, ifNoneMatch, fmt.Sprintf("gproxy; hit; ttl=%v", int((fresh-age).Seconds()))), Hit, nil
+		}
+		if age < fresh+swr && !revalidate {
+			c.revalidate(key, req, entry, fetch)
+			return c.respond(req, entry, ifNoneMatch, fmt.Sprintf("gproxy; hit; ttl=%v", int((fresh-age).Seconds()))), Stale, nil
+		}
+		conditional = setValidators(req, entry)
+	}
+	resp, err := fetch(req)
+	if err != nil {
+		return nil, Miss, err
+	}
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		refreshed := refresh(entry, resp)
+		c.set(key, req.Header, refreshed)
+		return c.respond(req, refreshed, ifNoneMatch, "gproxy; fwd=stale; fwd-status=304"), Revalidated, nil
+	}
+	status := "gproxy; fwd=miss"
+	if entry != nil {
+		status = "gproxy; fwd=stale"
+	}
+	if c.storeResponse(key, req, resp) {
+		status += "; stored"
+	}
+	resp.Header.Set(StatusHeader, status)
+	return resp, Miss, nil
+}
+
+// lookup returns the entry(or variant) stored for the request
+func (c *Cache) lookup(key string, header http.Header) *Entry {
+	entry, ok := c.store.Get(key)
+	if !ok {
+		return nil
+	}
+	if len(entry.Vary) > 0 {
+		entry, ok = c.store.Get(variantKey(key, entry.Vary, header))
+		if !ok {
+			return nil
+		}
+	}
+	return entry
+}
+
+// set stores the entry under the key, storing a marker entry pointing at the variant if the response varies by request headers
+func (c *Cache) set(key string, header http.Header, entry *Entry) {
+	vary := varyHeaders(entry.Header)
+	if len(vary) == 0 {
+		entry.Key = key
+		c.store.Set(entry)
+		return
+	}
+	c.store.Set(&Entry{Key: key, Stored: entry.Stored, Vary: vary})
+	entry.Key = variantKey(key, vary, header)
+	c.store.Set(entry)
+}
+
+// revalidate refreshes a stale entry in the background. Concurrent revalidations of the same key are collapsed
+func (c *Cache) revalidate(key string, req *http.Request, entry *Entry, fetch Fetch) {
+	if _, loaded := c.pending.LoadOrStore(key, true); loaded {
+		return
+	}
+	bg := req.Clone(context.Background())
+	conditional := setValidators(bg, entry)
+	go func() {
+		defer c.pending.Delete(key)
+		resp, err := fetch(bg)
+		if err != nil {
+			return
+		}
+		if conditional && resp.StatusCode == http.StatusNotModified {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			c.set(key, bg.Header, refresh(entry, resp))
+			return
+		}
+		c.storeResponse(key, bg, resp)
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// storeResponse stores the response if it is cacheable, buffering its body(if it is smaller than the max entry size)
+func (c *Cache) storeResponse(key string, req *http.Request, resp *http.Response) bool {
+	if req.Method != http.MethodGet || !storable(req, resp) {
+		return false
+	}
+	buffered, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(c.maxEntryBytes)+1))
+	if err != nil || len(buffered) > c.maxEntryBytes {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{
+			Reader: io.MultiReader(bytes.NewReader(buffered), resp.Body),
+			Closer: resp.Body,
+		}
+		return false
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(buffered))
+	c.set(key, req.Header, &Entry{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+		Body:       buffered,
+		Stored:     responseTime(resp.Header),
+	})
+	return true
+}
+
+// respond builds a response from the entry, answering the clients own conditional request(ifNoneMatch) with a 304 if the entry matches it
+func (c *Cache) respond(req *http.Request, entry *Entry, ifNoneMatch, status string) *http.Response {
+	header := entry.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(time.Since(entry.Stored).Seconds())))
+	header.Set(StatusHeader, status)
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%v %s", entry.StatusCode, http.StatusText(entry.StatusCode)),
+		StatusCode: entry.StatusCode,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Request:    req,
+	}
+	body := entry.Body
+	if etag := entry.Header.Get("ETag"); etag != "" && matchesETag(ifNoneMatch, etag) {
+		header.Del("Content-Length")
+		resp.StatusCode = http.StatusNotModified
+		resp.Status = fmt.Sprintf("%v %s", http.StatusNotModified, http.StatusText(http.StatusNotModified))
+		body = nil
+	}
+	if req.Method == http.MethodHead {
+		body = nil
+	}
+	resp.ContentLength = int64(len(body))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp
+}
+
+// storable reports whether the response may be stored by a shared cache
+func storable(req *http.Request, resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent, http.StatusMultipleChoices,
+		http.StatusMovedPermanently, http.StatusPermanentRedirect, http.StatusNotFound, http.StatusGone:
+	default:
+		return false
+	}
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-store") || cc.has("private") || resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("Vary") == "*" {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+	return cc.has("max-age") || cc.has("s-maxage") || resp.Header.Get("Expires") != "" ||
+		resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// lifetime returns how long the entry is fresh & how long it may be served stale while it is revalidated
+func lifetime(entry *Entry) (fresh time.Duration, swr time.Duration) {
+	cc := parseCacheControl(entry.Header)
+	if cc.has("no-cache") {
+		return 0, 0
+	}
+	switch {
+	case cc.has("s-maxage"):
+		fresh = cc.duration("s-maxage")
+	case cc.has("max-age"):
+		fresh = cc.duration("max-age")
+	default:
+		if expires, err := http.ParseTime(entry.Header.Get("Expires")); err == nil {
+			date, err := http.ParseTime(entry.Header.Get("Date"))
+			if err != nil {
+				date = entry.Stored
+			}
+			fresh = expires.Sub(date)
+		}
+	}
+	if !cc.has("must-revalidate") && !cc.has("proxy-revalidate") {
+		swr = cc.duration("stale-while-revalidate")
+	}
+	return fresh, swr
+}
+
+// setValidators makes the request conditional on the entries validators unless the client sent its own conditional request
+func setValidators(req *http.Request, entry *Entry) bool {
+	if req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+	etag, modified := entry.Header.Get("ETag"), entry.Header.Get("Last-Modified")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if modified != "" {
+		req.Header.Set("If-Modified-Since", modified)
+	}
+	return etag != "" || modified != ""
+}
+
+// refresh updates the entry with the headers of a 304 response
+func refresh(entry *Entry, resp *http.Response) *Entry {
+	updated := *entry
+	updated.Header = entry.Header.Clone()
+	for k, v := range resp.Header {
+		if k == "Content-Length" {
+			continue
+		}
+		updated.Header[k] = v
+	}
+	updated.Stored = responseTime(resp.Header)
+	return &updated
+}
+
+// responseTime returns the time the response was generated according to its Age header
+func responseTime(header http.Header) time.Time {
+	now := time.Now()
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		return now.Add(-time.Duration(age) * time.Second)
+	}
+	return now
+}
+
+func varyHeaders(header http.Header) []string {
+	var vary []string
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+	return vary
+}
+
+func variantKey(key string, vary []string, header http.Header) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(strings.Join(header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func matchesETag(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, v := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if directive == "" {
+				continue
+			}
+			if i := strings.Index(directive, "="); i >= 0 {
+				cc[directive[:i]] = strings.Trim(directive[i+1:], `"`)
+			} else {
+				cc[directive] = ""
+			}
+		}
+	}
+	return cc
+}
+
+func (c cacheControl) has(directive string) bool {
+	_, ok := c[directive]
+	return ok
+}
+
+func (c cacheControl) duration(directive string) time.Duration {
+	seconds, err := strconv.Atoi(c[directive])
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
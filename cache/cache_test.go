@@ -0,0 +1,190 @@
+package cache_test
+
+import (
+	"bytes"
+	"github.com/graphikDB/gproxy/cache"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// upstream returns a fetch function that serves the handler & counts requests
+func upstream(handler http.HandlerFunc) (cache.Fetch, *int64) {
+	var calls int64
+	return func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt64(&calls, 1)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		resp := rec.Result()
+		resp.Request = req
+		return resp, nil
+	}, &calls
+}
+
+func get(t *testing.T, c *cache.Cache, fetch cache.Fetch, path string, header http.Header) (*http.Response, string, cache.Status) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, status, err := c.Do(req, fetch)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bits, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, string(bits), status
+}
+
+func TestCache(t *testing.T) {
+	c := cache.New(cache.NewMemory(1<<20), 0)
+	fetch, calls := upstream(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("fresh"))
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			w.Write([]byte(r.Header.Get("Accept-Language")))
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+			w.Write([]byte("private"))
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte("etag"))
+		}
+	})
+	if _, body, status := get(t, c, fetch, "/fresh", nil); status != cache.Miss || body != "fresh" {
+		t.Fatalf("expected miss: %s %s", status, body)
+	}
+	resp, body, status := get(t, c, fetch, "/fresh", nil)
+	if status != cache.Hit || body != "fresh" || atomic.LoadInt64(calls) != 1 {
+		t.Fatalf("expected hit: %s %s", status, body)
+	}
+	if resp.Header.Get(cache.StatusHeader) == "" || resp.Header.Get("Age") == "" {
+		t.Fatalf("expected cache status & age headers: %v", resp.Header)
+	}
+	if _, _, status := get(t, c, fetch, "/fresh", http.Header{"Cache-Control": {"no-store"}}); status != cache.Bypass {
+		t.Fatalf("expected bypass: %s", status)
+	}
+
+	// variants are stored per Vary header value
+	for _, lang := range []string{"en", "fr", "en", "fr"} {
+		if _, body, _ := get(t, c, fetch, "/vary", http.Header{"Accept-Language": {lang}}); body != lang {
+			t.Fatalf("expected %s variant: %s", lang, body)
+		}
+	}
+	if _, _, status := get(t, c, fetch, "/vary", http.Header{"Accept-Language": {"fr"}}); status != cache.Hit {
+		t.Fatalf("expected variant hit: %s", status)
+	}
+
+	get(t, c, fetch, "/private", nil)
+	if _, _, status := get(t, c, fetch, "/private", nil); status != cache.Miss {
+		t.Fatalf("expected private response not to be stored: %s", status)
+	}
+
+	// no-cache responses are revalidated with their etag
+	get(t, c, fetch, "/etag", nil)
+	before := atomic.LoadInt64(calls)
+	_, body, status = get(t, c, fetch, "/etag", nil)
+	if status != cache.Revalidated || body != "etag" || atomic.LoadInt64(calls) != before+1 {
+		t.Fatalf("expected revalidation: %s %s", status, body)
+	}
+	// the clients own conditional request is answered by the cache
+	resp, _, _ = get(t, c, fetch, "/etag", http.Header{"If-None-Match": {`"v1"`}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected 304: %v", resp.StatusCode)
+	}
+
+	if purged := c.Purge("example.com/fresh"); purged != 1 {
+		t.Fatalf("expected 1 purged entry: %v", purged)
+	}
+	if _, _, status := get(t, c, fetch, "/fresh", nil); status != cache.Miss {
+		t.Fatalf("expected purged entry to miss: %s", status)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	c := cache.New(cache.NewMemory(1<<20), 0)
+	var version int64
+	fetch, calls := upstream(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=60")
+		w.Header().Set("Age", "1")
+		if atomic.AddInt64(&version, 1) == 1 {
+			w.Write([]byte("v1"))
+		} else {
+			w.Write([]byte("v2"))
+		}
+	})
+	get(t, c, fetch, "/", nil)
+	_, body, status := get(t, c, fetch, "/", nil)
+	if status != cache.Stale || body != "v1" {
+		t.Fatalf("expected stale response: %s %s", status, body)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(calls) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected background revalidation")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for {
+		if _, body, _ := get(t, c, fetch, "/", nil); body == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected revalidated response to be stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStores(t *testing.T) {
+	mem := cache.NewMemory(100)
+	mem.Set(&cache.Entry{Key: "a", Body: bytes.Repeat([]byte("a"), 60)})
+	mem.Set(&cache.Entry{Key: "b", Body: bytes.Repeat([]byte("b"), 60)})
+	if _, ok := mem.Get("a"); ok {
+		t.Fatal("expected least recently used entry to be evicted")
+	}
+	if _, ok := mem.Get("b"); !ok {
+		t.Fatal("expected entry")
+	}
+
+	dir, err := ioutil.TempDir("", "gproxy-cache")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	disk, err := cache.NewDisk(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	disk.Set(&cache.Entry{Key: "example.com/users", StatusCode: http.StatusOK, Header: http.Header{"Etag": {`"v1"`}}, Body: []byte("users")})
+	disk.Set(&cache.Entry{Key: "example.com/posts", StatusCode: http.StatusOK, Body: []byte("posts")})
+	// entries are loaded from the directory when the store is reopened
+	reopened, err := cache.NewDisk(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	entry, ok := reopened.Get("example.com/users")
+	if !ok || string(entry.Body) != "users" || entry.Header.Get("ETag") != `"v1"` {
+		t.Fatalf("expected persisted entry: %v", entry)
+	}
+	if purged := reopened.Purge("example.com/"); purged != 2 {
+		t.Fatalf("expected 2 purged entries: %v", purged)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Fatalf("expected purged files to be removed: %v", len(files))
+	}
+}
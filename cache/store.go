@@ -0,0 +1,257 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a cached response
+type Entry struct {
+	// Key is the cache key the entry is stored under
+	Key        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Stored is the time the response was generated(the response time minus its Age)
+	Stored time.Time
+	// Vary lists the request headers that select a variant. Entries with a Vary list are markers pointing at their variants
+	Vary []string
+}
+
+func (e *Entry) size() int64 {
+	size := len(e.Key) + len(e.Body)
+	for k, values := range e.Header {
+		size += len(k)
+		for _, v := range values {
+			size += len(v)
+		}
+	}
+	for _, v := range e.Vary {
+		size += len(v)
+	}
+	return int64(size)
+}
+
+// Store stores cache entries. Implementations must be safe for concurrent use
+type Store interface {
+	// Get returns the entry stored under the key
+	Get(key string) (*Entry, bool)
+	// Set stores the entry under its key, evicting the least recently used entries if the store is full
+	Set(entry *Entry)
+	// Purge deletes every entry whose key starts with the prefix & returns the number of deleted entries
+	Purge(prefix string) int
+}
+
+// lru tracks the size & recency of stored keys
+type lru struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List
+	items    map[string]*list.Element
+	evict    func(key string, value interface{})
+}
+
+type lruItem struct {
+	key   string
+	size  int64
+	value interface{}
+}
+
+func newLRU(maxBytes int64, evict func(key string, value interface{})) *lru {
+	return &lru{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    map[string]*list.Element{},
+		evict:    evict,
+	}
+}
+
+func (l *lru) get(key string) (interface{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	elem, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(elem)
+	return elem.Value.(*lruItem).value, true
+}
+
+func (l *lru) set(key string, size int64, value interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elem, ok := l.items[key]; ok {
+		l.remove(elem, false)
+	}
+	l.items[key] = l.order.PushFront(&lruItem{key: key, size: size, value: value})
+	l.size += size
+	for l.maxBytes > 0 && l.size > l.maxBytes && l.order.Len() > 1 {
+		l.remove(l.order.Back(), true)
+	}
+}
+
+func (l *lru) delete(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elem, ok := l.items[key]; ok {
+		l.remove(elem, true)
+	}
+}
+
+func (l *lru) purge(prefix string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var purged int
+	for key, elem := range l.items {
+		if strings.HasPrefix(key, prefix) {
+			l.remove(elem, true)
+			purged++
+		}
+	}
+	return purged
+}
+
+func (l *lru) remove(elem *list.Element, evict bool) {
+	item := elem.Value.(*lruItem)
+	l.order.Remove(elem)
+	delete(l.items, item.key)
+	l.size -= item.size
+	if evict && l.evict != nil {
+		l.evict(item.key, item.value)
+	}
+}
+
+type memoryStore struct {
+	lru *lru
+}
+
+// NewMemory returns an in-memory store that holds up to maxBytes of entries, evicting the least recently used entries
+func NewMemory(maxBytes int64) Store {
+	return &memoryStore{lru: newLRU(maxBytes, nil)}
+}
+
+func (m *memoryStore) Get(key string) (*Entry, bool) {
+	val, ok := m.lru.get(key)
+	if !ok {
+		return nil, false
+	}
+	return val.(*Entry), true
+}
+
+func (m *memoryStore) Set(entry *Entry) {
+	m.lru.set(entry.Key, entry.size(), entry)
+}
+
+func (m *memoryStore) Purge(prefix string) int {
+	return m.lru.purge(prefix)
+}
+
+type diskStore struct {
+	dir string
+	lru *lru
+}
+
+// NewDisk returns a store that persists up to maxBytes of entries as files in the directory, evicting the least recently
+// used entries. Entries that were stored by a previous process are loaded from the directory
+func NewDisk(dir string, maxBytes int64) (Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "cache: create directory")
+	}
+	d := &diskStore{dir: dir}
+	d.lru = newLRU(maxBytes, func(key string, value interface{}) {
+		os.Remove(value.(string))
+	})
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "cache: read directory")
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		if f.IsDir() || filepath.Ext(path) != ".entry" {
+			continue
+		}
+		entry, err := readEntry(path)
+		if err != nil {
+			os.Remove(path)
+			continue
+		}
+		d.lru.set(entry.Key, f.Size(), path)
+	}
+	return d, nil
+}
+
+func (d *diskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:])+".entry")
+}
+
+func (d *diskStore) Get(key string) (*Entry, bool) {
+	val, ok := d.lru.get(key)
+	if !ok {
+		return nil, false
+	}
+	entry, err := readEntry(val.(string))
+	if err != nil || entry.Key != key {
+		d.lru.delete(key)
+		return nil, false
+	}
+	return entry, true
+}
+
+func (d *diskStore) Set(entry *Entry) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return
+	}
+	path := d.path(entry.Key)
+	tmp, err := ioutil.TempFile(d.dir, "tmp-")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	d.lru.set(entry.Key, int64(buf.Len()), path)
+}
+
+func (d *diskStore) Purge(prefix string) int {
+	return d.lru.purge(prefix)
+}
+
+func readEntry(path string) (*Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entry Entry
+	if err := gob.NewDecoder(f).Decode(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
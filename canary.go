@@ -0,0 +1,132 @@
+package gproxy
+
+import (
+	"encoding/json"
+	"github.com/graphikDB/gproxy/canary"
+	"github.com/graphikDB/gproxy/metrics"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+)
+
+// errNoCanary is returned when ramping a route without a canary policy
+var errNoCanary = errors.New("route has no canary")
+
+// canaryRamp is a canary percentage set at runtime along with the configured percentage it replaced
+type canaryRamp struct {
+	configured float64
+	percent    float64
+}
+
+// OverrideCanaries replaces the canary policies(ex: when the config is reloaded). Percentages ramped with
+// SetCanaryPercent are kept until the routes configured percentage changes or its canary is removed
+func (p *Proxy) OverrideCanaries(policies map[string]*canary.Policy) error {
+	canaries := map[string]*canary.Policy{}
+	for name, policy := range policies {
+		if err := policy.Validate(); err != nil {
+			return errors.Wrapf(err, "route %s", name)
+		}
+		canaries[name] = policy
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name, ramp := range p.canaryRamps {
+		policy, ok := canaries[name]
+		if !ok || policy.Percent != ramp.configured {
+			delete(p.canaryRamps, name)
+			continue
+		}
+		ramped, err := policy.WithPercent(ramp.percent)
+		if err != nil {
+			return errors.Wrapf(err, "route %s", name)
+		}
+		canaries[name] = ramped
+	}
+	p.canaries = canaries
+	return nil
+}
+
+// SetCanaryPercent changes the percentage of the named routes clients that are sent to its canary. The percentage is
+// kept when the canary policies are reloaded unless the routes configured percentage changes. It is concurrency safe
+func (p *Proxy) SetCanaryPercent(routeName string, percent float64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	policy, ok := p.canaries[routeName]
+	if !ok {
+		return errNoCanary
+	}
+	ramped, err := policy.WithPercent(percent)
+	if err != nil {
+		return err
+	}
+	ramp, ok := p.canaryRamps[routeName]
+	if !ok {
+		ramp.configured = policy.Percent
+	}
+	ramp.percent = percent
+	p.canaryRamps[routeName] = ramp
+	p.canaries[routeName] = ramped
+	return nil
+}
+
+// canaryPolicy returns the canary policy registered for the route. Canary targets are route specific so there is no default("*") policy
+func (p *Proxy) canaryPolicy(routeName string) *canary.Policy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.canaries[routeName]
+}
+
+// splitTraffic sends the request to the routes canary targets if the routes canary policy selects the canary variant.
+// issueClientID reports whether the client can receive a sticky cookie(http)
+func (p *Proxy) splitTraffic(rt *route, header http.Header, clientIP string, issueClientID bool) canary.Decision {
+	policy := p.canaryPolicy(rt.name)
+	if policy == nil {
+		rt.variant = canary.Stable
+		return canary.Decision{}
+	}
+	decision := policy.Decide(header, clientIP, issueClientID)
+	rt.variant = decision.Variant
+	if decision.Variant == canary.Canary {
+		rt.targets = append([]string{}, policy.Targets...)
+	}
+	metrics.CanaryRequests.WithLabelValues(rt.name, string(decision.Variant), string(decision.Reason)).Inc()
+	return decision
+}
+
+// canaryHandler lists the canary policies(GET) & ramps a routes canary percentage(POST ?route=api&percent=25 with the admin token)
+func (p *Proxy) canaryHandler() http.Handler {
+	type canaryStatus struct {
+		Targets []string `json:"targets"`
+		Percent float64  `json:"percent"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			percent, err := strconv.ParseFloat(r.URL.Query().Get("percent"), 64)
+			if err != nil {
+				http.Error(w, "invalid percent", http.StatusBadRequest)
+				return
+			}
+			if err := p.SetCanaryPercent(r.URL.Query().Get("route"), percent); err != nil {
+				code := http.StatusBadRequest
+				if err == errNoCanary {
+					code = http.StatusNotFound
+				}
+				http.Error(w, err.Error(), code)
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		statuses := map[string]canaryStatus{}
+		p.mu.RLock()
+		for name, policy := range p.canaries {
+			statuses[name] = canaryStatus{Targets: policy.Targets, Percent: policy.Percent}
+		}
+		p.mu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statuses)
+	})
+}
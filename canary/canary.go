@@ -0,0 +1,163 @@
+// Package canary splits a routes traffic between its stable targets & canary targets for progressive delivery
+package canary
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"hash/fnv"
+	"net/http"
+)
+
+// Variant is the set of targets a request was sent to
+type Variant string
+
+const (
+	// Stable requests are sent to the routes targets
+	Stable Variant = "stable"
+	// Canary requests are sent to the canary targets
+	Canary Variant = "canary"
+)
+
+// Reason describes why a variant was chosen
+type Reason string
+
+const (
+	// Header requests were pinned by a header
+	Header Reason = "header"
+	// Cookie requests were pinned by a cookie
+	Cookie Reason = "cookie"
+	// Percent requests were assigned by hashing the clients sticky key into the canary percentage
+	Percent Reason = "percent"
+)
+
+// Pin sends requests whose header or cookie matches one of its values to the canary. If Values is empty, any
+// non-empty value matches
+type Pin struct {
+	// Header is the name of the header to match(ex: X-Canary)
+	Header string
+	// Cookie is the name of the cookie to match
+	Cookie string
+	// Values are the values that pin a request to the canary(ex: a list of user ids)
+	Values []string
+}
+
+// Policy sends a percentage of a routes traffic(and pinned clients) to canary targets. Decisions are sticky: a client
+// is identified by its sticky key & always receives the same variant for a given percentage. Raising the percentage
+// only moves stable clients to the canary
+type Policy struct {
+	// Targets are the canary targets. http routes require urls(ex: http://api-canary:8080) & gRPC routes gRPC targets(ex: api-canary:8080)
+	Targets []string
+	// Percent is the percentage(0-100) of clients that are sent to the canary
+	Percent float64
+	// Pins send matching requests to the canary regardless of the percentage
+	Pins []Pin
+	// StickyHeader identifies clients by a header(ex: X-User-Id). If empty or missing, the sticky cookie or client ip is used
+	StickyHeader string
+	// StickyCookie identifies clients by a cookie. If the cookie is missing, a random client id is issued so http clients
+	// keep their variant when their ip changes. Clients that can't receive the cookie(gRPC) are identified by their ip
+	StickyCookie string
+}
+
+// Decision is the outcome of a canary decision
+type Decision struct {
+	Variant Variant
+	Reason  Reason
+	// ClientID is a newly issued client id that should be set as the sticky cookie
+	ClientID string
+}
+
+// Validate returns an error if the policy is invalid
+func (p *Policy) Validate() error {
+	if len(p.Targets) == 0 {
+		return errors.New("canary: zero targets")
+	}
+	if p.Percent < 0 || p.Percent > 100 {
+		return errors.Errorf("canary: percent must be between 0 & 100: %v", p.Percent)
+	}
+	for _, pin := range p.Pins {
+		if pin.Header == "" && pin.Cookie == "" {
+			return errors.New("canary: pin requires a header or cookie")
+		}
+	}
+	return nil
+}
+
+// WithPercent returns a copy of the policy with the percentage changed
+func (p *Policy) WithPercent(percent float64) (*Policy, error) {
+	cp := *p
+	cp.Percent = percent
+	if err := cp.Validate(); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// Decide chooses the variant for a request with the given headers. clientIP is the sticky key used when the request
+// has no sticky header or cookie. issueClientID reports whether a new client id may be issued as the sticky cookie. If it
+// is false(ex: gRPC calls, which never send the cookie back) clients without the cookie are identified by clientIP, so
+// their decisions stay sticky
+func (p *Policy) Decide(header http.Header, clientIP string, issueClientID bool) Decision {
+	req := &http.Request{Header: header}
+	for _, pin := range p.Pins {
+		if pin.Header != "" && matches(header.Get(pin.Header), pin.Values) {
+			return Decision{Variant: Canary, Reason: Header}
+		}
+		if pin.Cookie != "" {
+			if c, err := req.Cookie(pin.Cookie); err == nil && matches(c.Value, pin.Values) {
+				return Decision{Variant: Canary, Reason: Cookie}
+			}
+		}
+	}
+	var (
+		key      string
+		clientID string
+	)
+	if p.StickyHeader != "" {
+		key = header.Get(p.StickyHeader)
+	}
+	if key == "" && p.StickyCookie != "" {
+		if c, err := req.Cookie(p.StickyCookie); err == nil && c.Value != "" {
+			key = c.Value
+		} else if issueClientID {
+			clientID = newClientID()
+			key = clientID
+		}
+	}
+	if key == "" {
+		key = clientIP
+	}
+	decision := Decision{Variant: Stable, Reason: Percent, ClientID: clientID}
+	if p.Percent > 0 && Bucket(key) < p.Percent {
+		decision.Variant = Canary
+	}
+	return decision
+}
+
+// Bucket hashes the sticky key into a bucket between 0(inclusive) & 100(exclusive)
+func Bucket(key string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return float64(h.Sum64()%10000) / 100
+}
+
+func matches(value string, values []string) bool {
+	if value == "" {
+		return false
+	}
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func newClientID() string {
+	bits := make([]byte, 16)
+	rand.Read(bits)
+	return hex.EncodeToString(bits)
+}
@@ -0,0 +1,93 @@
+package canary_test
+
+import (
+	"fmt"
+	"github.com/graphikDB/gproxy/canary"
+	"net/http"
+	"testing"
+)
+
+func TestDecide(t *testing.T) {
+	policy := &canary.Policy{
+		Targets: []string{"http://localhost:8081"},
+		Percent: 20,
+		Pins: []canary.Pin{
+			{Header: "X-Canary"},
+			{Cookie: "user", Values: []string{"alice"}},
+		},
+		StickyHeader: "X-User-Id",
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if d := policy.Decide(http.Header{"X-Canary": {"1"}}, "10.0.0.1", true); d.Variant != canary.Canary || d.Reason != canary.Header {
+		t.Fatalf("expected header pin: %v", d)
+	}
+	if d := policy.Decide(http.Header{"Cookie": {"user=alice"}}, "10.0.0.1", true); d.Variant != canary.Canary || d.Reason != canary.Cookie {
+		t.Fatalf("expected cookie pin: %v", d)
+	}
+	if d := policy.Decide(http.Header{"Cookie": {"user=bob"}}, "10.0.0.1", true); d.Reason != canary.Percent {
+		t.Fatalf("expected unpinned cookie: %v", d)
+	}
+	var canaries int
+	decisions := map[string]canary.Variant{}
+	for i := 0; i < 10000; i++ {
+		id := fmt.Sprintf("user-%v", i)
+		d := policy.Decide(http.Header{"X-User-Id": {id}}, "10.0.0.1", true)
+		if d.Variant == canary.Canary {
+			canaries++
+		}
+		decisions[id] = d.Variant
+	}
+	if canaries < 1700 || canaries > 2300 {
+		t.Fatalf("expected ~20%% of clients to be sent to the canary: %v", canaries)
+	}
+	// decisions are sticky & ramping up only moves stable clients to the canary
+	ramped, err := policy.WithPercent(50)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for id, variant := range decisions {
+		d := ramped.Decide(http.Header{"X-User-Id": {id}}, "10.0.0.1", true)
+		if variant == canary.Canary && d.Variant != canary.Canary {
+			t.Fatalf("%s: expected canary client to stay on the canary", id)
+		}
+		if again := policy.Decide(http.Header{"X-User-Id": {id}}, "10.0.0.2", true); again.Variant != variant {
+			t.Fatalf("%s: expected sticky decision", id)
+		}
+	}
+	if policy.Percent != 20 {
+		t.Fatal("expected ramping to copy the policy")
+	}
+	if _, err := policy.WithPercent(150); err == nil {
+		t.Fatal("expected invalid percent to be rejected")
+	}
+}
+
+func TestStickyCookie(t *testing.T) {
+	policy := &canary.Policy{Targets: []string{"localhost:8081"}, Percent: 50, StickyCookie: "gproxy_canary"}
+	d := policy.Decide(http.Header{}, "10.0.0.1", true)
+	if d.ClientID == "" {
+		t.Fatal("expected a client id to be issued")
+	}
+	again := policy.Decide(http.Header{"Cookie": {"gproxy_canary=" + d.ClientID}}, "10.0.0.2", true)
+	if again.ClientID != "" || again.Variant != d.Variant {
+		t.Fatalf("expected sticky decision for issued client id: %v %v", d, again)
+	}
+	// clients that can't receive the cookie are identified by their ip
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		d := policy.Decide(http.Header{}, ip, false)
+		if d.ClientID != "" || d.Variant != policy.Decide(http.Header{}, ip, false).Variant {
+			t.Fatalf("expected sticky decision by client ip for %s: %v", ip, d)
+		}
+		if expected := canary.Bucket(ip) < policy.Percent; (d.Variant == canary.Canary) != expected {
+			t.Fatalf("expected %s to be bucketed by its ip: %v", ip, d)
+		}
+	}
+	if err := (&canary.Policy{Percent: 10}).Validate(); err == nil {
+		t.Fatal("expected empty targets to be rejected")
+	}
+	if err := (&canary.Policy{Targets: []string{"x"}, Pins: []canary.Pin{{}}}).Validate(); err == nil {
+		t.Fatal("expected empty pin to be rejected")
+	}
+}
@@ -0,0 +1,986 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-redis/redis/v8"
+	"github.com/graphikDB/gproxy"
+	"github.com/graphikDB/gproxy/affinity"
+	"github.com/graphikDB/gproxy/auth"
+	"github.com/graphikDB/gproxy/authz"
+	"github.com/graphikDB/gproxy/breaker"
+	"github.com/graphikDB/gproxy/cache"
+	"github.com/graphikDB/gproxy/canary"
+	"github.com/graphikDB/gproxy/compress"
+	"github.com/graphikDB/gproxy/discovery"
+	"github.com/graphikDB/gproxy/headers"
+	"github.com/graphikDB/gproxy/ipfilter"
+	"github.com/graphikDB/gproxy/l4"
+	"github.com/graphikDB/gproxy/listener"
+	"github.com/graphikDB/gproxy/mirror"
+	"github.com/graphikDB/gproxy/ratelimit"
+	"github.com/graphikDB/gproxy/retry"
+	"github.com/graphikDB/gproxy/rewrite"
+	"github.com/graphikDB/gproxy/server"
+	"github.com/graphikDB/gproxy/sizelimit"
+	"github.com/graphikDB/gproxy/upstream"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc/codes"
+	"io/ioutil"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type retryConfig struct {
+	MaxAttempts    int           `mapstructure:"max_attempts"`
+	Codes          []string      `mapstructure:"codes"`
+	Statuses       []int         `mapstructure:"statuses"`
+	BaseBackoff    time.Duration `mapstructure:"base_backoff"`
+	MaxBackoff     time.Duration `mapstructure:"max_backoff"`
+	HedgingDelay   time.Duration `mapstructure:"hedging_delay"`
+	MaxBufferBytes int           `mapstructure:"max_buffer_bytes"`
+	Budget         *struct {
+		Ratio        float64 `mapstructure:"ratio"`
+		MinPerSecond int     `mapstructure:"min_per_second"`
+	} `mapstructure:"budget"`
+}
+
+// retryOpts converts the retry section of the config(route name -> policy) into proxy options
+func retryOpts() ([]gproxy.Opt, error) {
+	var configs = map[string]retryConfig{}
+	if err := viper.UnmarshalKey("retry", &configs); err != nil {
+		return nil, err
+	}
+	var opts []gproxy.Opt
+	for name, config := range configs {
+		policy := &retry.Policy{
+			MaxAttempts:    config.MaxAttempts,
+			Statuses:       config.Statuses,
+			BaseBackoff:    config.BaseBackoff,
+			MaxBackoff:     config.MaxBackoff,
+			HedgingDelay:   config.HedgingDelay,
+			MaxBufferBytes: config.MaxBufferBytes,
+		}
+		for _, c := range config.Codes {
+			code, err := parseCode(c)
+			if err != nil {
+				return nil, err
+			}
+			policy.Codes = append(policy.Codes, code)
+		}
+		if config.Budget != nil {
+			policy.Budget = retry.NewBudget(config.Budget.Ratio, config.Budget.MinPerSecond)
+		}
+		opts = append(opts, gproxy.WithRetryPolicy(name, policy))
+	}
+	return opts, nil
+}
+
+type breakerConfig struct {
+	ConsecutiveFailures int           `mapstructure:"consecutive_failures"`
+	ErrorRate           float64       `mapstructure:"error_rate"`
+	MinRequests         int           `mapstructure:"min_requests"`
+	Window              time.Duration `mapstructure:"window"`
+	OpenTimeout         time.Duration `mapstructure:"open_timeout"`
+	HalfOpenProbes      int           `mapstructure:"half_open_probes"`
+}
+
+// breakerOpts converts the circuit_breaker section of the config(route name -> config) into proxy options
+func breakerOpts() ([]gproxy.Opt, error) {
+	var configs = map[string]breakerConfig{}
+	if err := viper.UnmarshalKey("circuit_breaker", &configs); err != nil {
+		return nil, err
+	}
+	var opts []gproxy.Opt
+	for name, config := range configs {
+		opts = append(opts, gproxy.WithCircuitBreaker(name, &breaker.Config{
+			ConsecutiveFailures: config.ConsecutiveFailures,
+			ErrorRate:           config.ErrorRate,
+			MinRequests:         config.MinRequests,
+			Window:              config.Window,
+			OpenTimeout:         config.OpenTimeout,
+			HalfOpenProbes:      config.HalfOpenProbes,
+		}))
+	}
+	return opts, nil
+}
+
+type headerRuleConfig struct {
+	Action     string `mapstructure:"action"`
+	Name       string `mapstructure:"name"`
+	Value      string `mapstructure:"value"`
+	Expression string `mapstructure:"expression"`
+	To         string `mapstructure:"to"`
+}
+
+type headersConfig struct {
+	Request  []headerRuleConfig `mapstructure:"request"`
+	Response []headerRuleConfig `mapstructure:"response"`
+}
+
+// headerOpts converts the headers section of the config(route name -> rules) into proxy options
+func headerOpts() ([]gproxy.Opt, error) {
+	var configs = map[string]headersConfig{}
+	if err := viper.UnmarshalKey("headers", &configs); err != nil {
+		return nil, err
+	}
+	toRules := func(configs []headerRuleConfig) []headers.Rule {
+		var rules []headers.Rule
+		for _, c := range configs {
+			rules = append(rules, headers.Rule{
+				Action:     headers.Action(strings.ToLower(c.Action)),
+				Name:       c.Name,
+				Value:      c.Value,
+				Expression: c.Expression,
+				To:         c.To,
+			})
+		}
+		return rules
+	}
+	var opts []gproxy.Opt
+	for name, config := range configs {
+		rules, err := headers.NewRules(toRules(config.Request), toRules(config.Response))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, gproxy.WithHeaderRules(name, rules))
+	}
+	return opts, nil
+}
+
+type rewriteConfig struct {
+	StripPrefix string `mapstructure:"strip_prefix"`
+	Regex       string `mapstructure:"regex"`
+	Replacement string `mapstructure:"replacement"`
+	AddPrefix   string `mapstructure:"add_prefix"`
+}
+
+// rewriteOpts converts the rewrite section of the config(route name -> rules) into proxy options
+func rewriteOpts() ([]gproxy.Opt, error) {
+	var configs = map[string][]rewriteConfig{}
+	if err := viper.UnmarshalKey("rewrite", &configs); err != nil {
+		return nil, err
+	}
+	var opts []gproxy.Opt
+	for name, config := range configs {
+		var rules []rewrite.Rule
+		for _, c := range config {
+			rules = append(rules, rewrite.Rule{
+				StripPrefix: c.StripPrefix,
+				Regex:       c.Regex,
+				Replacement: c.Replacement,
+				AddPrefix:   c.AddPrefix,
+			})
+		}
+		compiled, err := rewrite.NewRules(rules...)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, gproxy.WithPathRewrite(name, compiled))
+	}
+	return opts, nil
+}
+
+type rateLimitConfig struct {
+	Name      string        `mapstructure:"name"`
+	Key       string        `mapstructure:"key"`
+	Algorithm string        `mapstructure:"algorithm"`
+	Limit     int           `mapstructure:"limit"`
+	Period    time.Duration `mapstructure:"period"`
+	Burst     int           `mapstructure:"burst"`
+}
+
+type rateLimitStoreConfig struct {
+	Redis *struct {
+		Address  string `mapstructure:"address"`
+		Password string `mapstructure:"password"`
+		DB       int    `mapstructure:"db"`
+		Prefix   string `mapstructure:"prefix"`
+	} `mapstructure:"redis"`
+}
+
+// rateLimitOpts converts the rate_limit section of the config(route name -> rules) into proxy options.
+// All limiters share the store configured in the rate_limit_store section(default: in-memory)
+func rateLimitOpts() ([]gproxy.Opt, error) {
+	var configs = map[string][]rateLimitConfig{}
+	if err := viper.UnmarshalKey("rate_limit", &configs); err != nil {
+		return nil, err
+	}
+	var storeConfig rateLimitStoreConfig
+	if err := viper.UnmarshalKey("rate_limit_store", &storeConfig); err != nil {
+		return nil, err
+	}
+	var store ratelimit.Store = ratelimit.NewMemoryStore()
+	if storeConfig.Redis != nil {
+		store = ratelimit.NewRedisStore(redis.NewClient(&redis.Options{
+			Addr:     storeConfig.Redis.Address,
+			Password: storeConfig.Redis.Password,
+			DB:       storeConfig.Redis.DB,
+		}), storeConfig.Redis.Prefix)
+	}
+	var opts []gproxy.Opt
+	for name, config := range configs {
+		var rules []ratelimit.Rule
+		for _, c := range config {
+			rules = append(rules, ratelimit.Rule{
+				Name:      c.Name,
+				Key:       c.Key,
+				Algorithm: ratelimit.Algorithm(strings.ToLower(c.Algorithm)),
+				Limit:     c.Limit,
+				Period:    c.Period,
+				Burst:     c.Burst,
+			})
+		}
+		limiter, err := ratelimit.New(store, rules...)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, gproxy.WithRateLimit(name, limiter))
+	}
+	return opts, nil
+}
+
+type upstreamConfig struct {
+	Protocol              string        `mapstructure:"protocol"`
+	DialTimeout           time.Duration `mapstructure:"dial_timeout"`
+	KeepAlive             time.Duration `mapstructure:"keep_alive"`
+	MaxIdleConns          int           `mapstructure:"max_idle_conns"`
+	MaxIdleConnsPerHost   int           `mapstructure:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int           `mapstructure:"max_conns_per_host"`
+	IdleConnTimeout       time.Duration `mapstructure:"idle_conn_timeout"`
+	ResponseHeaderTimeout time.Duration `mapstructure:"response_header_timeout"`
+	TLSHandshakeTimeout   time.Duration `mapstructure:"tls_handshake_timeout"`
+	ExpectContinueTimeout time.Duration `mapstructure:"expect_continue_timeout"`
+	DisableKeepAlives     bool          `mapstructure:"disable_keep_alives"`
+	DisableCompression    bool          `mapstructure:"disable_compression"`
+	PingInterval          time.Duration `mapstructure:"ping_interval"`
+	PingTimeout           time.Duration `mapstructure:"ping_timeout"`
+	TLS                   *struct {
+		CAFile             string `mapstructure:"ca_file"`
+		ServerName         string `mapstructure:"server_name"`
+		InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+	} `mapstructure:"tls"`
+}
+
+// upstreamOpts converts the upstream section of the config(route name -> transport settings) into proxy options
+func upstreamOpts() ([]gproxy.Opt, error) {
+	var configs = map[string]upstreamConfig{}
+	if err := viper.UnmarshalKey("upstream", &configs); err != nil {
+		return nil, err
+	}
+	var opts []gproxy.Opt
+	for name, c := range configs {
+		config := &upstream.Config{
+			Protocol:              upstream.Protocol(strings.ToLower(c.Protocol)),
+			DialTimeout:           c.DialTimeout,
+			KeepAlive:             c.KeepAlive,
+			MaxIdleConns:          c.MaxIdleConns,
+			MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+			MaxConnsPerHost:       c.MaxConnsPerHost,
+			IdleConnTimeout:       c.IdleConnTimeout,
+			ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+			TLSHandshakeTimeout:   c.TLSHandshakeTimeout,
+			ExpectContinueTimeout: c.ExpectContinueTimeout,
+			DisableKeepAlives:     c.DisableKeepAlives,
+			DisableCompression:    c.DisableCompression,
+			PingInterval:          c.PingInterval,
+			PingTimeout:           c.PingTimeout,
+		}
+		if c.TLS != nil {
+			config.TLS = &tls.Config{
+				ServerName:         c.TLS.ServerName,
+				InsecureSkipVerify: c.TLS.InsecureSkipVerify,
+			}
+			if c.TLS.CAFile != "" {
+				pem, err := ioutil.ReadFile(c.TLS.CAFile)
+				if err != nil {
+					return nil, err
+				}
+				config.TLS.RootCAs = x509.NewCertPool()
+				if !config.TLS.RootCAs.AppendCertsFromPEM(pem) {
+					return nil, errors.Errorf("upstream %s: no certificates found in %s", name, c.TLS.CAFile)
+				}
+			}
+		}
+		opts = append(opts, gproxy.WithUpstreamTransport(name, config))
+	}
+	return opts, nil
+}
+
+type mirrorConfig struct {
+	Target       string        `mapstructure:"target"`
+	Percent      float64       `mapstructure:"percent"`
+	MaxBodyBytes int           `mapstructure:"max_body_bytes"`
+	Timeout      time.Duration `mapstructure:"timeout"`
+}
+
+// mirrorOpts converts the mirror section of the config(route name -> policy) into proxy options
+func mirrorOpts() ([]gproxy.Opt, error) {
+	var configs = map[string]mirrorConfig{}
+	if err := viper.UnmarshalKey("mirror", &configs); err != nil {
+		return nil, err
+	}
+	var opts []gproxy.Opt
+	for name, c := range configs {
+		opts = append(opts, gproxy.WithMirror(name, &mirror.Policy{
+			Target:       c.Target,
+			Percent:      c.Percent,
+			MaxBodyBytes: c.MaxBodyBytes,
+			Timeout:      c.Timeout,
+		}))
+	}
+	return opts, nil
+}
+
+type canaryPinConfig struct {
+	Header string   `mapstructure:"header"`
+	Cookie string   `mapstructure:"cookie"`
+	Values []string `mapstructure:"values"`
+}
+
+type canaryConfig struct {
+	Targets      []string          `mapstructure:"targets"`
+	Percent      float64           `mapstructure:"percent"`
+	Pins         []canaryPinConfig `mapstructure:"pins"`
+	StickyHeader string            `mapstructure:"sticky_header"`
+	StickyCookie string            `mapstructure:"sticky_cookie"`
+}
+
+// canaries converts the canary section of the config(route name -> policy) into canary policies
+func canaries() (map[string]*canary.Policy, error) {
+	var configs = map[string]canaryConfig{}
+	if err := viper.UnmarshalKey("canary", &configs); err != nil {
+		return nil, err
+	}
+	policies := map[string]*canary.Policy{}
+	for name, c := range configs {
+		policy := &canary.Policy{
+			Targets:      c.Targets,
+			Percent:      c.Percent,
+			StickyHeader: c.StickyHeader,
+			StickyCookie: c.StickyCookie,
+		}
+		for _, pin := range c.Pins {
+			policy.Pins = append(policy.Pins, canary.Pin{
+				Header: pin.Header,
+				Cookie: pin.Cookie,
+				Values: pin.Values,
+			})
+		}
+		policies[name] = policy
+	}
+	return policies, nil
+}
+
+// canaryOpts converts the canary section of the config into proxy options
+func canaryOpts() ([]gproxy.Opt, error) {
+	policies, err := canaries()
+	if err != nil {
+		return nil, err
+	}
+	var opts []gproxy.Opt
+	for name, policy := range policies {
+		opts = append(opts, gproxy.WithCanary(name, policy))
+	}
+	return opts, nil
+}
+
+type affinityConfig struct {
+	Cookie    string        `mapstructure:"cookie"`
+	CookieTTL time.Duration `mapstructure:"cookie_ttl"`
+	Hash      string        `mapstructure:"hash"`
+	Key       string        `mapstructure:"key"`
+}
+
+// affinityOpts converts the affinity section of the config(route name -> policy) into proxy options
+func affinityOpts() ([]gproxy.Opt, error) {
+	var configs = map[string]affinityConfig{}
+	if err := viper.UnmarshalKey("affinity", &configs); err != nil {
+		return nil, err
+	}
+	var opts []gproxy.Opt
+	for name, c := range configs {
+		opts = append(opts, gproxy.WithAffinity(name, &affinity.Policy{
+			Cookie:    c.Cookie,
+			CookieTTL: c.CookieTTL,
+			Hash:      affinity.Source(c.Hash),
+			Key:       c.Key,
+		}))
+	}
+	return opts, nil
+}
+
+type cacheConfig struct {
+	Store         string `mapstructure:"store"`
+	Dir           string `mapstructure:"dir"`
+	MaxBytes      int64  `mapstructure:"max_bytes"`
+	MaxEntryBytes int    `mapstructure:"max_entry_bytes"`
+}
+
+// cacheOpts converts the cache section of the config(route name -> cache) into proxy options
+func cacheOpts() ([]gproxy.Opt, error) {
+	var configs = map[string]cacheConfig{}
+	if err := viper.UnmarshalKey("cache", &configs); err != nil {
+		return nil, err
+	}
+	var opts []gproxy.Opt
+	for name, c := range configs {
+		if c.MaxBytes <= 0 {
+			c.MaxBytes = 100 << 20
+		}
+		var store cache.Store
+		switch c.Store {
+		case "", "memory":
+			store = cache.NewMemory(c.MaxBytes)
+		case "disk":
+			if c.Dir == "" {
+				return nil, errors.Errorf("cache %s: empty dir", name)
+			}
+			disk, err := cache.NewDisk(c.Dir, c.MaxBytes)
+			if err != nil {
+				return nil, errors.Wrapf(err, "cache %s", name)
+			}
+			store = disk
+		default:
+			return nil, errors.Errorf("cache %s: unsupported store: %s", name, c.Store)
+		}
+		opts = append(opts, gproxy.WithCache(name, cache.New(store, c.MaxEntryBytes)))
+	}
+	return opts, nil
+}
+
+type compressionConfig struct {
+	GRPCCompressors []string `mapstructure:"grpc_compressors"`
+	Routes          map[string]struct {
+		Encodings    []string `mapstructure:"encodings"`
+		ContentTypes []string `mapstructure:"content_types"`
+		MinBytes     int      `mapstructure:"min_bytes"`
+		GRPCEncoding string   `mapstructure:"grpc_encoding"`
+	} `mapstructure:"routes"`
+}
+
+// compressionOpts converts the compression section of the config into proxy options
+func compressionOpts() ([]gproxy.Opt, error) {
+	var config compressionConfig
+	if err := viper.UnmarshalKey("compression", &config); err != nil {
+		return nil, err
+	}
+	var opts []gproxy.Opt
+	if len(config.GRPCCompressors) > 0 {
+		opts = append(opts, gproxy.WithGRPCCompressors(config.GRPCCompressors...))
+	}
+	for name, c := range config.Routes {
+		opts = append(opts, gproxy.WithCompression(name, &compress.Policy{
+			Encodings:    c.Encodings,
+			ContentTypes: c.ContentTypes,
+			MinBytes:     c.MinBytes,
+			GRPCEncoding: c.GRPCEncoding,
+		}))
+	}
+	return opts, nil
+}
+
+type limitsConfig struct {
+	MaxHeaderBytes  int   `mapstructure:"max_header_bytes"`
+	MaxBodyBytes    int64 `mapstructure:"max_body_bytes"`
+	MaxMessageBytes int   `mapstructure:"max_message_bytes"`
+	MaxStreamBytes  int64 `mapstructure:"max_stream_bytes"`
+}
+
+// limitsOpts converts the limits section of the config(route name -> limits) into proxy options
+func limitsOpts() ([]gproxy.Opt, error) {
+	var config map[string]limitsConfig
+	if err := viper.UnmarshalKey("limits", &config); err != nil {
+		return nil, err
+	}
+	var opts []gproxy.Opt
+	for name, c := range config {
+		opts = append(opts, gproxy.WithSizeLimits(name, &sizelimit.Limits{
+			MaxHeaderBytes:  c.MaxHeaderBytes,
+			MaxBodyBytes:    c.MaxBodyBytes,
+			MaxMessageBytes: c.MaxMessageBytes,
+			MaxStreamBytes:  c.MaxStreamBytes,
+		}))
+	}
+	return opts, nil
+}
+
+type serverConfig struct {
+	ReadHeaderTimeout       time.Duration `mapstructure:"read_header_timeout"`
+	ReadTimeout             time.Duration `mapstructure:"read_timeout"`
+	WriteTimeout            time.Duration `mapstructure:"write_timeout"`
+	IdleTimeout             time.Duration `mapstructure:"idle_timeout"`
+	KeepaliveTime           time.Duration `mapstructure:"keepalive_time"`
+	KeepaliveTimeout        time.Duration `mapstructure:"keepalive_timeout"`
+	MinPingInterval         time.Duration `mapstructure:"min_ping_interval"`
+	PermitPingWithoutStream bool          `mapstructure:"permit_ping_without_stream"`
+	MaxConnections          int           `mapstructure:"max_connections"`
+	MaxConnectionsPerIP     int           `mapstructure:"max_connections_per_ip"`
+}
+
+// serverOpts converts the timeouts & connection limits of the server section of the config into proxy options
+func serverOpts() ([]gproxy.Opt, error) {
+	var c serverConfig
+	if err := viper.UnmarshalKey("server", &c); err != nil {
+		return nil, err
+	}
+	return []gproxy.Opt{gproxy.WithServerConfig(&server.Config{
+		ReadHeaderTimeout:       c.ReadHeaderTimeout,
+		ReadTimeout:             c.ReadTimeout,
+		WriteTimeout:            c.WriteTimeout,
+		IdleTimeout:             c.IdleTimeout,
+		KeepaliveTime:           c.KeepaliveTime,
+		KeepaliveTimeout:        c.KeepaliveTimeout,
+		MinPingInterval:         c.MinPingInterval,
+		PermitPingWithoutStream: c.PermitPingWithoutStream,
+		MaxConnections:          c.MaxConnections,
+		MaxConnectionsPerIP:     c.MaxConnectionsPerIP,
+	})}, nil
+}
+
+type l4Config struct {
+	Passthrough       bool          `mapstructure:"passthrough"`
+	Ports             []int         `mapstructure:"ports"`
+	TLSPorts          []int         `mapstructure:"tls_ports"`
+	DialTimeout       time.Duration `mapstructure:"dial_timeout"`
+	IdleTimeout       time.Duration `mapstructure:"idle_timeout"`
+	UDPPorts          []int         `mapstructure:"udp_ports"`
+	UDPSessionTimeout time.Duration `mapstructure:"udp_session_timeout"`
+	MaxUDPSessions    int           `mapstructure:"max_udp_sessions"`
+	Routes            []string      `mapstructure:"routes"`
+}
+
+// l4Opts converts the l4 section of the config into proxy options
+func l4Opts() ([]gproxy.Opt, error) {
+	var c l4Config
+	if err := viper.UnmarshalKey("l4", &c); err != nil {
+		return nil, err
+	}
+	if !c.Passthrough && len(c.Ports) == 0 && len(c.TLSPorts) == 0 && len(c.UDPPorts) == 0 {
+		return nil, nil
+	}
+	opts := []gproxy.Opt{gproxy.WithL4(&l4.Config{
+		Passthrough:       c.Passthrough,
+		Ports:             c.Ports,
+		TLSPorts:          c.TLSPorts,
+		DialTimeout:       c.DialTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		UDPPorts:          c.UDPPorts,
+		UDPSessionTimeout: c.UDPSessionTimeout,
+		MaxUDPSessions:    c.MaxUDPSessions,
+	})}
+	for _, route := range c.Routes {
+		opts = append(opts, gproxy.WithL4Route(route))
+	}
+	return opts, nil
+}
+
+type listenerConfig struct {
+	Network   string   `mapstructure:"network"`
+	Address   string   `mapstructure:"address"`
+	Acme      bool     `mapstructure:"acme"`
+	Protocols []string `mapstructure:"protocols"`
+	TLS       *struct {
+		CertFile     string `mapstructure:"cert_file"`
+		KeyFile      string `mapstructure:"key_file"`
+		ClientCAFile string `mapstructure:"client_ca_file"`
+	} `mapstructure:"tls"`
+	Routes []string `mapstructure:"routes"`
+}
+
+func listenerConfigs() (map[string]listenerConfig, error) {
+	var configs = map[string]listenerConfig{}
+	if err := viper.UnmarshalKey("listeners", &configs); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// listenerOpts converts the listeners section of the config(listener name -> listener settings & scoped routes) into proxy
+// options. Only the routes of the built in insecure & secure listeners may be configured
+func listenerOpts() ([]gproxy.Opt, error) {
+	configs, err := listenerConfigs()
+	if err != nil {
+		return nil, err
+	}
+	var opts []gproxy.Opt
+	for name, c := range configs {
+		if len(c.Routes) > 0 {
+			opts = append(opts, gproxy.WithListenerRoutes(name, c.Routes...))
+		}
+		if name == "insecure" || name == "secure" {
+			if c.Address != "" {
+				return nil, errors.Errorf("listener %s: the address is set by server.%s_port", name, name)
+			}
+			continue
+		}
+		config := &listener.Config{
+			Network: c.Network,
+			Address: c.Address,
+			Acme:    c.Acme,
+		}
+		for _, protocol := range c.Protocols {
+			config.Protocols = append(config.Protocols, listener.Protocol(strings.ToLower(protocol)))
+		}
+		if c.TLS != nil {
+			cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+			if err != nil {
+				return nil, errors.Wrapf(err, "listener %s", name)
+			}
+			config.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+			if c.TLS.ClientCAFile != "" {
+				pem, err := ioutil.ReadFile(c.TLS.ClientCAFile)
+				if err != nil {
+					return nil, err
+				}
+				config.TLS.ClientCAs = x509.NewCertPool()
+				if !config.TLS.ClientCAs.AppendCertsFromPEM(pem) {
+					return nil, errors.Errorf("listener %s: no certificates found in %s", name, c.TLS.ClientCAFile)
+				}
+				config.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+		opts = append(opts, gproxy.WithListener(name, config))
+	}
+	return opts, nil
+}
+
+type serviceConfig struct {
+	DNSSRV *struct {
+		Service  string        `mapstructure:"service"`
+		Proto    string        `mapstructure:"proto"`
+		Name     string        `mapstructure:"name"`
+		Interval time.Duration `mapstructure:"interval"`
+	} `mapstructure:"dns_srv"`
+	File *struct {
+		Path     string        `mapstructure:"path"`
+		Interval time.Duration `mapstructure:"interval"`
+	} `mapstructure:"file"`
+	Kubernetes *struct {
+		Namespace      string `mapstructure:"namespace"`
+		Name           string `mapstructure:"name"`
+		Port           string `mapstructure:"port"`
+		EndpointSlices bool   `mapstructure:"endpoint_slices"`
+	} `mapstructure:"kubernetes"`
+	Consul *struct {
+		Address    string `mapstructure:"address"`
+		Service    string `mapstructure:"service"`
+		Tag        string `mapstructure:"tag"`
+		Datacenter string `mapstructure:"datacenter"`
+		Token      string `mapstructure:"token"`
+	} `mapstructure:"consul"`
+	Etcd *struct {
+		Address  string        `mapstructure:"address"`
+		Prefix   string        `mapstructure:"prefix"`
+		Interval time.Duration `mapstructure:"interval"`
+	} `mapstructure:"etcd"`
+}
+
+// serviceOpts converts the services section of the config(service name -> provider) into proxy options
+func serviceOpts(onErr func(err error)) ([]gproxy.Opt, error) {
+	var configs = map[string]serviceConfig{}
+	if err := viper.UnmarshalKey("services", &configs); err != nil {
+		return nil, err
+	}
+	var (
+		opts      []gproxy.Opt
+		clientset kubernetes.Interface
+	)
+	for name, config := range configs {
+		var provider discovery.Provider
+		switch {
+		case config.DNSSRV != nil:
+			provider = &discovery.DNSSRV{
+				Service:  config.DNSSRV.Service,
+				Proto:    config.DNSSRV.Proto,
+				Name:     config.DNSSRV.Name,
+				Interval: config.DNSSRV.Interval,
+				OnError:  onErr,
+			}
+		case config.File != nil:
+			provider = &discovery.File{
+				Path:     config.File.Path,
+				Interval: config.File.Interval,
+				OnError:  onErr,
+			}
+		case config.Kubernetes != nil:
+			if clientset == nil {
+				restConfig, err := rest.InClusterConfig()
+				if err != nil {
+					return nil, errors.Wrap(err, "kubernetes service discovery requires an in-cluster config")
+				}
+				clientset, err = kubernetes.NewForConfig(restConfig)
+				if err != nil {
+					return nil, err
+				}
+			}
+			provider = &discovery.Kubernetes{
+				Client:         clientset,
+				Namespace:      config.Kubernetes.Namespace,
+				Name:           config.Kubernetes.Name,
+				Port:           config.Kubernetes.Port,
+				EndpointSlices: config.Kubernetes.EndpointSlices,
+			}
+		case config.Consul != nil:
+			provider = &discovery.Consul{
+				Address:    config.Consul.Address,
+				Service:    config.Consul.Service,
+				Tag:        config.Consul.Tag,
+				Datacenter: config.Consul.Datacenter,
+				Token:      config.Consul.Token,
+				OnError:    onErr,
+			}
+		case config.Etcd != nil:
+			provider = &discovery.Etcd{
+				Address:  config.Etcd.Address,
+				Prefix:   config.Etcd.Prefix,
+				Interval: config.Etcd.Interval,
+				OnError:  onErr,
+			}
+		default:
+			return nil, errors.Errorf("service %s: expected one of dns_srv, file, kubernetes, consul, etcd", name)
+		}
+		opts = append(opts, gproxy.WithService(name, provider))
+	}
+	return opts, nil
+}
+
+type authConfig struct {
+	Issuer     string        `mapstructure:"issuer"`
+	Audiences  []string      `mapstructure:"audiences"`
+	JWKSURLs   []string      `mapstructure:"jwks_urls"`
+	Algorithms []string      `mapstructure:"algorithms"`
+	Leeway     time.Duration `mapstructure:"leeway"`
+	Keys       []struct {
+		ID        string `mapstructure:"id"`
+		Algorithm string `mapstructure:"algorithm"`
+		PEM       string `mapstructure:"pem"`
+		Secret    string `mapstructure:"secret"`
+	} `mapstructure:"keys"`
+	Required      []string          `mapstructure:"required"`
+	ForwardClaims map[string]string `mapstructure:"forward_claims"`
+}
+
+// authOpts converts the auth section of the config into proxy options. Routes listed in required(or "*") reject
+// requests without a valid token
+func authOpts() ([]gproxy.Opt, error) {
+	if !viper.IsSet("auth") {
+		return nil, nil
+	}
+	var config authConfig
+	if err := viper.UnmarshalKey("auth", &config); err != nil {
+		return nil, err
+	}
+	verifierConfig := auth.Config{
+		Issuer:     config.Issuer,
+		Audiences:  config.Audiences,
+		JWKSURLs:   config.JWKSURLs,
+		Algorithms: config.Algorithms,
+		Leeway:     config.Leeway,
+	}
+	for _, k := range config.Keys {
+		key := auth.Key{ID: k.ID, Algorithm: k.Algorithm}
+		switch {
+		case k.PEM != "":
+			pub, err := auth.ParsePublicKeyPEM([]byte(k.PEM))
+			if err != nil {
+				return nil, err
+			}
+			key.Key = pub
+		case k.Secret != "":
+			key.Key = []byte(k.Secret)
+		default:
+			return nil, errors.Errorf("auth key %s: expected one of pem, secret", k.ID)
+		}
+		verifierConfig.Keys = append(verifierConfig.Keys, key)
+	}
+	verifier, err := auth.NewVerifier(verifierConfig)
+	if err != nil {
+		return nil, err
+	}
+	opts := []gproxy.Opt{gproxy.WithAuthentication(verifier)}
+	for _, name := range config.Required {
+		opts = append(opts, gproxy.WithAuthRequired(name, true))
+	}
+	if len(config.ForwardClaims) > 0 {
+		opts = append(opts, gproxy.WithForwardClaims(config.ForwardClaims))
+	}
+	return opts, nil
+}
+
+type authzConfig struct {
+	Policies map[string]struct {
+		Decision string `mapstructure:"decision"`
+		DryRun   bool   `mapstructure:"dry_run"`
+	} `mapstructure:"policies"`
+	Routes map[string][]string `mapstructure:"routes"`
+}
+
+// authzOpts converts the authz section of the config(named policies & route name -> policy names) into proxy options
+func authzOpts() ([]gproxy.Opt, error) {
+	var config authzConfig
+	if err := viper.UnmarshalKey("authz", &config); err != nil {
+		return nil, err
+	}
+	var opts []gproxy.Opt
+	for name, c := range config.Policies {
+		policy, err := authz.NewPolicy(name, c.Decision, c.DryRun)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, gproxy.WithAuthzPolicy(policy))
+	}
+	for name, policies := range config.Routes {
+		opts = append(opts, gproxy.WithRouteAuthz(name, policies...))
+	}
+	return opts, nil
+}
+
+type ipFilterConfig struct {
+	Allow     []string `mapstructure:"allow"`
+	Deny      []string `mapstructure:"deny"`
+	AllowFile string   `mapstructure:"allow_file"`
+	DenyFile  string   `mapstructure:"deny_file"`
+}
+
+// filter creates an ip filter from the configs inline & file entries
+func (c ipFilterConfig) filter() (*ipfilter.Filter, error) {
+	allow, deny := c.Allow, c.Deny
+	if c.AllowFile != "" {
+		values, err := ipfilter.ReadFile(c.AllowFile)
+		if err != nil {
+			return nil, err
+		}
+		allow = append(append([]string{}, allow...), values...)
+	}
+	if c.DenyFile != "" {
+		values, err := ipfilter.ReadFile(c.DenyFile)
+		if err != nil {
+			return nil, err
+		}
+		deny = append(append([]string{}, deny...), values...)
+	}
+	return ipfilter.New(allow, deny)
+}
+
+type ipFiltersConfig struct {
+	TrustedProxies []string                  `mapstructure:"trusted_proxies"`
+	Listener       *ipFilterConfig           `mapstructure:"listener"`
+	Routes         map[string]ipFilterConfig `mapstructure:"routes"`
+}
+
+// files returns the allow & deny files referenced by the config so they may be watched for changes
+func (c ipFiltersConfig) files() []string {
+	var files []string
+	configs := []ipFilterConfig{}
+	if c.Listener != nil {
+		configs = append(configs, *c.Listener)
+	}
+	for _, r := range c.Routes {
+		configs = append(configs, r)
+	}
+	for _, r := range configs {
+		for _, f := range []string{r.AllowFile, r.DenyFile} {
+			if f != "" {
+				files = append(files, f)
+			}
+		}
+	}
+	return files
+}
+
+// ipFilters converts the ip_filter section of the config into the listener & per-route(route name -> filter) ip filters
+func ipFilters() (ipFiltersConfig, *ipfilter.Filter, map[string]*ipfilter.Filter, error) {
+	var config ipFiltersConfig
+	if err := viper.UnmarshalKey("ip_filter", &config); err != nil {
+		return config, nil, nil, err
+	}
+	var listener *ipfilter.Filter
+	if config.Listener != nil {
+		filter, err := config.Listener.filter()
+		if err != nil {
+			return config, nil, nil, errors.Wrap(err, "listener")
+		}
+		listener = filter
+	}
+	routes := map[string]*ipfilter.Filter{}
+	for name, c := range config.Routes {
+		filter, err := c.filter()
+		if err != nil {
+			return config, nil, nil, errors.Wrap(err, name)
+		}
+		routes[name] = filter
+	}
+	return config, listener, routes, nil
+}
+
+// ipFilterOpts converts the ip_filter section of the config into proxy options
+func ipFilterOpts() ([]gproxy.Opt, error) {
+	config, listener, routes, err := ipFilters()
+	if err != nil {
+		return nil, err
+	}
+	var opts []gproxy.Opt
+	if len(config.TrustedProxies) > 0 {
+		opts = append(opts, gproxy.WithTrustedProxies(config.TrustedProxies...))
+	}
+	if listener != nil {
+		opts = append(opts, gproxy.WithListenerIPFilter(listener))
+	}
+	for name, filter := range routes {
+		opts = append(opts, gproxy.WithIPFilter(name, filter))
+	}
+	return opts, nil
+}
+
+// watchFiles calls onChange whenever one of the files is written, created or renamed(ex: replaced by a config management tool)
+func watchFiles(ctx context.Context, files []string, onChange func(), onErr func(err error)) error {
+	if len(files) == 0 {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	watched := map[string]bool{}
+	for _, f := range files {
+		f = filepath.Clean(f)
+		watched[f] = true
+		// watch the parent directory so replaced files keep being watched
+		if err := watcher.Add(filepath.Dir(f)); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-watcher.Events:
+				if watched[filepath.Clean(event.Name)] && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					onChange()
+				}
+			case err := <-watcher.Errors:
+				onErr(err)
+			}
+		}
+	}()
+	return nil
+}
+
+func parseCode(c string) (codes.Code, error) {
+	var code codes.Code
+	if err := code.UnmarshalJSON([]byte(fmt.Sprintf("%q", strings.ToUpper(c)))); err != nil {
+		return code, err
+	}
+	return code, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/graphikDB/gproxy"
+	"github.com/graphikDB/gproxy/ingress"
+	"github.com/graphikDB/gproxy/logger"
+	"go.uber.org/zap"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"sync"
+)
+
+type controllerConfig struct {
+	Enabled        bool   `mapstructure:"enabled"`
+	Namespace      string `mapstructure:"namespace"`
+	IngressClass   string `mapstructure:"ingress_class"`
+	GatewayAPI     bool   `mapstructure:"gateway_api"`
+	GatewayClass   string `mapstructure:"gateway_class"`
+	GatewayVersion string `mapstructure:"gateway_version"`
+	ClusterDomain  string `mapstructure:"cluster_domain"`
+}
+
+// routeTable merges the routes & acme policy of the config file with the routes & TLS hosts reported by the ingress controller.
+// config file routes are evaluated first so they may override controller routes
+type routeTable struct {
+	mu               sync.Mutex
+	proxy            *gproxy.Proxy
+	routing          []string
+	policy           string
+	controllerRoutes []string
+	controllerHosts  []string
+	controller       bool
+}
+
+func (r *routeTable) setConfig(routing []string, policy string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routing = routing
+	r.policy = policy
+	return r.apply()
+}
+
+func (r *routeTable) setController(routes []string, hosts []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.controllerRoutes = routes
+	r.controllerHosts = hosts
+	return r.apply()
+}
+
+func (r *routeTable) apply() error {
+	if err := r.proxy.OverrideRoutes(append(append([]string{}, r.routing...), r.controllerRoutes...)); err != nil {
+		return err
+	}
+	return r.proxy.OverrideAcmePolicy(r.acmePolicy())
+}
+
+func (r *routeTable) acmePolicy() string {
+	if !r.controller {
+		return r.policy
+	}
+	if r.policy == "" {
+		return ingress.AcmePolicy(r.controllerHosts)
+	}
+	return fmt.Sprintf("(%s) || %s", r.policy, ingress.AcmePolicy(r.controllerHosts))
+}
+
+// runController watches the clusters Ingress & Gateway API resources, updating the route table until the context is cancelled
+func runController(ctx context.Context, lgger *logger.Logger, config controllerConfig, table *routeTable) error {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return err
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+	controller := &ingress.Controller{
+		Client:         client,
+		Namespace:      config.Namespace,
+		IngressClass:   config.IngressClass,
+		GatewayClass:   config.GatewayClass,
+		GatewayVersion: config.GatewayVersion,
+		ClusterDomain:  config.ClusterDomain,
+		OnChange: func(routes []string, hosts []string) {
+			lgger.Info("ingress controller routes updated", zap.Strings("routes", routes), zap.Strings("hosts", hosts))
+			if err := table.setController(routes, hosts); err != nil {
+				lgger.Error("ingress controller failure", zap.Error(err))
+			}
+		},
+		OnError: func(err error) {
+			lgger.Error("ingress controller failure", zap.Error(err))
+		},
+	}
+	if config.GatewayAPI {
+		controller.Dynamic, err = dynamic.NewForConfig(restConfig)
+		if err != nil {
+			return err
+		}
+	}
+	return controller.Run(ctx)
+}
@@ -45,6 +45,8 @@ func main() {
 	var (
 		insecurePort = viper.GetInt("server.insecure_port")
 		securePort   = viper.GetInt("server.secure_port")
+		adminPort    = viper.GetInt("server.admin_port")
+		proxyProto   = viper.GetStringSlice("server.proxy_protocol")
 		policy       = viper.GetString("autocert.policy")
 		corigins     = viper.GetStringSlice("cors.origins")
 		cheaders     = viper.GetStringSlice("cors.headers")
@@ -57,7 +59,12 @@ func main() {
 	if policy == "" {
 		lgger.Debug("config: empty autocert policy")
 	}
-	if len(routing) == 0 {
+	var controller controllerConfig
+	if err := viper.UnmarshalKey("controller", &controller); err != nil {
+		lgger.Error("config: invalid controller", zap.Error(err))
+		return
+	}
+	if len(routing) == 0 && !controller.Enabled {
 		lgger.Error("config: at least one routing trigger/expression entry expected")
 		return
 	}
@@ -72,23 +79,245 @@ func main() {
 		gproxy.WithHttpsInit(gproxy.WithMiddlewares(c.Handler)),
 		gproxy.WithInsecurePort(insecurePort),
 		gproxy.WithSecurePort(securePort),
-		gproxy.WithAcmePolicy(policy),
 	}
-	for _, route := range routing {
-		opts = append(opts, gproxy.WithRoute(route))
+	table := &routeTable{controller: controller.Enabled}
+	if controller.Enabled {
+		// routes & certificate hosts are provided once the controllers caches have synced
+		opts = append(opts, gproxy.WithAcmePolicy("false"))
+	} else {
+		opts = append(opts, gproxy.WithAcmePolicy(policy))
+		for _, route := range routing {
+			opts = append(opts, gproxy.WithRoute(route))
+		}
+	}
+	ropts, err := retryOpts()
+	if err != nil {
+		lgger.Error("config: invalid retry policy", zap.Error(err))
+		return
+	}
+	opts = append(opts, ropts...)
+	bopts, err := breakerOpts()
+	if err != nil {
+		lgger.Error("config: invalid circuit breaker", zap.Error(err))
+		return
+	}
+	opts = append(opts, bopts...)
+	hopts, err := headerOpts()
+	if err != nil {
+		lgger.Error("config: invalid header rules", zap.Error(err))
+		return
+	}
+	opts = append(opts, hopts...)
+	rwopts, err := rewriteOpts()
+	if err != nil {
+		lgger.Error("config: invalid rewrite rules", zap.Error(err))
+		return
+	}
+	opts = append(opts, rwopts...)
+	rlopts, err := rateLimitOpts()
+	if err != nil {
+		lgger.Error("config: invalid rate limit", zap.Error(err))
+		return
+	}
+	opts = append(opts, rlopts...)
+	aopts, err := authOpts()
+	if err != nil {
+		lgger.Error("config: invalid auth", zap.Error(err))
+		return
+	}
+	opts = append(opts, aopts...)
+	azopts, err := authzOpts()
+	if err != nil {
+		lgger.Error("config: invalid authz", zap.Error(err))
+		return
+	}
+	opts = append(opts, azopts...)
+	uopts, err := upstreamOpts()
+	if err != nil {
+		lgger.Error("config: invalid upstream", zap.Error(err))
+		return
+	}
+	opts = append(opts, uopts...)
+	mopts, err := mirrorOpts()
+	if err != nil {
+		lgger.Error("config: invalid mirror", zap.Error(err))
+		return
+	}
+	opts = append(opts, mopts...)
+	copts, err := canaryOpts()
+	if err != nil {
+		lgger.Error("config: invalid canary", zap.Error(err))
+		return
+	}
+	opts = append(opts, copts...)
+	afopts, err := affinityOpts()
+	if err != nil {
+		lgger.Error("config: invalid affinity", zap.Error(err))
+		return
+	}
+	opts = append(opts, afopts...)
+	caopts, err := cacheOpts()
+	if err != nil {
+		lgger.Error("config: invalid cache", zap.Error(err))
+		return
+	}
+	opts = append(opts, caopts...)
+	cmopts, err := compressionOpts()
+	if err != nil {
+		lgger.Error("config: invalid compression", zap.Error(err))
+		return
+	}
+	opts = append(opts, cmopts...)
+	lmopts, err := limitsOpts()
+	if err != nil {
+		lgger.Error("config: invalid limits", zap.Error(err))
+		return
+	}
+	opts = append(opts, lmopts...)
+	sropts, err := serverOpts()
+	if err != nil {
+		lgger.Error("config: invalid server", zap.Error(err))
+		return
+	}
+	opts = append(opts, sropts...)
+	l4opts, err := l4Opts()
+	if err != nil {
+		lgger.Error("config: invalid l4", zap.Error(err))
+		return
+	}
+	opts = append(opts, l4opts...)
+	lsopts, err := listenerOpts()
+	if err != nil {
+		lgger.Error("config: invalid listeners", zap.Error(err))
+		return
+	}
+	opts = append(opts, lsopts...)
+	ipopts, err := ipFilterOpts()
+	if err != nil {
+		lgger.Error("config: invalid ip filter", zap.Error(err))
+		return
+	}
+	opts = append(opts, ipopts...)
+	sopts, err := serviceOpts(func(err error) {
+		lgger.Error("service discovery failure", zap.Error(err))
+	})
+	if err != nil {
+		lgger.Error("config: invalid service", zap.Error(err))
+		return
+	}
+	opts = append(opts, sopts...)
+	if adminPort > 0 {
+		opts = append(opts, gproxy.WithAdminPort(adminPort))
+	}
+	if adminAddress := viper.GetString("server.admin_address"); adminAddress != "" {
+		opts = append(opts, gproxy.WithAdminAddress(adminAddress))
+	}
+	if adminToken := viper.GetString("server.admin_token"); adminToken != "" {
+		opts = append(opts, gproxy.WithAdminToken(adminToken))
+	}
+	if viper.GetBool("server.http3") {
+		opts = append(opts, gproxy.WithHTTP3(true))
+	}
+	if mode := viper.GetString("forwarded.mode"); mode != "" || viper.GetBool("forwarded.rfc7239") {
+		if mode == "" {
+			mode = string(gproxy.ForwardedAppend)
+		}
+		opts = append(opts, gproxy.WithForwardedHeaders(gproxy.ForwardedMode(mode), viper.GetBool("forwarded.rfc7239")))
+	}
+	if len(proxyProto) > 0 {
+		opts = append(opts, gproxy.WithProxyProtocol(proxyProto...))
 	}
 	proxy, err := gproxy.New(ctx, opts...)
 	if err != nil {
 		lgger.Error("failed to create proxy", zap.Error(err))
 		return
 	}
+	table.proxy = proxy
 	if viper.GetBool("watch") {
+		reloadIPFilters := func() {
+			_, listener, routes, err := ipFilters()
+			if err != nil {
+				lgger.Error("ip filter reload failure", zap.Error(err))
+				return
+			}
+			proxy.OverrideIPFilters(listener, routes)
+		}
+		// listeners can't be added or removed without a restart, but their scoped routes are replaced. scoped tracks the
+		// listeners that had routes at the last load, so routes removed from the config are removed from the proxy too
+		scoped := map[string]bool{}
+		configs, err := listenerConfigs()
+		if err != nil {
+			lgger.Error("config: invalid listeners", zap.Error(err))
+			return
+		}
+		for name, c := range configs {
+			scoped[name] = len(c.Routes) > 0
+		}
+		reloadListenerRoutes := func() {
+			configs, err := listenerConfigs()
+			if err != nil {
+				lgger.Error("listener route reload failure", zap.Error(err))
+				return
+			}
+			for name := range configs {
+				if _, ok := scoped[name]; !ok {
+					scoped[name] = false
+				}
+			}
+			for name, hadRoutes := range scoped {
+				routes := configs[name].Routes
+				if err := proxy.OverrideListenerRoutes(name, routes); err != nil {
+					lgger.Error("listener route reload failure", zap.Error(err))
+					continue
+				}
+				if hadRoutes && len(routes) == 0 {
+					// the listener stays isolated instead of falling back to the global routes
+					lgger.Warn("listener routes removed: the listener matches zero routes", zap.String("listener", name))
+				}
+				scoped[name] = len(routes) > 0
+			}
+		}
 		viper.OnConfigChange(func(in fsnotify.Event) {
 			lgger.Debug("config change", zap.String("file", in.Name))
-			if err := proxy.OverrideRoutes(viper.GetStringSlice("routing")); err != nil {
+			if err := table.setConfig(viper.GetStringSlice("routing"), viper.GetString("autocert.policy")); err != nil {
 				lgger.Error("config change failure", zap.Error(err))
 			}
+			reloadIPFilters()
+			if err := proxy.OverrideL4Routes(viper.GetStringSlice("l4.routes")); err != nil {
+				lgger.Error("l4 route reload failure", zap.Error(err))
+			}
+			reloadListenerRoutes()
+			policies, err := canaries()
+			if err == nil {
+				err = proxy.OverrideCanaries(policies)
+			}
+			if err != nil {
+				lgger.Error("canary reload failure", zap.Error(err))
+			}
 		})
+		config, _, _, err := ipFilters()
+		if err != nil {
+			lgger.Error("config: invalid ip filter", zap.Error(err))
+			return
+		}
+		if err := watchFiles(ctx, config.files(), reloadIPFilters, func(err error) {
+			lgger.Error("ip filter file watch failure", zap.Error(err))
+		}); err != nil {
+			lgger.Error("config: failed to watch ip filter files", zap.Error(err))
+			return
+		}
+	}
+	if controller.Enabled {
+		if err := table.setConfig(routing, policy); err != nil {
+			lgger.Error("config: invalid routing", zap.Error(err))
+			return
+		}
+		go func() {
+			if err := runController(ctx, lgger, controller, table); err != nil {
+				lgger.Error("ingress controller failure", zap.Error(err))
+				cancel()
+			}
+		}()
 	}
 	if err := proxy.Serve(ctx); err != nil {
 		lgger.Error("server failure", zap.Error(err))
@@ -6,6 +6,11 @@ import (
 	"google.golang.org/grpc/encoding"
 )
 
+// Frame is a raw gRPC message that is passed through the proxy without being decoded
+type Frame struct {
+	Payload []byte
+}
+
 func NewProxyCodec() encoding.Codec {
 	return &proxyCodec{codec: proxy.Codec()}
 }
@@ -19,10 +24,17 @@ func (p *proxyCodec) Name() string {
 }
 
 func (p *proxyCodec) Marshal(v interface{}) ([]byte, error) {
+	if f, ok := v.(*Frame); ok {
+		return f.Payload, nil
+	}
 	return p.codec.Marshal(v)
 }
 
 func (p *proxyCodec) Unmarshal(data []byte, v interface{}) error {
+	if f, ok := v.(*Frame); ok {
+		f.Payload = data
+		return nil
+	}
 	return p.codec.Unmarshal(data, v)
 }
 
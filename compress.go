@@ -0,0 +1,36 @@
+package gproxy
+
+import (
+	"github.com/graphikDB/gproxy/compress"
+	"google.golang.org/grpc"
+	"net/http"
+)
+
+// compressionPolicy returns the compression policy registered for the route, falling back to the default("*") policy
+func (p *Proxy) compressionPolicy(routeName string) *compress.Policy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if policy, ok := p.compressions[routeName]; ok {
+		return policy
+	}
+	return p.compressions["*"]
+}
+
+// compressResponse compresses the upstream response with the best encoding accepted by the client
+func (p *Proxy) compressResponse(routeName string, resp *http.Response) error {
+	policy := p.compressionPolicy(routeName)
+	if policy == nil {
+		return nil
+	}
+	_, err := policy.Response(resp, resp.Request.Header.Get("Accept-Encoding"))
+	return err
+}
+
+// grpcCallOptions returns the call options used for calls to the routes gRPC targets
+func (p *Proxy) grpcCallOptions(routeName string) []grpc.CallOption {
+	policy := p.compressionPolicy(routeName)
+	if policy == nil || policy.GRPCEncoding == "" {
+		return nil
+	}
+	return []grpc.CallOption{grpc.UseCompressor(policy.GRPCEncoding)}
+}
@@ -0,0 +1,238 @@
+// Package compress negotiates & applies http response compression(gzip, brotli, zstd) & registers gRPC compressors
+package compress
+
+import (
+	"bufio"
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Gzip is the gzip content & gRPC encoding
+	Gzip = "gzip"
+	// Brotli is the brotli content encoding(http only)
+	Brotli = "br"
+	// Zstd is the zstd content & gRPC encoding
+	Zstd = "zstd"
+)
+
+// DefaultContentTypes are the media types that are compressed when a policy doesn't specify its own
+var DefaultContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/grpc-web-text",
+	"image/svg+xml",
+}
+
+// Policy compresses http responses whose content type is allowed & whose size is at least MinBytes with the best
+// encoding accepted by the client. Messages sent to gRPC targets are compressed with GRPCEncoding
+type Policy struct {
+	// Encodings are the supported content encodings in order of preference(default: br, zstd, gzip)
+	Encodings []string
+	// ContentTypes are the compressible media types. A type may end with /* to match every subtype(default: DefaultContentTypes)
+	ContentTypes []string
+	// MinBytes is the minimum response size that is compressed(default: 1024)
+	MinBytes int
+	// GRPCEncoding is the compressor(gzip, zstd) used for messages sent to gRPC targets. If empty, messages are sent uncompressed
+	GRPCEncoding string
+}
+
+// Validate returns an error if the policy is invalid
+func (p *Policy) Validate() error {
+	for _, enc := range p.Encodings {
+		switch enc {
+		case Gzip, Brotli, Zstd:
+		default:
+			return errors.Errorf("compress: unsupported encoding: %s", enc)
+		}
+	}
+	switch p.GRPCEncoding {
+	case "", Gzip, Zstd:
+	default:
+		return errors.Errorf("compress: unsupported gRPC encoding: %s", p.GRPCEncoding)
+	}
+	if p.MinBytes < 0 {
+		return errors.Errorf("compress: negative min bytes: %v", p.MinBytes)
+	}
+	return nil
+}
+
+func (p *Policy) encodings() []string {
+	if len(p.Encodings) == 0 {
+		return []string{Brotli, Zstd, Gzip}
+	}
+	return p.Encodings
+}
+
+func (p *Policy) minBytes() int {
+	if p.MinBytes == 0 {
+		return 1024
+	}
+	return p.MinBytes
+}
+
+// Negotiate returns the preferred encoding accepted by the Accept-Encoding header or an empty string if none is acceptable
+func (p *Policy) Negotiate(acceptEncoding string) string {
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[name] = q
+	}
+	var (
+		best  string
+		bestQ float64
+	)
+	for _, enc := range p.encodings() {
+		q, ok := accepted[enc]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// Compressible reports whether responses with the content type may be compressed
+func (p *Policy) Compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	// event streams are flushed message by message, so they are never buffered by a compressor
+	if err != nil || mediaType == "text/event-stream" {
+		return false
+	}
+	types := p.ContentTypes
+	if len(types) == 0 {
+		types = DefaultContentTypes
+	}
+	for _, t := range types {
+		if t == mediaType || strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Response compresses the response body with the preferred encoding accepted by the client(acceptEncoding). The body
+// is compressed as it is streamed to the client. It returns the encoding or an empty string if the response wasn't compressed
+func (p *Policy) Response(resp *http.Response, acceptEncoding string) (string, error) {
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Range") != "" ||
+		resp.StatusCode < http.StatusOK || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified ||
+		resp.Request != nil && resp.Request.Method == http.MethodHead ||
+		strings.Contains(resp.Header.Get("Cache-Control"), "no-transform") ||
+		!p.Compressible(resp.Header.Get("Content-Type")) {
+		return "", nil
+	}
+	resp.Header.Add("Vary", "Accept-Encoding")
+	encoding := p.Negotiate(acceptEncoding)
+	if encoding == "" {
+		return "", nil
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < int64(p.minBytes()) {
+		return "", nil
+	}
+	body := bufio.NewReaderSize(resp.Body, p.minBytes())
+	if resp.ContentLength < 0 {
+		// the response is streamed, so wait for enough of it to decide whether it is worth compressing
+		if peeked, _ := body.Peek(p.minBytes()); len(peeked) < p.minBytes() {
+			resp.Body = readCloser{Reader: body, Closer: resp.Body}
+			return "", nil
+		}
+	}
+	pr, pw := io.Pipe()
+	w, err := NewWriter(encoding, pw)
+	if err != nil {
+		return "", err
+	}
+	original := resp.Body
+	go func() {
+		_, err := io.Copy(w, body)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		original.Close()
+		pw.CloseWithError(err)
+	}()
+	resp.Body = readCloser{Reader: pr, Closer: closerFunc(func() error {
+		pr.Close()
+		return original.Close()
+	})}
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Accept-Ranges")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// the compressed representation isn't byte for byte identical to the upstream representation
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	resp.ContentLength = -1
+	return encoding, nil
+}
+
+// NewWriter returns a writer that compresses with the encoding
+func NewWriter(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Brotli:
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression), nil
+	case Zstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	default:
+		return nil, errors.Errorf("compress: unsupported encoding: %s", encoding)
+	}
+}
+
+// NewReader returns a reader that decompresses the encoding
+func NewReader(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Brotli:
+		return ioutil.NopCloser(brotli.NewReader(r)), nil
+	case Zstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{Reader: d, Closer: closerFunc(func() error {
+			d.Close()
+			return nil
+		})}, nil
+	default:
+		return nil, errors.Errorf("compress: unsupported encoding: %s", encoding)
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
@@ -0,0 +1,163 @@
+package compress_test
+
+import (
+	"bytes"
+	"github.com/graphikDB/gproxy/compress"
+	"google.golang.org/grpc/encoding"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	policy := &compress.Policy{}
+	for accept, expected := range map[string]string{
+		"gzip, deflate, br":     compress.Brotli,
+		"gzip;q=1.0, br;q=0.5":  compress.Gzip,
+		"zstd, gzip":            compress.Zstd,
+		"*":                     compress.Brotli,
+		"br;q=0, gzip":          compress.Gzip,
+		"identity":              "",
+		"":                      "",
+		"deflate, compress;q=1": "",
+	} {
+		if enc := policy.Negotiate(accept); enc != expected {
+			t.Fatalf("%s: expected %q got %q", accept, expected, enc)
+		}
+	}
+	if enc := (&compress.Policy{Encodings: []string{compress.Gzip}}).Negotiate("br, gzip"); enc != compress.Gzip {
+		t.Fatalf("expected gzip: %s", enc)
+	}
+	for contentType, expected := range map[string]bool{
+		"text/html; charset=utf-8": true,
+		"application/json":         true,
+		"image/png":                false,
+		"text/event-stream":        false,
+	} {
+		if policy.Compressible(contentType) != expected {
+			t.Fatalf("%s: expected compressible=%v", contentType, expected)
+		}
+	}
+	if err := (&compress.Policy{Encodings: []string{"deflate"}}).Validate(); err == nil {
+		t.Fatal("expected unsupported encoding to be rejected")
+	}
+}
+
+func TestResponse(t *testing.T) {
+	body := strings.Repeat("hello world ", 200)
+	policy := &compress.Policy{}
+	for _, enc := range []string{compress.Gzip, compress.Brotli, compress.Zstd} {
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": {"text/plain"}, "Etag": {`"v1"`}},
+			Body:          ioutil.NopCloser(strings.NewReader(body)),
+			ContentLength: -1,
+		}
+		encoding, err := policy.Response(resp, enc)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if encoding != enc || resp.Header.Get("Content-Encoding") != enc || resp.Header.Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("expected %s response: %v", enc, resp.Header)
+		}
+		if resp.Header.Get("ETag") != `W/"v1"` {
+			t.Fatalf("expected weak etag: %s", resp.Header.Get("ETag"))
+		}
+		compressed, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if len(compressed) >= len(body) {
+			t.Fatalf("%s: expected compressed body", enc)
+		}
+		r, err := compress.NewReader(enc, bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		decompressed, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		r.Close()
+		if string(decompressed) != body {
+			t.Fatalf("%s: unexpected body", enc)
+		}
+	}
+	// small responses are passed through
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"text/plain"}},
+		Body:          ioutil.NopCloser(strings.NewReader("small")),
+		ContentLength: -1,
+	}
+	if encoding, _ := policy.Response(resp, "gzip"); encoding != "" {
+		t.Fatal("expected small response not to be compressed")
+	}
+	if bits, _ := ioutil.ReadAll(resp.Body); string(bits) != "small" {
+		t.Fatalf("unexpected body: %s", bits)
+	}
+}
+
+func TestRegisterGRPC(t *testing.T) {
+	for _, name := range []string{compress.Gzip, compress.Zstd} {
+		if err := compress.RegisterGRPC(name); err != nil {
+			t.Fatal(err.Error())
+		}
+		c := encoding.GetCompressor(name)
+		if c == nil {
+			t.Fatalf("expected %s compressor to be registered", name)
+		}
+		var buf bytes.Buffer
+		w, err := c.Compress(&buf)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		w.Write([]byte("hello world"))
+		w.Close()
+		r, err := c.Decompress(&buf)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if msg, _ := ioutil.ReadAll(r); string(msg) != "hello world" {
+			t.Fatalf("%s: unexpected message: %s", name, msg)
+		}
+	}
+	if err := compress.RegisterGRPC("snappy"); err == nil {
+		t.Fatal("expected unsupported compressor to be rejected")
+	}
+}
+
+func TestZstdMaxMessageSize(t *testing.T) {
+	if err := compress.RegisterGRPC(compress.Zstd); err != nil {
+		t.Fatal(err.Error())
+	}
+	compress.SetGRPCMaxMessageSize(1 << 20)
+	defer compress.SetGRPCMaxMessageSize(4 << 20)
+	c := encoding.GetCompressor(compress.Zstd)
+	// concatenated frames that each inflate to less than the limit
+	var bomb bytes.Buffer
+	for i := 0; i < 64; i++ {
+		w, _ := c.Compress(&bomb)
+		w.Write(make([]byte, 512<<10))
+		w.Close()
+	}
+	r, err := c.Decompress(&bomb)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	msg, err := ioutil.ReadAll(r)
+	if err == nil || len(msg) != 1<<20+1 {
+		t.Fatalf("expected decompression to stop after the max message size: %v %v", len(msg), err)
+	}
+	// the decoder is reused once the message is rejected
+	var buf bytes.Buffer
+	w, _ := c.Compress(&buf)
+	w.Write([]byte("hello world"))
+	w.Close()
+	r, err = c.Decompress(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if msg, _ := ioutil.ReadAll(r); string(msg) != "hello world" {
+		t.Fatalf("unexpected message: %s", msg)
+	}
+}
@@ -0,0 +1,164 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/encoding"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// RegisterGRPC registers the gRPC compressor(gzip, zstd) so gRPC servers accept messages compressed with it(responding
+// with the same compressor) & it may be used for messages sent to gRPC targets. Registration is global & idempotent
+func RegisterGRPC(name string) error {
+	switch name {
+	case Gzip:
+		encoding.RegisterCompressor(gzipCompressor{})
+		return nil
+	case Zstd:
+		encoding.RegisterCompressor(zstdCompressor{})
+		return nil
+	default:
+		return errors.Errorf("compress: unsupported gRPC compressor: %s", name)
+	}
+}
+
+// gzipCompressor is a gRPC gzip compressor
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+func (gzipCompressor) Name() string {
+	return Gzip
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	// zstdDecoders are idle streaming decoders. Decoders own a goroutine, so they are closed instead of being
+	// dropped when the pool is full
+	zstdDecoders = make(chan *zstdDecoder, 64)
+	// zstdMaxMessageSize is the maximum decompressed size of a gRPC message
+	zstdMaxMessageSize int64 = 4 << 20
+)
+
+// SetGRPCMaxMessageSize sets the maximum decompressed size of gRPC messages(default: 4MB), which should match the gRPC
+// servers max receive message size. Decompression stops once a message exceeds it, so small compressed messages
+// can't inflate into large allocations(decompression bombs)
+func SetGRPCMaxMessageSize(size int) {
+	atomic.StoreInt64(&zstdMaxMessageSize, int64(size))
+}
+
+type zstdDecoder struct {
+	*zstd.Decoder
+	maxMessageSize int64
+}
+
+// zstdCompressor is a gRPC compressor that compresses whole messages with a shared, concurrency safe zstd encoder &
+// decompresses them with pooled streaming decoders
+type zstdCompressor struct{}
+
+func (zstdCompressor) init() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil)
+	})
+}
+
+func (z zstdCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	z.init()
+	return &zstdMessageWriter{w: w}, nil
+}
+
+// Decompress returns a reader that decompresses the message as it is read. gRPC reads at most its max receive message
+// size + 1 bytes, so decompression stops as soon as a message is too large instead of inflating it first
+func (zstdCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	max := atomic.LoadInt64(&zstdMaxMessageSize)
+	var dec *zstdDecoder
+	select {
+	case dec = <-zstdDecoders:
+		if dec.maxMessageSize != max {
+			dec.Close()
+			dec = nil
+		}
+	default:
+	}
+	if dec == nil {
+		// the window(history) of a frame is bounded by the max message size too
+		d, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(max)))
+		if err != nil {
+			return nil, err
+		}
+		dec = &zstdDecoder{Decoder: d, maxMessageSize: max}
+	}
+	// only readers without a Bytes method are decoded as a stream(see zstd.Decoder.Reset)
+	if err := dec.Reset(struct{ io.Reader }{r}); err != nil {
+		dec.Close()
+		return nil, err
+	}
+	return &zstdMessageReader{dec: dec, remaining: max + 1}, nil
+}
+
+func (zstdCompressor) Name() string {
+	return Zstd
+}
+
+// zstdMessageReader reads a decompressed message. The decoder is returned to the pool once the message has been read,
+// decompression failed or max message size + 1 bytes were read(the caller rejects the message)
+type zstdMessageReader struct {
+	dec       *zstdDecoder
+	remaining int64
+	err       error
+}
+
+func (z *zstdMessageReader) Read(p []byte) (int, error) {
+	if z.dec == nil {
+		return 0, z.err
+	}
+	if int64(len(p)) > z.remaining {
+		p = p[:z.remaining]
+	}
+	n, err := z.dec.Read(p)
+	z.remaining -= int64(n)
+	switch {
+	case err != nil:
+		z.release(err)
+	case z.remaining == 0:
+		z.release(zstd.ErrDecoderSizeExceeded)
+	}
+	return n, err
+}
+
+func (z *zstdMessageReader) release(err error) {
+	// cancels the current stream
+	_ = z.dec.Reset(nil)
+	select {
+	case zstdDecoders <- z.dec:
+	default:
+		z.dec.Close()
+	}
+	z.dec, z.err = nil, err
+}
+
+// zstdMessageWriter buffers a message & compresses it when it is closed
+type zstdMessageWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (z *zstdMessageWriter) Write(p []byte) (int, error) {
+	return z.buf.Write(p)
+}
+
+func (z *zstdMessageWriter) Close() error {
+	_, err := z.w.Write(zstdEncoder.EncodeAll(z.buf.Bytes(), nil))
+	return err
+}
@@ -0,0 +1,132 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Consul resolves the passing instances of a service registered with Consul.
+// Changes are detected with Consul blocking queries against the health api
+type Consul struct {
+	// Address is the Consul http api address(default: http://127.0.0.1:8500)
+	Address string
+	// Service is the name of the Consul service
+	Service string
+	// Tag filters instances by tag(optional)
+	Tag string
+	// Datacenter overrides the agents datacenter(optional)
+	Datacenter string
+	// Token is the Consul ACL token(optional)
+	Token string
+	// Wait is the maximum duration of a blocking query(default: 5m)
+	Wait time.Duration
+	// Client overrides the default http client(optional)
+	Client *http.Client
+	// OnError is called when a query fails(optional)
+	OnError func(err error)
+}
+
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+func (c *Consul) Watch(ctx context.Context, update func(endpoints []string)) error {
+	var (
+		index string
+		last  []string
+	)
+	for {
+		endpoints, next, err := c.query(ctx, index)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			if c.OnError != nil {
+				c.OnError(err)
+			}
+			// reset the index & back off so a restarted agent doesn't cause a tight loop
+			index = ""
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		index = next
+		if endpoints = normalize(endpoints); !equal(last, endpoints) {
+			last = endpoints
+			update(endpoints)
+		}
+	}
+}
+
+func (c *Consul) query(ctx context.Context, index string) ([]string, string, error) {
+	address := c.Address
+	if address == "" {
+		address = "http://127.0.0.1:8500"
+	}
+	wait := c.Wait
+	if wait <= 0 {
+		wait = 5 * time.Minute
+	}
+	params := url.Values{}
+	params.Set("passing", "true")
+	params.Set("wait", fmt.Sprintf("%vs", int(wait.Seconds())))
+	if index != "" {
+		params.Set("index", index)
+	}
+	if c.Tag != "" {
+		params.Set("tag", c.Tag)
+	}
+	if c.Datacenter != "" {
+		params.Set("dc", c.Datacenter)
+	}
+	u := fmt.Sprintf("%s/v1/health/service/%s?%s", strings.TrimSuffix(address, "/"), url.PathEscape(c.Service), params.Encode())
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req = req.WithContext(ctx)
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", errors.Errorf("consul: unexpected status %v", resp.StatusCode)
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, "", err
+	}
+	var endpoints []string
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		endpoints = append(endpoints, net.JoinHostPort(host, fmt.Sprint(e.Service.Port)))
+	}
+	return endpoints, resp.Header.Get("X-Consul-Index"), nil
+}
@@ -0,0 +1,93 @@
+package discovery
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// DefaultInterval is the polling interval used by providers that don't support watches
+const DefaultInterval = 30 * time.Second
+
+// Provider resolves a service into a list of endpoints(host:port)
+type Provider interface {
+	// Watch calls update with the services endpoints whenever they change. It blocks until the context is cancelled
+	Watch(ctx context.Context, update func(endpoints []string)) error
+}
+
+// ProviderFunc resolves a services endpoints once
+type ProviderFunc func(ctx context.Context) ([]string, error)
+
+// Poll creates a Provider that calls the resolver every interval(default: 30s), reporting changes to the endpoints.
+// onErr(optional) is called when the resolver fails - the previous endpoints are kept
+func Poll(resolver ProviderFunc, interval time.Duration, onErr func(err error)) Provider {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &poller{
+		resolve:  resolver,
+		interval: interval,
+		onErr:    onErr,
+	}
+}
+
+type poller struct {
+	resolve  ProviderFunc
+	interval time.Duration
+	onErr    func(err error)
+}
+
+func (p *poller) Watch(ctx context.Context, update func(endpoints []string)) error {
+	return p.watch(ctx, update, nil)
+}
+
+// watch resolves the endpoints every interval & whenever a value is received on refresh
+func (p *poller) watch(ctx context.Context, update func(endpoints []string), refresh <-chan struct{}) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	var last []string
+	for {
+		endpoints, err := p.resolve(ctx)
+		if err != nil {
+			if p.onErr != nil && ctx.Err() == nil {
+				p.onErr(err)
+			}
+		} else if endpoints = normalize(endpoints); !equal(last, endpoints) {
+			last = endpoints
+			update(endpoints)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-refresh:
+		}
+	}
+}
+
+// normalize sorts & dedupes endpoints so updates are only reported when the set of endpoints changes
+func normalize(endpoints []string) []string {
+	seen := map[string]struct{}{}
+	var normalized = []string{}
+	for _, e := range endpoints {
+		if _, ok := seen[e]; ok || e == "" {
+			continue
+		}
+		seen[e] = struct{}{}
+		normalized = append(normalized, e)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+func equal(a, b []string) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package discovery_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/graphikDB/gproxy/discovery"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// watch runs the provider in the background, returning a channel of endpoint updates
+func watch(t *testing.T, ctx context.Context, provider discovery.Provider) <-chan []string {
+	updates := make(chan []string, 10)
+	go func() {
+		if err := provider.Watch(ctx, func(endpoints []string) {
+			updates <- endpoints
+		}); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	return updates
+}
+
+func expect(t *testing.T, updates <-chan []string, expected ...string) {
+	select {
+	case endpoints := <-updates:
+		if strings.Join(endpoints, ",") != strings.Join(expected, ",") {
+			t.Fatalf("expected %v got %v", expected, endpoints)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %v", expected)
+	}
+}
+
+func TestFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "endpoints.txt")
+	if err := ioutil.WriteFile(path, []byte("# users\n10.0.0.2:8080\n10.0.0.1:8080\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	updates := watch(t, ctx, &discovery.File{Path: path, Interval: time.Minute})
+	expect(t, updates, "10.0.0.1:8080", "10.0.0.2:8080")
+	if err := ioutil.WriteFile(path, []byte("10.0.0.3:8080\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect(t, updates, "10.0.0.3:8080")
+}
+
+func TestConsul(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var index int64 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/users" || r.URL.Query().Get("passing") != "true" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		current := atomic.LoadInt64(&index)
+		if r.URL.Query().Get("index") == fmt.Sprint(current) {
+			// emulate a blocking query that is released by a change
+			time.Sleep(100 * time.Millisecond)
+			current = atomic.AddInt64(&index, 1)
+		}
+		w.Header().Set("X-Consul-Index", fmt.Sprint(current))
+		port := 8080
+		if current > 1 {
+			port = 9090
+		}
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"Node": map[string]interface{}{"Address": "10.0.0.1"}, "Service": map[string]interface{}{"Address": "", "Port": port}},
+			{"Node": map[string]interface{}{"Address": "10.0.0.9"}, "Service": map[string]interface{}{"Address": "10.0.0.2", "Port": port}},
+		})
+	}))
+	defer srv.Close()
+	updates := watch(t, ctx, &discovery.Consul{Address: srv.URL, Service: "users"})
+	expect(t, updates, "10.0.0.1:8080", "10.0.0.2:8080")
+	expect(t, updates, "10.0.0.1:9090", "10.0.0.2:9090")
+}
+
+func TestEtcd(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var endpoints atomic.Value
+	endpoints.Store([]string{"10.0.0.1:8080"})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		key, _ := base64.StdEncoding.DecodeString(req["key"])
+		end, _ := base64.StdEncoding.DecodeString(req["range_end"])
+		if r.URL.Path != "/v3/kv/range" || string(key) != "/services/users/" || string(end) != "/services/users0" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var kvs []map[string]string
+		for i, e := range endpoints.Load().([]string) {
+			kvs = append(kvs, map[string]string{
+				"key":   base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("/services/users/%v", i))),
+				"value": base64.StdEncoding.EncodeToString([]byte(e)),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"kvs": kvs})
+	}))
+	defer srv.Close()
+	updates := watch(t, ctx, &discovery.Etcd{Address: srv.URL, Prefix: "/services/users/", Interval: 50 * time.Millisecond})
+	expect(t, updates, "10.0.0.1:8080")
+	endpoints.Store([]string{"10.0.0.1:8080", "10.0.0.2:8080"})
+	expect(t, updates, "10.0.0.1:8080", "10.0.0.2:8080")
+}
+
+func TestKubernetes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	eps := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "users", Namespace: "default"},
+		Subsets: []corev1.EndpointSubset{
+			{
+				Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}},
+				Ports:     []corev1.EndpointPort{{Name: "metrics", Port: 9090}, {Name: "http", Port: 8080}},
+			},
+		},
+	}
+	client := fake.NewSimpleClientset(eps)
+	updates := watch(t, ctx, &discovery.Kubernetes{Client: client, Namespace: "default", Name: "users", Port: "http"})
+	expect(t, updates, "10.0.0.1:8080")
+	eps.Subsets[0].Addresses = append(eps.Subsets[0].Addresses, corev1.EndpointAddress{IP: "10.0.0.2"})
+	if _, err := client.CoreV1().Endpoints("default").Update(ctx, eps, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect(t, updates, "10.0.0.1:8080", "10.0.0.2:8080")
+}
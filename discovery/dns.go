@@ -0,0 +1,45 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNSSRV resolves endpoints from DNS SRV records(_service._proto.name)
+type DNSSRV struct {
+	// Service is the SRV service name(ex: http). If Service & Proto are empty, Name is looked up directly
+	Service string
+	// Proto is the SRV protocol(ex: tcp)
+	Proto string
+	// Name is the domain name(ex: users.internal)
+	Name string
+	// Interval is the polling interval(default: 30s)
+	Interval time.Duration
+	// Resolver overrides the default net.Resolver(optional)
+	Resolver *net.Resolver
+	// OnError is called when a lookup fails(optional)
+	OnError func(err error)
+}
+
+func (d *DNSSRV) Watch(ctx context.Context, update func(endpoints []string)) error {
+	return Poll(d.lookup, d.Interval, d.OnError).Watch(ctx, update)
+}
+
+func (d *DNSSRV) lookup(ctx context.Context) ([]string, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	_, records, err := resolver.LookupSRV(ctx, d.Service, d.Proto, d.Name)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []string
+	for _, r := range records {
+		endpoints = append(endpoints, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), fmt.Sprint(r.Port)))
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,96 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Etcd resolves endpoints stored under a key prefix in etcd(ex: /services/users/<instance> = 10.0.0.1:8080).
+// The etcd v3 json gateway is polled every Interval
+type Etcd struct {
+	// Address is the etcd http address(default: http://127.0.0.1:2379)
+	Address string
+	// Prefix is the key prefix the services endpoints are stored under. Each value is an endpoint
+	Prefix string
+	// Interval is the polling interval(default: 30s)
+	Interval time.Duration
+	// Client overrides the default http client(optional)
+	Client *http.Client
+	// OnError is called when a request fails(optional)
+	OnError func(err error)
+}
+
+func (e *Etcd) Watch(ctx context.Context, update func(endpoints []string)) error {
+	return Poll(e.rangePrefix, e.Interval, e.OnError).Watch(ctx, update)
+}
+
+func (e *Etcd) rangePrefix(ctx context.Context) ([]string, error) {
+	address := e.Address
+	if address == "" {
+		address = "http://127.0.0.1:2379"
+	}
+	body, err := json.Marshal(map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(e.Prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(prefixEnd([]byte(e.Prefix))),
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v3/kv/range", strings.TrimSuffix(address, "/")), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("etcd: unexpected status %v", resp.StatusCode)
+	}
+	var result struct {
+		Kvs []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	var endpoints []string
+	for _, kv := range result.Kvs {
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, strings.TrimSpace(string(value)))
+	}
+	return endpoints, nil
+}
+
+// prefixEnd returns the range end that matches all keys with the prefix
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// the prefix is all 0xff bytes - range to the end of the keyspace
+	return []byte{0}
+}
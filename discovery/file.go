@@ -0,0 +1,78 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File resolves endpoints from a file containing one endpoint per line. Blank lines & lines starting with # are ignored.
+// The file is watched for changes & re-read every Interval in case change notifications are missed
+type File struct {
+	// Path is the path to the endpoints file
+	Path string
+	// Interval is the polling interval(default: 30s)
+	Interval time.Duration
+	// OnError is called when the file can't be read(optional)
+	OnError func(err error)
+}
+
+func (f *File) Watch(ctx context.Context, update func(endpoints []string)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	// watch the directory so the file may be atomically replaced(ex: kubernetes ConfigMap volumes)
+	if err := watcher.Add(filepath.Dir(f.Path)); err != nil {
+		return err
+	}
+	changes := make(chan struct{}, 1)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == filepath.Clean(f.Path) || event.Op&fsnotify.Remove == fsnotify.Remove {
+					select {
+					case changes <- struct{}{}:
+					default:
+					}
+				}
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+	return Poll(func(ctx context.Context) ([]string, error) {
+		return f.read()
+	}, f.Interval, f.OnError).(*poller).watch(ctx, update, changes)
+}
+
+func (f *File) read() ([]string, error) {
+	bits, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []string
+	scanner := bufio.NewScanner(bytes.NewReader(bits))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		endpoints = append(endpoints, line)
+	}
+	return endpoints, scanner.Err()
+}
@@ -0,0 +1,155 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"net"
+	"sync"
+	"time"
+)
+
+// Kubernetes resolves the ready endpoints of a Kubernetes Service from its Endpoints or EndpointSlices
+type Kubernetes struct {
+	// Client is the kubernetes clientset
+	Client kubernetes.Interface
+	// Namespace is the namespace of the service
+	Namespace string
+	// Name is the name of the service
+	Name string
+	// Port is the name of the service port to use. If empty, the first port is used
+	Port string
+	// EndpointSlices watches discovery.k8s.io EndpointSlices instead of core Endpoints
+	EndpointSlices bool
+	// Resync is the informer resync period(default: 10m)
+	Resync time.Duration
+}
+
+func (k *Kubernetes) Watch(ctx context.Context, update func(endpoints []string)) error {
+	resync := k.Resync
+	if resync <= 0 {
+		resync = 10 * time.Minute
+	}
+	var (
+		mu   sync.Mutex
+		last []string
+	)
+	var factory informers.SharedInformerFactory
+	var informer cache.SharedIndexInformer
+	var list func() []string
+	if k.EndpointSlices {
+		factory = informers.NewSharedInformerFactoryWithOptions(k.Client, resync,
+			informers.WithNamespace(k.Namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = labels.SelectorFromSet(labels.Set{discoveryv1beta1.LabelServiceName: k.Name}).String()
+			}),
+		)
+		slices := factory.Discovery().V1beta1().EndpointSlices()
+		informer = slices.Informer()
+		list = func() []string {
+			objs, _ := slices.Lister().EndpointSlices(k.Namespace).List(labels.Everything())
+			var endpoints []string
+			for _, slice := range objs {
+				endpoints = append(endpoints, k.sliceEndpoints(slice)...)
+			}
+			return endpoints
+		}
+	} else {
+		factory = informers.NewSharedInformerFactoryWithOptions(k.Client, resync,
+			informers.WithNamespace(k.Namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.FieldSelector = fields.OneTermEqualSelector("metadata.name", k.Name).String()
+			}),
+		)
+		eps := factory.Core().V1().Endpoints()
+		informer = eps.Informer()
+		list = func() []string {
+			obj, err := eps.Lister().Endpoints(k.Namespace).Get(k.Name)
+			if err != nil {
+				return nil
+			}
+			return k.endpoints(obj)
+		}
+	}
+	refresh := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		endpoints := normalize(list())
+		if !equal(last, endpoints) {
+			last = endpoints
+			update(endpoints)
+		}
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			refresh()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			refresh()
+		},
+		DeleteFunc: func(obj interface{}) {
+			refresh()
+		},
+	})
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+	refresh()
+	<-ctx.Done()
+	return nil
+}
+
+func (k *Kubernetes) endpoints(eps *corev1.Endpoints) []string {
+	var endpoints []string
+	for _, subset := range eps.Subsets {
+		port, ok := k.endpointPort(subset.Ports)
+		if !ok {
+			continue
+		}
+		for _, addr := range subset.Addresses {
+			endpoints = append(endpoints, net.JoinHostPort(addr.IP, fmt.Sprint(port)))
+		}
+	}
+	return endpoints
+}
+
+func (k *Kubernetes) endpointPort(ports []corev1.EndpointPort) (int32, bool) {
+	for _, p := range ports {
+		if k.Port == "" || p.Name == k.Port {
+			return p.Port, true
+		}
+	}
+	return 0, false
+}
+
+func (k *Kubernetes) sliceEndpoints(slice *discoveryv1beta1.EndpointSlice) []string {
+	var port int32
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+		if k.Port == "" || (p.Name != nil && *p.Name == k.Port) {
+			port = *p.Port
+			break
+		}
+	}
+	if port == 0 {
+		return nil
+	}
+	var endpoints []string
+	for _, e := range slice.Endpoints {
+		if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+			continue
+		}
+		for _, addr := range e.Addresses {
+			endpoints = append(endpoints, net.JoinHostPort(addr, fmt.Sprint(port)))
+		}
+	}
+	return endpoints
+}
@@ -0,0 +1,116 @@
+package gproxy
+
+import (
+	"fmt"
+	"github.com/graphikDB/gproxy/ipfilter"
+	"google.golang.org/grpc/metadata"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForwardedMode controls how forwarding headers received from clients are handled
+type ForwardedMode string
+
+const (
+	// ForwardedAppend appends to the forwarding headers of requests received from trusted proxies(WithTrustedProxies)
+	// & replaces the forwarding headers of requests from all other clients
+	ForwardedAppend ForwardedMode = "append"
+	// ForwardedOverwrite always replaces forwarding headers so upstreams only see the proxies immediate client
+	ForwardedOverwrite ForwardedMode = "overwrite"
+)
+
+// forwardedHeaders are the http forwarding headers managed by the proxy
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"}
+
+// trustedHop reports whether forwarding headers sent by the remote address should be kept
+func (p *Proxy) trustedHop(remoteAddr string) bool {
+	if p.forwardedMode == ForwardedOverwrite {
+		return false
+	}
+	ip := net.ParseIP(ipfilter.Host(remoteAddr))
+	return ip != nil && ipfilter.Contains(p.trustedProxies, ip)
+}
+
+// setForwardedHTTP sets the X-Forwarded-Proto, X-Forwarded-Host & Forwarded(if enabled) headers of a proxied request.
+// X-Forwarded-For is appended by the reverse proxy once the client supplied value has been removed/kept
+func (p *Proxy) setForwardedHTTP(h http.Header, remoteAddr, host string, secure bool) {
+	if !p.trustedHop(remoteAddr) {
+		for _, k := range forwardedHeaders {
+			h.Del(k)
+		}
+	}
+	proto := scheme(secure)
+	if h.Get("X-Forwarded-Proto") == "" {
+		h.Set("X-Forwarded-Proto", proto)
+	}
+	if h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", host)
+	}
+	if p.rfc7239 {
+		h.Set("Forwarded", appendForwarded(strings.Join(h.Values("Forwarded"), ", "), remoteAddr, host, proto))
+	}
+}
+
+// setForwardedMetadata sets the x-forwarded-for, x-forwarded-proto, x-forwarded-host & forwarded(if enabled) metadata of a proxied gRPC call
+func (p *Proxy) setForwardedMetadata(md metadata.MD, remoteAddr, host string, secure bool) {
+	if !p.trustedHop(remoteAddr) {
+		for _, k := range forwardedHeaders {
+			delete(md, strings.ToLower(k))
+		}
+	}
+	proto := scheme(secure)
+	if client := ipfilter.Host(remoteAddr); client != "" {
+		if prior := md.Get("x-forwarded-for"); len(prior) > 0 {
+			client = strings.Join(prior, ", ") + ", " + client
+		}
+		md.Set("x-forwarded-for", client)
+	}
+	if len(md.Get("x-forwarded-proto")) == 0 {
+		md.Set("x-forwarded-proto", proto)
+	}
+	if len(md.Get("x-forwarded-host")) == 0 {
+		md.Set("x-forwarded-host", host)
+	}
+	if p.rfc7239 {
+		md.Set("forwarded", appendForwarded(strings.Join(md.Get("forwarded"), ", "), remoteAddr, host, proto))
+	}
+}
+
+func scheme(secure bool) string {
+	if secure {
+		return "https"
+	}
+	return "http"
+}
+
+// appendForwarded appends an RFC 7239 forwarded-element for the hop to the prior header value
+// ex: for=192.0.2.60;host=example.com;proto=https
+func appendForwarded(prior, remoteAddr, host, proto string) string {
+	element := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(ipfilter.Host(remoteAddr)), forwardedValue(host), proto)
+	if prior == "" {
+		return element
+	}
+	return prior + ", " + element
+}
+
+// forwardedNode formats a node identifier. IPv6 addresses must be bracketed & quoted
+func forwardedNode(ip string) string {
+	if ip == "" {
+		return "unknown"
+	}
+	if strings.Contains(ip, ":") {
+		return fmt.Sprintf(`"[%s]"`, ip)
+	}
+	return ip
+}
+
+// forwardedValue quotes values that aren't valid RFC 7230 tokens(ex: hosts with ports)
+func forwardedValue(v string) string {
+	for _, r := range v {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r)) {
+			return fmt.Sprintf("%q", v)
+		}
+	}
+	return v
+}
@@ -0,0 +1,162 @@
+package headers
+
+import (
+	"fmt"
+	"github.com/graphikDB/trigger"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+)
+
+// Action is an operation applied to a header/metadata key
+type Action string
+
+const (
+	// Set replaces all values of the key
+	Set Action = "set"
+	// Append adds a value to the key
+	Append Action = "append"
+	// Remove deletes the key
+	Remove Action = "remove"
+	// Rename moves the values of the key to a new key
+	Rename Action = "rename"
+)
+
+// Rule is a single header/metadata operation
+type Rule struct {
+	Action Action
+	// Name is the header/metadata key the rule operates on
+	Name string
+	// Value is the static value used by set & append rules
+	Value string
+	// Expression computes the value used by set & append rules from the request(overrides Value)
+	// ex: this.client_ip
+	// expression attributes: (this.http<bool>, this.grpc<bool>, this.host<string>, this.headers<map>, this.path<string>, this.method<string>, this.client_ip<string>, this.claims<map>, this.route<string>)
+	Expression string
+	// To is the new key used by rename rules
+	To string
+}
+
+// Rules are the header/metadata operations applied to a routes requests & responses
+type Rules struct {
+	request  []*compiledRule
+	response []*compiledRule
+}
+
+type compiledRule struct {
+	Rule
+	trigger *trigger.Trigger
+}
+
+// NewRules compiles request & response rules
+func NewRules(request []Rule, response []Rule) (*Rules, error) {
+	var (
+		rules = &Rules{}
+		err   error
+	)
+	if rules.request, err = compile(request); err != nil {
+		return nil, err
+	}
+	if rules.response, err = compile(response); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func compile(rules []Rule) ([]*compiledRule, error) {
+	var compiled []*compiledRule
+	for _, r := range rules {
+		if r.Name == "" {
+			return nil, errors.New("headers: empty rule name")
+		}
+		c := &compiledRule{Rule: r}
+		switch r.Action {
+		case Set, Append:
+			if r.Expression != "" {
+				t, err := trigger.NewArrowTrigger(fmt.Sprintf("true => %s", r.Expression))
+				if err != nil {
+					return nil, errors.Wrapf(err, "headers: invalid expression for %s", r.Name)
+				}
+				c.trigger = t
+			}
+		case Remove:
+		case Rename:
+			if r.To == "" {
+				return nil, errors.Errorf("headers: empty rename target for %s", r.Name)
+			}
+		default:
+			return nil, errors.Errorf("headers: unsupported action: %s", r.Action)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// RequestHTTP applies the request rules to http headers
+func (r *Rules) RequestHTTP(h http.Header, data map[string]interface{}) error {
+	if r == nil {
+		return nil
+	}
+	return apply(r.request, h, http.CanonicalHeaderKey, data)
+}
+
+// ResponseHTTP applies the response rules to http headers
+func (r *Rules) ResponseHTTP(h http.Header, data map[string]interface{}) error {
+	if r == nil {
+		return nil
+	}
+	return apply(r.response, h, http.CanonicalHeaderKey, data)
+}
+
+// RequestMetadata applies the request rules to gRPC metadata
+func (r *Rules) RequestMetadata(md map[string][]string, data map[string]interface{}) error {
+	if r == nil {
+		return nil
+	}
+	return apply(r.request, md, strings.ToLower, data)
+}
+
+// ResponseMetadata applies the response rules to gRPC metadata
+func (r *Rules) ResponseMetadata(md map[string][]string, data map[string]interface{}) error {
+	if r == nil {
+		return nil
+	}
+	return apply(r.response, md, strings.ToLower, data)
+}
+
+func apply(rules []*compiledRule, h map[string][]string, key func(string) string, data map[string]interface{}) error {
+	for _, r := range rules {
+		name := key(r.Name)
+		switch r.Action {
+		case Set, Append:
+			value, err := r.value(data)
+			if err != nil {
+				return err
+			}
+			if r.Action == Set {
+				h[name] = []string{value}
+			} else {
+				h[name] = append(h[name], value)
+			}
+		case Remove:
+			delete(h, name)
+		case Rename:
+			if values, ok := h[name]; ok {
+				delete(h, name)
+				h[key(r.To)] = append(h[key(r.To)], values...)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *compiledRule) value(data map[string]interface{}) (string, error) {
+	if r.trigger == nil {
+		return r.Value, nil
+	}
+	result, err := r.trigger.Trigger(data)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(result["value"]), nil
+}
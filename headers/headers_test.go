@@ -0,0 +1,54 @@
+package headers_test
+
+import (
+	"github.com/graphikDB/gproxy/headers"
+	"google.golang.org/grpc/metadata"
+	"net/http"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	rules, err := headers.NewRules([]headers.Rule{
+		{Action: headers.Set, Name: "x-client-ip", Expression: "this.client_ip"},
+		{Action: headers.Append, Name: "x-via", Value: "gproxy"},
+		{Action: headers.Remove, Name: "x-internal"},
+		{Action: headers.Rename, Name: "x-api-key", To: "x-upstream-key"},
+	}, []headers.Rule{
+		{Action: headers.Set, Name: "x-route", Expression: "this.route"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data := map[string]interface{}{
+		"client_ip": "10.0.0.1",
+		"route":     "api",
+	}
+	h := http.Header{}
+	h.Set("X-Via", "lb")
+	h.Set("X-Internal", "true")
+	h.Set("X-Api-Key", "secret")
+	if err := rules.RequestHTTP(h, data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if h.Get("X-Client-Ip") != "10.0.0.1" || len(h.Values("X-Via")) != 2 || h.Get("X-Internal") != "" ||
+		h.Get("X-Api-Key") != "" || h.Get("X-Upstream-Key") != "secret" {
+		t.Fatalf("unexpected request headers: %v", h)
+	}
+	md := metadata.Pairs("x-api-key", "secret")
+	if err := rules.RequestMetadata(md, data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if md.Get("x-client-ip")[0] != "10.0.0.1" || md.Get("x-upstream-key")[0] != "secret" {
+		t.Fatalf("unexpected request metadata: %v", md)
+	}
+	resp := metadata.MD{}
+	if err := rules.ResponseMetadata(resp, data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp.Get("x-route")[0] != "api" {
+		t.Fatalf("unexpected response metadata: %v", resp)
+	}
+	if _, err := headers.NewRules([]headers.Rule{{Action: "replace", Name: "x"}}, nil); err == nil {
+		t.Fatal("expected unsupported action error")
+	}
+}
@@ -0,0 +1,54 @@
+package gproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/autom8ter/machine"
+	"github.com/quic-go/quic-go/http3"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// altSvc advertises the HTTP/3 endpoint(if enabled) on responses so clients may switch to QUIC
+func (p *Proxy) altSvc(handler http.Handler) http.Handler {
+	if !p.http3 {
+		return handler
+	}
+	_, port, _ := net.SplitHostPort(p.securePort)
+	value := fmt.Sprintf(`h3=":%s"; ma=86400`, port)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", value)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// serveHTTP3 serves the https servers handler over HTTP/3(QUIC) on the UDP port of the secure listener with the secure
+// listeners certificates & the https servers limits. It returns a func that gracefully shuts the server down
+func (p *Proxy) serveHTTP3(httpServer *http.Server, tlsConfig *tls.Config) (func(ctx context.Context), error) {
+	conn, err := net.ListenPacket("udp", p.securePort)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http3.Server{
+		Handler:        httpServer.Handler,
+		TLSConfig:      http3.ConfigureTLSConfig(tlsConfig.Clone()),
+		MaxHeaderBytes: httpServer.MaxHeaderBytes,
+		IdleTimeout:    httpServer.IdleTimeout,
+	}
+	// packets from denied addresses are dropped before the QUIC handshake
+	filtered := p.filterPacketConn(conn)
+	p.mach.Go(func(routine machine.Routine) {
+		p.logger.Debug("starting HTTP/3 server", zap.String("address", conn.LocalAddr().String()))
+		if err := srv.Serve(filtered); err != nil && err != http.ErrServerClosed &&
+			!strings.Contains(err.Error(), "closed") {
+			p.logger.Error("HTTP/3 proxy failure", zap.Error(err))
+		}
+	})
+	return func(ctx context.Context) {
+		_ = srv.Shutdown(ctx)
+		_ = conn.Close()
+	}, nil
+}
@@ -0,0 +1,216 @@
+// Package ingress translates Kubernetes Ingress & Gateway API(HTTPRoute, GRPCRoute) resources into gproxy routing expressions
+package ingress
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultClass is the default IngressClass & GatewayClass name that the controller manages
+const DefaultClass = "gproxy"
+
+// Controller watches Ingress, Gateway, HTTPRoute & GRPCRoute resources, reporting the translated routes
+// & the TLS hosts that certificates should be issued for whenever they change
+type Controller struct {
+	// Client is the kubernetes clientset used to watch Ingresses & Services
+	Client kubernetes.Interface
+	// Dynamic is used to watch Gateway API resources. Gateway API resources are ignored if nil
+	Dynamic dynamic.Interface
+	// Namespace restricts the watched resources to a single namespace(default: all namespaces)
+	Namespace string
+	// IngressClass is the IngressClass name that is managed by the controller(default: gproxy)
+	IngressClass string
+	// GatewayClass is the GatewayClass name that is managed by the controller(default: gproxy)
+	GatewayClass string
+	// GatewayVersion is the Gateway API version(default: v1)
+	GatewayVersion string
+	// ClusterDomain is the clusters dns domain used to address services(default: cluster.local)
+	ClusterDomain string
+	// Resync is the informer resync period(default: 10m)
+	Resync time.Duration
+	// OnChange is called with the routing expressions & TLS hosts whenever they change
+	OnChange func(routes []string, hosts []string)
+	// OnError is called when a resource cannot be translated(optional)
+	OnError func(err error)
+
+	mu         sync.Mutex
+	reported   bool
+	lastRoutes string
+	lastHosts  string
+}
+
+// Run watches resources until the context is cancelled. OnChange is called once the informer caches have synced
+func (c *Controller) Run(ctx context.Context) error {
+	if c.Client == nil {
+		return errors.New("ingress: empty kubernetes client")
+	}
+	if c.OnChange == nil {
+		return errors.New("ingress: empty OnChange handler")
+	}
+	resync := c.Resync
+	if resync <= 0 {
+		resync = 10 * time.Minute
+	}
+	var synced bool
+	var listers lister
+	refresh := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if synced {
+			c.refresh(listers)
+		}
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			refresh()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			refresh()
+		},
+		DeleteFunc: func(obj interface{}) {
+			refresh()
+		},
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(c.Client, resync, informers.WithNamespace(c.Namespace))
+	ingresses := factory.Networking().V1().Ingresses()
+	services := factory.Core().V1().Services()
+	ingresses.Informer().AddEventHandler(handler)
+	services.Informer().AddEventHandler(handler)
+	listers.ingresses = ingresses.Lister()
+	listers.services = services.Lister()
+
+	var dynamicFactory dynamicinformer.DynamicSharedInformerFactory
+	if c.Dynamic != nil {
+		dynamicFactory = dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.Dynamic, resync, c.Namespace, nil)
+		gateways := dynamicFactory.ForResource(c.gatewayResource("gateways"))
+		httpRoutes := dynamicFactory.ForResource(c.gatewayResource("httproutes"))
+		grpcRoutes := dynamicFactory.ForResource(c.gatewayResource("grpcroutes"))
+		for _, informer := range []cache.SharedIndexInformer{gateways.Informer(), httpRoutes.Informer(), grpcRoutes.Informer()} {
+			informer.AddEventHandler(handler)
+		}
+		listers.gateways = gateways.Lister()
+		listers.httpRoutes = httpRoutes.Lister()
+		listers.grpcRoutes = grpcRoutes.Lister()
+	}
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+	if dynamicFactory != nil {
+		dynamicFactory.Start(ctx.Done())
+		dynamicFactory.WaitForCacheSync(ctx.Done())
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	c.mu.Lock()
+	synced = true
+	c.refresh(listers)
+	c.mu.Unlock()
+	<-ctx.Done()
+	return nil
+}
+
+// refresh translates all watched resources & calls OnChange if the routes or hosts changed
+func (c *Controller) refresh(l lister) {
+	rules, hosts := c.translate(l)
+	sortRules(rules)
+	var routes []string
+	for _, r := range rules {
+		exp := r.expression()
+		// triggers are split on the arrow - a match value containing one cannot be expressed
+		if strings.Count(exp, "=>") != 1 {
+			c.error(errors.Errorf("ingress: %s: unsupported match value containing '=>'", r.name))
+			continue
+		}
+		routes = append(routes, exp)
+	}
+	hosts = dedupe(hosts)
+	joinedRoutes, joinedHosts := strings.Join(routes, "\n"), strings.Join(hosts, "\n")
+	if c.reported && c.lastRoutes == joinedRoutes && c.lastHosts == joinedHosts {
+		return
+	}
+	c.reported, c.lastRoutes, c.lastHosts = true, joinedRoutes, joinedHosts
+	c.OnChange(routes, hosts)
+}
+
+func (c *Controller) translate(l lister) ([]rule, []string) {
+	var (
+		rules []rule
+		hosts []string
+	)
+	ingresses, err := l.ingresses.List(labels.Everything())
+	if err != nil {
+		c.error(err)
+	}
+	for _, ing := range ingresses {
+		if !c.managesIngress(ing) {
+			continue
+		}
+		r, h := c.translateIngress(l, ing)
+		rules = append(rules, r...)
+		hosts = append(hosts, h...)
+	}
+	if l.gateways == nil {
+		return rules, hosts
+	}
+	gateways, h := c.managedGateways(l)
+	hosts = append(hosts, h...)
+	httpRoutes, err := l.httpRoutes.List(labels.Everything())
+	if err != nil {
+		c.error(err)
+	}
+	for _, obj := range httpRoutes {
+		rules = append(rules, c.translateRoute(obj, gateways, false)...)
+	}
+	grpcRoutes, err := l.grpcRoutes.List(labels.Everything())
+	if err != nil {
+		c.error(err)
+	}
+	for _, obj := range grpcRoutes {
+		rules = append(rules, c.translateRoute(obj, gateways, true)...)
+	}
+	return rules, hosts
+}
+
+func (c *Controller) error(err error) {
+	if c.OnError != nil {
+		c.OnError(err)
+	}
+}
+
+func (c *Controller) class(class string) string {
+	if class == "" {
+		return DefaultClass
+	}
+	return class
+}
+
+func (c *Controller) clusterDomain() string {
+	if c.ClusterDomain == "" {
+		return "cluster.local"
+	}
+	return c.ClusterDomain
+}
+
+func dedupe(values []string) []string {
+	seen := map[string]struct{}{}
+	var deduped []string
+	for _, v := range values {
+		if _, ok := seen[v]; ok || v == "" {
+			continue
+		}
+		seen[v] = struct{}{}
+		deduped = append(deduped, v)
+	}
+	sort.Strings(deduped)
+	return deduped
+}
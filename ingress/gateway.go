@@ -0,0 +1,244 @@
+package ingress
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"net/http"
+	"strings"
+)
+
+// GatewayGroup is the api group of Gateway API resources
+const GatewayGroup = "gateway.networking.k8s.io"
+
+func (c *Controller) gatewayResource(resource string) schema.GroupVersionResource {
+	version := c.GatewayVersion
+	if version == "" {
+		version = "v1"
+	}
+	return schema.GroupVersionResource{Group: GatewayGroup, Version: version, Resource: resource}
+}
+
+// managedGateways returns the Gateways(namespace/name) of the controllers GatewayClass & the hostnames of their HTTPS/TLS listeners
+func (c *Controller) managedGateways(l lister) (map[string]struct{}, []string) {
+	var (
+		gateways = map[string]struct{}{}
+		hosts    []string
+	)
+	objs, err := l.gateways.List(labels.Everything())
+	if err != nil {
+		c.error(err)
+	}
+	for _, obj := range objs {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		if class, _, _ := unstructured.NestedString(u.Object, "spec", "gatewayClassName"); class != c.class(c.GatewayClass) {
+			continue
+		}
+		gateways[u.GetNamespace()+"/"+u.GetName()] = struct{}{}
+		listeners, _, _ := unstructured.NestedSlice(u.Object, "spec", "listeners")
+		for _, listener := range listeners {
+			protocol := str(listener, "protocol")
+			hostname := str(listener, "hostname")
+			// wildcard certificates cannot be issued with the http-01/tls-alpn-01 challenges
+			if (protocol == "HTTPS" || protocol == "TLS") && hostname != "" && !strings.HasPrefix(hostname, "*") {
+				hosts = append(hosts, hostname)
+			}
+		}
+	}
+	return gateways, hosts
+}
+
+// translateRoute returns the rules of an HTTPRoute or GRPCRoute that is attached to a managed Gateway.
+// Rules are named httproute/<namespace>/<name> or grpcroute/<namespace>/<name>.
+// Backends with a zero weight are excluded - other weights are balanced equally
+func (c *Controller) translateRoute(obj runtime.Object, gateways map[string]struct{}, grpc bool) []rule {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil
+	}
+	kind := "httproute"
+	if grpc {
+		kind = "grpcroute"
+	}
+	name := fmt.Sprintf("%s/%s/%s", kind, u.GetNamespace(), u.GetName())
+	parents, _, _ := unstructured.NestedSlice(u.Object, "spec", "parentRefs")
+	var attached bool
+	for _, parent := range parents {
+		if k := str(parent, "kind"); k != "" && k != "Gateway" {
+			continue
+		}
+		namespace := str(parent, "namespace")
+		if namespace == "" {
+			namespace = u.GetNamespace()
+		}
+		if _, ok := gateways[namespace+"/"+str(parent, "name")]; ok {
+			attached = true
+		}
+	}
+	if !attached {
+		return nil
+	}
+	hostnames, _, _ := unstructured.NestedStringSlice(u.Object, "spec", "hostnames")
+	if len(hostnames) == 0 {
+		hostnames = []string{""}
+	}
+	specRules, _, _ := unstructured.NestedSlice(u.Object, "spec", "rules")
+	var rules []rule
+	for _, specRule := range specRules {
+		targets := c.backendTargets(u.GetNamespace(), specRule, grpc)
+		if len(targets) == 0 {
+			c.error(errors.Errorf("ingress: %s: rule has zero backends", name))
+			continue
+		}
+		matches := slice(specRule, "matches")
+		if len(matches) == 0 {
+			matches = []interface{}{map[string]interface{}{}}
+		}
+		for _, match := range matches {
+			var (
+				r   rule
+				err error
+			)
+			if grpc {
+				r, err = grpcMatch(match)
+			} else {
+				r, err = httpMatch(match)
+			}
+			if err != nil {
+				c.error(errors.Wrap(err, name))
+				continue
+			}
+			for _, host := range hostnames {
+				r.name = name
+				r.grpc = grpc
+				r.host = host
+				r.targets = targets
+				rules = append(rules, r)
+			}
+		}
+	}
+	return rules
+}
+
+func (c *Controller) backendTargets(namespace string, specRule interface{}, grpc bool) []string {
+	var targets []string
+	for _, ref := range slice(specRule, "backendRefs") {
+		if kind := str(ref, "kind"); kind != "" && kind != "Service" {
+			continue
+		}
+		if weight, ok := integer(ref, "weight"); ok && weight == 0 {
+			continue
+		}
+		port, _ := integer(ref, "port")
+		ns := str(ref, "namespace")
+		if ns == "" {
+			ns = namespace
+		}
+		target := c.serviceHost(ns, str(ref, "name"), port)
+		if !grpc {
+			target = "http://" + target
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+func httpMatch(match interface{}) (rule, error) {
+	r := rule{pathType: pathPrefix, path: "/"}
+	if path, ok := field(match, "path").(map[string]interface{}); ok {
+		if value := str(path, "value"); value != "" {
+			r.path = value
+		}
+		switch str(path, "type") {
+		case "", "PathPrefix":
+		case "Exact":
+			r.pathType = pathExact
+		case "RegularExpression":
+			r.pathType = pathRegex
+		default:
+			return r, errors.Errorf("unsupported path match type: %s", str(path, "type"))
+		}
+	}
+	r.method = str(match, "method")
+	headers, err := headerMatches(match, http.CanonicalHeaderKey)
+	if err != nil {
+		return r, err
+	}
+	r.headers = headers
+	return r, nil
+}
+
+func grpcMatch(match interface{}) (rule, error) {
+	var r rule
+	if method, ok := field(match, "method").(map[string]interface{}); ok {
+		if t := str(method, "type"); t != "" && t != "Exact" {
+			return r, errors.Errorf("unsupported method match type: %s", t)
+		}
+		service, name := str(method, "service"), str(method, "method")
+		switch {
+		case service != "" && name != "":
+			r.pathType, r.path = pathExact, fmt.Sprintf("/%s/%s", service, name)
+		case service != "":
+			r.pathType, r.path = pathPrefix, "/"+service
+		case name != "":
+			r.pathType, r.path = pathRegex, "/[^/]+/"+name
+		}
+	}
+	headers, err := headerMatches(match, strings.ToLower)
+	if err != nil {
+		return r, err
+	}
+	r.headers = headers
+	return r, nil
+}
+
+// headerMatches returns the exact header matches of a route match. http header names are canonicalized & gRPC metadata keys are lower case
+func headerMatches(match interface{}, key func(string) string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, h := range slice(match, "headers") {
+		if t := str(h, "type"); t != "" && t != "Exact" {
+			return nil, errors.Errorf("unsupported header match type: %s", t)
+		}
+		headers[key(str(h, "name"))] = str(h, "value")
+	}
+	return headers, nil
+}
+
+func field(obj interface{}, key string) interface{} {
+	m, ok := obj.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return m[key]
+}
+
+func str(obj interface{}, key string) string {
+	s, _ := field(obj, key).(string)
+	return s
+}
+
+func slice(obj interface{}, key string) []interface{} {
+	s, _ := field(obj, key).([]interface{})
+	return s
+}
+
+func integer(obj interface{}, key string) (int64, bool) {
+	switch i := field(obj, key).(type) {
+	case int64:
+		return i, true
+	case int32:
+		return int64(i), true
+	case int:
+		return int64(i), true
+	case float64:
+		return int64(i), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,112 @@
+package ingress
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	networkingv1 "k8s.io/api/networking/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	networkingv1listers "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+	"strings"
+)
+
+const ingressClassAnnotation = "kubernetes.io/ingress.class"
+
+type lister struct {
+	ingresses  networkingv1listers.IngressLister
+	services   corev1listers.ServiceLister
+	gateways   cache.GenericLister
+	httpRoutes cache.GenericLister
+	grpcRoutes cache.GenericLister
+}
+
+func (c *Controller) managesIngress(ing *networkingv1.Ingress) bool {
+	class := ing.Annotations[ingressClassAnnotation]
+	if ing.Spec.IngressClassName != nil {
+		class = *ing.Spec.IngressClassName
+	}
+	return class == c.class(c.IngressClass)
+}
+
+// translateIngress returns the http rules & TLS hosts of an Ingress. Rules are named ingress/<namespace>/<name>
+func (c *Controller) translateIngress(l lister, ing *networkingv1.Ingress) ([]rule, []string) {
+	var (
+		name  = fmt.Sprintf("ingress/%s/%s", ing.Namespace, ing.Name)
+		rules []rule
+		hosts []string
+	)
+	for _, tls := range ing.Spec.TLS {
+		for _, host := range tls.Hosts {
+			// wildcard certificates cannot be issued with the http-01/tls-alpn-01 challenges
+			if host != "" && !strings.HasPrefix(host, "*") {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	for _, ir := range ing.Spec.Rules {
+		if ir.HTTP == nil {
+			continue
+		}
+		for _, path := range ir.HTTP.Paths {
+			target, err := c.ingressTarget(l, ing.Namespace, path.Backend)
+			if err != nil {
+				c.error(errors.Wrap(err, name))
+				continue
+			}
+			pathType := pathPrefix
+			if path.PathType != nil && *path.PathType == networkingv1.PathTypeExact {
+				pathType = pathExact
+			}
+			p := path.Path
+			if p == "" {
+				p = "/"
+			}
+			rules = append(rules, rule{
+				name:     name,
+				host:     ir.Host,
+				pathType: pathType,
+				path:     p,
+				targets:  []string{target},
+			})
+		}
+	}
+	if ing.Spec.DefaultBackend != nil {
+		target, err := c.ingressTarget(l, ing.Namespace, *ing.Spec.DefaultBackend)
+		if err != nil {
+			c.error(errors.Wrap(err, name))
+		} else {
+			rules = append(rules, rule{
+				name:    name,
+				targets: []string{target},
+			})
+		}
+	}
+	return rules, hosts
+}
+
+// ingressTarget returns the http target of an Ingress backend, resolving named service ports
+func (c *Controller) ingressTarget(l lister, namespace string, backend networkingv1.IngressBackend) (string, error) {
+	if backend.Service == nil {
+		return "", errors.New("only service backends are supported")
+	}
+	port := backend.Service.Port.Number
+	if port == 0 {
+		svc, err := l.services.Services(namespace).Get(backend.Service.Name)
+		if err != nil {
+			return "", err
+		}
+		for _, p := range svc.Spec.Ports {
+			if p.Name == backend.Service.Port.Name {
+				port = p.Port
+			}
+		}
+		if port == 0 {
+			return "", errors.Errorf("service %s/%s has no port named %s", namespace, backend.Service.Name, backend.Service.Port.Name)
+		}
+	}
+	return fmt.Sprintf("http://%s", c.serviceHost(namespace, backend.Service.Name, int64(port))), nil
+}
+
+func (c *Controller) serviceHost(namespace, name string, port int64) string {
+	return fmt.Sprintf("%s.%s.svc.%s:%v", name, namespace, c.clusterDomain(), port)
+}
@@ -0,0 +1,254 @@
+package ingress_test
+
+import (
+	"context"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/graphikDB/gproxy/ingress"
+	"github.com/graphikDB/trigger"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+	"time"
+)
+
+type change struct {
+	routes []string
+	hosts  []string
+}
+
+func run(t *testing.T, ctx context.Context, c *ingress.Controller) <-chan change {
+	changes := make(chan change, 10)
+	c.OnChange = func(routes []string, hosts []string) {
+		changes <- change{routes: routes, hosts: hosts}
+	}
+	c.OnError = func(err error) {
+		t.Log(err.Error())
+	}
+	go func() {
+		if err := c.Run(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	return changes
+}
+
+func next(t *testing.T, changes <-chan change) change {
+	select {
+	case c := <-changes:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for routes")
+		return change{}
+	}
+}
+
+// match evaluates the routes in order, returning the name & targets of the first route that matches the request
+func match(t *testing.T, routes []string, data map[string]interface{}) string {
+	for _, r := range routes {
+		trig, err := trigger.NewArrowTrigger(r)
+		if err != nil {
+			t.Fatalf("%s: %s", r, err.Error())
+		}
+		result, err := trig.Trigger(data)
+		if err != nil {
+			t.Fatalf("%s: %s", r, err.Error())
+		}
+		if len(result) == 0 {
+			continue
+		}
+		var targets []string
+		if values, ok := result["targets"].([]ref.Val); ok {
+			for _, v := range values {
+				targets = append(targets, v.Value().(string))
+			}
+		}
+		return result["name"].(string) + " " + strings.Join(targets, ",")
+	}
+	return ""
+}
+
+func request(grpc bool, host, path string, headers map[string]interface{}) map[string]interface{} {
+	if headers == nil {
+		headers = map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		"http":    !grpc,
+		"grpc":    grpc,
+		"host":    host,
+		"path":    path,
+		"method":  "GET",
+		"headers": headers,
+	}
+}
+
+func TestIngress(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	class := "gproxy"
+	exact := networkingv1.PathTypeExact
+	prefix := networkingv1.PathTypePrefix
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: networkingv1.IngressSpec{
+			IngressClassName: &class,
+			TLS:              []networkingv1.IngressTLS{{Hosts: []string{"example.com", "*.example.com"}}},
+			Rules: []networkingv1.IngressRule{
+				{
+					Host: "example.com",
+					IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+						Paths: []networkingv1.HTTPIngressPath{
+							{Path: "/", PathType: &prefix, Backend: backend("web", networkingv1.ServiceBackendPort{Number: 80})},
+							{Path: "/api", PathType: &prefix, Backend: backend("api", networkingv1.ServiceBackendPort{Name: "http"})},
+							{Path: "/healthz", PathType: &exact, Backend: backend("health", networkingv1.ServiceBackendPort{Number: 8081})},
+						},
+					}},
+				},
+			},
+		},
+	}
+	other := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default", Annotations: map[string]string{"kubernetes.io/ingress.class": "nginx"}},
+		Spec: networkingv1.IngressSpec{
+			DefaultBackend: &networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: "other", Port: networkingv1.ServiceBackendPort{Number: 80}}},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 8080}}},
+	}
+	client := fake.NewSimpleClientset(ing, other, svc)
+	changes := run(t, ctx, &ingress.Controller{Client: client})
+	c := next(t, changes)
+	// wildcard hosts are excluded from the acme host policy
+	if strings.Join(c.hosts, ",") != "example.com" {
+		t.Fatalf("unexpected hosts: %v", c.hosts)
+	}
+	for path, expected := range map[string]string{
+		"/":          "ingress/default/web http://web.default.svc.cluster.local:80",
+		"/apis":      "ingress/default/web http://web.default.svc.cluster.local:80",
+		"/api/users": "ingress/default/web http://api.default.svc.cluster.local:8080",
+		"/healthz":   "ingress/default/web http://health.default.svc.cluster.local:8081",
+		"/healthz/x": "ingress/default/web http://web.default.svc.cluster.local:80",
+	} {
+		if got := match(t, c.routes, request(false, "example.com:443", path, nil)); got != expected {
+			t.Fatalf("%s: expected %q got %q", path, expected, got)
+		}
+	}
+	if got := match(t, c.routes, request(false, "other.com", "/", nil)); got != "" {
+		t.Fatalf("unexpected match for unmanaged ingress: %s", got)
+	}
+	if got := match(t, c.routes, request(true, "example.com", "/", nil)); got != "" {
+		t.Fatalf("unexpected gRPC match: %s", got)
+	}
+	ing.Spec.TLS = nil
+	if _, err := client.NetworkingV1().Ingresses("default").Update(ctx, ing, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if c := next(t, changes); len(c.hosts) != 0 || len(c.routes) != 3 {
+		t.Fatalf("unexpected change: %v", c)
+	}
+}
+
+func TestGatewayAPI(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	gateway := object("Gateway", "edge", map[string]interface{}{
+		"gatewayClassName": "gproxy",
+		"listeners": []interface{}{
+			map[string]interface{}{"name": "https", "protocol": "HTTPS", "port": int64(443), "hostname": "api.example.com"},
+			map[string]interface{}{"name": "http", "protocol": "HTTP", "port": int64(80), "hostname": "plain.example.com"},
+		},
+	})
+	parentRefs := []interface{}{map[string]interface{}{"name": "edge"}}
+	httpRoute := object("HTTPRoute", "users", map[string]interface{}{
+		"parentRefs": parentRefs,
+		"hostnames":  []interface{}{"api.example.com"},
+		"rules": []interface{}{
+			map[string]interface{}{
+				"matches": []interface{}{map[string]interface{}{
+					"path":    map[string]interface{}{"type": "PathPrefix", "value": "/users"},
+					"headers": []interface{}{map[string]interface{}{"name": "x-version", "value": "v2"}},
+				}},
+				"backendRefs": []interface{}{map[string]interface{}{"name": "users-v2", "port": int64(8080)}},
+			},
+			map[string]interface{}{
+				"matches":     []interface{}{map[string]interface{}{"path": map[string]interface{}{"type": "PathPrefix", "value": "/users"}}},
+				"backendRefs": []interface{}{map[string]interface{}{"name": "users", "port": int64(8080)}, map[string]interface{}{"name": "users-drain", "port": int64(8080), "weight": int64(0)}},
+			},
+		},
+	})
+	grpcRoute := object("GRPCRoute", "health", map[string]interface{}{
+		"parentRefs": parentRefs,
+		"rules": []interface{}{
+			map[string]interface{}{
+				"matches":     []interface{}{map[string]interface{}{"method": map[string]interface{}{"service": "grpc.health.v1.Health"}}},
+				"backendRefs": []interface{}{map[string]interface{}{"name": "health", "namespace": "infra", "port": int64(9000)}},
+			},
+		},
+	})
+	unattached := object("HTTPRoute", "unattached", map[string]interface{}{
+		"parentRefs": []interface{}{map[string]interface{}{"name": "other-gateway"}},
+		"rules": []interface{}{
+			map[string]interface{}{"backendRefs": []interface{}{map[string]interface{}{"name": "unattached", "port": int64(80)}}},
+		},
+	})
+	gvr := func(resource string) schema.GroupVersionResource {
+		return schema.GroupVersionResource{Group: ingress.GatewayGroup, Version: "v1", Resource: resource}
+	}
+	dynamic := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		gvr("gateways"):   "GatewayList",
+		gvr("httproutes"): "HTTPRouteList",
+		gvr("grpcroutes"): "GRPCRouteList",
+	})
+	for resource, obj := range map[string]*unstructured.Unstructured{
+		"gateways":   gateway,
+		"httproutes": httpRoute,
+		"grpcroutes": grpcRoute,
+	} {
+		if _, err := dynamic.Resource(gvr(resource)).Namespace("default").Create(ctx, obj, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if _, err := dynamic.Resource(gvr("httproutes")).Namespace("default").Create(ctx, unattached, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err.Error())
+	}
+	changes := run(t, ctx, &ingress.Controller{Client: fake.NewSimpleClientset(), Dynamic: dynamic})
+	c := next(t, changes)
+	if strings.Join(c.hosts, ",") != "api.example.com" {
+		t.Fatalf("unexpected hosts: %v", c.hosts)
+	}
+	for _, test := range []struct {
+		data     map[string]interface{}
+		expected string
+	}{
+		{request(false, "api.example.com", "/users/1", map[string]interface{}{"X-Version": "v2"}), "httproute/default/users http://users-v2.default.svc.cluster.local:8080"},
+		{request(false, "api.example.com", "/users/1", nil), "httproute/default/users http://users.default.svc.cluster.local:8080"},
+		{request(false, "other.example.com", "/users/1", nil), ""},
+		{request(true, "api.example.com", "/grpc.health.v1.Health/Check", nil), "grpcroute/default/health health.infra.svc.cluster.local:9000"},
+		{request(true, "api.example.com", "/other.Service/Check", nil), ""},
+	} {
+		if got := match(t, c.routes, test.data); got != test.expected {
+			t.Fatalf("%v: expected %q got %q", test.data, test.expected, got)
+		}
+	}
+}
+
+func backend(name string, port networkingv1.ServiceBackendPort) networkingv1.IngressBackend {
+	return networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: name, Port: port}}
+}
+
+func object(kind, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": ingress.GatewayGroup + "/v1",
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": name, "namespace": "default"},
+		"spec":       spec,
+	}}
+}
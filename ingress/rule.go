@@ -0,0 +1,139 @@
+package ingress
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	pathExact  = "Exact"
+	pathPrefix = "Prefix"
+	pathRegex  = "RegularExpression"
+)
+
+// rule is a single translated routing rule. Each rule becomes one routing expression
+type rule struct {
+	name     string
+	grpc     bool
+	host     string
+	pathType string
+	path     string
+	method   string
+	headers  map[string]string
+	targets  []string
+}
+
+// expression returns the routing trigger expression of the rule
+// ex: this.http && this.host.matches('^api\\.example\\.com(:[0-9]+)?$') && (this.path == '/v1' || this.path.startsWith('/v1/')) => {'name': 'ingress/default/api', 'targets': ['http://api.default.svc.cluster.local:80']}
+func (r rule) expression() string {
+	var conditions []string
+	if r.grpc {
+		conditions = append(conditions, "this.grpc")
+	} else {
+		conditions = append(conditions, "this.http")
+	}
+	if r.host != "" {
+		conditions = append(conditions, fmt.Sprintf("this.host.matches(%s)", quote(hostPattern(r.host))))
+	}
+	switch r.pathType {
+	case pathExact:
+		conditions = append(conditions, fmt.Sprintf("this.path == %s", quote(r.path)))
+	case pathRegex:
+		conditions = append(conditions, fmt.Sprintf("this.path.matches(%s)", quote("^"+r.path+"$")))
+	case pathPrefix:
+		if prefix := strings.TrimSuffix(r.path, "/"); prefix != "" {
+			conditions = append(conditions, fmt.Sprintf("(this.path == %s || this.path.startsWith(%s))", quote(prefix), quote(prefix+"/")))
+		}
+	}
+	if r.method != "" {
+		conditions = append(conditions, fmt.Sprintf("this.method == %s", quote(r.method)))
+	}
+	var names []string
+	for name := range r.headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		conditions = append(conditions, fmt.Sprintf("(%s in this.headers && this.headers[%s] == %s)", quote(name), quote(name), quote(r.headers[name])))
+	}
+	var targets []string
+	for _, t := range r.targets {
+		targets = append(targets, quote(t))
+	}
+	return fmt.Sprintf("%s => {'name': %s, 'targets': [%s]}", strings.Join(conditions, " && "), quote(r.name), strings.Join(targets, ", "))
+}
+
+// hostPattern returns a regular expression matching the host(& an optional port). A leading '*.' matches a single dns label
+func hostPattern(host string) string {
+	if strings.HasPrefix(host, "*.") {
+		return fmt.Sprintf("^[^.]+%s(:[0-9]+)?$", regexp.QuoteMeta(strings.TrimPrefix(host, "*")))
+	}
+	return fmt.Sprintf("^%s(:[0-9]+)?$", regexp.QuoteMeta(host))
+}
+
+// quote returns a single quoted expression string literal
+func quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `'`, `\'`)
+	return "'" + s + "'"
+}
+
+// sortRules orders rules from most to least specific so the first matching expression wins:
+// exact hosts, wildcard hosts, then any host; exact paths before prefixes; longer paths first; more header matches first
+func sortRules(rules []rule) {
+	hostRank := func(host string) int {
+		switch {
+		case host == "":
+			return 2
+		case strings.HasPrefix(host, "*."):
+			return 1
+		default:
+			return 0
+		}
+	}
+	pathRank := func(pathType string) int {
+		switch pathType {
+		case pathExact:
+			return 0
+		case pathRegex:
+			return 1
+		case pathPrefix:
+			return 2
+		default:
+			return 3
+		}
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		if hostRank(a.host) != hostRank(b.host) {
+			return hostRank(a.host) < hostRank(b.host)
+		}
+		if pathRank(a.pathType) != pathRank(b.pathType) {
+			return pathRank(a.pathType) < pathRank(b.pathType)
+		}
+		if len(a.path) != len(b.path) {
+			return len(a.path) > len(b.path)
+		}
+		if (a.method != "") != (b.method != "") {
+			return a.method != ""
+		}
+		if len(a.headers) != len(b.headers) {
+			return len(a.headers) > len(b.headers)
+		}
+		return a.name < b.name
+	})
+}
+
+// AcmePolicy returns a decision expression that allows the Acme client to respond to the given hosts
+func AcmePolicy(hosts []string) string {
+	if len(hosts) == 0 {
+		return "false"
+	}
+	var quoted []string
+	for _, h := range hosts {
+		quoted = append(quoted, quote(h))
+	}
+	return fmt.Sprintf("this.host in [%s]", strings.Join(quoted, ", "))
+}
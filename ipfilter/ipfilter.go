@@ -0,0 +1,142 @@
+// Package ipfilter allows & denies clients by IP address or CIDR
+package ipfilter
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"net"
+	"os"
+	"strings"
+)
+
+// Filter is a CIDR allow & deny list. Deny entries take precedence over allow entries.
+// If the allow list is empty, every address that isn't denied is allowed
+type Filter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// New creates a Filter from lists of CIDRs or bare IP addresses
+// ex: New([]string{"10.0.0.0/8", "192.168.1.10"}, []string{"10.1.0.0/16"})
+func New(allow, deny []string) (*Filter, error) {
+	a, err := ParseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	d, err := ParseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{allow: a, deny: d}, nil
+}
+
+// Allowed reports whether the address is allowed by the filter. A nil filter allows every address,
+// and addresses that cannot be parsed are only allowed if the allow list is empty & the deny list is empty
+func (f *Filter) Allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if ip == nil {
+		return len(f.allow) == 0 && len(f.deny) == 0
+	}
+	if Contains(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || Contains(f.allow, ip)
+}
+
+// AllowedAddr reports whether the host of the address(ip or ip:port) is allowed by the filter
+func (f *Filter) AllowedAddr(addr string) bool {
+	return f.Allowed(net.ParseIP(Host(addr)))
+}
+
+// ParseCIDRs parses CIDRs or bare IP addresses(treated as a single address). Empty values are ignored
+func ParseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, errors.Errorf("ipfilter: invalid address: %s", v)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "ipfilter")
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ReadFile reads a file of CIDRs or IP addresses(one per line). Blank lines & lines starting with # are ignored
+func ReadFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var values []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		values = append(values, line)
+	}
+	return values, scanner.Err()
+}
+
+// Contains reports whether any of the networks contain the address
+func Contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Host returns the host of an ip:port address, or the address itself if it has no port
+func Host(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// ClientIP returns the address of the client that sent a request received from remote(ip or ip:port).
+// If remote is a trusted proxy, X-Forwarded-For values are walked from right to left & the first untrusted address is returned
+func ClientIP(remote string, forwardedFor []string, trusted []*net.IPNet) string {
+	client := Host(remote)
+	if len(trusted) == 0 {
+		return client
+	}
+	var hops []string
+	for _, value := range forwardedFor {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops); ; i-- {
+		ip := net.ParseIP(client)
+		if ip == nil || !Contains(trusted, ip) || i == 0 {
+			return client
+		}
+		client = Host(hops[i-1])
+	}
+}
@@ -0,0 +1,178 @@
+package ipfilter_test
+
+import (
+	"github.com/graphikDB/gproxy/ipfilter"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	f, err := ipfilter.New([]string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32"}, []string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for addr, allowed := range map[string]bool{
+		"10.0.0.1":         true,
+		"10.0.0.1:8080":    true,
+		"10.1.2.3":         false,
+		"192.168.1.10":     true,
+		"192.168.1.11":     false,
+		"[2001:db8::1]:80": true,
+		"2001:db9::1":      false,
+		"not-an-ip":        false,
+	} {
+		if f.AllowedAddr(addr) != allowed {
+			t.Fatalf("%s: expected allowed = %v", addr, allowed)
+		}
+	}
+	deny, err := ipfilter.New(nil, []string{"172.16.0.0/12"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !deny.AllowedAddr("8.8.8.8") || deny.AllowedAddr("172.16.5.5") {
+		t.Fatal("unexpected deny-only result")
+	}
+	var empty *ipfilter.Filter
+	if !empty.AllowedAddr("8.8.8.8") {
+		t.Fatal("expected nil filter to allow")
+	}
+	if _, err := ipfilter.New([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Fatal("expected invalid cidr to be rejected")
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deny.txt")
+	if err := ioutil.WriteFile(path, []byte("# blocked\n10.0.0.0/8\n\n 192.168.0.1 \n"), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	values, err := ipfilter.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(values) != 2 || values[0] != "10.0.0.0/8" || values[1] != "192.168.0.1" {
+		t.Fatalf("unexpected values: %v", values)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ipfilter.ParseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, tc := range []struct {
+		remote   string
+		xff      []string
+		trusted  bool
+		expected string
+	}{
+		{"1.2.3.4:5000", []string{"9.9.9.9"}, true, "1.2.3.4"},
+		{"10.0.0.1:5000", []string{"9.9.9.9, 5.6.7.8"}, true, "5.6.7.8"},
+		{"10.0.0.1:5000", []string{"9.9.9.9", "5.6.7.8, 10.0.0.2"}, true, "5.6.7.8"},
+		{"10.0.0.1:5000", []string{"10.0.0.3, 10.0.0.2"}, true, "10.0.0.3"},
+		{"10.0.0.1:5000", nil, true, "10.0.0.1"},
+		{"10.0.0.1:5000", []string{"9.9.9.9"}, false, "10.0.0.1"},
+	} {
+		var nets = trusted
+		if !tc.trusted {
+			nets = nil
+		}
+		if ip := ipfilter.ClientIP(tc.remote, tc.xff, nets); ip != tc.expected {
+			t.Fatalf("%s %v: expected %s got %s", tc.remote, tc.xff, tc.expected, ip)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	deny, _ := ipfilter.New(nil, []string{"127.0.0.1"})
+	allow, _ := ipfilter.New([]string{"127.0.0.1"}, nil)
+	var current atomic.Value
+	current.Store(deny)
+	denied := make(chan net.Addr, 1)
+	filtered := ipfilter.Listener(l, func() *ipfilter.Filter { return current.Load().(*ipfilter.Filter) }, func(addr net.Addr) { denied <- addr })
+	defer filtered.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := filtered.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	select {
+	case <-denied:
+	case <-time.After(time.Second):
+		t.Fatal("expected connection to be denied")
+	}
+	current.Store(allow)
+	conn2, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn2.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("expected connection to be accepted")
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	deny, _ := ipfilter.New(nil, []string{"127.0.0.1"})
+	var current atomic.Value
+	current.Store(deny)
+	denied := make(chan net.Addr, 1)
+	filtered := ipfilter.PacketConn(conn, func() *ipfilter.Filter { return current.Load().(*ipfilter.Filter) }, func(addr net.Addr) {
+		select {
+		case denied <- addr:
+		default:
+		}
+		// allow the next packet once the first one has been dropped
+		current.Store((*ipfilter.Filter)(nil))
+	})
+	defer filtered.Close()
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+	client.Write([]byte("denied"))
+	client.Write([]byte("allowed"))
+	filtered.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	n, _, err := filtered.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(buf[:n]) != "allowed" {
+		t.Fatalf("expected denied packet to be dropped: %s", buf[:n])
+	}
+	select {
+	case <-denied:
+	default:
+		t.Fatal("expected onDeny to be called")
+	}
+}
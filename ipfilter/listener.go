@@ -0,0 +1,77 @@
+package ipfilter
+
+import (
+	"github.com/pkg/errors"
+	"net"
+)
+
+// Listener wraps a listener, closing connections from addresses that aren't allowed by the current filter before they
+// are returned from Accept(ex: before a TLS handshake). The filter func is called for every connection so filters may be reloaded.
+// onDeny is called with the address of each rejected connection(optional)
+func Listener(l net.Listener, filter func() *Filter, onDeny func(addr net.Addr)) net.Listener {
+	return &listener{Listener: l, filter: filter, onDeny: onDeny}
+}
+
+type listener struct {
+	net.Listener
+	filter func() *Filter
+	onDeny func(addr net.Addr)
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.filter().AllowedAddr(conn.RemoteAddr().String()) {
+			return conn, nil
+		}
+		if l.onDeny != nil {
+			l.onDeny(conn.RemoteAddr())
+		}
+		conn.Close()
+	}
+}
+
+// PacketConn wraps a packet conn(ex: a QUIC listeners UDP socket), dropping packets from addresses that aren't allowed
+// by the current filter. onDeny is called with the address of each dropped packet(optional)
+func PacketConn(conn net.PacketConn, filter func() *Filter, onDeny func(addr net.Addr)) net.PacketConn {
+	return &packetConn{PacketConn: conn, filter: filter, onDeny: onDeny}
+}
+
+type packetConn struct {
+	net.PacketConn
+	filter func() *Filter
+	onDeny func(addr net.Addr)
+}
+
+func (c *packetConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.filter().AllowedAddr(addr.String()) {
+			return n, addr, err
+		}
+		if c.onDeny != nil {
+			c.onDeny(addr)
+		}
+	}
+}
+
+// SetReadBuffer sets the size of the wrapped sockets receive buffer(ex: so QUIC servers may raise it)
+func (c *packetConn) SetReadBuffer(bytes int) error {
+	conn, ok := c.PacketConn.(interface{ SetReadBuffer(int) error })
+	if !ok {
+		return errors.New("ipfilter: packet conn doesn't support setting the receive buffer size")
+	}
+	return conn.SetReadBuffer(bytes)
+}
+
+// SetWriteBuffer sets the size of the wrapped sockets send buffer(ex: so QUIC servers may raise it)
+func (c *packetConn) SetWriteBuffer(bytes int) error {
+	conn, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error })
+	if !ok {
+		return errors.New("ipfilter: packet conn doesn't support setting the send buffer size")
+	}
+	return conn.SetWriteBuffer(bytes)
+}
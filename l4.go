@@ -0,0 +1,225 @@
+package gproxy
+
+import (
+	"fmt"
+	"github.com/autom8ter/machine"
+	"github.com/graphikDB/gproxy/breaker"
+	"github.com/graphikDB/gproxy/ipfilter"
+	"github.com/graphikDB/gproxy/l4"
+	"github.com/graphikDB/gproxy/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// handleL4 routes the connection by its server name(sni) & listener port. It returns false if no L4 route matched
+func (p *Proxy) handleL4(conn net.Conn, sni string, port int) bool {
+	data := l4RequestData("tcp", sni, port, ipfilter.Host(conn.RemoteAddr().String()))
+	rt, err := p.matchL4Route(data)
+	if err != nil {
+		p.logger.Error("failed to find L4 routing target", zap.Error(err))
+		return false
+	}
+	if rt == nil {
+		return false
+	}
+	p.spliceL4(conn, rt, routeData(data, rt))
+	return true
+}
+
+// spliceL4 connects to one of the routes targets & splices the connection to it until either side closes or the
+// connection is idle
+func (p *Proxy) spliceL4(conn net.Conn, rt *route, data map[string]interface{}) {
+	defer conn.Close()
+	if err := p.checkIP(rt, data); err != nil {
+		metrics.L4Connections.WithLabelValues(rt.name, "denied").Inc()
+		return
+	}
+	attempted := map[string]bool{}
+	var upstream net.Conn
+	for upstream == nil {
+		target, done, err := p.nextTarget(rt, attempted)
+		if err == nil && attempted[target] {
+			// every target has been attempted
+			done(breaker.Ignored)
+		}
+		if err != nil || attempted[target] {
+			metrics.L4Connections.WithLabelValues(rt.name, "unavailable").Inc()
+			p.logger.Debug("no L4 target available", zap.String("route", rt.name), zap.Error(err))
+			return
+		}
+		attempted[target] = true
+		upstream, err = p.l4Config.Dial(target)
+		if err != nil {
+			done(breaker.Failure)
+			p.logger.Debug("failed to dial L4 target", zap.String("route", rt.name), zap.String("target", target), zap.Error(err))
+			continue
+		}
+		done(breaker.Success)
+	}
+	metrics.L4Connections.WithLabelValues(rt.name, "proxied").Inc()
+	start := time.Now()
+	in, out := p.l4Config.Splice(conn, upstream)
+	metrics.L4Bytes.WithLabelValues(rt.name, "in").Add(float64(in))
+	metrics.L4Bytes.WithLabelValues(rt.name, "out").Add(float64(out))
+	p.logger.Debug("proxied L4 connection",
+		zap.String("route", rt.name),
+		zap.String("sni", data["sni"].(string)),
+		zap.String("client_ip", data["client_ip"].(string)),
+		zap.String("target", upstream.RemoteAddr().String()),
+		zap.Int64("bytes_in", in),
+		zap.Int64("bytes_out", out),
+		zap.Duration("duration", time.Since(start)),
+	)
+}
+
+// passthroughListener splices connections to the secure port that match an L4 route(by SNI) to their target before the
+// TLS handshake. The remaining connections are returned from Accept so TLS is terminated by the proxy
+func (p *Proxy) passthroughListener(l net.Listener) net.Listener {
+	if p.l4Config == nil || !p.l4Config.Passthrough {
+		return l
+	}
+	port := listenerPort(p.securePort)
+	return l4.Listener(l, p.serverConfig.HandshakeTimeout(), func(conn net.Conn, sni string) bool {
+		return p.handleL4(conn, sni, port)
+	})
+}
+
+// serveL4 serves the L4 TCP & UDP ports. Connections that don't match an L4 route are closed & datagrams are dropped.
+// It returns a func that closes the listeners
+func (p *Proxy) serveL4() (func(), error) {
+	if p.l4Config == nil {
+		return func() {}, nil
+	}
+	var listeners []io.Closer
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	for _, ports := range []struct {
+		ports []int
+		tls   bool
+	}{{p.l4Config.Ports, false}, {p.l4Config.TLSPorts, true}} {
+		for _, port := range ports.ports {
+			lis, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			listeners = append(listeners, lis)
+			name := fmt.Sprintf("l4:%v", port)
+			lis = p.limitListener(p.filterListener(p.proxyProtocolListener(lis)), name)
+			port, peek := port, ports.tls
+			p.mach.Go(func(routine machine.Routine) {
+				p.logger.Debug("starting L4 listener", zap.String("address", lis.Addr().String()), zap.Bool("tls", peek))
+				for {
+					conn, err := lis.Accept()
+					if err != nil {
+						if !strings.Contains(err.Error(), "closed network connection") {
+							p.logger.Error("L4 listener failure", zap.Error(err))
+						}
+						return
+					}
+					go p.serveL4Conn(conn, port, peek)
+				}
+			})
+		}
+	}
+	for _, port := range p.l4Config.UDPPorts {
+		conn, err := net.ListenPacket("udp", fmt.Sprintf(":%v", port))
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		listeners = append(listeners, conn)
+		port := port
+		p.mach.Go(func(routine machine.Routine) {
+			p.logger.Debug("starting UDP listener", zap.String("address", conn.LocalAddr().String()))
+			err := p.l4Config.ServeUDP(p.filterPacketConn(conn), func(client net.Addr) (net.Conn, string, error) {
+				return p.dialUDP(client, port)
+			}, func(s *l4.Session) {
+				metrics.UDPActiveSessions.WithLabelValues(s.Route).Dec()
+				metrics.L4Bytes.WithLabelValues(s.Route, "in").Add(float64(atomic.LoadInt64(&s.In)))
+				metrics.L4Bytes.WithLabelValues(s.Route, "out").Add(float64(atomic.LoadInt64(&s.Out)))
+				p.logger.Debug("UDP session expired",
+					zap.String("route", s.Route),
+					zap.String("client", s.Client.String()),
+					zap.String("target", s.Target.String()),
+				)
+			}, func(client net.Addr) {
+				metrics.UDPSessions.WithLabelValues("", "limit").Inc()
+				p.logger.Debug("UDP session limit reached", zap.String("client", client.String()))
+			})
+			if err != nil && !strings.Contains(err.Error(), "closed network connection") {
+				p.logger.Error("UDP listener failure", zap.Error(err))
+			}
+		})
+	}
+	return closeAll, nil
+}
+
+func (p *Proxy) serveL4Conn(conn net.Conn, port int, peek bool) {
+	var sni string
+	if peek {
+		name, peeked, err := l4.PeekServerName(conn, p.serverConfig.HandshakeTimeout())
+		if err != nil {
+			conn.Close()
+			return
+		}
+		sni, conn = name, peeked
+	}
+	if !p.handleL4(conn, sni, port) {
+		metrics.L4Connections.WithLabelValues("", "no_route").Inc()
+		conn.Close()
+	}
+}
+
+// listenerPort returns the port of a listener address(ex: :443)
+func listenerPort(addr string) int {
+	_, port, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// errNoL4Route is returned when no L4 route matched a UDP session
+var errNoL4Route = errors.New("zero L4 routes for UDP session")
+
+// dialUDP connects a new UDP session to a target of the L4 route matched by the clients first datagram
+func (p *Proxy) dialUDP(client net.Addr, port int) (net.Conn, string, error) {
+	data := l4RequestData("udp", "", port, ipfilter.Host(client.String()))
+	rt, err := p.matchL4Route(data)
+	if err != nil {
+		p.logger.Error("failed to find L4 routing target", zap.Error(err))
+		return nil, "", err
+	}
+	if rt == nil {
+		metrics.UDPSessions.WithLabelValues("", "no_route").Inc()
+		return nil, "", errNoL4Route
+	}
+	if err := p.checkIP(rt, routeData(data, rt)); err != nil {
+		metrics.UDPSessions.WithLabelValues(rt.name, "denied").Inc()
+		return nil, "", err
+	}
+	target, done, err := p.nextTarget(rt, map[string]bool{})
+	if err != nil {
+		metrics.UDPSessions.WithLabelValues(rt.name, "unavailable").Inc()
+		return nil, "", err
+	}
+	conn, err := p.l4Config.DialUDP(target)
+	if err != nil {
+		done(breaker.Failure)
+		metrics.UDPSessions.WithLabelValues(rt.name, "unavailable").Inc()
+		return nil, "", err
+	}
+	// datagrams aren't acknowledged, so sessions don't report outcomes to the circuit breaker
+	done(breaker.Ignored)
+	metrics.UDPSessions.WithLabelValues(rt.name, "created").Inc()
+	metrics.UDPActiveSessions.WithLabelValues(rt.name).Inc()
+	return conn, rt.name, nil
+}
@@ -0,0 +1,262 @@
+// Package l4 peeks at the TLS ClientHello of raw TCP connections(so they may be routed by SNI without terminating TLS),
+// splices connections to their targets & forwards UDP datagrams per client session
+package l4
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config configures layer 4(TCP & TLS passthrough) proxying. Zero values use the defaults
+type Config struct {
+	// Passthrough peeks at the SNI of connections to the secure port. Connections matched by an L4 route are spliced to the
+	// routes target without terminating TLS while the rest are served by the proxy
+	Passthrough bool
+	// Ports are additional ports whose connections are spliced to the target of the matching L4 route(ex: databases)
+	Ports []int
+	// TLSPorts are additional ports whose clients speak TLS first, so connections are also routed by SNI
+	TLSPorts []int
+	// DialTimeout is the maximum amount of time to wait for a connection to a target(default: 10s)
+	DialTimeout time.Duration
+	// IdleTimeout closes connections that haven't sent or received data for the duration(default: 5m). Negative values disable the timeout
+	IdleTimeout time.Duration
+	// UDPPorts are ports whose datagrams are forwarded to the target of the matching L4 route(ex: DNS)
+	UDPPorts []int
+	// UDPSessionTimeout expires UDP sessions whose client & target haven't sent a datagram for the duration(default: 1m)
+	UDPSessionTimeout time.Duration
+	// MaxUDPSessions is the maximum number of active sessions per UDP port(default: 10000). Datagrams from new clients
+	// are dropped once it is reached. Negative values disable the limit
+	MaxUDPSessions int
+}
+
+// Validate returns an error if the config is invalid
+func (c *Config) Validate() error {
+	for _, port := range append(append(append([]int{}, c.Ports...), c.TLSPorts...), c.UDPPorts...) {
+		if port <= 0 || port > 65535 {
+			return errors.Errorf("l4: invalid port: %v", port)
+		}
+	}
+	if c.DialTimeout < 0 || c.UDPSessionTimeout < 0 {
+		return errors.New("l4: negative dial or UDP session timeout")
+	}
+	return nil
+}
+
+// Dial connects to the target(host:port or tcp://host:port)
+func (c *Config) Dial(target string) (net.Conn, error) {
+	timeout := 10 * time.Second
+	if c != nil && c.DialTimeout > 0 {
+		timeout = c.DialTimeout
+	}
+	return net.DialTimeout("tcp", strings.TrimPrefix(target, "tcp://"), timeout)
+}
+
+func (c *Config) idleTimeout() time.Duration {
+	switch {
+	case c == nil || c.IdleTimeout == 0:
+		return 5 * time.Minute
+	case c.IdleTimeout < 0:
+		return 0
+	default:
+		return c.IdleTimeout
+	}
+}
+
+var errPeeked = errors.New("l4: client hello peeked")
+
+// PeekServerName reads the TLS ClientHello of the connection & returns the requested server name(SNI) along with a
+// connection that replays the bytes that were read. An empty name is returned for connections that don't start with a
+// ClientHello. An error is returned if the connection fails or doesn't send enough data before the timeout(if positive)
+func PeekServerName(conn net.Conn, timeout time.Duration) (string, net.Conn, error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	var (
+		buf   bytes.Buffer
+		name  string
+		hello bool
+	)
+	r := &recordingReader{r: io.TeeReader(conn, &buf)}
+	// the handshake is aborted as soon as the ClientHello has been parsed, so nothing is written to the client
+	_ = tls.Server(readOnlyConn{Conn: conn, r: r}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			name, hello = info.ServerName, true
+			return nil, errPeeked
+		},
+	}).Handshake()
+	if !hello && r.err != nil {
+		return "", nil, r.err
+	}
+	return name, &replayConn{Conn: conn, r: io.MultiReader(&buf, conn)}, nil
+}
+
+type recordingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// readOnlyConn feeds the connections data to a TLS server while discarding its writes(ex: alerts)
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c readOnlyConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// replayConn replays the peeked bytes before reading from the connection
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Listener peeks at the server name of each accepted connection & passes it to handle, which returns true if it took
+// ownership of the connection(handle may block). Connections that weren't handled are returned from Accept with the
+// peeked bytes replayed. Connections are peeked concurrently, so slow clients don't block Accept
+func Listener(l net.Listener, timeout time.Duration, handle func(conn net.Conn, serverName string) bool) net.Listener {
+	pl := &listener{
+		Listener: l,
+		timeout:  timeout,
+		handle:   handle,
+		conns:    make(chan net.Conn),
+		failed:   make(chan struct{}),
+	}
+	go pl.serve()
+	return pl
+}
+
+type listener struct {
+	net.Listener
+	timeout time.Duration
+	handle  func(conn net.Conn, serverName string) bool
+	conns   chan net.Conn
+	failed  chan struct{}
+	err     error
+}
+
+func (l *listener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.failed)
+			return
+		}
+		go func() {
+			name, peeked, err := PeekServerName(conn, l.timeout)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			if l.handle(peeked, name) {
+				return
+			}
+			select {
+			case l.conns <- peeked:
+			case <-l.failed:
+				peeked.Close()
+			}
+		}()
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.failed:
+		return nil, l.err
+	}
+}
+
+// Splice copies data between the client & target connections until both directions are closed or no data has been sent
+// or received for longer than the configs idle timeout. Both connections are closed once it returns. It returns the
+// number of bytes sent to the target(in) & to the client(out)
+func (c *Config) Splice(client, target net.Conn) (in int64, out int64) {
+	var (
+		last = time.Now().UnixNano()
+		wg   sync.WaitGroup
+		once sync.Once
+		done = make(chan struct{})
+	)
+	closeAll := func() {
+		once.Do(func() {
+			client.Close()
+			target.Close()
+		})
+	}
+	defer closeAll()
+	pipe := func(dst, src net.Conn, n *int64) {
+		defer wg.Done()
+		buf := make([]byte, 32*1024)
+		for {
+			nr, err := src.Read(buf)
+			if nr > 0 {
+				atomic.StoreInt64(&last, time.Now().UnixNano())
+				nw, werr := dst.Write(buf[:nr])
+				atomic.AddInt64(n, int64(nw))
+				if werr != nil {
+					closeAll()
+					return
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		// half close, so the peer sees EOF while the opposite direction keeps flowing
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			closeAll()
+		}
+	}
+	if idle := c.idleTimeout(); idle > 0 {
+		go func() {
+			ticker := time.NewTicker(idle / 4)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case now := <-ticker.C:
+					if now.Sub(time.Unix(0, atomic.LoadInt64(&last))) > idle {
+						closeAll()
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Add(2)
+	go pipe(target, client, &in)
+	go pipe(client, target, &out)
+	wg.Wait()
+	close(done)
+	return atomic.LoadInt64(&in), atomic.LoadInt64(&out)
+}
@@ -0,0 +1,269 @@
+package l4_test
+
+import (
+	"crypto/tls"
+	"github.com/graphikDB/gproxy/l4"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeekServerName(t *testing.T) {
+	// the peeked connection is forwarded to a TLS server that completes the handshake
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	names := make(chan string, 1)
+	config := &l4.Config{}
+	peeked := l4.Listener(l, time.Second, func(conn net.Conn, serverName string) bool {
+		names <- serverName
+		target, err := config.Dial("tcp://" + srv.Listener.Addr().String())
+		if err != nil {
+			t.Error(err.Error())
+			return false
+		}
+		config.Splice(conn, target)
+		return true
+	})
+	defer peeked.Close()
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{ServerName: "db.graphikdb.io", InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get("https://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	if bits, _ := ioutil.ReadAll(resp.Body); string(bits) != "hello" {
+		t.Fatalf("unexpected response: %s", bits)
+	}
+	if name := <-names; name != "db.graphikdb.io" {
+		t.Fatalf("unexpected server name: %s", name)
+	}
+}
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// connections that aren't handled are returned from Accept with the peeked bytes replayed
+	peeked := l4.Listener(l, time.Second, func(conn net.Conn, serverName string) bool {
+		return false
+	})
+	defer peeked.Close()
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		time.Sleep(time.Second)
+	}()
+	conn, err := peeked.Accept()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	buf := make([]byte, 18)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "GET / HTTP/1.1\r\n\r\n" {
+		t.Fatalf("expected peeked bytes to be replayed: %q %v", buf, err)
+	}
+}
+
+func TestSpliceIdleTimeout(t *testing.T) {
+	client, proxyClient := net.Pipe()
+	proxyTarget, target := net.Pipe()
+	defer client.Close()
+	defer target.Close()
+	config := &l4.Config{IdleTimeout: 200 * time.Millisecond}
+	done := make(chan struct{})
+	go func() {
+		config.Splice(proxyClient, proxyTarget)
+		close(done)
+	}()
+	go func() {
+		buf := make([]byte, 5)
+		io.ReadFull(target, buf)
+		target.Write(buf)
+	}()
+	client.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("expected echoed data: %s %v", buf, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected idle connections to be closed")
+	}
+}
+
+func TestServeUDP(t *testing.T) {
+	target := echoUDP(t)
+	defer target.Close()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	config := &l4.Config{UDPSessionTimeout: 200 * time.Millisecond}
+	closed := make(chan *l4.Session, 1)
+	go config.ServeUDP(conn, func(client net.Addr) (net.Conn, string, error) {
+		c, err := config.DialUDP("udp://" + target.LocalAddr().String())
+		return c, "echo", err
+	}, func(s *l4.Session) {
+		closed <- s
+	}, nil)
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+	for _, msg := range []string{"hello", "world"} {
+		client.Write([]byte(msg))
+		buf := make([]byte, 16)
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := client.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("expected echoed datagram: %s %v", buf[:n], err)
+		}
+	}
+	select {
+	case s := <-closed:
+		if s.Route != "echo" || atomic.LoadInt64(&s.In) != 10 || atomic.LoadInt64(&s.Out) != 10 {
+			t.Fatalf("unexpected session bytes: %v %v", s.In, s.Out)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected idle session to expire")
+	}
+}
+
+// echoUDP starts a UDP target that echoes datagrams
+func echoUDP(t *testing.T) net.PacketConn {
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := target.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			target.WriteTo(buf[:n], addr)
+		}
+	}()
+	return target
+}
+
+func TestServeUDPSlowClients(t *testing.T) {
+	target := echoUDP(t)
+	defer target.Close()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	var (
+		slow, failing net.Conn
+		failedDials   int64
+		release       = make(chan struct{})
+	)
+	defer close(release)
+	for _, c := range []*net.Conn{&slow, &failing} {
+		*c, err = net.Dial("udp", conn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer (*c).Close()
+	}
+	config := &l4.Config{}
+	go config.ServeUDP(conn, func(client net.Addr) (net.Conn, string, error) {
+		switch client.String() {
+		case slow.LocalAddr().String():
+			<-release
+		case failing.LocalAddr().String():
+			atomic.AddInt64(&failedDials, 1)
+			return nil, "", errors.New("unavailable")
+		}
+		c, err := config.DialUDP(target.LocalAddr().String())
+		return c, "echo", err
+	}, nil, nil)
+	slow.Write([]byte("slow"))
+	for i := 0; i < 3; i++ {
+		failing.Write([]byte("failing"))
+	}
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+	// the slow & failing sessions don't block the read loop
+	client.Write([]byte("hello"))
+	buf := make([]byte, 16)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("expected echoed datagram: %s %v", buf[:n], err)
+	}
+	if dials := atomic.LoadInt64(&failedDials); dials != 1 {
+		t.Fatalf("expected failed dial to be cached, got %v dials", dials)
+	}
+}
+
+func TestServeUDPSessionLimit(t *testing.T) {
+	target := echoUDP(t)
+	defer target.Close()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	config := &l4.Config{MaxUDPSessions: 1}
+	rejected := make(chan net.Addr, 1)
+	go config.ServeUDP(conn, func(client net.Addr) (net.Conn, string, error) {
+		c, err := config.DialUDP(target.LocalAddr().String())
+		return c, "echo", err
+	}, nil, func(client net.Addr) {
+		rejected <- client
+	})
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("udp", conn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+	clients[0].Write([]byte("hello"))
+	buf := make([]byte, 16)
+	clients[0].SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := clients[0].Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("expected echoed datagram: %s %v", buf[:n], err)
+	}
+	clients[1].Write([]byte("hello"))
+	select {
+	case client := <-rejected:
+		if client.String() != clients[1].LocalAddr().String() {
+			t.Fatalf("unexpected rejected client: %s", client)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected second session to be rejected")
+	}
+}
@@ -0,0 +1,166 @@
+package l4
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// udpQueueSize is the number of datagrams buffered per session while its target is dialed or written to.
+	// Datagrams received while the queue is full are dropped
+	udpQueueSize = 64
+	// udpFailedDialTTL is the amount of time a session whose dial failed is kept, so datagrams from the client are
+	// dropped instead of evaluating the routes again for each of them
+	udpFailedDialTTL = 5 * time.Second
+)
+
+// Session is the state of a UDP client(address & port) whose datagrams are forwarded to a target
+type Session struct {
+	// Client is the address of the client
+	Client net.Addr
+	// Target is the address of the target
+	Target net.Addr
+	// Route is the name of the route returned by dial
+	Route string
+	// In is the number of bytes forwarded to the target
+	In int64
+	// Out is the number of bytes returned to the client
+	Out    int64
+	conn   net.Conn
+	last   int64
+	failed int32
+	queue  chan []byte
+}
+
+// DialUDP connects to the target(host:port or udp://host:port)
+func (c *Config) DialUDP(target string) (net.Conn, error) {
+	return net.Dial("udp", strings.TrimPrefix(target, "udp://"))
+}
+
+func (c *Config) udpSessionTimeout() time.Duration {
+	if c == nil || c.UDPSessionTimeout <= 0 {
+		return time.Minute
+	}
+	return c.UDPSessionTimeout
+}
+
+func (c *Config) maxUDPSessions() int {
+	if c == nil || c.MaxUDPSessions == 0 {
+		return 10000
+	}
+	return c.MaxUDPSessions
+}
+
+// ServeUDP forwards the datagrams received on conn until it is closed. The first datagram from a client creates a
+// session whose socket is connected to the target returned by dial(along with the name of its route), so replies are
+// returned to the client. Sessions are dialed off the read loop, so a slow dial only delays the datagrams of its own
+// client. If dial returns an error, the clients datagrams are dropped for a few seconds before it is dialed again.
+// Sessions expire once the client & target haven't sent a datagram for the configs session timeout & closed is called
+// with each expired session(optional). Datagrams from new clients are dropped once the configs max sessions are active
+// & rejected is called with the client(optional)
+func (c *Config) ServeUDP(conn net.PacketConn, dial func(client net.Addr) (net.Conn, string, error), closed func(s *Session), rejected func(client net.Addr)) error {
+	var (
+		mu       sync.Mutex
+		sessions = map[string]*Session{}
+		timeout  = c.udpSessionTimeout()
+		max      = c.maxUDPSessions()
+		stopped  = make(chan struct{})
+		buf      = make([]byte, 64*1024)
+	)
+	defer close(stopped)
+	remove := func(s *Session) {
+		mu.Lock()
+		delete(sessions, s.Client.String())
+		mu.Unlock()
+	}
+	serve := func(s *Session) {
+		target, route, err := dial(s.Client)
+		if err != nil {
+			atomic.StoreInt32(&s.failed, 1)
+			select {
+			case <-time.After(udpFailedDialTTL):
+			case <-stopped:
+			}
+			remove(s)
+			return
+		}
+		s.Target, s.Route, s.conn = target.RemoteAddr(), route, target
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case datagram := <-s.queue:
+					if written, err := target.Write(datagram); err == nil {
+						atomic.AddInt64(&s.In, int64(written))
+					}
+				case <-stopped:
+					// unblocks reply
+					target.Close()
+					return
+				case <-done:
+					return
+				}
+			}
+		}()
+		c.reply(conn, s, timeout)
+		close(done)
+		remove(s)
+		target.Close()
+		if closed != nil {
+			closed(s)
+		}
+	}
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		s, ok := sessions[addr.String()]
+		if !ok {
+			if max > 0 && len(sessions) >= max {
+				mu.Unlock()
+				if rejected != nil {
+					rejected(addr)
+				}
+				continue
+			}
+			s = &Session{Client: addr, last: time.Now().UnixNano(), queue: make(chan []byte, udpQueueSize)}
+			sessions[addr.String()] = s
+			go serve(s)
+		}
+		mu.Unlock()
+		if atomic.LoadInt32(&s.failed) == 1 {
+			continue
+		}
+		atomic.StoreInt64(&s.last, time.Now().UnixNano())
+		select {
+		case s.queue <- append([]byte(nil), buf[:n]...):
+		default:
+		}
+	}
+}
+
+// reply returns the targets datagrams to the client until the session expires or fails
+func (c *Config) reply(conn net.PacketConn, s *Session, timeout time.Duration) {
+	buf := make([]byte, 64*1024)
+	for {
+		s.conn.SetReadDeadline(time.Unix(0, atomic.LoadInt64(&s.last)).Add(timeout))
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() &&
+				time.Since(time.Unix(0, atomic.LoadInt64(&s.last))) < timeout {
+				// the client sent a datagram since the deadline was set
+				continue
+			}
+			return
+		}
+		atomic.StoreInt64(&s.last, time.Now().UnixNano())
+		if written, err := conn.WriteTo(buf[:n], s.Client); err == nil {
+			atomic.AddInt64(&s.Out, int64(written))
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package gproxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/graphikDB/gproxy/metrics"
+	"github.com/graphikDB/gproxy/ratelimit"
+	"go.uber.org/zap"
+	"math"
+	"time"
+)
+
+// rateLimitError is returned when a request is denied by its routes rate limiter
+type rateLimitError struct {
+	route  string
+	result ratelimit.Result
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded(%s): retry after %s", e.result.Rule, e.result.RetryAfter)
+}
+
+// retryAfter returns the value of the Retry-After header in whole seconds(minimum: 1)
+func (e *rateLimitError) retryAfter() string {
+	return fmt.Sprint(int64(math.Max(1, math.Ceil(e.result.RetryAfter.Seconds()))))
+}
+
+// rateLimiter returns the rate limiter registered for the route, falling back to the default("*") limiter
+func (p *Proxy) rateLimiter(routeName string) *ratelimit.Limiter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if limiter, ok := p.rateLimiters[routeName]; ok {
+		return limiter
+	}
+	return p.rateLimiters["*"]
+}
+
+// rateLimit checks the request against the routes rate limiter. Requests are allowed if the limiters store fails
+func (p *Proxy) rateLimit(ctx context.Context, r *route, data map[string]interface{}) error {
+	limiter := p.rateLimiter(r.name)
+	if limiter == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	result, err := limiter.Allow(ctx, data)
+	if err != nil {
+		p.logger.Error("rate limiter failure", zap.String("route", r.name), zap.Error(err))
+		return nil
+	}
+	if result.Allowed {
+		return nil
+	}
+	metrics.RateLimited.WithLabelValues(r.name, result.Rule).Inc()
+	return &rateLimitError{route: r.name, result: result}
+}
@@ -0,0 +1,91 @@
+// Package listener configures additional named listeners(ex: an internal-only admin port alongside the public ports)
+// with their own address, network(tcp or unix sockets), TLS settings & protocols
+package listener
+
+import (
+	"crypto/tls"
+	"github.com/pkg/errors"
+	"net"
+	"os"
+)
+
+// Protocol is a protocol served by a listener
+type Protocol string
+
+const (
+	// HTTP serves http(and websocket) requests
+	HTTP Protocol = "http"
+	// GRPC serves gRPC requests
+	GRPC Protocol = "grpc"
+)
+
+// Config configures a named listener. Zero values use the defaults
+type Config struct {
+	// Network is the network of the listener: tcp or unix(default: tcp)
+	Network string
+	// Address is the address(ex: 127.0.0.1:8080, :8080) or unix socket path the listener is bound to
+	Address string
+	// TLS terminates TLS with the config(ex: static certificates or client certificate verification)
+	TLS *tls.Config
+	// Acme terminates TLS with the proxies acme certificates. Ignored if TLS is set
+	Acme bool
+	// Protocols are the protocols served by the listener(default: http & grpc)
+	Protocols []Protocol
+}
+
+// Validate returns an error if the config is invalid
+func (c *Config) Validate() error {
+	switch c.Network {
+	case "", "tcp", "unix":
+	default:
+		return errors.Errorf("listener: unsupported network: %s", c.Network)
+	}
+	if c.Address == "" {
+		return errors.New("listener: empty address")
+	}
+	for _, protocol := range c.Protocols {
+		if protocol != HTTP && protocol != GRPC {
+			return errors.Errorf("listener: unsupported protocol: %s", protocol)
+		}
+	}
+	return nil
+}
+
+// Unix returns true if the listener is bound to a unix socket
+func (c *Config) Unix() bool {
+	return c.Network == "unix"
+}
+
+// Secure returns true if the listener terminates TLS
+func (c *Config) Secure() bool {
+	return c.TLS != nil || c.Acme
+}
+
+// Serves returns true if the listener serves the protocol
+func (c *Config) Serves(protocol Protocol) bool {
+	if len(c.Protocols) == 0 {
+		return true
+	}
+	for _, p := range c.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// Listen binds the listener. A stale unix socket left behind by a previous process is removed first
+func (c *Config) Listen() (net.Listener, error) {
+	if !c.Unix() {
+		return net.Listen("tcp", c.Address)
+	}
+	if info, err := os.Stat(c.Address); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("listener: %s exists & isn't a unix socket", c.Address)
+		}
+		if err := os.Remove(c.Address); err != nil {
+			return nil, errors.Wrap(err, "listener: failed to remove stale unix socket")
+		}
+	}
+	return net.Listen("unix", c.Address)
+}
@@ -0,0 +1,59 @@
+package listener_test
+
+import (
+	"github.com/graphikDB/gproxy/listener"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	if err := (&listener.Config{Address: ":8080"}).Validate(); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, config := range []*listener.Config{
+		{},
+		{Network: "udp", Address: ":8080"},
+		{Address: ":8080", Protocols: []listener.Protocol{"websocket"}},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Fatalf("expected invalid config: %+v", config)
+		}
+	}
+	config := &listener.Config{Address: ":8080", Protocols: []listener.Protocol{listener.GRPC}}
+	if config.Serves(listener.HTTP) || !config.Serves(listener.GRPC) {
+		t.Fatal("expected grpc only listener")
+	}
+	if !(&listener.Config{Address: ":8080"}).Serves(listener.HTTP) {
+		t.Fatal("expected listeners to serve http by default")
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gproxy-listener")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	config := &listener.Config{Network: "unix", Address: filepath.Join(dir, "gproxy.sock")}
+	l, err := config.Listen()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// a stale socket(ex: left behind by a crashed process) is replaced
+	l.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = config.Listen()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	l.Close()
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("data"), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := (&listener.Config{Network: "unix", Address: file}).Listen(); err == nil {
+		t.Fatal("expected regular files not to be removed")
+	}
+}
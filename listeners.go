@@ -0,0 +1,209 @@
+package gproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/autom8ter/machine"
+	"github.com/graphikDB/gproxy/compress"
+	"github.com/graphikDB/gproxy/listener"
+	"github.com/graphikDB/trigger"
+	"github.com/pkg/errors"
+	"github.com/soheilhy/cmux"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+)
+
+const (
+	// insecureListener is the name of the listener bound to the insecure port(this.listener)
+	insecureListener = "insecure"
+	// secureListener is the name of the listener bound to the secure port(this.listener)
+	secureListener = "secure"
+)
+
+type namedListener struct {
+	name   string
+	config *listener.Config
+}
+
+// namedListeners returns the insecure & secure listeners followed by the listeners registered with WithListener(sorted by name)
+func (p *Proxy) namedListeners() []namedListener {
+	listeners := []namedListener{
+		{name: insecureListener, config: &listener.Config{Address: p.insecurePort}},
+		{name: secureListener, config: &listener.Config{Address: p.securePort, Acme: true}},
+	}
+	var names []string
+	for name := range p.listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		listeners = append(listeners, namedListener{name: name, config: p.listeners[name]})
+	}
+	return listeners
+}
+
+func (p *Proxy) hasListener(name string) bool {
+	if name == insecureListener || name == secureListener {
+		return true
+	}
+	_, ok := p.listeners[name]
+	return ok
+}
+
+// OverrideListenerRoutes replaces the routing expressions scoped to the named listener. Requests received by a listener
+// with scoped routes are only matched against them. A listener stays isolated once it has scoped routes, so empty
+// expressions leave it matching zero routes instead of falling back to the proxies routes(ex: an internal listener never
+// starts serving the public routes because its routes were removed). It is concurrency safe
+func (p *Proxy) OverrideListenerRoutes(name string, expressions []string) error {
+	if !p.hasListener(name) {
+		return errors.Errorf("unknown listener: %s", name)
+	}
+	var triggers []*trigger.Trigger
+	for _, exp := range expressions {
+		t, err := trigger.NewArrowTrigger(exp)
+		if err != nil {
+			return errors.Wrapf(err, "listener %s", name)
+		}
+		triggers = append(triggers, t)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.listenerRoutes[name]; ok || len(triggers) > 0 {
+		p.listenerRoutes[name] = triggers
+	}
+	return nil
+}
+
+// serveListener binds the named listener & starts its http & gRPC servers(as configured by the listeners protocols).
+// It returns the bound listener, the mux that must be served once every listener is bound & the funcs that shut the
+// servers down
+func (p *Proxy) serveListener(name string, config *listener.Config, m *autocert.Manager, tlsConfig *tls.Config) (net.Listener, cmux.CMux, []func(ctx context.Context), error) {
+	var shutdown []func(ctx context.Context)
+	bound, err := config.Listen()
+	if err != nil {
+		return nil, nil, nil, errors.Wrapf(err, "listener %s", name)
+	}
+	l := bound
+	if !config.Unix() {
+		// denied connections are closed before they are counted against the connection limits or the TLS handshake
+		l = p.filterListener(p.proxyProtocolListener(l))
+	}
+	l = p.limitListener(l, name)
+	if name == secureListener {
+		// connections matched by an L4 route(by SNI) are spliced to their target instead of terminating TLS
+		l = p.passthroughListener(l)
+	}
+	secure := config.Secure()
+	switch {
+	case config.TLS != nil:
+		l = tls.NewListener(l, config.TLS)
+	case config.Acme:
+		l = tls.NewListener(l, tlsConfig)
+	}
+	mux := cmux.New(l)
+	// bound the time clients may take to complete the TLS handshake & send enough bytes for the protocol to be detected
+	mux.SetReadTimeout(p.serverConfig.HandshakeTimeout())
+	// matchers are evaluated in the order they are created, so gRPC must be matched before falling back to http
+	var grpcMatcher, httpMatcher net.Listener
+	if config.Serves(listener.GRPC) {
+		grpcMatcher = mux.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
+	}
+	if config.Serves(listener.HTTP) {
+		httpMatcher = mux.Match(cmux.Any())
+	}
+	fields := []zap.Field{zap.String("listener", name), zap.String("address", bound.Addr().String())}
+	if httpMatcher != nil {
+		var handler http.Handler = p.authenticateHTTP(&httputil.ReverseProxy{
+			Director:       p.httpDirector(name, secure),
+			Transport:      p.httpTransport(),
+			ModifyResponse: p.modifyResponse(),
+			ErrorHandler:   p.httpErrorHandler(),
+		})
+		switch name {
+		case insecureListener:
+			if p.redirectHttps {
+				handler = nil
+			}
+			handler = m.HTTPHandler(handler)
+		case secureListener:
+			handler = m.HTTPHandler(p.altSvc(handler))
+		}
+		httpServer := &http.Server{
+			Handler:        handler,
+			MaxHeaderBytes: p.maxHeaderBytes(),
+		}
+		p.serverConfig.HTTP(httpServer)
+		httpInit := p.httpInit
+		if secure {
+			httpInit = p.httpsInit
+		}
+		for _, o := range httpInit {
+			o(httpServer)
+		}
+		if name == secureListener && p.http3 {
+			// HTTP/3 requests are served by the same handler(including middlewares) as the TLS http server. It's bound
+			// before any of the listeners servers are started so a failure only leaves the listener to be closed
+			shutdownHTTP3, err := p.serveHTTP3(httpServer, tlsConfig)
+			if err != nil {
+				bound.Close()
+				return nil, nil, nil, err
+			}
+			shutdown = append(shutdown, shutdownHTTP3)
+		}
+		p.mach.Go(func(routine machine.Routine) {
+			p.logger.Debug("starting http server", fields...)
+			if err := httpServer.Serve(httpMatcher); err != nil && err != http.ErrServerClosed &&
+				!strings.Contains(err.Error(), "mux: listener closed") {
+				p.logger.Error("http proxy failure", append(fields, zap.Error(err))...)
+			}
+		})
+		shutdown = append(shutdown, func(ctx context.Context) {
+			_ = httpServer.Shutdown(ctx)
+		})
+	}
+	if grpcMatcher != nil {
+		maxRecvMsgSize := p.maxRecvMsgSize()
+		// compressed messages stop being decompressed once they exceed the same limit
+		compress.SetGRPCMaxMessageSize(maxRecvMsgSize)
+		gopts := []grpc.ServerOption{
+			grpc.UnknownServiceHandler(p.gRPCHandler(name, secure)),
+			grpc.MaxRecvMsgSize(maxRecvMsgSize),
+		}
+		gopts = append(gopts, p.serverConfig.GRPCOptions()...)
+		grpcOpts, grpcInit := p.grpcOpts, p.grpcInit
+		if secure {
+			grpcOpts, grpcInit = p.grpcsOpts, p.grpcsInit
+		}
+		gopts = append(gopts, grpcOpts...)
+		gserver := grpc.NewServer(gopts...)
+		for _, o := range grpcInit {
+			o(gserver)
+		}
+		p.mach.Go(func(routine machine.Routine) {
+			p.logger.Debug("starting gRPC server", fields...)
+			if err := gserver.Serve(grpcMatcher); err != nil && !strings.Contains(err.Error(), "mux: listener closed") {
+				p.logger.Error("gRPC proxy failure", append(fields, zap.Error(err))...)
+			}
+		})
+		shutdown = append(shutdown, func(ctx context.Context) {
+			stopped := make(chan struct{}, 1)
+			go func() {
+				gserver.GracefulStop()
+				stopped <- struct{}{}
+			}()
+			select {
+			case <-ctx.Done():
+				gserver.Stop()
+			case <-stopped:
+				return
+			}
+		})
+	}
+	return bound, mux, shutdown, nil
+}
@@ -0,0 +1,172 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+const namespace = "gproxy"
+
+var (
+	// Registry is the prometheus registry all gproxy metrics are registered with
+	Registry = prometheus.NewRegistry()
+
+	// BreakerState is the current state of each route targets circuit breaker(0 = closed, 1 = half-open, 2 = open)
+	BreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "circuit_breaker",
+		Name:      "state",
+		Help:      "circuit breaker state by route & target (0 = closed, 1 = half-open, 2 = open)",
+	}, []string{"route", "target"})
+
+	// BreakerTransitions counts circuit breaker state changes
+	BreakerTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "circuit_breaker",
+		Name:      "transitions_total",
+		Help:      "circuit breaker state transitions by route & target",
+	}, []string{"route", "target", "from", "to"})
+
+	// BreakerRejections counts requests short-circuited by an open breaker
+	BreakerRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "circuit_breaker",
+		Name:      "rejections_total",
+		Help:      "requests short-circuited because every target's circuit breaker was open, by route",
+	}, []string{"route"})
+
+	// RateLimited counts requests denied by rate limiters
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "rate_limit",
+		Name:      "denied_total",
+		Help:      "requests denied by a rate limit, by route & rule",
+	}, []string{"route", "rule"})
+
+	// AuthzDenied counts requests denied by authorization policies. Dry-run denials are counted with mode="dry_run"
+	AuthzDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "authz",
+		Name:      "denied_total",
+		Help:      "requests denied by an authorization policy, by route, policy & mode(enforced, dry_run)",
+	}, []string{"route", "policy", "mode"})
+
+	// IPDenied counts connections(scope="listener") & requests(scope="route") denied by ip filters
+	IPDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ip_filter",
+		Name:      "denied_total",
+		Help:      "connections & requests denied by an ip filter, by scope(listener, route) & route",
+	}, []string{"scope", "route"})
+
+	// MirrorRequests counts mirrored requests by whether the shadow status matched the primary status(match, mismatch),
+	// the shadow request failed(error) or the request was too large to mirror(skipped)
+	MirrorRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mirror",
+		Name:      "requests_total",
+		Help:      "mirrored requests by route & result(match, mismatch, error, skipped)",
+	}, []string{"route", "result"})
+
+	// MirrorLatencyDelta observes the difference between shadow & primary latency(shadow - primary) in seconds
+	MirrorLatencyDelta = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "mirror",
+		Name:      "latency_delta_seconds",
+		Help:      "shadow latency minus primary latency by route",
+		Buckets:   []float64{-5, -1, -0.5, -0.1, -0.05, -0.01, 0, 0.01, 0.05, 0.1, 0.5, 1, 5},
+	}, []string{"route"})
+
+	// CanaryRequests counts canary decisions by route, variant(stable, canary) & reason(header, cookie, percent)
+	CanaryRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "canary",
+		Name:      "requests_total",
+		Help:      "canary decisions by route, variant & reason",
+	}, []string{"route", "variant", "reason"})
+
+	// CacheRequests counts requests to routes with a response cache by route & cache status(hit, stale, revalidated, miss, bypass)
+	CacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "requests_total",
+		Help:      "response cache requests by route & status(hit, stale, revalidated, miss, bypass)",
+	}, []string{"route", "status"})
+
+	// RejectedTooLarge counts requests rejected for exceeding a size limit by route & limit(header, body, message, stream)
+	RejectedTooLarge = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "sizelimit",
+		Name:      "rejected_total",
+		Help:      "requests rejected for exceeding a size limit by route & limit(header, body, message, stream)",
+	}, []string{"route", "limit"})
+
+	// ConnectionsRejected counts connections closed for exceeding a connection limit by listener(insecure, secure) & reason(listener, client_ip)
+	ConnectionsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "server",
+		Name:      "connections_rejected_total",
+		Help:      "connections closed for exceeding a connection limit by listener(insecure, secure) & reason(listener, client_ip)",
+	}, []string{"listener", "reason"})
+
+	// L4Connections counts L4(TCP & TLS passthrough) connections by route & result(proxied, no_route, denied, unavailable)
+	L4Connections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "l4",
+		Name:      "connections_total",
+		Help:      "L4(TCP & TLS passthrough) connections by route & result(proxied, no_route, denied, unavailable)",
+	}, []string{"route", "result"})
+
+	// L4Bytes counts bytes spliced by L4 routes by route & direction(in = client to target, out = target to client)
+	L4Bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "l4",
+		Name:      "bytes_total",
+		Help:      "bytes spliced by L4 routes by route & direction(in = client to target, out = target to client)",
+	}, []string{"route", "direction"})
+
+	// UDPSessions counts UDP sessions by route & result(created, no_route, denied, unavailable, limit)
+	UDPSessions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "l4",
+		Name:      "udp_sessions_total",
+		Help:      "UDP sessions by route & result(created, no_route, denied, unavailable, limit)",
+	}, []string{"route", "result"})
+
+	// UDPActiveSessions is the number of UDP sessions that haven't expired by route
+	UDPActiveSessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "l4",
+		Name:      "udp_active_sessions",
+		Help:      "UDP sessions that haven't expired by route",
+	}, []string{"route"})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		BreakerState,
+		BreakerTransitions,
+		BreakerRejections,
+		RateLimited,
+		AuthzDenied,
+		IPDenied,
+		MirrorRequests,
+		MirrorLatencyDelta,
+		CanaryRequests,
+		CacheRequests,
+		RejectedTooLarge,
+		ConnectionsRejected,
+		L4Connections,
+		L4Bytes,
+		UDPSessions,
+		UDPActiveSessions,
+	)
+}
+
+// Handler returns an http handler that serves all gproxy metrics in the prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,162 @@
+package gproxy
+
+import (
+	"bytes"
+	"context"
+	"github.com/autom8ter/machine"
+	"github.com/graphikDB/gproxy/codec"
+	"github.com/graphikDB/gproxy/metrics"
+	"github.com/graphikDB/gproxy/mirror"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// mirrorPolicy returns the mirror policy registered for the route, falling back to the default("*") policy
+func (p *Proxy) mirrorPolicy(routeName string) *mirror.Policy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if policy, ok := p.mirrors[routeName]; ok {
+		return policy
+	}
+	return p.mirrors["*"]
+}
+
+// shadowHTTP is a copy of a sampled http request that is sent to the routes shadow target once the primary request completes
+type shadowHTTP struct {
+	policy *mirror.Policy
+	req    *http.Request
+	body   []byte
+}
+
+// prepareHTTPMirror samples the request & copies it(buffering its body) if it should be mirrored
+func (p *Proxy) prepareHTTPMirror(req *http.Request, call *httpCall) *shadowHTTP {
+	policy := p.mirrorPolicy(call.route.name)
+	if !policy.Sample() {
+		return nil
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		limit := policy.BodyLimit()
+		buffered, err := ioutil.ReadAll(io.LimitReader(req.Body, int64(limit)+1))
+		if err != nil || len(buffered) > limit {
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{
+				Reader: io.MultiReader(bytes.NewReader(buffered), req.Body),
+				Closer: req.Body,
+			}
+			metrics.MirrorRequests.WithLabelValues(call.route.name, "skipped").Inc()
+			return nil
+		}
+		req.Body.Close()
+		body = buffered
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	shadow := req.Clone(context.Background())
+	if err := setHTTPTarget(shadow, policy.Target, call.inbound); err != nil {
+		p.logger.Error("invalid mirror target", zap.String("route", call.route.name), zap.Error(err))
+		return nil
+	}
+	shadow.RequestURI = ""
+	return &shadowHTTP{policy: policy, req: shadow, body: body}
+}
+
+// mirrorHTTP sends the shadow request in the background, discarding its response & recording how it differs from the primary response
+func (p *Proxy) mirrorHTTP(routeName string, shadow *shadowHTTP, primary *http.Response, primaryErr error, primaryLatency time.Duration) {
+	primaryStatus := 0
+	if primaryErr == nil && primary != nil {
+		primaryStatus = primary.StatusCode
+	}
+	transport := p.upstreamTransport(routeName, http.DefaultTransport)
+	p.mach.Go(func(routine machine.Routine) {
+		ctx, cancel := context.WithTimeout(context.Background(), shadow.policy.TimeoutOrDefault())
+		defer cancel()
+		req := shadow.req.WithContext(ctx)
+		if shadow.body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(shadow.body))
+		}
+		start := time.Now()
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			p.recordMirror(routeName, "", "", err, 0, 0)
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		p.recordMirror(routeName, strconv.Itoa(primaryStatus), strconv.Itoa(resp.StatusCode), nil, primaryLatency, time.Since(start))
+	})
+}
+
+// mirrorGRPC sends a unary calls request message to the routes shadow target in the background
+func (p *Proxy) mirrorGRPC(ctx context.Context, call *grpcCall, policy *mirror.Policy, msg *codec.Frame, primaryErr error, primaryLatency time.Duration) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	p.mach.Go(func(routine machine.Routine) {
+		ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(context.Background(), md), policy.TimeoutOrDefault())
+		defer cancel()
+		start := time.Now()
+		err := p.shadowGRPC(ctx, policy.Target, call.method, msg)
+		if code := status.Code(err); code == codes.Unavailable || code == codes.DeadlineExceeded {
+			p.recordMirror(call.route.name, "", "", err, 0, 0)
+			return
+		}
+		p.recordMirror(call.route.name, status.Code(primaryErr).String(), status.Code(err).String(), nil, primaryLatency, time.Since(start))
+	})
+}
+
+// shadowGRPC sends the message to the target & drains the response
+func (p *Proxy) shadowGRPC(ctx context.Context, target, method string, msg *codec.Frame) error {
+	conn, err := p.dial(ctx, target)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	stream, err := grpc.NewClientStream(ctx, clientStreamDesc, conn, method)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(msg); err != nil && err != io.EOF {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		if err := stream.RecvMsg(&codec.Frame{}); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (p *Proxy) recordMirror(routeName, primaryStatus, shadowStatus string, err error, primaryLatency, shadowLatency time.Duration) {
+	if err != nil {
+		metrics.MirrorRequests.WithLabelValues(routeName, "error").Inc()
+		p.logger.Debug("mirror request failed", zap.String("route", routeName), zap.Error(err))
+		return
+	}
+	result := "match"
+	if primaryStatus != shadowStatus {
+		result = "mismatch"
+		p.logger.Debug("mirror status mismatch",
+			zap.String("route", routeName),
+			zap.String("primary", primaryStatus),
+			zap.String("shadow", shadowStatus),
+		)
+	}
+	metrics.MirrorRequests.WithLabelValues(routeName, result).Inc()
+	metrics.MirrorLatencyDelta.WithLabelValues(routeName).Observe((shadowLatency - primaryLatency).Seconds())
+}
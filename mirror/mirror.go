@@ -0,0 +1,56 @@
+// Package mirror configures shadowing of production traffic to a secondary target
+package mirror
+
+import (
+	"github.com/pkg/errors"
+	"math/rand"
+	"time"
+)
+
+// Policy copies a percentage of a routes http requests & unary gRPC calls to a shadow target.
+// Shadow responses are discarded - only their status & latency are compared with the primary response
+type Policy struct {
+	// Target is the shadow target. http routes require a url(ex: http://api-canary:8080) & gRPC routes a gRPC target(ex: api-canary:8080)
+	Target string
+	// Percent is the percentage(0-100) of requests that are mirrored
+	Percent float64
+	// MaxBodyBytes is the maximum request body/message size that is mirrored(default: 1MB). Larger requests are not mirrored
+	MaxBodyBytes int
+	// Timeout bounds each shadow request(default: 10s)
+	Timeout time.Duration
+}
+
+// Validate returns an error if the policy is invalid
+func (p *Policy) Validate() error {
+	if p.Target == "" {
+		return errors.New("mirror: empty target")
+	}
+	if p.Percent < 0 || p.Percent > 100 {
+		return errors.Errorf("mirror: percent must be between 0 & 100: %v", p.Percent)
+	}
+	return nil
+}
+
+// Sample reports whether a request should be mirrored
+func (p *Policy) Sample() bool {
+	if p == nil || p.Percent <= 0 {
+		return false
+	}
+	return p.Percent >= 100 || rand.Float64()*100 < p.Percent
+}
+
+// BodyLimit returns the maximum request size that is mirrored
+func (p *Policy) BodyLimit() int {
+	if p.MaxBodyBytes <= 0 {
+		return 1 << 20
+	}
+	return p.MaxBodyBytes
+}
+
+// TimeoutOrDefault returns the shadow request timeout
+func (p *Policy) TimeoutOrDefault() time.Duration {
+	if p.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return p.Timeout
+}
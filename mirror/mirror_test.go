@@ -0,0 +1,34 @@
+package mirror_test
+
+import (
+	"github.com/graphikDB/gproxy/mirror"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	var sampled int
+	policy := &mirror.Policy{Target: "http://localhost:8080", Percent: 25}
+	if err := policy.Validate(); err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 10000; i++ {
+		if policy.Sample() {
+			sampled++
+		}
+	}
+	if sampled < 2000 || sampled > 3000 {
+		t.Fatalf("expected ~25%% of requests to be sampled: %v", sampled)
+	}
+	if (&mirror.Policy{Target: "x", Percent: 0}).Sample() {
+		t.Fatal("expected 0% not to sample")
+	}
+	if !(&mirror.Policy{Target: "x", Percent: 100}).Sample() {
+		t.Fatal("expected 100% to sample")
+	}
+	if err := (&mirror.Policy{Target: "x", Percent: 101}).Validate(); err == nil {
+		t.Fatal("expected invalid percent to be rejected")
+	}
+	if err := (&mirror.Policy{Percent: 10}).Validate(); err == nil {
+		t.Fatal("expected empty target to be rejected")
+	}
+}
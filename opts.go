@@ -3,8 +3,29 @@ package gproxy
 import (
 	"context"
 	"fmt"
+	"github.com/graphikDB/gproxy/affinity"
+	"github.com/graphikDB/gproxy/auth"
+	"github.com/graphikDB/gproxy/authz"
+	"github.com/graphikDB/gproxy/breaker"
+	"github.com/graphikDB/gproxy/cache"
+	"github.com/graphikDB/gproxy/canary"
+	"github.com/graphikDB/gproxy/compress"
+	"github.com/graphikDB/gproxy/discovery"
+	"github.com/graphikDB/gproxy/headers"
+	"github.com/graphikDB/gproxy/ipfilter"
+	"github.com/graphikDB/gproxy/l4"
+	"github.com/graphikDB/gproxy/listener"
 	"github.com/graphikDB/gproxy/logger"
+	"github.com/graphikDB/gproxy/mirror"
+	"github.com/graphikDB/gproxy/ratelimit"
+	"github.com/graphikDB/gproxy/retry"
+	"github.com/graphikDB/gproxy/rewrite"
+	"github.com/graphikDB/gproxy/server"
+	"github.com/graphikDB/gproxy/sizelimit"
+	"github.com/graphikDB/gproxy/upstream"
 	"github.com/graphikDB/trigger"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
 	"google.golang.org/grpc"
 	"net/http"
 )
@@ -18,19 +39,27 @@ type Opt func(p *Proxy) error
 // expression attributes: (this.host<string>)
 func WithAcmePolicy(decision string) Opt {
 	return func(p *Proxy) error {
-		decision, err := trigger.NewDecision(decision)
+		policy, err := newHostPolicy(decision)
 		if err != nil {
 			return err
 		}
-		p.hostPolicy = func(ctx context.Context, host string) error {
-			return decision.Eval(map[string]interface{}{
-				"host": host,
-			})
-		}
+		p.hostPolicy = policy
 		return nil
 	}
 }
 
+func newHostPolicy(decision string) (autocert.HostPolicy, error) {
+	d, err := trigger.NewDecision(decision)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, host string) error {
+		return d.Eval(map[string]interface{}{
+			"host": host,
+		})
+	}, nil
+}
+
 // WithLogger sets the proxies logger instance(optional)
 func WithLogger(logger *logger.Logger) Opt {
 	return func(p *Proxy) error {
@@ -64,7 +93,9 @@ func WithCertCacheDir(certCache string) Opt {
 }
 
 // WithRoute adds a trigger/expression based route to the reverse proxy
-// expression attributes: (this.http<bool>, this.grpc<bool>, this.host<string>, this.headers<map>, this.path<string>)
+// gRPC targets may specify their transport & resolver: host:port, grpc://host:port, grpcs://host:port(TLS),
+// unix:///path/to/socket, dns:///host:port, grpcs+dns:///host:port or any registered gRPC resolver scheme
+// expression attributes: (this.http<bool>, this.grpc<bool>, this.host<string>, this.headers<map>, this.path<string>, this.method<string>, this.client_ip<string>, this.claims<map>, this.listener<string>)
 func WithRoute(triggerExpression string) Opt {
 	return func(p *Proxy) error {
 		trig, err := trigger.NewArrowTrigger(triggerExpression)
@@ -76,6 +107,310 @@ func WithRoute(triggerExpression string) Opt {
 	}
 }
 
+// WithRetryPolicy sets the retry policy for the named route. Routes are named by returning a map from the routing trigger
+// ex: this.grpc => {'name': 'api', 'targets': ['api-0:8080', 'api-1:8080']}
+// the policy registered under the name "*" applies to all routes without a policy of their own
+func WithRetryPolicy(routeName string, policy *retry.Policy) Opt {
+	return func(p *Proxy) error {
+		p.retryPolicies[routeName] = policy
+		return nil
+	}
+}
+
+// WithCircuitBreaker sets the circuit breaker config for the targets of the named route.
+// Requests are short-circuited with UNAVAILABLE(gRPC) or 503(http) once every target's breaker is open.
+// the config registered under the name "*" applies to all routes without a config of their own
+func WithCircuitBreaker(routeName string, config *breaker.Config) Opt {
+	return func(p *Proxy) error {
+		p.breakerConfigs[routeName] = config
+		return nil
+	}
+}
+
+// WithHeaderRules sets the header(http) & metadata(gRPC) rules applied to the named routes requests & responses.
+// the rules registered under the name "*" apply to all routes without rules of their own
+func WithHeaderRules(routeName string, rules *headers.Rules) Opt {
+	return func(p *Proxy) error {
+		p.headerRuleSets[routeName] = rules
+		return nil
+	}
+}
+
+// WithPathRewrite sets the rules that rewrite the named routes http request paths(before they are joined with the target url)
+// & gRPC full method names(ex: renaming a package during a migration).
+// the rules registered under the name "*" apply to all routes without rules of their own
+func WithPathRewrite(routeName string, rules *rewrite.Rules) Opt {
+	return func(p *Proxy) error {
+		p.pathRewrites[routeName] = rules
+		return nil
+	}
+}
+
+// WithRateLimit sets the rate limiter applied to requests matching the named route.
+// The "*" route name sets the default limiter for routes without a limiter of their own.
+// Denied requests receive a 429(http) or RESOURCE_EXHAUSTED(gRPC) with a Retry-After header/retry-after trailer
+func WithRateLimit(routeName string, limiter *ratelimit.Limiter) Opt {
+	return func(p *Proxy) error {
+		p.rateLimiters[routeName] = limiter
+		return nil
+	}
+}
+
+// WithAuthentication verifies bearer tokens in the Authorization header(http) or authorization metadata(gRPC) before requests are routed.
+// Requests with an invalid token are rejected with a 401(http) or UNAUTHENTICATED(gRPC).
+// Verified claims are exposed to routing & header expressions as this.claims(empty if the request has no token)
+func WithAuthentication(verifier *auth.Verifier) Opt {
+	return func(p *Proxy) error {
+		p.verifier = verifier
+		return nil
+	}
+}
+
+// WithAuthRequired rejects requests to the named routes that don't contain a verified bearer token.
+// The "*" route name requires authentication for all routes without a setting of their own
+func WithAuthRequired(routeName string, required bool) Opt {
+	return func(p *Proxy) error {
+		p.requireAuth[routeName] = required
+		return nil
+	}
+}
+
+// WithForwardClaims forwards verified claims upstream as headers/metadata(claim name -> header name).
+// Client supplied values for the headers are always removed
+func WithForwardClaims(claims map[string]string) Opt {
+	return func(p *Proxy) error {
+		for claim, header := range claims {
+			p.claimHeaders[claim] = header
+		}
+		return nil
+	}
+}
+
+// WithAuthzPolicy registers a named authorization policy. Policies are attached to routes with WithRouteAuthz
+func WithAuthzPolicy(policy *authz.Policy) Opt {
+	return func(p *Proxy) error {
+		p.policies[policy.Name()] = policy
+		return nil
+	}
+}
+
+// WithRouteAuthz attaches the named authorization policies to the named route. Requests are denied with a 403(http) or
+// PERMISSION_DENIED(gRPC) before they are proxied unless every policy allows them.
+// The policies attached to the "*" route name apply to all routes without policies of their own
+func WithRouteAuthz(routeName string, policyNames ...string) Opt {
+	return func(p *Proxy) error {
+		p.routeAuthz[routeName] = policyNames
+		return nil
+	}
+}
+
+// WithListenerIPFilter sets the ip filter applied to every connection accepted by the proxies listeners.
+// Denied connections are closed before the TLS handshake. When PROXY protocol is enabled, the filter is applied to the headers source address
+func WithListenerIPFilter(filter *ipfilter.Filter) Opt {
+	return func(p *Proxy) error {
+		p.listenerFilter = filter
+		return nil
+	}
+}
+
+// WithIPFilter sets the ip filter applied to the client ip(this.client_ip) of requests matching the named route.
+// Denied requests receive a 403(http) or PERMISSION_DENIED(gRPC).
+// The filter registered under the name "*" applies to all routes without a filter of their own
+func WithIPFilter(routeName string, filter *ipfilter.Filter) Opt {
+	return func(p *Proxy) error {
+		p.ipFilters[routeName] = filter
+		return nil
+	}
+}
+
+// WithTrustedProxies sets the CIDRs/addresses of trusted proxies(ex: cloud load balancers). When a request is received
+// from a trusted proxy, its client ip is the right-most untrusted address in the X-Forwarded-For header(http) or x-forwarded-for metadata(gRPC)
+// & its forwarding headers are appended to(see WithForwardedHeaders)
+func WithTrustedProxies(cidrs ...string) Opt {
+	return func(p *Proxy) error {
+		trusted, err := ipfilter.ParseCIDRs(cidrs)
+		if err != nil {
+			return err
+		}
+		p.trustedProxies = append(p.trustedProxies, trusted...)
+		return nil
+	}
+}
+
+// WithProxyProtocol enables PROXY protocol(v1 & v2) on the insecure & secure listeners for connections from the trusted
+// CIDRs/addresses(ex: the subnets of an AWS NLB). The headers source address is used as the client address in ip filters,
+// logs, routing(this.client_ip) & forwarded headers. Connections from other sources are served without parsing a header
+func WithProxyProtocol(trusted ...string) Opt {
+	return func(p *Proxy) error {
+		nets, err := ipfilter.ParseCIDRs(trusted)
+		if err != nil {
+			return err
+		}
+		if len(nets) == 0 {
+			return errors.New("proxy protocol: at least one trusted source is required")
+		}
+		p.proxyProtocol = append(p.proxyProtocol, nets...)
+		return nil
+	}
+}
+
+// WithForwardedHeaders sets how X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host & Forwarded headers(http) and
+// x-forwarded-* metadata(gRPC) are sent upstream(default: ForwardedAppend). Headers are only appended to when the request was
+// received from a trusted proxy(WithTrustedProxies). If rfc7239 is true, an RFC 7239 Forwarded header is also added
+func WithForwardedHeaders(mode ForwardedMode, rfc7239 bool) Opt {
+	return func(p *Proxy) error {
+		switch mode {
+		case ForwardedAppend, ForwardedOverwrite:
+		default:
+			return errors.Errorf("unsupported forwarded mode: %s", mode)
+		}
+		p.forwardedMode = mode
+		p.rfc7239 = rfc7239
+		return nil
+	}
+}
+
+// WithUpstreamTransport sets the transport settings(connection pooling, timeouts, keep-alives, compression & protocol) used to
+// send http requests to the named routes targets. HTTP/2 may be spoken to targets over TLS(upstream.HTTP2) or cleartext(upstream.H2C).
+// The config registered under the name "*" applies to all routes without a config of their own(default: http.DefaultTransport)
+func WithUpstreamTransport(routeName string, config *upstream.Config) Opt {
+	return func(p *Proxy) error {
+		rt, err := upstream.New(config)
+		if err != nil {
+			return errors.Wrapf(err, "route %s", routeName)
+		}
+		p.transports[routeName] = rt
+		return nil
+	}
+}
+
+// WithMirror asynchronously copies a percentage of the named routes http requests(including bodies) & unary gRPC calls to
+// the policies shadow target. Shadow responses are discarded & never affect the primary response - status & latency
+// differences are recorded in the gproxy_mirror_* metrics.
+// The policy registered under the name "*" applies to all routes without a policy of their own
+func WithMirror(routeName string, policy *mirror.Policy) Opt {
+	return func(p *Proxy) error {
+		if err := policy.Validate(); err != nil {
+			return errors.Wrapf(err, "route %s", routeName)
+		}
+		p.mirrors[routeName] = policy
+		return nil
+	}
+}
+
+// WithCanary sends a percentage of the named routes clients(and clients pinned by header or cookie) to the policies canary
+// targets instead of the routes targets. Decisions are sticky per client, exposed to header rules as this.variant & recorded
+// in access logs & the gproxy_canary_requests_total metric. The percentage may be ramped with SetCanaryPercent or the
+// admin servers /canary endpoint
+func WithCanary(routeName string, policy *canary.Policy) Opt {
+	return func(p *Proxy) error {
+		if err := policy.Validate(); err != nil {
+			return errors.Wrapf(err, "route %s", routeName)
+		}
+		p.canaries[routeName] = policy
+		return nil
+	}
+}
+
+// WithAffinity pins clients of the named routes to one of the routes targets with a proxy-issued affinity cookie(http)
+// or consistent hashing of a header, gRPC metadata key, cookie or the client ip. Clients are only moved to another target
+// when their target is removed or its circuit breaker is open.
+// The policy registered under the name "*" applies to all routes without a policy of their own
+func WithAffinity(routeName string, policy *affinity.Policy) Opt {
+	return func(p *Proxy) error {
+		if err := policy.Validate(); err != nil {
+			return errors.Wrapf(err, "route %s", routeName)
+		}
+		p.affinities[routeName] = policy
+		return nil
+	}
+}
+
+// WithCache caches the named routes GET/HEAD responses according to their Cache-Control, Expires & Vary headers.
+// Cached responses are still subject to the routes authentication, authorization, ip filter & rate limit. Stale responses
+// are revalidated with ETag/Last-Modified validators(in the background within stale-while-revalidate) & responses report
+// how they were served in a Cache-Status header. Entries may be purged with PurgeCache or the admin servers /cache/purge endpoint.
+// The cache registered under the name "*" applies to all routes without a cache of their own
+func WithCache(routeName string, c *cache.Cache) Opt {
+	return func(p *Proxy) error {
+		p.caches[routeName] = c
+		return nil
+	}
+}
+
+// WithCompression compresses the named routes http responses with the best encoding(br, zstd, gzip) accepted by the client
+// if their content type is allowed & they are at least the policies minimum size. Messages sent to the routes gRPC targets
+// are compressed with the policies gRPC encoding(the compressor is registered with WithGRPCCompressors).
+// The policy registered under the name "*" applies to all routes without a policy of their own
+func WithCompression(routeName string, policy *compress.Policy) Opt {
+	return func(p *Proxy) error {
+		if err := policy.Validate(); err != nil {
+			return errors.Wrapf(err, "route %s", routeName)
+		}
+		if policy.GRPCEncoding != "" {
+			if err := compress.RegisterGRPC(policy.GRPCEncoding); err != nil {
+				return err
+			}
+		}
+		p.compressions[routeName] = policy
+		return nil
+	}
+}
+
+// WithGRPCCompressors registers gRPC compressors(gzip, zstd) so clients may send compressed messages. Responses are
+// compressed with the compressor used by the client while calls to gRPC targets are (re)compressed according to the
+// routes compression policy
+func WithGRPCCompressors(names ...string) Opt {
+	return func(p *Proxy) error {
+		for _, name := range names {
+			if err := compress.RegisterGRPC(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// WithService registers a named service whose endpoints are kept up to date by the discovery provider.
+// Routes reference services by name & are routed to the services current endpoints
+// ex: this.http => {'name': 'api', 'service': 'users', 'scheme': 'http'}
+func WithService(name string, provider discovery.Provider) Opt {
+	return func(p *Proxy) error {
+		p.services[name] = &service{
+			provider: provider,
+		}
+		return nil
+	}
+}
+
+// WithAdminPort sets the port the admin server(prometheus metrics at /metrics, canary ramping at /canary, cache purging at /cache/purge) will be served on(optional).
+// The admin server only listens on the loopback interface - use WithAdminAddress to serve it on other interfaces
+func WithAdminPort(adminPort int) Opt {
+	return func(p *Proxy) error {
+		p.adminAddr = fmt.Sprintf("127.0.0.1:%v", adminPort)
+		return nil
+	}
+}
+
+// WithAdminAddress sets the address the admin server will be served on(ex: :9090 to let prometheus scrape metrics from
+// other hosts)
+func WithAdminAddress(address string) Opt {
+	return func(p *Proxy) error {
+		p.adminAddr = address
+		return nil
+	}
+}
+
+// WithAdminToken sets the bearer token(Authorization: Bearer <token>) required by admin requests that change the
+// proxies state(canary ramping & cache purging). Those requests are rejected if no token is set. /metrics & canary
+// statuses are readable without it
+func WithAdminToken(token string) Opt {
+	return func(p *Proxy) error {
+		p.adminToken = token
+		return nil
+	}
+}
+
 // WithAutoRedirectHttps makes the proxy redirect http requests to https(443)
 func WithAutoRedirectHttps(redirect bool) Opt {
 	return func(p *Proxy) error {
@@ -124,3 +459,98 @@ func WithMiddlewares(middlewares ...func(handler http.Handler) http.Handler) fun
 		}
 	}
 }
+
+// WithSizeLimits bounds the size of the routes request headers, bodies & gRPC messages. Http requests that exceed a
+// limit are rejected with 413(431 for headers) & gRPC calls with RESOURCE_EXHAUSTED.
+// The limits registered under the name "*" apply to all routes without limits of their own
+func WithSizeLimits(routeName string, limits *sizelimit.Limits) Opt {
+	return func(p *Proxy) error {
+		if err := limits.Validate(); err != nil {
+			return errors.Wrapf(err, "route %s", routeName)
+		}
+		p.sizeLimits[routeName] = limits
+		return nil
+	}
+}
+
+// WithServerConfig configures the timeouts, gRPC keepalive enforcement & connection limits of the proxies servers &
+// listeners. Servers use the configs defaults(ex: a 10s header timeout) if it isn't set. Changes made by WithHttpInit &
+// WithHttpsInit take precedence
+func WithServerConfig(config *server.Config) Opt {
+	return func(p *Proxy) error {
+		if err := config.Validate(); err != nil {
+			return err
+		}
+		p.serverConfig = config
+		return nil
+	}
+}
+
+// WithHTTP3 serves HTTP/3(QUIC) on the UDP port of the secure listener with the proxies acme certificates & advertises
+// it to TLS clients with an Alt-Svc header. HTTP/3 requests are routed & proxied exactly like https requests
+func WithHTTP3(enabled bool) Opt {
+	return func(p *Proxy) error {
+		p.http3 = enabled
+		return nil
+	}
+}
+
+// WithL4Route adds an L4(TCP, TLS passthrough & UDP) routing expression. L4 routes are evaluated against connections to
+// the L4 ports, the first datagram of UDP sessions & (if passthrough is enabled) the SNI of connections to the secure
+// port, before TLS is terminated.
+// expression attributes: (this.tcp<bool>, this.udp<bool>, this.sni<string>, this.port<int>, this.client_ip<string>)
+// ex: this.sni == 'db.graphikdb.io' => {'name': 'db', 'targets': ['db-0:5432', 'db-1:5432']}
+func WithL4Route(triggerExpression string) Opt {
+	return func(p *Proxy) error {
+		trig, err := trigger.NewArrowTrigger(triggerExpression)
+		if err != nil {
+			return err
+		}
+		p.l4Triggers = append(p.l4Triggers, trig)
+		return nil
+	}
+}
+
+// WithL4 enables L4 proxying. Connections matched by an L4 route are spliced to the routes targets without being
+// terminated. Route ip filters & circuit breakers apply to L4 routes
+func WithL4(config *l4.Config) Opt {
+	return func(p *Proxy) error {
+		if err := config.Validate(); err != nil {
+			return err
+		}
+		p.l4Config = config
+		return nil
+	}
+}
+
+// WithListener adds a named listener(ex: an internal-only admin port or a unix socket) that serves requests alongside the
+// insecure & secure ports. Requests are matched against the proxies routes(this.listener is the listeners name) unless
+// routes are scoped to the listener with WithListenerRoutes. The names "insecure" & "secure" are reserved
+func WithListener(name string, config *listener.Config) Opt {
+	return func(p *Proxy) error {
+		if name == "" || name == insecureListener || name == secureListener {
+			return errors.Errorf("invalid listener name: %q", name)
+		}
+		if err := config.Validate(); err != nil {
+			return errors.Wrapf(err, "listener %s", name)
+		}
+		p.listeners[name] = config
+		return nil
+	}
+}
+
+// WithListenerRoutes adds routing expressions scoped to the named listener("insecure", "secure" or a listener added with
+// WithListener). Requests received by the listener are only matched against its scoped routes
+// ex: this.http && this.path.startsWith('/admin') => {'name': 'admin', 'targets': ['localhost:9090']}
+func WithListenerRoutes(name string, triggerExpressions ...string) Opt {
+	return func(p *Proxy) error {
+		for _, exp := range triggerExpressions {
+			trig, err := trigger.NewArrowTrigger(exp)
+			if err != nil {
+				return errors.Wrapf(err, "listener %s", name)
+			}
+			p.listenerRoutes[name] = append(p.listenerRoutes[name], trig)
+		}
+		return nil
+	}
+}
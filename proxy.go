@@ -5,10 +5,26 @@ import (
 	"crypto/tls"
 	"fmt"
 	"github.com/autom8ter/machine"
+	"github.com/graphikDB/gproxy/affinity"
+	"github.com/graphikDB/gproxy/auth"
+	"github.com/graphikDB/gproxy/authz"
+	"github.com/graphikDB/gproxy/breaker"
+	"github.com/graphikDB/gproxy/cache"
+	"github.com/graphikDB/gproxy/canary"
 	"github.com/graphikDB/gproxy/codec"
+	"github.com/graphikDB/gproxy/compress"
+	"github.com/graphikDB/gproxy/headers"
+	"github.com/graphikDB/gproxy/ipfilter"
+	"github.com/graphikDB/gproxy/l4"
+	"github.com/graphikDB/gproxy/listener"
 	"github.com/graphikDB/gproxy/logger"
+	"github.com/graphikDB/gproxy/mirror"
+	"github.com/graphikDB/gproxy/ratelimit"
+	"github.com/graphikDB/gproxy/retry"
+	"github.com/graphikDB/gproxy/rewrite"
+	"github.com/graphikDB/gproxy/server"
+	"github.com/graphikDB/gproxy/sizelimit"
 	"github.com/graphikDB/trigger"
-	"github.com/mwitkow/grpc-proxy/proxy"
 	"github.com/pkg/errors"
 	"github.com/soheilhy/cmux"
 	"go.uber.org/zap"
@@ -17,10 +33,10 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/encoding"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
@@ -36,37 +52,110 @@ func init() {
 
 // Proxy is a secure(lets encrypt) gRPC & http reverse proxy
 type Proxy struct {
-	mu            sync.RWMutex
-	mach          *machine.Machine
-	logger        *logger.Logger
-	triggers      []*trigger.Trigger
-	hostPolicy    autocert.HostPolicy
-	certCache     string
-	insecurePort  string
-	securePort    string
-	redirectHttps bool
-	httpInit      []func(srv *http.Server)
-	httpsInit     []func(srv *http.Server)
-	grpcInit      []func(srv *grpc.Server)
-	grpcsInit     []func(srv *grpc.Server)
-	grpcOpts      []grpc.ServerOption
-	grpcsOpts     []grpc.ServerOption
+	mu             sync.RWMutex
+	mach           *machine.Machine
+	logger         *logger.Logger
+	triggers       []*trigger.Trigger
+	listeners      map[string]*listener.Config
+	listenerRoutes map[string][]*trigger.Trigger
+	l4Triggers     []*trigger.Trigger
+	l4Config       *l4.Config
+	hostPolicy     autocert.HostPolicy
+	certCache      string
+	insecurePort   string
+	securePort     string
+	redirectHttps  bool
+	httpInit       []func(srv *http.Server)
+	httpsInit      []func(srv *http.Server)
+	grpcInit       []func(srv *grpc.Server)
+	grpcsInit      []func(srv *grpc.Server)
+	grpcOpts       []grpc.ServerOption
+	grpcsOpts      []grpc.ServerOption
+	retryPolicies  map[string]*retry.Policy
+	breakerConfigs map[string]*breaker.Config
+	headerRuleSets map[string]*headers.Rules
+	pathRewrites   map[string]*rewrite.Rules
+	services       map[string]*service
+	rateLimiters   map[string]*ratelimit.Limiter
+	verifier       *auth.Verifier
+	requireAuth    map[string]bool
+	claimHeaders   map[string]string
+	policies       map[string]*authz.Policy
+	routeAuthz     map[string][]string
+	listenerFilter *ipfilter.Filter
+	ipFilters      map[string]*ipfilter.Filter
+	trustedProxies []*net.IPNet
+	proxyProtocol  []*net.IPNet
+	forwardedMode  ForwardedMode
+	transports     map[string]http.RoundTripper
+	mirrors        map[string]*mirror.Policy
+	canaries       map[string]*canary.Policy
+	canaryRamps    map[string]canaryRamp
+	affinities     map[string]*affinity.Policy
+	caches         map[string]*cache.Cache
+	compressions   map[string]*compress.Policy
+	sizeLimits     map[string]*sizelimit.Limits
+	serverConfig   *server.Config
+	http3          bool
+	rfc7239        bool
+	breakers       sync.Map
+	adminAddr      string
+	adminToken     string
+	counters       sync.Map
+	connMu         sync.Mutex
+	conns          map[string]*clientConn
 }
 
-// New creates a new proxy instance. A host policy & either http routes, gRPC routes, or both are required.
+// New creates a new proxy instance. A host policy is required.
+// Routes are registered with WithRoute or provided later with OverrideRoutes(ex: by the ingress controller)
 func New(ctx context.Context, opts ...Opt) (*Proxy, error) {
-	p := &Proxy{}
+	p := &Proxy{
+		listeners:      map[string]*listener.Config{},
+		listenerRoutes: map[string][]*trigger.Trigger{},
+		retryPolicies:  map[string]*retry.Policy{},
+		breakerConfigs: map[string]*breaker.Config{},
+		headerRuleSets: map[string]*headers.Rules{},
+		pathRewrites:   map[string]*rewrite.Rules{},
+		services:       map[string]*service{},
+		rateLimiters:   map[string]*ratelimit.Limiter{},
+		requireAuth:    map[string]bool{},
+		claimHeaders:   map[string]string{},
+		policies:       map[string]*authz.Policy{},
+		routeAuthz:     map[string][]string{},
+		ipFilters:      map[string]*ipfilter.Filter{},
+		transports:     map[string]http.RoundTripper{},
+		mirrors:        map[string]*mirror.Policy{},
+		canaries:       map[string]*canary.Policy{},
+		canaryRamps:    map[string]canaryRamp{},
+		affinities:     map[string]*affinity.Policy{},
+		caches:         map[string]*cache.Cache{},
+		compressions:   map[string]*compress.Policy{},
+		sizeLimits:     map[string]*sizelimit.Limits{},
+		conns:          map[string]*clientConn{},
+	}
 	for _, o := range opts {
 		if err := o(p); err != nil {
 			return nil, err
 		}
 	}
-	if len(p.triggers) == 0 {
-		return nil, errors.New("zero triggers")
-	}
 	if p.hostPolicy == nil {
 		return nil, errors.New("empty host policy")
 	}
+	for routeName, names := range p.routeAuthz {
+		for _, name := range names {
+			if _, ok := p.policies[name]; !ok {
+				return nil, errors.Errorf("route %s: unknown authorization policy: %s", routeName, name)
+			}
+		}
+	}
+	for name := range p.listenerRoutes {
+		if !p.hasListener(name) {
+			return nil, errors.Errorf("unknown listener: %s", name)
+		}
+	}
+	if p.forwardedMode == "" {
+		p.forwardedMode = ForwardedAppend
+	}
 	if p.insecurePort == "" {
 		p.insecurePort = ":80"
 	}
@@ -88,12 +177,13 @@ func New(ctx context.Context, opts ...Opt) (*Proxy, error) {
 	return p, nil
 }
 
-// Serve starts the gRPC(if grpc router was registered) & http proxy(if http router was registered)
+// Serve starts the gRPC(if grpc router was registered) & http proxy(if http router was registered) on the insecure port,
+// the secure port & every listener added with WithListener
 func (p *Proxy) Serve(ctx context.Context) error {
 	var (
 		m = &autocert.Manager{
 			Prompt:     autocert.AcceptTOS,
-			HostPolicy: p.hostPolicy,
+			HostPolicy: p.acmeHostPolicy,
 			Cache:      autocert.DirCache(p.certCache),
 		}
 		tlsConfig = &tls.Config{
@@ -101,153 +191,80 @@ func (p *Proxy) Serve(ctx context.Context) error {
 		}
 		shutdown []func(ctx context.Context)
 	)
-	insecure, err := net.Listen("tcp", p.insecurePort)
-	if err != nil {
-		return err
-	}
-	secure, err := tls.Listen("tcp", p.securePort, tlsConfig)
-	if err != nil {
-		return err
-	}
-	defer insecure.Close()
-	defer secure.Close()
-	imux := cmux.New(insecure)
-	smux := cmux.New(secure)
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 	defer signal.Stop(interrupt)
-	var httpHandler http.Handler
-	if p.redirectHttps {
-		httpHandler = m.HTTPHandler(nil)
-	} else {
-		httpHandler = m.HTTPHandler(&httputil.ReverseProxy{
-			Director: p.httpDirector(),
-		})
-	}
-	httpServer := &http.Server{
-		Handler: httpHandler,
-	}
-	for _, o := range p.httpInit {
-		o(httpServer)
-	}
-	p.mach.Go(func(routine machine.Routine) {
-		matcher := imux.Match(cmux.Any())
-		p.logger.Debug("starting http server", zap.String("address", matcher.Addr().String()))
-		if err := httpServer.Serve(matcher); err != nil && err != http.ErrServerClosed &&
-			!strings.Contains(err.Error(), "mux: listener closed") {
-			p.logger.Error("http proxy failure", zap.Error(err))
+	var (
+		listeners []net.Listener
+		muxes     []cmux.CMux
+	)
+	// abort closes the listeners & servers that were started before a later one failed
+	abort := func(err error) error {
+		for _, l := range listeners {
+			l.Close()
 		}
-	})
-	shutdown = append(shutdown, func(ctx context.Context) {
-		_ = httpServer.Shutdown(ctx)
-	})
-	var httpsHandler = m.HTTPHandler(&httputil.ReverseProxy{
-		Director: p.httpDirector(),
-	})
-	tlsHttpServer := &http.Server{
-		Handler: httpsHandler,
-	}
-
-	for _, o := range p.httpsInit {
-		o(tlsHttpServer)
-	}
-	p.mach.Go(func(routine machine.Routine) {
-		matcher := smux.Match(cmux.Any())
-		p.logger.Debug("starting secure http server", zap.String("address", matcher.Addr().String()))
-		if err := tlsHttpServer.Serve(matcher); err != nil &&
-			err != http.ErrServerClosed &&
-			!strings.Contains(err.Error(), "mux: listener closed") {
-			p.logger.Error("TLS http proxy failure", zap.Error(err))
+		for _, mux := range muxes {
+			// the closed listener makes Serve return immediately, closing its matchers so the servers exit
+			_ = mux.Serve()
 		}
-	})
-
-	shutdown = append(shutdown, func(ctx context.Context) {
-		_ = tlsHttpServer.Shutdown(ctx)
-	})
-	gopts := []grpc.ServerOption{
-		grpc.UnknownServiceHandler(proxy.TransparentHandler(p.gRPCDirector())),
-	}
-	for _, o := range p.grpcOpts {
-		gopts = append(gopts, o)
-	}
-	gserver := grpc.NewServer(gopts...)
-	for _, o := range p.grpcInit {
-		o(gserver)
+		p.shutdown(shutdown)
+		return err
 	}
-	p.mach.Go(func(routine machine.Routine) {
-		matcher := imux.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
-		p.logger.Debug("starting gRPC server", zap.String("address", matcher.Addr().String()))
-		if err := gserver.Serve(matcher); err != nil && !strings.Contains(err.Error(), "mux: listener closed") {
-			p.logger.Error("gRPC proxy failure", zap.Error(err))
-		}
-	})
-	shutdown = append(shutdown, func(ctx context.Context) {
-		stopped := make(chan struct{}, 1)
-		go func() {
-			gserver.GracefulStop()
-			stopped <- struct{}{}
-		}()
-		select {
-		case <-ctx.Done():
-			gserver.Stop()
-		case <-stopped:
-			return
+	for _, nl := range p.namedListeners() {
+		l, mux, closers, err := p.serveListener(nl.name, nl.config, m, tlsConfig)
+		if err != nil {
+			return abort(err)
 		}
-	})
-	gsopts := []grpc.ServerOption{
-		grpc.UnknownServiceHandler(proxy.TransparentHandler(p.gRPCDirector())),
+		defer l.Close()
+		listeners = append(listeners, l)
+		muxes = append(muxes, mux)
+		shutdown = append(shutdown, closers...)
 	}
-	for _, o := range p.grpcsOpts {
-		gsopts = append(gsopts, o)
-	}
-	tlsGserver := grpc.NewServer(gsopts...)
-	for _, o := range p.grpcsInit {
-		o(tlsGserver)
+	closeL4, err := p.serveL4()
+	if err != nil {
+		return abort(err)
 	}
-	p.mach.Go(func(routine machine.Routine) {
-		matcher := smux.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
-		p.logger.Debug("starting secure gRPC server", zap.String("address", matcher.Addr().String()))
-		if err := tlsGserver.Serve(matcher); err != nil && !strings.Contains(err.Error(), "mux: listener closed") {
-			p.logger.Error("TLS gRPC proxy failure", zap.Error(err))
-		}
-	})
 	shutdown = append(shutdown, func(ctx context.Context) {
-		stopped := make(chan struct{}, 1)
-		go func() {
-			tlsGserver.GracefulStop()
-			stopped <- struct{}{}
-		}()
-		select {
-		case <-ctx.Done():
-			tlsGserver.Stop()
-		case <-stopped:
-			return
-		}
-	})
-
-	p.mach.Go(func(routine machine.Routine) {
-		if err := imux.Serve(); err != nil && !strings.Contains(err.Error(), "closed network connection") {
-			p.logger.Error("listener mux error", zap.Error(err))
-		}
+		closeL4()
 	})
-	p.mach.Go(func(routine machine.Routine) {
-		if err := smux.Serve(); err != nil && !strings.Contains(err.Error(), "closed network connection") {
-			p.logger.Error("listener mux error", zap.Error(err))
+	p.watchServices()
+	p.pruneBreakers()
+	if p.adminAddr != "" {
+		adminServer, err := p.serveAdmin()
+		if err != nil {
+			return abort(err)
 		}
-	})
+		shutdown = append(shutdown, func(ctx context.Context) {
+			_ = adminServer.Shutdown(ctx)
+		})
+	}
+	for _, mux := range muxes {
+		mux := mux
+		p.mach.Go(func(routine machine.Routine) {
+			if err := mux.Serve(); err != nil && !strings.Contains(err.Error(), "closed network connection") {
+				p.logger.Error("listener mux error", zap.Error(err))
+			}
+		})
+	}
 	select {
 	case <-interrupt:
-		p.mach.Close()
 		break
 	case <-ctx.Done():
-		p.mach.Close()
 		break
 	}
 	p.logger.Debug("shutdown signal received")
+	p.shutdown(shutdown)
+	p.logger.Debug("shutdown successful")
+	return nil
+}
+
+// shutdown stops the proxies routines, gracefully shuts the servers down & closes the cached upstream connections
+func (p *Proxy) shutdown(closers []func(ctx context.Context)) {
+	p.mach.Close()
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer shutdownCancel()
 	wg := &sync.WaitGroup{}
-	for _, closer := range shutdown {
+	for _, closer := range closers {
 		wg.Add(1)
 		go func(c func(ctx context.Context)) {
 			defer wg.Done()
@@ -257,9 +274,8 @@ func (p *Proxy) Serve(ctx context.Context) error {
 		}(closer)
 	}
 	wg.Wait()
+	p.closeConns()
 	p.mach.Wait()
-	p.logger.Debug("shutdown successful")
-	return nil
 }
 
 // OverrideRoutes overrides the routes on the Proxy. It is concurrency safe
@@ -278,14 +294,63 @@ func (p *Proxy) OverrideRoutes(expressions []string) error {
 	return nil
 }
 
-func (p *Proxy) gRPCDirector() proxy.StreamDirector {
-	return func(ctx context.Context, fullMethodName string) (context.Context, *grpc.ClientConn, error) {
+// OverrideL4Routes overrides the L4(TCP & TLS passthrough) routing expressions. It is concurrency safe
+func (p *Proxy) OverrideL4Routes(expressions []string) error {
+	var triggers []*trigger.Trigger
+	for _, exp := range expressions {
+		t, err := trigger.NewArrowTrigger(exp)
+		if err != nil {
+			return err
+		}
+		triggers = append(triggers, t)
+	}
+	p.mu.Lock()
+	p.l4Triggers = triggers
+	p.mu.Unlock()
+	return nil
+}
+
+// OverrideAcmePolicy overrides the decision expression that specifies which host names the Acme client may respond to.
+// It is concurrency safe
+func (p *Proxy) OverrideAcmePolicy(decision string) error {
+	policy, err := newHostPolicy(decision)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.hostPolicy = policy
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Proxy) acmeHostPolicy(ctx context.Context, host string) error {
+	p.mu.RLock()
+	policy := p.hostPolicy
+	p.mu.RUnlock()
+	return policy(ctx, host)
+}
+
+type grpcCall struct {
+	route     *route
+	method    string
+	data      map[string]interface{}
+	attempted map[string]bool
+}
+
+func (p *Proxy) gRPCDirector(listener string, secure bool) func(ctx context.Context, fullMethodName string) (context.Context, *grpcCall, error) {
+	return func(ctx context.Context, fullMethodName string) (context.Context, *grpcCall, error) {
 		ctx = invertContext(ctx)
 		md, ok := metadata.FromIncomingContext(ctx)
 		if ok {
 			if val, exists := md[":authority"]; exists && val[0] != "" {
 				now := time.Now()
-				target, err := p.getgRPCRoute(val[0], fullMethodName, md)
+				claims, err := p.authenticateGRPC(ctx, md)
+				if err != nil {
+					return nil, nil, status.Error(codes.Unauthenticated, err.Error())
+				}
+				clientIP := p.grpcClientIP(ctx, md)
+				data := grpcRequestData(val[0], fullMethodName, listener, clientIP, md, claims)
+				rt, err := p.getgRPCRoute(data)
 				if err != nil {
 					return nil, nil, status.Error(codes.InvalidArgument, err.Error())
 				}
@@ -293,30 +358,153 @@ func (p *Proxy) gRPCDirector() proxy.StreamDirector {
 					zap.String("proxy", "gRPC"),
 					zap.Any("metadata", md),
 					zap.String("method", fullMethodName),
-					zap.String("target", target),
 				}
 				defer func() {
 					dur := time.Since(now)
 					fields = append(fields, zap.Duration("duration", dur))
 					p.logger.Debug("proxied request", fields...)
 				}()
-				if target == "" {
+				if rt == nil {
 					return nil, nil, status.Error(codes.PermissionDenied, "unknown route")
 				}
-
-				// Make sure we use DialContext so the dialing can be cancelled/time out together with the context.
-				conn, err := grpc.DialContext(invertContext(ctx), target, grpc.WithInsecure())
-				if err != nil {
-					return nil, nil, err
+				// denied calls are rejected before traffic splitting, rewrites or header rules are applied
+				if claims == nil && p.authRequired(rt.name) {
+					return nil, nil, status.Error(codes.Unauthenticated, errUnauthenticated.Error())
+				}
+				if err := p.checkIP(rt, data); err != nil {
+					return nil, nil, status.Error(codes.PermissionDenied, err.Error())
+				}
+				if err := p.authorize(rt, routeData(data, rt)); err != nil {
+					return nil, nil, status.Error(codes.PermissionDenied, err.Error())
+				}
+				if err := p.rateLimit(ctx, rt, routeData(data, rt)); err != nil {
+					if rerr, ok := err.(*rateLimitError); ok {
+						grpc.SetTrailer(ctx, metadata.Pairs("retry-after", rerr.retryAfter()))
+					}
+					return nil, nil, status.Error(codes.ResourceExhausted, err.Error())
+				}
+				header := metadataHeader(md)
+				// gRPC clients never send the sticky cookie back, so they are identified by their ip instead
+				decision := p.splitTraffic(rt, header, clientIP, false)
+				p.setAffinity(rt, header, clientIP)
+				fields = append(fields, zap.String("route", rt.name), zap.Strings("targets", rt.targets))
+				if decision.Variant != "" {
+					fields = append(fields, zap.String("variant", string(decision.Variant)), zap.String("variant_reason", string(decision.Reason)))
+				}
+				call := &grpcCall{
+					route:     rt,
+					method:    p.pathRewrite(rt.name).Rewrite(fullMethodName),
+					data:      routeData(data, rt),
+					attempted: map[string]bool{},
+				}
+				if call.method != fullMethodName {
+					fields = append(fields, zap.String("rewrite", call.method))
+				}
+				outgoing := md.Copy()
+				var remoteAddr string
+				if pr, ok := peer.FromContext(ctx); ok && pr.Addr != nil {
+					remoteAddr = pr.Addr.String()
 				}
-				return ctx, conn, err
+				p.setForwardedMetadata(outgoing, remoteAddr, val[0], secure)
+				p.forwardClaims(outgoing, claims, strings.ToLower)
+				if err := p.headerRules(rt.name).RequestMetadata(outgoing, call.data); err != nil {
+					return nil, nil, status.Error(codes.Internal, err.Error())
+				}
+				ctx = metadata.NewOutgoingContext(ctx, outgoing)
+				return ctx, call, nil
 			}
 		}
 		return nil, nil, status.Error(codes.Unimplemented, "Unknown method")
 	}
 }
 
-func (p *Proxy) httpDirector() func(r *http.Request) {
+// clientConn is a cached gRPC client connection & the number of calls using it
+type clientConn struct {
+	*grpc.ClientConn
+	calls int
+	// removed is set once the connection is evicted from the cache - it's closed when its last call completes
+	removed bool
+}
+
+// dial returns a(cached) client connection to the gRPC target. The connection is held by the call until ctx is done
+func (p *Proxy) dial(ctx context.Context, target string) (*grpc.ClientConn, error) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	conn, ok := p.conns[target]
+	if !ok {
+		t, err := parseGRPCTarget(target)
+		if err != nil {
+			return nil, err
+		}
+		cc, err := grpc.DialContext(ctx, t.dialTarget, t.dialOptions()...)
+		if err != nil {
+			return nil, err
+		}
+		conn = &clientConn{ClientConn: cc}
+		p.conns[target] = conn
+	}
+	conn.calls++
+	context.AfterFunc(ctx, func() {
+		p.releaseConn(conn)
+	})
+	return conn.ClientConn, nil
+}
+
+// releaseConn releases a call's hold on the connection, closing it if it was evicted & no other calls are using it
+func (p *Proxy) releaseConn(conn *clientConn) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	conn.calls--
+	if conn.removed && conn.calls == 0 {
+		conn.Close()
+	}
+}
+
+func (p *Proxy) closeConns() {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	for target, conn := range p.conns {
+		conn.Close()
+		delete(p.conns, target)
+	}
+	for _, rt := range p.transports {
+		if closer, ok := rt.(interface{ CloseIdleConnections() }); ok {
+			closer.CloseIdleConnections()
+		}
+	}
+}
+
+// headerRules returns the header rules registered for the route, falling back to the default("*") rules
+func (p *Proxy) headerRules(routeName string) *headers.Rules {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if rules, ok := p.headerRuleSets[routeName]; ok {
+		return rules
+	}
+	return p.headerRuleSets["*"]
+}
+
+// pathRewrite returns the path rewrite rules registered for the route, falling back to the default("*") rules
+func (p *Proxy) pathRewrite(routeName string) *rewrite.Rules {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if rules, ok := p.pathRewrites[routeName]; ok {
+		return rules
+	}
+	return p.pathRewrites["*"]
+}
+
+// retryPolicy returns the retry policy registered for the route, falling back to the default("*") policy
+func (p *Proxy) retryPolicy(routeName string) *retry.Policy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if policy, ok := p.retryPolicies[routeName]; ok {
+		return policy
+	}
+	return p.retryPolicies["*"]
+}
+
+func (p *Proxy) httpDirector(listener string, secure bool) func(r *http.Request) {
 	return func(req *http.Request) {
 		now := time.Now()
 		fields := []zap.Field{
@@ -331,105 +519,110 @@ func (p *Proxy) httpDirector() func(r *http.Request) {
 			p.logger.Debug("proxied request", fields...)
 		}()
 
-		target, err := p.getHttpRoute(req)
+		clientIP := p.httpClientIP(req)
+		data := httpRequestData(req, listener, clientIP)
+		rt, err := p.getHttpRoute(data)
 		if err != nil {
 			p.logger.Error("failed to find routing target", zap.Error(err))
 			return
 		}
-		fields = append(fields, zap.String("target", target))
-		if target == "" {
+		if rt == nil {
 			p.logger.Debug("empty routing target", fields...)
 			return
-		} else {
-			u, err := url.Parse(target)
-			if err != nil {
-				fields = append(fields, zap.Error(err))
-				p.logger.Debug("failed to parse target", fields...)
-				return
+		}
+		claims, _ := claimsFromContext(req.Context())
+		if err := p.admitHTTP(req, rt, routeData(data, rt), claims != nil); err != nil {
+			// the request is rejected by the transport before traffic splitting, rewrites or header rules are applied
+			fields = append(fields, zap.String("route", rt.name), zap.Error(err))
+			*req = *req.WithContext(context.WithValue(withRoute(req.Context(), rt), httpCallCtxKey{}, &httpCall{
+				route:         rt,
+				data:          routeData(data, rt),
+				authenticated: claims != nil,
+				denied:        err,
+			}))
+			return
+		}
+		decision := p.splitTraffic(rt, req.Header, clientIP, true)
+		p.setAffinity(rt, req.Header, clientIP)
+		call := &httpCall{
+			route:         rt,
+			data:          routeData(data, rt),
+			inbound:       &url.URL{},
+			attempted:     map[string]bool{},
+			authenticated: claims != nil,
+		}
+		if decision.ClientID != "" {
+			call.stickyCookie = &http.Cookie{
+				Name:     p.canaryPolicy(rt.name).StickyCookie,
+				Value:    decision.ClientID,
+				Path:     "/",
+				HttpOnly: true,
 			}
-			req.URL.Scheme = u.Scheme
-			req.URL.Host = u.Host
-			req.URL.Path, req.URL.RawPath = joinURLPath(u, req.URL)
-			if u.RawQuery == "" || req.URL.RawQuery == "" {
-				req.URL.RawQuery = u.RawQuery + req.URL.RawQuery
+		}
+		*call.inbound = *req.URL
+		if rules := p.pathRewrite(rt.name); rules != nil {
+			// the escaped path is rewritten so encoded segments(ex: %2F) are forwarded as they were received
+			escaped := rules.Rewrite(call.inbound.EscapedPath())
+			if unescaped, err := url.PathUnescape(escaped); err == nil {
+				call.inbound.Path, call.inbound.RawPath = unescaped, escaped
 			} else {
-				req.URL.RawQuery = u.RawQuery + "&" + req.URL.RawQuery
-			}
-			if _, ok := req.Header["User-Agent"]; !ok {
-				// explicitly disable User-Agent so it's not set to default value
-				req.Header.Set("User-Agent", "")
+				call.inbound.Path, call.inbound.RawPath = escaped, ""
 			}
+			fields = append(fields, zap.String("rewrite", call.inbound.Path))
+		}
+		fields = append(fields, zap.String("route", rt.name), zap.Strings("targets", rt.targets))
+		if decision.Variant != "" {
+			fields = append(fields, zap.String("variant", string(decision.Variant)), zap.String("variant_reason", string(decision.Reason)))
+		}
+		p.setForwardedHTTP(req.Header, req.RemoteAddr, req.Host, secure)
+		p.forwardClaims(req.Header, claims, http.CanonicalHeaderKey)
+		if err := p.headerRules(rt.name).RequestHTTP(req.Header, call.data); err != nil {
+			call.rulesFailed = &headerRulesError{route: rt.name, err: err}
+		}
+		*req = *req.WithContext(context.WithValue(withRoute(req.Context(), rt), httpCallCtxKey{}, call))
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// explicitly disable User-Agent so it's not set to default value
+			req.Header.Set("User-Agent", "")
 		}
 	}
 }
 
-// (this.http, this.grpc, this.host, this.headers, this.path)
-func (p *Proxy) getHttpRoute(req *http.Request) (string, error) {
-	headers := map[string]interface{}{}
-	for k, v := range req.Header {
-		headers[k] = v[0]
-	}
-	data := map[string]interface{}{
-		"http":    true,
-		"grpc":    false,
-		"host":    req.Host,
-		"headers": headers,
-		"path":    req.URL.Path,
+// (this.http, this.grpc, this.host, this.headers, this.path, this.method, this.client_ip, this.claims, this.listener)
+func (p *Proxy) getHttpRoute(data map[string]interface{}) (*route, error) {
+	rt, err := p.matchRoute(data)
+	if err != nil {
+		return nil, err
 	}
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	for _, trig := range p.triggers {
-		result, err := trig.Trigger(data)
-		if err != nil && err != trigger.ErrDecisionDenied {
-			return "", err
-		}
-		if result != nil {
-			target, ok := result["value"].(string)
-			if ok {
-				if !strings.Contains(target, "http") {
-					target = fmt.Sprintf("http://%s", target)
-				}
-				return target, nil
-			}
+	if rt == nil {
+		return nil, errors.New("zero http routes for request")
+	}
+	// the targets are copied so the trigger result isn't modified
+	targets := make([]string, 0, len(rt.targets))
+	for _, target := range rt.targets {
+		if !strings.Contains(target, "http") {
+			target = fmt.Sprintf("http://%s", target)
 		}
+		targets = append(targets, target)
 	}
-	return "", errors.New("zero http routes for request")
+	rt.targets = targets
+	return rt, nil
 }
 
-// (this.http, this.grpc, this.host, this.headers, this.path)
-func (p *Proxy) getgRPCRoute(host, fullMethod string, md metadata.MD) (string, error) {
-	meta := map[string]interface{}{}
-	for k, v := range md {
-		meta[k] = v[0]
-	}
-	data := map[string]interface{}{
-		"http":    false,
-		"grpc":    true,
-		"host":    host,
-		"path":    fullMethod,
-		"headers": meta,
+// (this.http, this.grpc, this.host, this.headers, this.path, this.method, this.client_ip, this.claims, this.listener)
+func (p *Proxy) getgRPCRoute(data map[string]interface{}) (*route, error) {
+	rt, err := p.matchRoute(data)
+	if err != nil {
+		return nil, err
 	}
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	for _, trig := range p.triggers {
-		result, err := trig.Trigger(data)
-		if err != nil && err != trigger.ErrDecisionDenied {
-			return "", err
-		}
-		if result != nil {
-			target, ok := result["value"].(string)
-			if ok {
-				if strings.Contains(target, "http://") {
-					target = strings.Split("http://", "")[1]
-				}
-				if strings.Contains(target, "https://") {
-					target = strings.Split("https://", "")[1]
-				}
-				return target, nil
-			}
+	if rt == nil {
+		return nil, errors.New("zero gRPC routes for request")
+	}
+	for _, target := range rt.targets {
+		if _, err := parseGRPCTarget(target); err != nil {
+			return nil, err
 		}
 	}
-	return "", errors.New("zero gRPC routes for request")
+	return rt, nil
 }
 
 func joinURLPath(a, b *url.URL) (path, rawpath string) {
@@ -1,13 +1,64 @@
 package gproxy_test
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"github.com/graphikDB/gproxy"
+	"github.com/graphikDB/gproxy/affinity"
+	"github.com/graphikDB/gproxy/auth"
+	"github.com/graphikDB/gproxy/authz"
+	"github.com/graphikDB/gproxy/breaker"
+	"github.com/graphikDB/gproxy/cache"
+	"github.com/graphikDB/gproxy/canary"
+	"github.com/graphikDB/gproxy/compress"
+	"github.com/graphikDB/gproxy/discovery"
+	"github.com/graphikDB/gproxy/headers"
+	"github.com/graphikDB/gproxy/ipfilter"
+	"github.com/graphikDB/gproxy/l4"
+	"github.com/graphikDB/gproxy/listener"
 	"github.com/graphikDB/gproxy/logger"
+	"github.com/graphikDB/gproxy/metrics"
+	"github.com/graphikDB/gproxy/mirror"
+	"github.com/graphikDB/gproxy/ratelimit"
+	"github.com/graphikDB/gproxy/retry"
+	"github.com/graphikDB/gproxy/rewrite"
+	"github.com/graphikDB/gproxy/server"
+	"github.com/graphikDB/gproxy/sizelimit"
+	"github.com/graphikDB/gproxy/upstream"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -64,10 +115,10 @@ func Test(t *testing.T) {
 	}
 	go func() {
 		if err := proxy.Serve(ctx); err != nil {
-			t.Fatal(err.Error())
+			t.Error(err.Error())
 		}
 	}()
-	time.Sleep(2 * time.Second)
+	waitForListener(t, "tcp", "localhost:8081")
 	resp, err := http.DefaultClient.Get("http://localhost:8081/")
 	if err != nil {
 		t.Fatal(err.Error())
@@ -83,3 +134,2164 @@ func Test(t *testing.T) {
 	cancel()
 
 }
+
+type unavailableHealthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+	calls int32
+}
+
+func (u *unavailableHealthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	atomic.AddInt32(&u.calls, 1)
+	return nil, status.Error(codes.Unavailable, "unavailable")
+}
+
+// waitForListener polls the address until it accepts connections(ex: once the proxy is serving)
+func waitForListener(t *testing.T, network, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.DialTimeout(network, addr, 100*time.Millisecond)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s isn't accepting connections: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func serveGRPC(t *testing.T, register func(srv *grpc.Server)) (string, func()) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	srv := grpc.NewServer()
+	register(srv)
+	go srv.Serve(lis)
+	return lis.Addr().String(), srv.Stop
+}
+
+func TestRetry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var failures int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failures, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	}))
+	defer healthy.Close()
+	unavailable := &unavailableHealthServer{}
+	badAddr, stopBad := serveGRPC(t, func(srv *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(srv, unavailable)
+	})
+	defer stopBad()
+	goodAddr, stopGood := serveGRPC(t, func(srv *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	})
+	defer stopGood()
+
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8083),
+		gproxy.WithSecurePort(8084),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'api', 'targets': ['%s', '%s']}`, failing.URL, healthy.URL)),
+		gproxy.WithRoute(fmt.Sprintf(`this.grpc => {'name': 'api', 'targets': ['%s', '%s']}`, badAddr, goodAddr)),
+		gproxy.WithRetryPolicy("api", &retry.Policy{
+			MaxAttempts: 2,
+			BaseBackoff: time.Millisecond,
+		}),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8083")
+	for i := 0; i < 4; i++ {
+		resp, err := http.DefaultClient.Get("http://localhost:8083/")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		bits, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(bits) != "hello world" {
+			t.Fatalf("expected retry to healthy target, got: %v %s", resp.StatusCode, string(bits))
+		}
+	}
+	if atomic.LoadInt32(&failures) == 0 {
+		t.Fatal("expected failing target to be attempted")
+	}
+	conn, err := grpc.DialContext(ctx, "localhost:8083", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+	for i := 0; i < 4; i++ {
+		resp, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if resp.GetStatus() != grpc_health_v1.HealthCheckResponse_SERVING {
+			t.Fatalf("unexpected health status: %s", resp.GetStatus())
+		}
+	}
+	if atomic.LoadInt32(&unavailable.calls) == 0 {
+		t.Fatal("expected unavailable target to be attempted")
+	}
+	cancel()
+}
+
+// TestGRPCWithoutRetryPolicy proxies gRPC calls over a route without a retry policy(the default)
+func TestGRPCWithoutRetryPolicy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addr, stop := serveGRPC(t, func(srv *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	})
+	defer stop()
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8137),
+		gproxy.WithSecurePort(8138),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithRoute(fmt.Sprintf(`this.grpc => {'name': 'api', 'targets': ['%s']}`, addr)),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8137")
+	conn, err := grpc.DialContext(ctx, "localhost:8137", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+	for i := 0; i < 2; i++ {
+		resp, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if resp.GetStatus() != grpc_health_v1.HealthCheckResponse_SERVING {
+			t.Fatalf("unexpected health status: %s", resp.GetStatus())
+		}
+	}
+	cancel()
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8085),
+		gproxy.WithSecurePort(8086),
+		gproxy.WithAdminPort(8087),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithRoute(fmt.Sprintf(`this.http && this.path == '/other' => {'name': 'other', 'target': '%s'}`, failing.URL)),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'api', 'target': '%s'}`, failing.URL)),
+		gproxy.WithCircuitBreaker("api", &breaker.Config{
+			ConsecutiveFailures: 2,
+			OpenTimeout:         time.Minute,
+		}),
+		gproxy.WithCircuitBreaker("other", &breaker.Config{
+			ConsecutiveFailures: 10,
+			OpenTimeout:         time.Minute,
+		}),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8085")
+	var statuses []int
+	for i := 0; i < 3; i++ {
+		resp, err := http.DefaultClient.Get("http://localhost:8085/")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+	}
+	if statuses[0] != http.StatusInternalServerError || statuses[2] != http.StatusServiceUnavailable {
+		t.Fatalf("expected breaker to short-circuit requests, got: %v", statuses)
+	}
+	// routes sharing a target have their own breakers
+	resp, err := http.DefaultClient.Get("http://localhost:8085/other")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected the other routes breaker to be closed, got: %v", resp.StatusCode)
+	}
+	resp, err = http.DefaultClient.Get("http://localhost:8087/metrics")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	bits, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(bits), "gproxy_circuit_breaker_state") {
+		t.Fatal("expected circuit breaker state metric")
+	}
+	cancel()
+}
+
+func TestHeaderRules(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "upstream")
+		w.Write([]byte(r.Header.Get("X-Client-Ip")))
+	}))
+	defer srv.Close()
+	addr, stop := serveGRPC(t, func(srv *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	})
+	defer stop()
+	rules, err := headers.NewRules([]headers.Rule{
+		{Action: headers.Set, Name: "x-client-ip", Expression: "this.client_ip"},
+	}, []headers.Rule{
+		{Action: headers.Set, Name: "x-route", Expression: "this.route"},
+		{Action: headers.Remove, Name: "server"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8088),
+		gproxy.WithSecurePort(8089),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'http-api', 'target': '%s'}`, srv.URL)),
+		gproxy.WithRoute(fmt.Sprintf(`this.grpc => {'name': 'grpc-api', 'target': '%s'}`, addr)),
+		gproxy.WithHeaderRules("*", rules),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8088")
+	resp, err := http.DefaultClient.Get("http://localhost:8088/")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	bits, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(bits) == "" || resp.Header.Get("X-Route") != "http-api" || resp.Header.Get("Server") != "" {
+		t.Fatalf("unexpected http response: %v %s", resp.Header, string(bits))
+	}
+	conn, err := grpc.DialContext(ctx, "localhost:8088", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	var md metadata.MD
+	if _, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.Header(&md)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if values := md.Get("x-route"); len(values) == 0 || values[0] != "grpc-api" {
+		t.Fatalf("unexpected gRPC response metadata: %v", md)
+	}
+	cancel()
+}
+
+func TestHeaderRulesFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var forwarded int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&forwarded, 1)
+	}))
+	defer srv.Close()
+	// the expression fails to evaluate when the header is missing
+	rules, err := headers.NewRules([]headers.Rule{
+		{Action: headers.Set, Name: "x-tenant", Expression: "this.headers['X-Api-Key']"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8141),
+		gproxy.WithSecurePort(8142),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'http-api', 'target': '%s'}`, srv.URL)),
+		gproxy.WithHeaderRules("*", rules),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8141")
+	resp, err := http.Get("http://localhost:8141/")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || atomic.LoadInt32(&forwarded) != 0 {
+		t.Fatalf("expected 500 without forwarding, got %v(forwarded: %v)", resp.StatusCode, forwarded)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:8141/", nil)
+	req.Header.Set("X-Api-Key", "a")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || atomic.LoadInt32(&forwarded) != 1 {
+		t.Fatalf("expected 200, got %v(forwarded: %v)", resp.StatusCode, forwarded)
+	}
+	cancel()
+}
+
+func TestPathRewrite(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RequestURI))
+	}))
+	defer srv.Close()
+	rules, err := rewrite.NewRules(rewrite.Rule{StripPrefix: "/api", AddPrefix: "/v2"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8139),
+		gproxy.WithSecurePort(8140),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'api', 'target': '%s'}`, srv.URL)),
+		gproxy.WithPathRewrite("api", rules),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8139")
+	for path, expected := range map[string]string{
+		"/api/users?limit=10": "/v2/users?limit=10",
+		// encoded segments aren't decoded by the rewrite
+		"/api/files/a%2Fb?x=1": "/v2/files/a%2Fb?x=1",
+		"/other":               "/v2/other",
+	} {
+		resp, err := http.Get("http://localhost:8139" + path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		bits, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(bits) != expected {
+			t.Fatalf("%s: expected upstream to receive %s got: %s", path, expected, bits)
+		}
+	}
+	cancel()
+}
+
+func TestGRPCTargets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addr, stop := serveGRPC(t, func(srv *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	})
+	defer stop()
+	dir, err := ioutil.TempDir("", "gproxy")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "health.sock")
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	unixServer := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(unixServer, health.NewServer())
+	go unixServer.Serve(lis)
+	defer unixServer.Stop()
+	_, port, _ := net.SplitHostPort(addr)
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8090),
+		gproxy.WithSecurePort(8091),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithRoute(fmt.Sprintf(`this.grpc && this.headers['x-backend'] == 'unix' => 'unix://%s'`, socket)),
+		gproxy.WithRoute(fmt.Sprintf(`this.grpc && this.headers['x-backend'] == 'dns' => 'dns:///localhost:%s'`, port)),
+		gproxy.WithRoute(fmt.Sprintf(`this.grpc && this.headers['x-backend'] == 'http' => 'http://%s'`, addr)),
+		gproxy.WithRoute(fmt.Sprintf(`this.grpc => 'grpc://%s'`, addr)),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8090")
+	conn, err := grpc.DialContext(ctx, "localhost:8090", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+	for _, backend := range []string{"unix", "dns", "http", "grpc"} {
+		ctx := metadata.AppendToOutgoingContext(ctx, "x-backend", backend)
+		if _, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+			t.Fatalf("%s target: %s", backend, err.Error())
+		}
+	}
+	cancel()
+}
+
+func TestServiceDiscovery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("users"))
+	}))
+	defer srv.Close()
+	var endpoints atomic.Value
+	endpoints.Store([]string{})
+	users := discovery.Poll(func(ctx context.Context) ([]string, error) {
+		return endpoints.Load().([]string), nil
+	}, 50*time.Millisecond, nil)
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	backend := &countingListener{Listener: lis}
+	grpcSrv := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(grpcSrv, health.NewServer())
+	go grpcSrv.Serve(backend)
+	defer grpcSrv.Stop()
+	var grpcEndpoints atomic.Value
+	grpcEndpoints.Store([]string{lis.Addr().String()})
+	grpcUsers := discovery.Poll(func(ctx context.Context) ([]string, error) {
+		return grpcEndpoints.Load().([]string), nil
+	}, 50*time.Millisecond, nil)
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8092),
+		gproxy.WithSecurePort(8093),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithService("users", users),
+		gproxy.WithService("grpc-users", grpcUsers),
+		gproxy.WithRoute(`this.http => {'name': 'users', 'service': 'users', 'scheme': 'http'}`),
+		gproxy.WithRoute(`this.grpc => {'name': 'grpc-users', 'service': 'grpc-users', 'scheme': 'grpc'}`),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8092")
+	resp, err := http.DefaultClient.Get("http://localhost:8092/")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("expected a service with zero endpoints to fail")
+	}
+	endpoints.Store([]string{strings.TrimPrefix(srv.URL, "http://")})
+	time.Sleep(500 * time.Millisecond)
+	resp, err = http.DefaultClient.Get("http://localhost:8092/")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	bits, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(bits) != "users" {
+		t.Fatalf("unexpected response: %v %s", resp.StatusCode, string(bits))
+	}
+	conn, err := grpc.DialContext(ctx, "localhost:8092", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	if _, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if backend.open() != 1 {
+		t.Fatalf("expected 1 connection to the discovered endpoint: %v", backend.open())
+	}
+	// calls in flight keep the connection to a removed endpoint open until they complete
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+	watch, err := grpc_health_v1.NewHealthClient(conn).Watch(watchCtx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := watch.Recv(); err != nil {
+		t.Fatal(err.Error())
+	}
+	grpcEndpoints.Store([]string{})
+	time.Sleep(500 * time.Millisecond)
+	if backend.open() != 1 {
+		t.Fatalf("expected the connection to stay open while a call is in flight: %v", backend.open())
+	}
+	// the proxies connection to an endpoint is closed once it's removed from the service
+	stopWatch()
+	deadline := time.Now().Add(2 * time.Second)
+	for backend.open() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the connection to the removed endpoint to be closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+}
+
+// countingListener counts the open connections accepted by a listener
+type countingListener struct {
+	net.Listener
+	count int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&l.count, 1)
+	return &countedConn{Conn: conn, release: func() { atomic.AddInt32(&l.count, -1) }}, nil
+}
+
+func (l *countingListener) open() int32 {
+	return atomic.LoadInt32(&l.count)
+}
+
+type countedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	addr, stop := serveGRPC(t, func(srv *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	})
+	defer stop()
+	limiter, err := ratelimit.New(ratelimit.NewMemoryStore(), ratelimit.Rule{
+		Name:   "per-route",
+		Key:    "this.route",
+		Limit:  2,
+		Period: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8094),
+		gproxy.WithSecurePort(8095),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'http-api', 'target': '%s'}`, srv.URL)),
+		gproxy.WithRoute(fmt.Sprintf(`this.grpc => {'name': 'grpc-api', 'target': '%s'}`, addr)),
+		gproxy.WithRateLimit("*", limiter),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8094")
+	for i := 0; i < 3; i++ {
+		resp, err := http.DefaultClient.Get("http://localhost:8094/")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		if i < 2 && resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %v: unexpected status: %v", i, resp.StatusCode)
+		}
+		if i == 2 && (resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "") {
+			t.Fatalf("expected rate limited response: %v %v", resp.StatusCode, resp.Header)
+		}
+	}
+	conn, err := grpc.DialContext(ctx, "localhost:8094", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+	for i := 0; i < 3; i++ {
+		var trailer metadata.MD
+		_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.Trailer(&trailer))
+		if i < 2 && err != nil {
+			t.Fatalf("request %v: %s", i, err.Error())
+		}
+		if i == 2 && (status.Code(err) != codes.ResourceExhausted || len(trailer.Get("retry-after")) == 0) {
+			t.Fatalf("expected rate limited response: %v %v", err, trailer)
+		}
+	}
+	cancel()
+}
+
+func TestAuthentication(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("public"))
+	}))
+	defer public.Close()
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("admin:" + r.Header.Get("X-User-Id")))
+	}))
+	defer admin.Close()
+	addr, stop := serveGRPC(t, func(srv *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	})
+	defer stop()
+	secret := []byte("secret")
+	verifier, err := auth.NewVerifier(auth.Config{
+		Keys:       []auth.Key{{Key: secret}},
+		Algorithms: []string{"HS256"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8096),
+		gproxy.WithSecurePort(8097),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithAuthentication(verifier),
+		gproxy.WithAuthRequired("grpc-api", true),
+		gproxy.WithForwardClaims(map[string]string{"sub": "x-user-id"}),
+		gproxy.WithRoute(fmt.Sprintf(`this.http && 'role' in this.claims && this.claims.role == 'admin' => {'name': 'admin', 'target': '%s'}`, admin.URL)),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'public', 'target': '%s'}`, public.URL)),
+		gproxy.WithRoute(fmt.Sprintf(`this.grpc => {'name': 'grpc-api', 'target': '%s'}`, addr)),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8096")
+	token := hs256(secret, fmt.Sprintf(`{"sub":"user-1","role":"admin","exp":%v}`, time.Now().Add(time.Minute).Unix()))
+	get := func(authorization string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:8096/", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		req.Header.Set("X-User-Id", "spoofed")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer resp.Body.Close()
+		bits, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(bits)
+	}
+	if code, body := get(""); code != http.StatusOK || body != "public" {
+		t.Fatalf("unexpected anonymous response: %v %s", code, body)
+	}
+	if code, body := get("Bearer " + token); code != http.StatusOK || body != "admin:user-1" {
+		t.Fatalf("unexpected authenticated response: %v %s", code, body)
+	}
+	if code, _ := get("Bearer " + token + "x"); code != http.StatusUnauthorized {
+		t.Fatalf("expected invalid token to be rejected: %v", code)
+	}
+	conn, err := grpc.DialContext(ctx, "localhost:8096", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+	if _, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected unauthenticated: %v", err)
+	}
+	authCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	if _, err := client.Check(authCtx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatal(err.Error())
+	}
+	cancel()
+}
+
+func hs256(secret []byte, claims string) string {
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuthorization(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	addr, stop := serveGRPC(t, func(srv *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	})
+	defer stop()
+	var policies []*authz.Policy
+	for _, p := range []struct {
+		name, decision string
+		dryRun         bool
+	}{
+		{"read-only", "this.method == 'GET'", false},
+		{"audit", "this.path != '/audited'", true},
+		{"tenant", "'x-tenant' in this.headers && this.headers['x-tenant'] == 'acme'", false},
+	} {
+		policy, err := authz.NewPolicy(p.name, p.decision, p.dryRun)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		policies = append(policies, policy)
+	}
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8098),
+		gproxy.WithSecurePort(8099),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithAuthzPolicy(policies[0]),
+		gproxy.WithAuthzPolicy(policies[1]),
+		gproxy.WithAuthzPolicy(policies[2]),
+		gproxy.WithRouteAuthz("api", "read-only", "audit"),
+		gproxy.WithRouteAuthz("*", "tenant"),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'api', 'target': '%s'}`, srv.URL)),
+		gproxy.WithRoute(fmt.Sprintf(`this.grpc => {'name': 'grpc-api', 'target': '%s'}`, addr)),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8098")
+	for _, tc := range []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, "/", http.StatusOK},
+		{http.MethodGet, "/audited", http.StatusOK},
+		{http.MethodPost, "/", http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest(tc.method, "http://localhost:8098"+tc.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s %s: expected %v got %v", tc.method, tc.path, tc.status, resp.StatusCode)
+		}
+	}
+	conn, err := grpc.DialContext(ctx, "localhost:8098", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+	if _, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected permission denied: %v", err)
+	}
+	tenantCtx := metadata.AppendToOutgoingContext(ctx, "x-tenant", "acme")
+	if _, err := client.Check(tenantCtx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := gproxy.New(ctx, gproxy.WithAcmePolicy("false"), gproxy.WithRouteAuthz("api", "missing")); err == nil {
+		t.Fatal("expected unknown policy to be rejected")
+	}
+	cancel()
+}
+
+func TestIPFilter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	addr, stop := serveGRPC(t, func(srv *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	})
+	defer stop()
+	routeFilter, err := ipfilter.New([]string{"203.0.113.0/24"}, []string{"203.0.113.66"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	listenerFilter, err := ipfilter.New(nil, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8100),
+		gproxy.WithSecurePort(8101),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithTrustedProxies("127.0.0.1", "::1"),
+		gproxy.WithListenerIPFilter(listenerFilter),
+		gproxy.WithIPFilter("*", routeFilter),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'api', 'target': '%s'}`, srv.URL)),
+		gproxy.WithRoute(fmt.Sprintf(`this.grpc => {'name': 'grpc-api', 'target': '%s'}`, addr)),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8100")
+	get := func(forwardedFor string) (int, error) {
+		req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:8100/", nil)
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		resp, err := (&http.Client{Transport: &http.Transport{DisableKeepAlives: true}}).Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	for forwardedFor, expected := range map[string]int{
+		"203.0.113.5":               http.StatusOK,
+		"198.51.100.1, 203.0.113.5": http.StatusOK,
+		"203.0.113.66":              http.StatusForbidden,
+		"198.51.100.1":              http.StatusForbidden,
+		"":                          http.StatusForbidden,
+	} {
+		code, err := get(forwardedFor)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if code != expected {
+			t.Fatalf("%q: expected %v got %v", forwardedFor, expected, code)
+		}
+	}
+	conn, err := grpc.DialContext(ctx, "127.0.0.1:8100", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+	if _, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected permission denied: %v", err)
+	}
+	forwardedCtx := metadata.AppendToOutgoingContext(ctx, "x-forwarded-for", "203.0.113.7")
+	if _, err := client.Check(forwardedCtx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatal(err.Error())
+	}
+	// connections from denied addresses are closed by the listener once the filters are reloaded
+	denyLocal, err := ipfilter.New(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	proxy.OverrideIPFilters(denyLocal, nil)
+	if _, err := get("203.0.113.5"); err == nil {
+		t.Fatal("expected connection to be closed")
+	}
+	cancel()
+}
+
+func TestProxyProtocol(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-For")))
+	}))
+	defer srv.Close()
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8102),
+		gproxy.WithSecurePort(8103),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithProxyProtocol("127.0.0.1"),
+		gproxy.WithRoute(fmt.Sprintf(`this.http && this.client_ip == '192.0.2.1' => {'name': 'api', 'target': '%s'}`, srv.URL)),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8102")
+	send := func(header string) *http.Response {
+		conn, err := net.Dial("tcp", "127.0.0.1:8102")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		t.Cleanup(func() { conn.Close() })
+		fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n", header)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return resp
+	}
+	resp := send("PROXY TCP4 192.0.2.1 127.0.0.1 56324 8102\r\n")
+	bits, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(bits) != "192.0.2.1" {
+		t.Fatalf("unexpected response: %v %s", resp.StatusCode, bits)
+	}
+	// without a header the load balancers address is used & no route matches
+	resp = send("")
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("expected request without PROXY header not to match the route")
+	}
+	cancel()
+}
+
+// echoHealthServer echoes the forwarding metadata it receives as response headers
+type echoHealthServer struct {
+	*health.Server
+}
+
+func (e *echoHealthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	echo := metadata.MD{}
+	for _, k := range []string{"x-forwarded-for", "x-forwarded-proto", "x-forwarded-host", "forwarded"} {
+		echo.Set("echo-"+k, md.Get(k)...)
+	}
+	grpc.SetHeader(ctx, echo)
+	return e.Server.Check(ctx, req)
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, k := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+			w.Header().Set("Echo-"+k, strings.Join(r.Header.Values(k), ", "))
+		}
+	}))
+	defer srv.Close()
+	addr, stop := serveGRPC(t, func(srv *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(srv, &echoHealthServer{Server: health.NewServer()})
+	})
+	defer stop()
+	serve := func(insecurePort, securePort int, opts ...gproxy.Opt) {
+		proxy, err := gproxy.New(ctx, append([]gproxy.Opt{
+			gproxy.WithInsecurePort(insecurePort),
+			gproxy.WithSecurePort(securePort),
+			gproxy.WithLogger(logger.New(true)),
+			gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'api', 'target': '%s'}`, srv.URL)),
+			gproxy.WithRoute(fmt.Sprintf(`this.grpc => {'name': 'grpc-api', 'target': '%s'}`, addr)),
+			gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"),
+		}, opts...)...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		go func() {
+			if err := proxy.Serve(ctx); err != nil {
+				t.Error(err.Error())
+			}
+		}()
+	}
+	// untrusted clients cannot spoof forwarding headers
+	serve(8104, 8105)
+	// clients from trusted proxies are appended to
+	serve(8106, 8107, gproxy.WithTrustedProxies("127.0.0.1"), gproxy.WithForwardedHeaders(gproxy.ForwardedAppend, true))
+	waitForListener(t, "tcp", "localhost:8104")
+	waitForListener(t, "tcp", "localhost:8106")
+	get := func(port int) http.Header {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%v/", port), nil)
+		req.Host = "api.example.com"
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("Forwarded", "for=203.0.113.9")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		return resp.Header
+	}
+	h := get(8104)
+	if h.Get("Echo-X-Forwarded-For") != "127.0.0.1" || h.Get("Echo-X-Forwarded-Proto") != "http" ||
+		h.Get("Echo-X-Forwarded-Host") != "api.example.com" || h.Get("Echo-Forwarded") != "" {
+		t.Fatalf("unexpected untrusted headers: %v", h)
+	}
+	h = get(8106)
+	if h.Get("Echo-X-Forwarded-For") != "203.0.113.9, 127.0.0.1" || h.Get("Echo-X-Forwarded-Proto") != "https" ||
+		h.Get("Echo-Forwarded") != "for=203.0.113.9, for=127.0.0.1;host=api.example.com;proto=http" {
+		t.Fatalf("unexpected trusted headers: %v", h)
+	}
+	conn, err := grpc.DialContext(ctx, "127.0.0.1:8106", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	var md metadata.MD
+	callCtx := metadata.AppendToOutgoingContext(ctx, "x-forwarded-for", "203.0.113.9")
+	if _, err := grpc_health_v1.NewHealthClient(conn).Check(callCtx, &grpc_health_v1.HealthCheckRequest{}, grpc.Header(&md)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.Join(md.Get("echo-x-forwarded-for"), ",") != "203.0.113.9, 127.0.0.1" ||
+		strings.Join(md.Get("echo-x-forwarded-proto"), ",") != "http" ||
+		strings.Join(md.Get("echo-x-forwarded-host"), ",") != "127.0.0.1:8106" ||
+		strings.Join(md.Get("echo-forwarded"), ",") != `for=127.0.0.1;host="127.0.0.1:8106";proto=http` {
+		t.Fatalf("unexpected gRPC metadata: %v", md)
+	}
+	cancel()
+}
+
+func TestUpstreamTransport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), &http2.Server{}))
+	defer srv.Close()
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8108),
+		gproxy.WithSecurePort(8109),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithUpstreamTransport("h2c", &upstream.Config{Protocol: upstream.H2C}),
+		gproxy.WithUpstreamTransport("*", &upstream.Config{Protocol: upstream.HTTP1, MaxIdleConnsPerHost: 10}),
+		gproxy.WithRoute(fmt.Sprintf(`this.http && this.path.startsWith('/h2c') => {'name': 'h2c', 'target': '%s'}`, srv.URL)),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'http1', 'target': '%s'}`, srv.URL)),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8108")
+	for path, expected := range map[string]string{
+		"/h2c": "HTTP/2.0",
+		"/":    "HTTP/1.1",
+	} {
+		resp, err := http.DefaultClient.Get("http://localhost:8108" + path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		bits, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(bits) != expected {
+			t.Fatalf("%s: expected %s got %s", path, expected, bits)
+		}
+	}
+	if _, err := gproxy.New(ctx, gproxy.WithAcmePolicy("false"), gproxy.WithUpstreamTransport("*", &upstream.Config{Protocol: "spdy"})); err == nil {
+		t.Fatal("expected unsupported protocol to be rejected")
+	}
+	cancel()
+}
+
+type countingHealthServer struct {
+	*health.Server
+	calls int64
+}
+
+func (c *countingHealthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	atomic.AddInt64(&c.calls, 1)
+	return c.Server.Check(ctx, req)
+}
+
+func TestMirror(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bits, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("primary:"), bits...))
+	}))
+	defer primary.Close()
+	mirrored := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bits, _ := ioutil.ReadAll(r.Body)
+		mirrored <- r.URL.Path + ":" + string(bits)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+	primaryGRPC, stopPrimary := serveGRPC(t, func(srv *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	})
+	defer stopPrimary()
+	shadowHealth := &countingHealthServer{Server: health.NewServer()}
+	shadowGRPC, stopShadow := serveGRPC(t, func(srv *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(srv, shadowHealth)
+	})
+	defer stopShadow()
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8110),
+		gproxy.WithSecurePort(8111),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithMirror("http-mirror", &mirror.Policy{Target: shadow.URL, Percent: 100}),
+		gproxy.WithMirror("grpc-mirror", &mirror.Policy{Target: shadowGRPC, Percent: 100}),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'http-mirror', 'target': '%s'}`, primary.URL)),
+		gproxy.WithRoute(fmt.Sprintf(`this.grpc => {'name': 'grpc-mirror', 'target': '%s'}`, primaryGRPC)),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8110")
+	resp, err := http.DefaultClient.Post("http://localhost:8110/users", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bits, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	// the shadows 500 never affects the primary response
+	if resp.StatusCode != http.StatusOK || string(bits) != "primary:hello" {
+		t.Fatalf("unexpected primary response: %v %s", resp.StatusCode, bits)
+	}
+	select {
+	case req := <-mirrored:
+		if req != "/users:hello" {
+			t.Fatalf("unexpected mirrored request: %s", req)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected request to be mirrored")
+	}
+	conn, err := grpc.DialContext(ctx, "localhost:8110", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	if _, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatal(err.Error())
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&shadowHealth.calls) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected gRPC call to be mirrored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(metrics.MirrorRequests.WithLabelValues("http-mirror", "mismatch")) != 1 ||
+		testutil.ToFloat64(metrics.MirrorRequests.WithLabelValues("grpc-mirror", "match")) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected mirror results to be recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+}
+
+func TestCanary(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("stable"))
+	}))
+	defer stable.Close()
+	canaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("canary"))
+	}))
+	defer canaryServer.Close()
+	stableGRPC, stopStable := serveGRPC(t, func(srv *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	})
+	defer stopStable()
+	canaryHealth := &countingHealthServer{Server: health.NewServer()}
+	canaryGRPC, stopCanary := serveGRPC(t, func(srv *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(srv, canaryHealth)
+	})
+	defer stopCanary()
+	blocked, err := authz.NewPolicy("unblocked", "!('X-Blocked' in this.headers)", false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8112),
+		gproxy.WithSecurePort(8113),
+		gproxy.WithAdminPort(8114),
+		gproxy.WithAdminToken("secret"),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithCanary("http-canary", &canary.Policy{
+			Targets:      []string{canaryServer.URL},
+			Pins:         []canary.Pin{{Header: "X-Canary"}},
+			StickyCookie: "gproxy_canary",
+		}),
+		gproxy.WithCanary("grpc-canary", &canary.Policy{
+			Targets:      []string{canaryGRPC},
+			Pins:         []canary.Pin{{Header: "x-canary", Values: []string{"beta"}}},
+			StickyHeader: "x-user-id",
+		}),
+		gproxy.WithAuthzPolicy(blocked),
+		gproxy.WithRouteAuthz("http-canary", "unblocked"),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'http-canary', 'target': '%s'}`, stable.URL)),
+		gproxy.WithRoute(fmt.Sprintf(`this.grpc => {'name': 'grpc-canary', 'target': '%s'}`, stableGRPC)),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8112")
+	get := func(header http.Header) (string, *http.Response) {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:8112/", nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer resp.Body.Close()
+		bits, _ := ioutil.ReadAll(resp.Body)
+		return string(bits), resp
+	}
+	// denied requests are rejected before traffic splitting
+	_, resp := get(http.Header{"X-Blocked": {"1"}})
+	if resp.StatusCode != http.StatusForbidden || len(resp.Cookies()) != 0 {
+		t.Fatalf("expected denied request to be rejected without a sticky cookie: %v %v", resp.StatusCode, resp.Cookies())
+	}
+	if n := testutil.ToFloat64(metrics.CanaryRequests.WithLabelValues("http-canary", "stable", "percent")); n != 0 {
+		t.Fatalf("expected denied request to be excluded from the canary metrics: %v", n)
+	}
+	body, resp := get(nil)
+	if body != "stable" {
+		t.Fatalf("expected stable response: %s", body)
+	}
+	var clientID string
+	for _, c := range resp.Cookies() {
+		if c.Name == "gproxy_canary" {
+			clientID = c.Value
+		}
+	}
+	if clientID == "" {
+		t.Fatal("expected sticky cookie to be issued")
+	}
+	if body, _ := get(http.Header{"X-Canary": {"1"}}); body != "canary" {
+		t.Fatalf("expected pinned request to be sent to the canary: %s", body)
+	}
+	// ramping the canary from the admin api requires the admin token
+	for method, expected := range map[string]int{http.MethodPost: http.StatusUnauthorized, http.MethodPut: http.StatusMethodNotAllowed} {
+		req, _ := http.NewRequest(method, "http://localhost:8114/canary?route=http-canary&percent=100", nil)
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("%s: expected %v got: %v", method, expected, resp.StatusCode)
+		}
+	}
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost:8114/canary?route=http-canary&percent=100", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected admin status: %v", resp.StatusCode)
+	}
+	body, resp = get(http.Header{"Cookie": {"gproxy_canary=" + clientID}})
+	if body != "canary" {
+		t.Fatalf("expected ramped request to be sent to the canary: %s", body)
+	}
+	if len(resp.Cookies()) != 0 {
+		t.Fatal("expected existing sticky cookie to be reused")
+	}
+	percent := func() float64 {
+		resp, err := http.DefaultClient.Get("http://localhost:8114/canary")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer resp.Body.Close()
+		var statuses map[string]struct {
+			Percent float64 `json:"percent"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+			t.Fatal(err.Error())
+		}
+		return statuses["http-canary"].Percent
+	}
+	reload := func(configured float64) {
+		if err := proxy.OverrideCanaries(map[string]*canary.Policy{
+			"http-canary": {Targets: []string{canaryServer.URL}, Percent: configured, StickyCookie: "gproxy_canary"},
+			"grpc-canary": {
+				Targets:      []string{canaryGRPC},
+				Pins:         []canary.Pin{{Header: "x-canary", Values: []string{"beta"}}},
+				StickyHeader: "x-user-id",
+			},
+		}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// ramps survive reloads until the configured percentage changes
+	reload(0)
+	if p := percent(); p != 100 {
+		t.Fatalf("expected ramped percent to survive a reload: %v", p)
+	}
+	reload(5)
+	if p := percent(); p != 5 {
+		t.Fatalf("expected the changed configured percent to replace the ramp: %v", p)
+	}
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost:8114/canary?route=unknown&percent=10", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected unknown canary route to be rejected: %v", resp.StatusCode)
+	}
+
+	conn, err := grpc.DialContext(ctx, "localhost:8112", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+	if _, err := client.Check(metadata.AppendToOutgoingContext(ctx, "x-user-id", "user-1"), &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if atomic.LoadInt64(&canaryHealth.calls) != 0 {
+		t.Fatal("expected unpinned gRPC call to be sent to the stable target")
+	}
+	if _, err := client.Check(metadata.AppendToOutgoingContext(ctx, "x-canary", "beta"), &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if atomic.LoadInt64(&canaryHealth.calls) != 1 {
+		t.Fatal("expected pinned gRPC call to be sent to the canary")
+	}
+	if testutil.ToFloat64(metrics.CanaryRequests.WithLabelValues("http-canary", "canary", "header")) != 1 ||
+		testutil.ToFloat64(metrics.CanaryRequests.WithLabelValues("http-canary", "canary", "percent")) != 1 ||
+		testutil.ToFloat64(metrics.CanaryRequests.WithLabelValues("grpc-canary", "stable", "percent")) != 1 {
+		t.Fatal("expected canary decisions to be recorded")
+	}
+	cancel()
+}
+
+func TestAffinity(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var urls []string
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("backend-%v", i)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		defer srv.Close()
+		urls = append(urls, fmt.Sprintf("'%s'", srv.URL))
+	}
+	var (
+		grpcTargets []string
+		healths     []*countingHealthServer
+	)
+	for i := 0; i < 3; i++ {
+		hs := &countingHealthServer{Server: health.NewServer()}
+		target, stop := serveGRPC(t, func(srv *grpc.Server) {
+			grpc_health_v1.RegisterHealthServer(srv, hs)
+		})
+		defer stop()
+		healths = append(healths, hs)
+		grpcTargets = append(grpcTargets, fmt.Sprintf("'%s'", target))
+	}
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8115),
+		gproxy.WithSecurePort(8116),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithAffinity("http-affinity", &affinity.Policy{Cookie: "gproxy_affinity"}),
+		gproxy.WithAffinity("grpc-affinity", &affinity.Policy{Hash: affinity.Metadata, Key: "x-session-id"}),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'http-affinity', 'targets': [%s]}`, strings.Join(urls, ", "))),
+		gproxy.WithRoute(fmt.Sprintf(`this.grpc => {'name': 'grpc-affinity', 'targets': [%s]}`, strings.Join(grpcTargets, ", "))),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8115")
+	get := func(cookie *http.Cookie) (string, *http.Response) {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:8115/", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer resp.Body.Close()
+		bits, _ := ioutil.ReadAll(resp.Body)
+		return string(bits), resp
+	}
+	pinned, resp := get(nil)
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == "gproxy_affinity" {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("expected affinity cookie to be issued")
+	}
+	for i := 0; i < 6; i++ {
+		body, resp := get(cookie)
+		if body != pinned {
+			t.Fatalf("expected pinned backend %s: %s", pinned, body)
+		}
+		if len(resp.Cookies()) != 0 {
+			t.Fatal("expected pinned client not to be issued a new cookie")
+		}
+	}
+	// clients without a cookie are load balanced
+	seen := map[string]bool{}
+	for i := 0; i < 6; i++ {
+		body, _ := get(nil)
+		seen[body] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected round robin without affinity: %v", seen)
+	}
+
+	conn, err := grpc.DialContext(ctx, "localhost:8115", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+	for i := 0; i < 6; i++ {
+		if _, err := client.Check(metadata.AppendToOutgoingContext(ctx, "x-session-id", "session-1"), &grpc_health_v1.HealthCheckRequest{}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	var max int64
+	for _, hs := range healths {
+		if calls := atomic.LoadInt64(&hs.calls); calls > max {
+			max = calls
+		}
+	}
+	if max != 6 {
+		t.Fatal("expected hashed gRPC calls to be sent to the same target")
+	}
+	cancel()
+}
+
+func TestCache(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var calls int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello world"))
+	}))
+	defer srv.Close()
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8117),
+		gproxy.WithSecurePort(8118),
+		gproxy.WithAdminPort(8119),
+		gproxy.WithAdminToken("secret"),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithCache("cached", cache.New(cache.NewMemory(1<<20), 0)),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'cached', 'target': '%s'}`, srv.URL)),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8117")
+	do := func(method, u string) (string, *http.Response) {
+		req, _ := http.NewRequest(method, u, nil)
+		if strings.Contains(u, "/cache/purge") {
+			req.Header.Set("Authorization", "Bearer secret")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer resp.Body.Close()
+		bits, _ := ioutil.ReadAll(resp.Body)
+		return string(bits), resp
+	}
+	for i := 0; i < 3; i++ {
+		body, resp := do(http.MethodGet, "http://localhost:8117/users")
+		if body != "hello world" {
+			t.Fatalf("unexpected response: %s", body)
+		}
+		if i > 0 && !strings.HasPrefix(resp.Header.Get("Cache-Status"), "gproxy; hit") {
+			t.Fatalf("expected cache hit: %s", resp.Header.Get("Cache-Status"))
+		}
+	}
+	if atomic.LoadInt64(&calls) != 1 {
+		t.Fatalf("expected cached responses: %v", atomic.LoadInt64(&calls))
+	}
+	do(http.MethodPost, "http://localhost:8117/users")
+	if atomic.LoadInt64(&calls) != 2 {
+		t.Fatal("expected POST requests to bypass the cache")
+	}
+	if body, _ := do(http.MethodPost, "http://localhost:8119/cache/purge?route=cached&prefix=localhost:8117/users"); body != "{\"purged\":1}\n" {
+		t.Fatalf("unexpected purge response: %s", body)
+	}
+	do(http.MethodGet, "http://localhost:8117/users")
+	if atomic.LoadInt64(&calls) != 3 {
+		t.Fatal("expected purged response to be fetched")
+	}
+	if testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("cached", "hit")) != 2 {
+		t.Fatal("expected cache hits to be recorded")
+	}
+	cancel()
+}
+
+func TestCompression(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	body := strings.Repeat("hello world ", 500)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	encodings := make(chan string, 1)
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	gsrv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		// grpc-encoding is a reserved header, so it's read from the transport stream instead of the metadata
+		if stream, ok := grpc.ServerTransportStreamFromContext(ctx).(interface{ RecvCompress() string }); ok {
+			encodings <- stream.RecvCompress()
+		}
+		return handler(ctx, req)
+	}))
+	grpc_health_v1.RegisterHealthServer(gsrv, health.NewServer())
+	go gsrv.Serve(lis)
+	defer gsrv.Stop()
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8120),
+		gproxy.WithSecurePort(8121),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithGRPCCompressors(compress.Zstd),
+		gproxy.WithCompression("*", &compress.Policy{GRPCEncoding: compress.Gzip}),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'http', 'target': '%s'}`, srv.URL)),
+		gproxy.WithRoute(fmt.Sprintf(`this.grpc => {'name': 'grpc', 'target': '%s'}`, lis.Addr().String())),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8120")
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:8120/", nil)
+	req.Header.Set("Accept-Encoding", "gzip;q=0.5, br")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != compress.Brotli {
+		t.Fatalf("expected brotli response: %v", resp.Header)
+	}
+	r, err := compress.NewReader(compress.Brotli, resp.Body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bits, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(bits) != body {
+		t.Fatal("unexpected decompressed body")
+	}
+
+	conn, err := grpc.DialContext(ctx, "localhost:8120", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	if _, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.UseCompressor(compress.Zstd)); err != nil {
+		t.Fatal(err.Error())
+	}
+	// zstd messages from the client are recompressed with gzip for the target
+	select {
+	case enc := <-encodings:
+		if enc != compress.Gzip {
+			t.Fatalf("expected gzip messages to be sent to the target: %s", enc)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected target to record the message encoding")
+	}
+	cancel()
+}
+
+func TestSizeLimits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	gsrv := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(gsrv, health.NewServer())
+	go gsrv.Serve(lis)
+	defer gsrv.Stop()
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8122),
+		gproxy.WithSecurePort(8123),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithSizeLimits("*", &sizelimit.Limits{MaxHeaderBytes: 1024, MaxBodyBytes: 100}),
+		gproxy.WithSizeLimits("grpc", &sizelimit.Limits{MaxMessageBytes: 8}),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'http', 'target': '%s'}`, srv.URL)),
+		gproxy.WithRoute(fmt.Sprintf(`this.grpc => {'name': 'grpc', 'target': '%s'}`, lis.Addr().String())),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8122")
+	post := func(body io.Reader, header http.Header) int {
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost:8122/", body)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post(strings.NewReader("small"), nil); code != http.StatusOK {
+		t.Fatalf("expected 200: %v", code)
+	}
+	if code := post(strings.NewReader(strings.Repeat("a", 200)), nil); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413: %v", code)
+	}
+	// bodies of unknown length are rejected once they are read past the limit
+	if code := post(ioutil.NopCloser(strings.NewReader(strings.Repeat("a", 200))), nil); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for streamed body: %v", code)
+	}
+	if code := post(nil, http.Header{"X-Large": {strings.Repeat("a", 2048)}}); code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("expected 431: %v", code)
+	}
+
+	conn, err := grpc.DialContext(ctx, "localhost:8122", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+	if _, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: "a very long service name"})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected RESOURCE_EXHAUSTED: %v", err)
+	}
+	cancel()
+}
+
+func TestServerLimits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8124),
+		gproxy.WithSecurePort(8125),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithServerConfig(&server.Config{
+			ReadHeaderTimeout:   500 * time.Millisecond,
+			MaxConnectionsPerIP: 1,
+		}),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'http', 'target': '%s'}`, srv.URL)),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	// connections are counted against the per listener limits, so readiness is checked on the secure port
+	waitForListener(t, "tcp", "localhost:8125")
+	// a slow client that never finishes its request headers
+	slow, err := net.Dial("tcp", "localhost:8124")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer slow.Close()
+	slow.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n"))
+	time.Sleep(100 * time.Millisecond)
+	// the client already has an open connection
+	rejected, err := net.Dial("tcp", "localhost:8124")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer rejected.Close()
+	rejected.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected connection over the per ip limit to be closed: %v", err)
+	}
+	start := time.Now()
+	slow.SetReadDeadline(time.Now().Add(3 * time.Second))
+	ioutil.ReadAll(slow)
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("expected slow client to be disconnected by the header timeout")
+	}
+	// the slow clients slot is released once its connection is closed
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://localhost:8124/")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200: %v", resp.StatusCode)
+	}
+	if v := testutil.ToFloat64(metrics.ConnectionsRejected.WithLabelValues("insecure", server.ReasonClientIP)); v != 1 {
+		t.Fatalf("expected 1 rejected connection: %v", v)
+	}
+	cancel()
+}
+
+// cacheCertificate writes a self-signed certificate for the host to the autocert cache dir so the proxy serves TLS
+// without an acme account. autocert serves RSA certificates to TLS 1.3 only clients(ex: QUIC). It returns a pool that
+// trusts the certificate
+func cacheCertificate(t *testing.T, dir, host string) *x509.CertPool {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(dir, host+"+rsa"), buf.Bytes(), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return pool
+}
+
+func TestHTTP3(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "gproxy-http3")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	pool := cacheCertificate(t, dir, "graphikdb.io")
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8126),
+		gproxy.WithSecurePort(8127),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithCertCacheDir(dir),
+		gproxy.WithHTTP3(true),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'http', 'target': '%s'}`, srv.URL)),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "127.0.0.1:8127")
+	transport := &http3.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+			return quic.DialAddrEarly(ctx, "127.0.0.1:8127", tlsCfg, cfg)
+		},
+	}
+	defer transport.Close()
+	// requests received over QUIC are routed like https requests
+	resp, err := (&http.Client{Transport: transport}).Get("https://graphikdb.io:8127/hello")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 3 || string(body) != "/hello" {
+		t.Fatalf("expected proxied HTTP/3 response: %v %s %s", resp.StatusCode, resp.Proto, body)
+	}
+	if resp.Header.Get("Alt-Svc") != `h3=":8127"; ma=86400` {
+		t.Fatalf("expected Alt-Svc header: %s", resp.Header.Get("Alt-Svc"))
+	}
+	cancel()
+}
+
+func TestServeFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	taken, err := net.Listen("tcp", ":8145")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer taken.Close()
+	var polls int32
+	users := discovery.Poll(func(ctx context.Context) ([]string, error) {
+		atomic.AddInt32(&polls, 1)
+		return []string{"localhost:8080"}, nil
+	}, 10*time.Millisecond, nil)
+	// the admin server is the last to be started
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8143),
+		gproxy.WithSecurePort(8144),
+		gproxy.WithAdminPort(8145),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithService("users", users),
+		gproxy.WithRoute(`this.http => {'name': 'users', 'service': 'users', 'scheme': 'http'}`),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- proxy.Serve(ctx)
+	}()
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Fatal("expected serve to fail when a port is taken")
+		}
+	case <-ctx.Done():
+		t.Fatal("expected serve to return when a port is taken")
+	}
+	// the listeners bound before the failure are closed & the routines that were started are stopped
+	for _, addr := range []string{":8143", ":8144"} {
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		lis.Close()
+	}
+	stopped := atomic.LoadInt32(&polls)
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&polls); n != stopped {
+		t.Fatalf("expected service discovery to stop: %v polls after serve returned", n-stopped)
+	}
+}
+
+func TestL4(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("passthrough"))
+	}))
+	defer tlsSrv.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tcp"))
+	}))
+	defer srv.Close()
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8128),
+		gproxy.WithSecurePort(8129),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithL4(&l4.Config{Passthrough: true, Ports: []int{8130}}),
+		gproxy.WithL4Route(fmt.Sprintf(`this.sni == 'db.graphikdb.io' => {'name': 'db', 'target': '%s'}`, tlsSrv.Listener.Addr().String())),
+		gproxy.WithL4Route(fmt.Sprintf(`this.port == 8130 => {'name': 'tcp', 'target': 'tcp://%s'}`, srv.Listener.Addr().String())),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	// L4 ports are bound after the proxies listeners
+	waitForListener(t, "tcp", "localhost:8130")
+	// TLS isn't terminated by the proxy, so the client sees the targets certificate
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{ServerName: "db.graphikdb.io", InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get("https://localhost:8129/")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bits, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(bits) != "passthrough" {
+		t.Fatalf("unexpected response: %s", bits)
+	}
+	if !resp.TLS.PeerCertificates[0].Equal(tlsSrv.Certificate()) {
+		t.Fatal("expected the targets certificate")
+	}
+	resp, err = http.Get("http://localhost:8130/")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bits, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(bits) != "tcp" {
+		t.Fatalf("unexpected response: %s", bits)
+	}
+	if v := testutil.ToFloat64(metrics.L4Connections.WithLabelValues("db", "proxied")); v != 1 {
+		t.Fatalf("expected 1 proxied connection: %v", v)
+	}
+	cancel()
+}
+
+func TestUDP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer target.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := target.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			target.WriteTo(append([]byte("echo: "), buf[:n]...), addr)
+		}
+	}()
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8131),
+		gproxy.WithSecurePort(8132),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithL4(&l4.Config{UDPPorts: []int{8133}, UDPSessionTimeout: 500 * time.Millisecond}),
+		gproxy.WithL4Route(fmt.Sprintf(`this.udp && this.port == 8133 => {'name': 'dns', 'target': 'udp://%s'}`, target.LocalAddr().String())),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	waitForListener(t, "tcp", "localhost:8131")
+	client, err := net.Dial("udp", "localhost:8133")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+	exchange := func(msg string) (string, error) {
+		client.Write([]byte(msg))
+		buf := make([]byte, 64)
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := client.Read(buf)
+		return string(buf[:n]), err
+	}
+	// the UDP port is bound after the proxies listeners, so the first datagram is resent until it's echoed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reply, err := exchange("hello")
+		if err == nil && reply == "echo: hello" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected echoed datagram: %s %v", reply, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reply, err := exchange("world"); err != nil || reply != "echo: world" {
+		t.Fatalf("expected echoed datagram: %s %v", reply, err)
+	}
+	// datagrams from the same client address share a session
+	if v := testutil.ToFloat64(metrics.UDPSessions.WithLabelValues("dns", "created")); v != 1 {
+		t.Fatalf("expected 1 session: %v", v)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(metrics.UDPActiveSessions.WithLabelValues("dns")) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected idle session to expire")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	cancel()
+}
+
+func TestListeners(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	public := newServer("public")
+	defer public.Close()
+	admin := newServer("admin")
+	defer admin.Close()
+	dir, err := ioutil.TempDir("", "gproxy-listeners")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "gproxy.sock")
+	if _, err := gproxy.New(ctx,
+		gproxy.WithListenerRoutes("unknown", `this.http => 'http://localhost:8080'`),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')")); err == nil {
+		t.Fatal("expected routes scoped to an unknown listener to be rejected")
+	}
+	proxy, err := gproxy.New(ctx,
+		gproxy.WithInsecurePort(8134),
+		gproxy.WithSecurePort(8135),
+		gproxy.WithLogger(logger.New(true)),
+		gproxy.WithListener("internal", &listener.Config{Address: "127.0.0.1:8136", Protocols: []listener.Protocol{listener.HTTP}}),
+		gproxy.WithListener("sidecar", &listener.Config{Network: "unix", Address: socket}),
+		gproxy.WithListenerRoutes("internal", fmt.Sprintf(`this.http => {'name': 'admin', 'target': '%s'}`, admin.URL)),
+		gproxy.WithRoute(fmt.Sprintf(`this.http && this.listener == 'sidecar' => {'name': 'sidecar', 'target': '%s'}`, admin.URL)),
+		gproxy.WithRoute(fmt.Sprintf(`this.http => {'name': 'public', 'target': '%s'}`, public.URL)),
+		gproxy.WithAcmePolicy("this.host.contains('graphikdb.io')"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		if err := proxy.Serve(ctx); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	// custom listeners are bound after the insecure & secure listeners(in order of their names)
+	waitForListener(t, "unix", socket)
+	get := func(client *http.Client, url string) string {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	for url, expected := range map[string]string{
+		"http://localhost:8134/": "public",
+		// the internal listener only matches its scoped routes
+		"http://127.0.0.1:8136/": "admin",
+	} {
+		if body := get(http.DefaultClient, url); body != expected {
+			t.Fatalf("%s: expected %s got: %s", url, expected, body)
+		}
+	}
+	if body := get(unixClient, "http://gproxy/"); body != "admin" {
+		t.Fatalf("expected unix socket requests to match this.listener: %s", body)
+	}
+	// removing the scoped routes keeps the listener isolated from the proxies routes
+	if err := proxy.OverrideListenerRoutes("internal", nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	if body := get(http.DefaultClient, "http://127.0.0.1:8136/"); body == "public" || body == "admin" {
+		t.Fatalf("expected internal listener to match zero routes: %s", body)
+	}
+	// listeners without scoped routes may be scoped by a reload
+	if err := proxy.OverrideListenerRoutes("insecure", []string{
+		fmt.Sprintf(`this.http => {'name': 'admin', 'target': '%s'}`, admin.URL),
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if body := get(http.DefaultClient, "http://localhost:8134/"); body != "admin" {
+		t.Fatalf("expected insecure listener to match its scoped routes: %s", body)
+	}
+	cancel()
+}
@@ -0,0 +1,166 @@
+// Package proxyproto parses HAProxy PROXY protocol(v1 & v2) headers sent by load balancers(ex: AWS NLB) so the original client address is preserved
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// v2Signature prefixes every PROXY protocol v2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// v1MaxLength is the maximum length of a v1 header including the trailing CRLF
+	v1MaxLength = 107
+	v2HeaderLen = 16
+)
+
+// ErrInvalidHeader is returned when a connection starts with a malformed PROXY protocol header
+var ErrInvalidHeader = errors.New("proxyproto: invalid header")
+
+// Header is a parsed PROXY protocol header. Source & Destination are nil when the header doesn't carry addresses
+// (v1 UNKNOWN, v2 LOCAL or unsupported address families)
+type Header struct {
+	Version     int
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// ReadHeader reads a v1 or v2 header from the reader. It returns a nil header & error if the stream doesn't start with a PROXY protocol signature
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		prefix, err := r.Peek(6)
+		if err != nil || string(prefix) != "PROXY " {
+			return nil, nil
+		}
+		return readV1(r)
+	case v2Signature[0]:
+		prefix, err := r.Peek(len(v2Signature))
+		if err != nil || !bytes.Equal(prefix, v2Signature) {
+			return nil, nil
+		}
+		return readV2(r)
+	default:
+		return nil, nil
+	}
+}
+
+// readV1 reads a human-readable header. ex: PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.Wrap(ErrInvalidHeader, "v1 header too long")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	header := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.Wrapf(ErrInvalidHeader, "v1: %q", line)
+	}
+	src, err := tcpAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := tcpAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	header.Source, header.Destination = src, dst
+	return header, nil
+}
+
+func tcpAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.Wrapf(ErrInvalidHeader, "v1: invalid address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidHeader, "v1: invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readV2 reads a binary header. TLVs are skipped
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, v2HeaderLen)
+	if _, err := readFull(r, fixed); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, errors.Wrapf(ErrInvalidHeader, "v2: unsupported version %v", fixed[12]>>4)
+	}
+	command := fixed[12] & 0x0F
+	family := fixed[13]
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := readFull(r, payload); err != nil {
+		return nil, err
+	}
+	header := &Header{Version: 2}
+	switch command {
+	case 0x0: // LOCAL: health checks etc. sent by the proxy itself
+		return header, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errors.Wrapf(ErrInvalidHeader, "v2: unsupported command %v", command)
+	}
+	var ipLen int
+	switch family >> 4 {
+	case 0x1:
+		ipLen = net.IPv4len
+	case 0x2:
+		ipLen = net.IPv6len
+	default:
+		// AF_UNSPEC & AF_UNIX addresses aren't exposed
+		return header, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, errors.Wrap(ErrInvalidHeader, "v2: address block too short")
+	}
+	src := net.IP(append([]byte{}, payload[:ipLen]...))
+	dst := net.IP(append([]byte{}, payload[ipLen:2*ipLen]...))
+	srcPort := int(binary.BigEndian.Uint16(payload[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))
+	if family&0x0F == 0x2 {
+		header.Source = &net.UDPAddr{IP: src, Port: srcPort}
+		header.Destination = &net.UDPAddr{IP: dst, Port: dstPort}
+	} else {
+		header.Source = &net.TCPAddr{IP: src, Port: srcPort}
+		header.Destination = &net.TCPAddr{IP: dst, Port: dstPort}
+	}
+	return header, nil
+}
+
+func readFull(r *bufio.Reader, buf []byte) (int, error) {
+	var n int
+	for n < len(buf) {
+		read, err := r.Read(buf[n:])
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,142 @@
+package proxyproto
+
+import (
+	"bufio"
+	"github.com/graphikDB/gproxy/ipfilter"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultHeaderTimeout is how long a trusted connection has to send its header before it is closed
+const DefaultHeaderTimeout = 10 * time.Second
+
+// Listener wraps a listener, reading PROXY protocol headers from connections sent by trusted sources. Headers are read
+// in the background so slow clients don't block Accept. Connections from untrusted sources are returned untouched -
+// their headers are never parsed so clients cannot spoof their address.
+// Trusted connections without a header are returned with their original address(ex: load balancer health checks)
+func Listener(l net.Listener, trusted []*net.IPNet, headerTimeout time.Duration, onErr func(addr net.Addr, err error)) net.Listener {
+	if headerTimeout <= 0 {
+		headerTimeout = DefaultHeaderTimeout
+	}
+	return &listener{
+		Listener:      l,
+		trusted:       trusted,
+		headerTimeout: headerTimeout,
+		onErr:         onErr,
+		conns:         make(chan net.Conn),
+		done:          make(chan struct{}),
+		closing:       make(chan struct{}),
+	}
+}
+
+type listener struct {
+	net.Listener
+	trusted       []*net.IPNet
+	headerTimeout time.Duration
+	onErr         func(addr net.Addr, err error)
+	conns         chan net.Conn
+	start         sync.Once
+	done          chan struct{}
+	err           error
+	closeOnce     sync.Once
+	closing       chan struct{}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	l.start.Do(func() {
+		go l.serve()
+	})
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closing)
+	})
+	return l.Listener.Close()
+}
+
+func (l *listener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			close(l.done)
+			return
+		}
+		if tcp, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !ipfilter.Contains(l.trusted, tcp.IP) {
+			l.deliver(conn)
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *listener) handshake(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(l.headerTimeout))
+	r := bufio.NewReader(conn)
+	header, err := ReadHeader(r)
+	if err != nil {
+		if l.onErr != nil {
+			l.onErr(conn.RemoteAddr(), err)
+		}
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	c := &Conn{Conn: conn, r: r}
+	if header != nil {
+		c.header = *header
+	}
+	l.deliver(c)
+}
+
+func (l *listener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closing:
+		conn.Close()
+	}
+}
+
+// Conn is a connection whose PROXY protocol header has been read
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	header Header
+}
+
+// Header returns the connections PROXY protocol header. The header is empty if the connection didn't send one
+func (c *Conn) Header() Header {
+	return c.header
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the source address from the PROXY protocol header, falling back to the connections address
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address from the PROXY protocol header, falling back to the connections address
+func (c *Conn) LocalAddr() net.Addr {
+	if c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,129 @@
+package proxyproto_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/graphikDB/gproxy/ipfilter"
+	"github.com/graphikDB/gproxy/proxyproto"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func v2Header(command byte, family byte, addrs []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("\r\n\r\n\x00\r\nQUIT\n")
+	buf.WriteByte(0x20 | command)
+	buf.WriteByte(family)
+	binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	return buf.Bytes()
+}
+
+func TestReadHeader(t *testing.T) {
+	ipv4 := append(append(net.ParseIP("192.0.2.1").To4(), net.ParseIP("198.51.100.1").To4()...), 0xDC, 0x04, 0x01, 0xBB)
+	// ipv4 addresses followed by a TLV that must be skipped
+	ipv4TLV := append(append([]byte{}, ipv4...), 0x04, 0x00, 0x01, 0xFF)
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xDC, 0x04, 0x01, 0xBB)
+	for name, tc := range map[string]struct {
+		input  string
+		source string
+		err    bool
+	}{
+		"v1-tcp4":    {input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET /", source: "192.0.2.1:56324"},
+		"v1-tcp6":    {input: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET /", source: "[2001:db8::1]:56324"},
+		"v1-unknown": {input: "PROXY UNKNOWN\r\nGET /"},
+		"v1-invalid": {input: "PROXY TCP4 not-an-ip 198.51.100.1 56324 443\r\nGET /", err: true},
+		"v1-long":    {input: "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", err: true},
+		"v2-tcp4":    {input: string(v2Header(0x1, 0x11, ipv4TLV)) + "GET /", source: "192.0.2.1:56324"},
+		"v2-tcp6":    {input: string(v2Header(0x1, 0x21, ipv6)) + "GET /", source: "[2001:db8::1]:56324"},
+		"v2-local":   {input: string(v2Header(0x0, 0x00, nil)) + "GET /"},
+		"v2-short":   {input: string(v2Header(0x1, 0x11, ipv4[:4])) + "GET /", err: true},
+		"none":       {input: "GET /"},
+	} {
+		r := bufio.NewReader(strings.NewReader(tc.input))
+		header, err := proxyproto.ReadHeader(r)
+		if tc.err {
+			if err == nil {
+				t.Fatalf("%s: expected error", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		var source string
+		if header != nil && header.Source != nil {
+			source = header.Source.String()
+		}
+		if source != tc.source {
+			t.Fatalf("%s: expected source %q got %q", name, tc.source, source)
+		}
+		rest, _ := ioutil.ReadAll(r)
+		if string(rest) != "GET /" {
+			t.Fatalf("%s: unexpected remaining bytes: %q", name, rest)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	trusted, _ := ipfilter.ParseCIDRs([]string{"127.0.0.1"})
+	pl := proxyproto.Listener(l, trusted, time.Second, nil)
+	defer pl.Close()
+	accept := func(payload string) (net.Conn, string) {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer client.Close()
+		if _, err := client.Write([]byte(payload)); err != nil {
+			t.Fatal(err.Error())
+		}
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		buf := make([]byte, 5)
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatal(err.Error())
+		}
+		return conn, string(buf)
+	}
+	conn, body := accept("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello")
+	if conn.RemoteAddr().String() != "192.0.2.1:56324" || body != "hello" {
+		t.Fatalf("unexpected connection: %s %q", conn.RemoteAddr(), body)
+	}
+	conn, body = accept("hello")
+	if !strings.HasPrefix(conn.RemoteAddr().String(), "127.0.0.1:") || body != "hello" {
+		t.Fatalf("unexpected connection: %s %q", conn.RemoteAddr(), body)
+	}
+	// headers from untrusted sources are never parsed
+	ul, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	untrusted := proxyproto.Listener(ul, nil, time.Second, nil)
+	defer untrusted.Close()
+	client, err := net.Dial("tcp", ul.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	conn, err = untrusted.Accept()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	if !strings.HasPrefix(conn.RemoteAddr().String(), "127.0.0.1:") {
+		t.Fatalf("unexpected untrusted address: %s", conn.RemoteAddr())
+	}
+}
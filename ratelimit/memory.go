@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often idle keys are removed from a MemoryStore
+const sweepInterval = time.Minute
+
+// MemoryStore keeps rate limiting state in memory. Limits are enforced per proxy instance
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	windows   map[string]*window
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	last    time.Time
+	expires time.Time
+}
+
+type window struct {
+	index   int64
+	prev    int64
+	curr    int64
+	expires time.Time
+}
+
+// NewMemoryStore creates an in-memory Store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:   map[string]*bucket{},
+		windows:   map[string]*window{},
+		lastSweep: time.Now(),
+	}
+}
+
+func (m *MemoryStore) TokenBucket(ctx context.Context, key string, rate float64, burst int, now time.Time) (float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep(now)
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		m.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(burst), b.tokens+elapsed*rate)
+		b.last = now
+	}
+	// a full bucket is indistinguishable from a missing one, so the key may be dropped once it has refilled
+	b.expires = now.Add(time.Duration((float64(burst) - b.tokens + 1) / rate * float64(time.Second)))
+	if b.tokens >= 1 {
+		b.tokens--
+		return b.tokens, nil
+	}
+	return b.tokens - 1, nil
+}
+
+func (m *MemoryStore) SlidingWindow(ctx context.Context, key string, limit int, size time.Duration, now time.Time) (int64, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep(now)
+	index := windowIndex(size, now)
+	w, ok := m.windows[key]
+	if !ok {
+		w = &window{index: index}
+		m.windows[key] = w
+	}
+	switch {
+	case w.index == index-1:
+		w.prev, w.curr = w.curr, 0
+	case w.index < index-1:
+		w.prev, w.curr = 0, 0
+	}
+	w.index = index
+	w.expires = now.Add(2 * size)
+	prev, curr := w.prev, w.curr
+	if slidingWindowAllowed(prev, curr, limit, size, now) {
+		w.curr++
+	}
+	return prev, curr, nil
+}
+
+// sweep removes idle keys
+func (m *MemoryStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+	m.lastSweep = now
+	for key, b := range m.buckets {
+		if now.After(b.expires) {
+			delete(m.buckets, key)
+		}
+	}
+	for key, w := range m.windows {
+		if now.After(w.expires) {
+			delete(m.windows, key)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Package ratelimit limits requests by keys computed from request attributes using token bucket or sliding window algorithms
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"github.com/graphikDB/trigger"
+	"github.com/pkg/errors"
+	"math"
+	"time"
+)
+
+// Algorithm is a rate limiting algorithm
+type Algorithm string
+
+const (
+	// TokenBucket allows bursts of up to Burst requests, refilling at Limit requests per Period
+	TokenBucket Algorithm = "token_bucket"
+	// SlidingWindow allows Limit requests within any Period, weighting the previous window by its overlap
+	SlidingWindow Algorithm = "sliding_window"
+)
+
+// Rule limits requests that share the same key
+type Rule struct {
+	// Name identifies the rule in store keys & metrics
+	Name string
+	// Key is an expression that computes the key requests are limited by(default: this.client_ip).
+	// Requests whose key evaluates to an empty string aren't limited by the rule, while requests whose key can't be
+	// evaluated(ex: a missing header) share a single bucket
+	// ex: 'X-Api-Key' in this.headers ? this.headers['X-Api-Key'] : ''
+	// expression attributes: (this.http<bool>, this.grpc<bool>, this.host<string>, this.headers<map>, this.path<string>, this.method<string>, this.client_ip<string>, this.claims<map>, this.route<string>)
+	Key string
+	// Algorithm is the limiting algorithm(default: token_bucket)
+	Algorithm Algorithm
+	// Limit is the number of requests allowed per Period
+	Limit int
+	// Period is the duration Limit applies to(default: 1s)
+	Period time.Duration
+	// Burst is the token bucket capacity(default: Limit)
+	Burst int
+}
+
+// Result is the outcome of a rate limit check
+type Result struct {
+	// Allowed reports whether the request may proceed
+	Allowed bool
+	// RetryAfter is the minimum duration before a denied request may be retried
+	RetryAfter time.Duration
+	// Rule is the name of the rule that denied the request
+	Rule string
+}
+
+// Store holds rate limiting state. Shared stores(ex: Redis) enforce limits across proxy replicas
+type Store interface {
+	// TokenBucket takes a token from the keys bucket, which holds at most burst tokens & refills at rate tokens per second.
+	// It returns the remaining tokens(negative if the request was denied)
+	TokenBucket(ctx context.Context, key string, rate float64, burst int, now time.Time) (float64, error)
+	// SlidingWindow counts a request against the keys current window if the weighted count is below the limit.
+	// It returns the request counts of the previous & current windows before the request was counted
+	SlidingWindow(ctx context.Context, key string, limit int, window time.Duration, now time.Time) (prev int64, curr int64, err error)
+}
+
+// Limiter enforces a set of rules
+type Limiter struct {
+	store Store
+	rules []*compiledRule
+}
+
+type compiledRule struct {
+	Rule
+	trigger *trigger.Trigger
+}
+
+// New creates a Limiter that enforces the rules using the store(default: in-memory)
+func New(store Store, rules ...Rule) (*Limiter, error) {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	l := &Limiter{store: store}
+	for _, r := range rules {
+		if r.Name == "" {
+			return nil, errors.New("ratelimit: empty rule name")
+		}
+		if r.Limit <= 0 {
+			return nil, errors.Errorf("ratelimit: %s: limit must be > 0", r.Name)
+		}
+		switch r.Algorithm {
+		case "":
+			r.Algorithm = TokenBucket
+		case TokenBucket, SlidingWindow:
+		default:
+			return nil, errors.Errorf("ratelimit: %s: unsupported algorithm: %s", r.Name, r.Algorithm)
+		}
+		if r.Period <= 0 {
+			r.Period = time.Second
+		}
+		if r.Burst <= 0 {
+			r.Burst = r.Limit
+		}
+		if r.Key == "" {
+			r.Key = "this.client_ip"
+		}
+		t, err := trigger.NewArrowTrigger(fmt.Sprintf("true => %s", r.Key))
+		if err != nil {
+			return nil, errors.Wrapf(err, "ratelimit: invalid key expression for %s", r.Name)
+		}
+		l.rules = append(l.rules, &compiledRule{Rule: r, trigger: t})
+	}
+	return l, nil
+}
+
+// Allow checks the request against every rule. Requests with an empty key are not limited by the rule & requests whose
+// key can't be evaluated are limited by the rules shared bucket, so they can't bypass the rule. Errors are only returned
+// if the store fails
+func (l *Limiter) Allow(ctx context.Context, data map[string]interface{}) (Result, error) {
+	if l == nil {
+		return Result{Allowed: true}, nil
+	}
+	now := time.Now()
+	for _, r := range l.rules {
+		// the shared buckets key can't collide with the keys of evaluated requests(name:value)
+		key := r.Name
+		if result, err := r.trigger.Trigger(data); err == nil {
+			value, ok := result["value"]
+			if !ok || value == nil || fmt.Sprint(value) == "" {
+				continue
+			}
+			key = fmt.Sprintf("%s:%v", r.Name, value)
+		}
+		var retryAfter time.Duration
+		switch r.Algorithm {
+		case SlidingWindow:
+			prev, curr, err := l.store.SlidingWindow(ctx, key, r.Limit, r.Period, now)
+			if err != nil {
+				return Result{Allowed: true}, err
+			}
+			retryAfter = SlidingWindowWait(prev, curr, r.Limit, r.Period, now)
+		default:
+			rate := float64(r.Limit) / r.Period.Seconds()
+			tokens, err := l.store.TokenBucket(ctx, key, rate, r.Burst, now)
+			if err != nil {
+				return Result{Allowed: true}, err
+			}
+			if tokens < 0 {
+				retryAfter = time.Duration((-tokens) / rate * float64(time.Second))
+			}
+		}
+		if retryAfter > 0 {
+			return Result{RetryAfter: retryAfter, Rule: r.Name}, nil
+		}
+	}
+	return Result{Allowed: true}, nil
+}
+
+// SlidingWindowWait returns the duration until a request would be allowed given the previous & current window counts(0 if allowed now)
+func SlidingWindowWait(prev, curr int64, limit int, window time.Duration, now time.Time) time.Duration {
+	if slidingWindowAllowed(prev, curr, limit, window, now) {
+		return 0
+	}
+	elapsed := time.Duration(now.UnixNano() % int64(window))
+	if curr < int64(limit) && prev > 0 {
+		// wait for the previous windows weight to decay
+		decay := float64(window) * (float64(prev)*slidingWindowWeight(window, now) + float64(curr) - float64(limit)) / float64(prev)
+		return time.Duration(math.Ceil(decay)) + time.Nanosecond
+	}
+	// wait for the next window, then for the current windows weight(as the previous window) to decay
+	return window - elapsed + time.Duration(float64(window)*(1-float64(limit)/float64(curr))) + time.Nanosecond
+}
+
+// slidingWindowWeight returns the weight of the previous window: the fraction of it that overlaps the sliding window
+func slidingWindowWeight(window time.Duration, now time.Time) float64 {
+	elapsed := time.Duration(now.UnixNano() % int64(window))
+	return float64(window-elapsed) / float64(window)
+}
+
+func slidingWindowAllowed(prev, curr int64, limit int, window time.Duration, now time.Time) bool {
+	return float64(prev)*slidingWindowWeight(window, now)+float64(curr) < float64(limit)
+}
+
+// windowIndex returns the index of the fixed window that contains now
+func windowIndex(window time.Duration, now time.Time) int64 {
+	return now.UnixNano() / int64(window)
+}
@@ -0,0 +1,131 @@
+package ratelimit_test
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/graphikDB/gproxy/ratelimit"
+	"testing"
+	"time"
+)
+
+func stores(t *testing.T) map[string]func() ratelimit.Store {
+	return map[string]func() ratelimit.Store{
+		"memory": func() ratelimit.Store {
+			return ratelimit.NewMemoryStore()
+		},
+		"redis": func() ratelimit.Store {
+			srv, err := miniredis.Run()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			t.Cleanup(srv.Close)
+			return ratelimit.NewRedisStore(redis.NewClient(&redis.Options{Addr: srv.Addr()}), "")
+		},
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range stores(t) {
+		for _, algorithm := range []ratelimit.Algorithm{ratelimit.TokenBucket, ratelimit.SlidingWindow} {
+			limiter, err := ratelimit.New(store(), ratelimit.Rule{
+				Name:      "api-key",
+				Key:       "this.headers['X-Api-Key']",
+				Algorithm: algorithm,
+				Limit:     3,
+				Period:    time.Hour,
+			})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			request := func(key string) map[string]interface{} {
+				return map[string]interface{}{"headers": map[string]interface{}{"X-Api-Key": key}}
+			}
+			for i := 0; i < 3; i++ {
+				result, err := limiter.Allow(ctx, request("a"))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if !result.Allowed {
+					t.Fatalf("%s %s: request %v denied", name, algorithm, i)
+				}
+			}
+			result, err := limiter.Allow(ctx, request("a"))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if result.Allowed || result.Rule != "api-key" || result.RetryAfter <= 0 || result.RetryAfter > 2*time.Hour {
+				t.Fatalf("%s %s: expected request to be denied: %+v", name, algorithm, result)
+			}
+			if result, _ := limiter.Allow(ctx, request("b")); !result.Allowed {
+				t.Fatalf("%s %s: expected other key to be allowed", name, algorithm)
+			}
+			// requests without the header can't evaluate the key, so they share a bucket instead of bypassing the rule
+			for i := 0; i < 4; i++ {
+				result, err := limiter.Allow(ctx, map[string]interface{}{"headers": map[string]interface{}{}})
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if result.Allowed != (i < 3) {
+					t.Fatalf("%s %s: unexpected shared bucket result for request %v: %+v", name, algorithm, i, result)
+				}
+			}
+		}
+	}
+}
+
+func TestRedisKeys(t *testing.T) {
+	srv, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer srv.Close()
+	store := ratelimit.NewRedisStore(redis.NewClient(&redis.Options{Addr: srv.Addr()}), "")
+	now := time.Unix(100, 0)
+	if _, _, err := store.SlidingWindow(context.Background(), "api-key:a", 3, time.Second, now); err != nil {
+		t.Fatal(err.Error())
+	}
+	// both windows of a key share a hash tag so the script's keys are in the same cluster slot
+	if keys := srv.Keys(); len(keys) != 1 || keys[0] != "gproxy:ratelimit:{api-key:a}:100" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range stores(t) {
+		s := store()
+		now := time.Now()
+		for i := 0; i < 2; i++ {
+			if tokens, err := s.TokenBucket(ctx, "refill", 10, 2, now); err != nil || tokens < 0 {
+				t.Fatalf("%s: request %v denied: %v %v", name, i, tokens, err)
+			}
+		}
+		tokens, err := s.TokenBucket(ctx, "refill", 10, 2, now)
+		if err != nil || tokens >= 0 {
+			t.Fatalf("%s: expected empty bucket: %v %v", name, tokens, err)
+		}
+		if tokens, err := s.TokenBucket(ctx, "refill", 10, 2, now.Add(100*time.Millisecond)); err != nil || tokens < 0 {
+			t.Fatalf("%s: expected a refilled token: %v %v", name, tokens, err)
+		}
+	}
+}
+
+func TestSlidingWindowWait(t *testing.T) {
+	window := time.Second
+	start := time.Unix(100, 0)
+	// the previous window was full & a quarter of the current window has elapsed: 10*0.75 + 0 >= 5
+	wait := ratelimit.SlidingWindowWait(10, 0, 5, window, start.Add(250*time.Millisecond))
+	if wait < 250*time.Millisecond || wait > 260*time.Millisecond {
+		t.Fatalf("unexpected wait: %s", wait)
+	}
+	// the current window is full: wait for the next window & for its weight to decay by half
+	wait = ratelimit.SlidingWindowWait(0, 10, 5, window, start.Add(500*time.Millisecond))
+	if wait < time.Second || wait > 1010*time.Millisecond {
+		t.Fatalf("unexpected wait: %s", wait)
+	}
+	if wait := ratelimit.SlidingWindowWait(2, 1, 5, window, start); wait != 0 {
+		t.Fatalf("unexpected wait: %s", wait)
+	}
+}
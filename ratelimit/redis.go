@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+// tokenBucketScript refills & takes a token from a bucket stored as a hash. ARGV: rate(tokens/µs), burst, now(µs), ttl(ms)
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) * rate)
+	ts = now
+end
+local remaining = tokens - 1
+if tokens >= 1 then
+	tokens = remaining
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(ts))
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return tostring(remaining)
+`)
+
+// slidingWindowScript counts a request against the current window if the weighted count is below the limit.
+// KEYS: previous window, current window. ARGV: limit, previous window weight, ttl(ms)
+var slidingWindowScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local weight = tonumber(ARGV[2])
+local prev = tonumber(redis.call('GET', KEYS[1]) or '0')
+local curr = tonumber(redis.call('GET', KEYS[2]) or '0')
+if prev * weight + curr < limit then
+	redis.call('INCR', KEYS[2])
+	redis.call('PEXPIRE', KEYS[2], ARGV[3])
+end
+return {prev, curr}
+`)
+
+// RedisStore keeps rate limiting state in Redis so limits are enforced across proxy replicas.
+// Replicas should have synchronized clocks
+type RedisStore struct {
+	client redis.Scripter
+	prefix string
+}
+
+// NewRedisStore creates a Store backed by the Redis client(ex: redis.NewClient, redis.NewClusterClient).
+// Keys are prefixed with prefix(default: gproxy:ratelimit:)
+func NewRedisStore(client redis.Scripter, prefix string) *RedisStore {
+	if prefix == "" {
+		prefix = "gproxy:ratelimit:"
+	}
+	return &RedisStore{client: client, prefix: prefix}
+}
+
+// key returns the redis key of a rate limit key. The key is wrapped in a hash tag so every window of a key is stored in
+// the same cluster slot(scripts may only access keys of a single slot)
+func (r *RedisStore) key(key string) string {
+	return fmt.Sprintf("%s{%s}", r.prefix, key)
+}
+
+func (r *RedisStore) TokenBucket(ctx context.Context, key string, rate float64, burst int, now time.Time) (float64, error) {
+	ttl := time.Duration((float64(burst) + 1) / rate * float64(time.Second))
+	result, err := tokenBucketScript.Run(ctx, r.client, []string{r.key(key)},
+		strconv.FormatFloat(rate/1e6, 'f', -1, 64),
+		burst,
+		now.UnixNano()/int64(time.Microsecond),
+		ttl.Milliseconds()+1,
+	).Text()
+	if err != nil {
+		return 0, errors.Wrap(err, "ratelimit: redis")
+	}
+	return strconv.ParseFloat(result, 64)
+}
+
+func (r *RedisStore) SlidingWindow(ctx context.Context, key string, limit int, window time.Duration, now time.Time) (int64, int64, error) {
+	index := windowIndex(window, now)
+	keys := []string{
+		fmt.Sprintf("%s:%v", r.key(key), index-1),
+		fmt.Sprintf("%s:%v", r.key(key), index),
+	}
+	result, err := slidingWindowScript.Run(ctx, r.client, keys,
+		limit,
+		strconv.FormatFloat(slidingWindowWeight(window, now), 'f', -1, 64),
+		(2*window).Milliseconds()+1,
+	).Result()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "ratelimit: redis")
+	}
+	counts, ok := result.([]interface{})
+	if !ok || len(counts) != 2 {
+		return 0, 0, errors.New("ratelimit: unexpected redis response")
+	}
+	prev, ok := counts[0].(int64)
+	if !ok {
+		return 0, 0, errors.New("ratelimit: unexpected redis response")
+	}
+	curr, ok := counts[1].(int64)
+	if !ok {
+		return 0, 0, errors.New("ratelimit: unexpected redis response")
+	}
+	return prev, curr, nil
+}
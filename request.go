@@ -0,0 +1,89 @@
+package gproxy
+
+import (
+	"google.golang.org/grpc/metadata"
+	"net/http"
+)
+
+// httpRequestData returns the attributes of an http request that are exposed to expressions
+// (this.http, this.grpc, this.host, this.headers, this.path, this.method, this.client_ip, this.claims, this.listener)
+func httpRequestData(req *http.Request, listener, clientIP string) map[string]interface{} {
+	headers := map[string]interface{}{}
+	for k, v := range req.Header {
+		headers[k] = v[0]
+	}
+	claims, _ := claimsFromContext(req.Context())
+	return map[string]interface{}{
+		"http":      true,
+		"grpc":      false,
+		"host":      req.Host,
+		"headers":   headers,
+		"path":      req.URL.Path,
+		"method":    req.Method,
+		"client_ip": clientIP,
+		"claims":    claimsOrEmpty(claims),
+		"listener":  listener,
+	}
+}
+
+// grpcRequestData returns the attributes of a gRPC request that are exposed to expressions
+// (this.http, this.grpc, this.host, this.headers, this.path, this.method, this.client_ip, this.claims, this.listener)
+func grpcRequestData(host, fullMethod, listener, clientIP string, md metadata.MD, claims map[string]interface{}) map[string]interface{} {
+	meta := map[string]interface{}{}
+	for k, v := range md {
+		meta[k] = v[0]
+	}
+	return map[string]interface{}{
+		"http":      false,
+		"grpc":      true,
+		"host":      host,
+		"path":      fullMethod,
+		"headers":   meta,
+		"method":    fullMethod,
+		"client_ip": clientIP,
+		"claims":    claimsOrEmpty(claims),
+		"listener":  listener,
+	}
+}
+
+// l4RequestData returns the attributes of a TCP connection or UDP session(proto) that are exposed to L4 routing expressions
+// (this.tcp, this.udp, this.sni, this.port, this.client_ip)
+func l4RequestData(proto, sni string, port int, clientIP string) map[string]interface{} {
+	return map[string]interface{}{
+		"tcp":       proto == "tcp",
+		"udp":       proto == "udp",
+		"sni":       sni,
+		"port":      int64(port),
+		"client_ip": clientIP,
+	}
+}
+
+// claimsOrEmpty returns the verified claims of a request or an empty map for unauthenticated requests
+func claimsOrEmpty(claims map[string]interface{}) map[string]interface{} {
+	if claims == nil {
+		return map[string]interface{}{}
+	}
+	return claims
+}
+
+// routeData copies the request attributes & adds the matched route(this.route)
+func routeData(data map[string]interface{}, rt *route) map[string]interface{} {
+	copied := make(map[string]interface{}, len(data)+2)
+	for k, v := range data {
+		copied[k] = v
+	}
+	copied["route"] = rt.name
+	copied["variant"] = string(rt.variant)
+	return copied
+}
+
+// metadataHeader converts gRPC metadata to http headers so canary pins & sticky keys apply to gRPC requests
+func metadataHeader(md metadata.MD) http.Header {
+	header := http.Header{}
+	for k, values := range md {
+		for _, v := range values {
+			header.Add(k, v)
+		}
+	}
+	return header
+}
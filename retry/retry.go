@@ -0,0 +1,210 @@
+package retry
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// DefaultBaseBackoff is the initial backoff used when a policy doesn't specify one
+	DefaultBaseBackoff = 25 * time.Millisecond
+	// DefaultMaxBackoff is the backoff ceiling used when a policy doesn't specify one
+	DefaultMaxBackoff = 1 * time.Second
+	// DefaultMaxBufferBytes is the maximum size of a request that will be buffered so it may be replayed
+	DefaultMaxBufferBytes = 64 * 1024
+)
+
+var (
+	// DefaultCodes are the gRPC codes that are retried when a policy doesn't specify any
+	DefaultCodes = []codes.Code{codes.Unavailable}
+	// DefaultStatuses are the http statuses that are retried when a policy doesn't specify any
+	DefaultStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+)
+
+// Policy configures automatic retries (and optionally hedging) of proxied requests
+type Policy struct {
+	// MaxAttempts is the total number of attempts made including the original request
+	MaxAttempts int
+	// Codes are the gRPC status codes that may be retried
+	Codes []codes.Code
+	// Statuses are the http response statuses that may be retried
+	Statuses []int
+	// BaseBackoff is the backoff before the first retry. It doubles on every subsequent retry
+	BaseBackoff time.Duration
+	// MaxBackoff caps the backoff between retries
+	MaxBackoff time.Duration
+	// HedgingDelay enables hedged requests for unary gRPC calls when > 0. A new attempt is sent
+	// to another target every HedgingDelay until one of them responds or MaxAttempts is reached
+	HedgingDelay time.Duration
+	// MaxBufferBytes is the maximum request size that will be buffered for replay(default: 64KiB)
+	MaxBufferBytes int
+	// Budget limits the ratio of retries to requests(optional)
+	Budget *Budget
+}
+
+// Attempts returns the maximum number of attempts allowed by the policy(minimum: 1)
+func (p *Policy) Attempts() int {
+	if p == nil || p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// BufferBytes returns the maximum request size that may be buffered for replay
+func (p *Policy) BufferBytes() int {
+	if p == nil || p.MaxBufferBytes <= 0 {
+		return DefaultMaxBufferBytes
+	}
+	return p.MaxBufferBytes
+}
+
+// RetryableCode returns true if the gRPC status code may be retried
+func (p *Policy) RetryableCode(code codes.Code) bool {
+	if p == nil {
+		return false
+	}
+	retryable := p.Codes
+	if len(retryable) == 0 {
+		retryable = DefaultCodes
+	}
+	for _, c := range retryable {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryableStatus returns true if the http status code may be retried
+func (p *Policy) RetryableStatus(status int) bool {
+	if p == nil {
+		return false
+	}
+	retryable := p.Statuses
+	if len(retryable) == 0 {
+		retryable = DefaultStatuses
+	}
+	for _, s := range retryable {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff returns the full-jitter exponential backoff to wait before the given retry(1 = first retry)
+func (p *Policy) Backoff(retry int) time.Duration {
+	base, max := DefaultBaseBackoff, DefaultMaxBackoff
+	if p != nil && p.BaseBackoff > 0 {
+		base = p.BaseBackoff
+	}
+	if p != nil && p.MaxBackoff > 0 {
+		max = p.MaxBackoff
+	}
+	if retry < 1 {
+		retry = 1
+	}
+	ceiling := base
+	for i := 1; i < retry && ceiling < max; i++ {
+		ceiling *= 2
+	}
+	if ceiling > max {
+		ceiling = max
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// Request records a new request against the policies retry budget
+func (p *Policy) Request() {
+	if p != nil && p.Budget != nil {
+		p.Budget.Request()
+	}
+}
+
+// AllowRetry returns true if the policies retry budget permits another retry, and records it if so
+func (p *Policy) AllowRetry() bool {
+	if p == nil {
+		return false
+	}
+	if p.Budget == nil {
+		return true
+	}
+	return p.Budget.Retry()
+}
+
+const budgetWindow = 10
+
+// Budget limits retries to a ratio of recent requests so retries can't amplify an outage.
+// Requests and retries are counted over a 10 second sliding window
+type Budget struct {
+	mu           sync.Mutex
+	ratio        float64
+	minPerSecond int
+	requests     [budgetWindow]int
+	retries      [budgetWindow]int
+	seconds      [budgetWindow]int64
+}
+
+// NewBudget creates a budget that allows retries up to ratio * requests plus minPerSecond retries every second
+func NewBudget(ratio float64, minPerSecond int) *Budget {
+	return &Budget{
+		ratio:        ratio,
+		minPerSecond: minPerSecond,
+	}
+}
+
+func (b *Budget) bucket() int {
+	now := time.Now().Unix()
+	i := int(now % budgetWindow)
+	if b.seconds[i] != now {
+		b.seconds[i] = now
+		b.requests[i] = 0
+		b.retries[i] = 0
+	}
+	return i
+}
+
+func (b *Budget) totals() (requests int, retries int) {
+	oldest := time.Now().Unix() - budgetWindow
+	for i := 0; i < budgetWindow; i++ {
+		if b.seconds[i] > oldest {
+			requests += b.requests[i]
+			retries += b.retries[i]
+		}
+	}
+	return requests, retries
+}
+
+// Request records a request
+func (b *Budget) Request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requests[b.bucket()]++
+}
+
+// Retry returns true & records a retry if the budget has capacity for it
+func (b *Budget) Retry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := b.bucket()
+	requests, retries := b.totals()
+	allowed := int(b.ratio*float64(requests)) + b.minPerSecond*budgetWindow
+	if retries >= allowed {
+		return false
+	}
+	b.retries[i]++
+	return true
+}
+
+// Idempotent returns true if the http method may be safely retried
+func Idempotent(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package retry_test
+
+import (
+	"github.com/graphikDB/gproxy/retry"
+	"google.golang.org/grpc/codes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPolicy(t *testing.T) {
+	policy := &retry.Policy{
+		MaxAttempts: 3,
+		BaseBackoff: 10 * time.Millisecond,
+		MaxBackoff:  40 * time.Millisecond,
+	}
+	if !policy.RetryableCode(codes.Unavailable) || policy.RetryableCode(codes.NotFound) {
+		t.Fatal("unexpected default retryable codes")
+	}
+	if !policy.RetryableStatus(http.StatusBadGateway) || policy.RetryableStatus(http.StatusNotFound) {
+		t.Fatal("unexpected default retryable statuses")
+	}
+	for i := 1; i < 10; i++ {
+		if backoff := policy.Backoff(i); backoff > policy.MaxBackoff {
+			t.Fatalf("backoff %v exceeds max backoff", backoff)
+		}
+	}
+	var empty *retry.Policy
+	if empty.Attempts() != 1 || empty.AllowRetry() {
+		t.Fatal("expected nil policy to disable retries")
+	}
+}
+
+func TestBudget(t *testing.T) {
+	budget := retry.NewBudget(0.5, 0)
+	for i := 0; i < 10; i++ {
+		budget.Request()
+	}
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if budget.Retry() {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Fatalf("expected 5 retries to be allowed, got %v", allowed)
+	}
+}
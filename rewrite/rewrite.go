@@ -0,0 +1,79 @@
+package rewrite
+
+import (
+	"github.com/pkg/errors"
+	"regexp"
+	"strings"
+)
+
+// Rule rewrites an http request path or a gRPC full method name(/package.Service/Method).
+// Each populated field is applied in order: StripPrefix, Regex/Replacement, AddPrefix
+type Rule struct {
+	// StripPrefix removes the prefix from the path if present(ex: /api/v1)
+	StripPrefix string
+	// Regex is matched against the path & replaced with Replacement
+	Regex string
+	// Replacement may reference Regex capture groups(ex: /users/$1)
+	Replacement string
+	// AddPrefix prepends the prefix to the path
+	AddPrefix string
+}
+
+// Rules are an ordered list of rewrite rules
+type Rules struct {
+	rules []*compiledRule
+}
+
+type compiledRule struct {
+	Rule
+	regex *regexp.Regexp
+}
+
+// NewRules compiles the rewrite rules
+func NewRules(rules ...Rule) (*Rules, error) {
+	compiled := &Rules{}
+	for _, r := range rules {
+		c := &compiledRule{Rule: r}
+		if r.Regex != "" {
+			regex, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return nil, errors.Wrapf(err, "rewrite: invalid regex %s", r.Regex)
+			}
+			c.regex = regex
+		} else if r.Replacement != "" {
+			return nil, errors.New("rewrite: replacement requires a regex")
+		}
+		compiled.rules = append(compiled.rules, c)
+	}
+	return compiled, nil
+}
+
+// Rewrite applies the rules to the path. Http paths are rewritten in their escaped form
+func (r *Rules) Rewrite(path string) string {
+	if r == nil {
+		return path
+	}
+	for _, rule := range r.rules {
+		if rule.StripPrefix != "" && hasPathPrefix(path, rule.StripPrefix) {
+			path = strings.TrimPrefix(path, rule.StripPrefix)
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+		}
+		if rule.regex != nil {
+			path = rule.regex.ReplaceAllString(path, rule.Replacement)
+		}
+		if rule.AddPrefix != "" {
+			path = strings.TrimSuffix(rule.AddPrefix, "/") + "/" + strings.TrimPrefix(path, "/")
+		}
+	}
+	return path
+}
+
+// hasPathPrefix only matches prefixes on a path segment boundary so /api doesn't match /apiv2
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return strings.HasSuffix(prefix, "/") || len(path) == len(prefix) || path[len(prefix)] == '/'
+}
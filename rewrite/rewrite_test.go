@@ -0,0 +1,34 @@
+package rewrite_test
+
+import (
+	"github.com/graphikDB/gproxy/rewrite"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	type testCase struct {
+		rules    []rewrite.Rule
+		path     string
+		expected string
+	}
+	for _, c := range []testCase{
+		{rules: []rewrite.Rule{{StripPrefix: "/api/v1"}}, path: "/api/v1/users", expected: "/users"},
+		{rules: []rewrite.Rule{{StripPrefix: "/api/v1"}}, path: "/api/v1", expected: "/"},
+		{rules: []rewrite.Rule{{StripPrefix: "/api"}}, path: "/apiv2/users", expected: "/apiv2/users"},
+		{rules: []rewrite.Rule{{AddPrefix: "/v2"}}, path: "/users", expected: "/v2/users"},
+		{rules: []rewrite.Rule{{StripPrefix: "/api", AddPrefix: "/internal"}}, path: "/api/users", expected: "/internal/users"},
+		{rules: []rewrite.Rule{{Regex: `^/users/(\d+)$`, Replacement: "/accounts/$1"}}, path: "/users/42", expected: "/accounts/42"},
+		{rules: []rewrite.Rule{{Regex: `^/legacy\.v1\.(.*)$`, Replacement: "/graphik.v2.$1"}}, path: "/legacy.v1.Users/Get", expected: "/graphik.v2.Users/Get"},
+	} {
+		rules, err := rewrite.NewRules(c.rules...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if actual := rules.Rewrite(c.path); actual != c.expected {
+			t.Fatalf("rewrite(%s): expected %s got %s", c.path, c.expected, actual)
+		}
+	}
+	if _, err := rewrite.NewRules(rewrite.Rule{Replacement: "/x"}); err == nil {
+		t.Fatal("expected error for replacement without regex")
+	}
+}
@@ -0,0 +1,275 @@
+package gproxy
+
+import (
+	"context"
+	"github.com/autom8ter/machine"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/graphikDB/gproxy/affinity"
+	"github.com/graphikDB/gproxy/breaker"
+	"github.com/graphikDB/gproxy/canary"
+	"github.com/graphikDB/gproxy/metrics"
+	"github.com/graphikDB/trigger"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"sync/atomic"
+	"time"
+)
+
+// route is the result of a routing trigger that matched a request.
+// A trigger may evaluate to a target string, a list of targets, or a map
+// ex: this.http => {'name': 'api', 'targets': ['http://api-0:8080', 'http://api-1:8080']}
+// targets may also be resolved from a discovered service(the optional scheme is prepended to each endpoint)
+// ex: this.http => {'name': 'api', 'service': 'users', 'scheme': 'http'}
+type route struct {
+	name     string
+	service  string
+	scheme   string
+	targets  []string
+	attrs    map[string]interface{}
+	variant  canary.Variant
+	affinity affinity.Affinity
+}
+
+type routeCtxKey struct{}
+
+func withRoute(ctx context.Context, r *route) context.Context {
+	return context.WithValue(ctx, routeCtxKey{}, r)
+}
+
+func routeFromContext(ctx context.Context) (*route, bool) {
+	r, ok := ctx.Value(routeCtxKey{}).(*route)
+	return r, ok
+}
+
+// newRoute parses the output of a routing trigger. It returns nil if the output doesn't contain a target
+func newRoute(result map[string]interface{}) *route {
+	if len(result) == 0 {
+		return nil
+	}
+	r := &route{
+		attrs: result,
+	}
+	if name, ok := result["name"].(string); ok {
+		r.name = name
+	}
+	if service, ok := result["service"].(string); ok {
+		r.service = service
+	}
+	if scheme, ok := result["scheme"].(string); ok {
+		r.scheme = scheme
+	}
+	for _, key := range []string{"value", "target", "targets"} {
+		r.targets = append(r.targets, toStrings(result[key])...)
+	}
+	if len(r.targets) == 0 && r.service == "" {
+		return nil
+	}
+	return r
+}
+
+func toStrings(val interface{}) []string {
+	switch val := val.(type) {
+	case string:
+		if val == "" {
+			return nil
+		}
+		return []string{val}
+	case []string:
+		return append([]string(nil), val...)
+	case []interface{}:
+		var values []string
+		for _, v := range val {
+			values = append(values, toStrings(v)...)
+		}
+		return values
+	case []ref.Val:
+		var values []string
+		for _, v := range val {
+			values = append(values, toStrings(v.Value())...)
+		}
+		return values
+	}
+	return nil
+}
+
+// matchRoute returns the route matched by the request or nil if no route matched. Requests received by a listener with
+// scoped routes(this.listener) are only matched against them
+func (p *Proxy) matchRoute(data map[string]interface{}) (*route, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	triggers := p.triggers
+	if name, _ := data["listener"].(string); name != "" {
+		if scoped, ok := p.listenerRoutes[name]; ok {
+			triggers = scoped
+		}
+	}
+	return p.evaluateRoutes(triggers, data)
+}
+
+// matchL4Route returns the L4 route matched by the connection or UDP session(this.tcp, this.udp, this.sni, this.port, this.client_ip)
+// or nil if no route matched
+func (p *Proxy) matchL4Route(data map[string]interface{}) (*route, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.evaluateRoutes(p.l4Triggers, data)
+}
+
+// evaluateRoutes returns the route of the first trigger that matches the data. The caller must hold p.mu
+func (p *Proxy) evaluateRoutes(triggers []*trigger.Trigger, data map[string]interface{}) (*route, error) {
+	for _, trig := range triggers {
+		result, err := trig.Trigger(data)
+		if err != nil && err != trigger.ErrDecisionDenied {
+			return nil, err
+		}
+		if r := newRoute(result); r != nil {
+			if r.service != "" {
+				targets, err := p.serviceTargets(r.service, r.scheme)
+				if err != nil {
+					return nil, err
+				}
+				r.targets = append(r.targets, targets...)
+			}
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+// errNoHealthyTargets is returned when every target of a route has an open circuit breaker
+var errNoHealthyTargets = errors.New("circuit breaker open for all route targets")
+
+// nextTarget selects the next target for the route(round robin or in order of the requests affinity), preferring targets
+// that haven't already been attempted & skipping targets with an open circuit breaker. The returned function must be
+// called with the outcome of the request
+func (p *Proxy) nextTarget(r *route, attempted map[string]bool) (string, func(outcome breaker.Outcome), error) {
+	if len(r.targets) == 0 {
+		return "", nil, errors.New("zero targets for route")
+	}
+	var next uint64
+	targets := r.affinity.Order(r.targets)
+	if targets == nil {
+		targets = r.targets
+		next = atomic.AddUint64(p.routeCounter(r), 1)
+	}
+	var candidates, retries []string
+	for _, target := range targets {
+		if attempted[target] {
+			retries = append(retries, target)
+		} else {
+			candidates = append(candidates, target)
+		}
+	}
+	for _, targets := range [][]string{candidates, retries} {
+		for i := range targets {
+			target := targets[(next+uint64(i))%uint64(len(targets))]
+			b := p.breaker(r.name, target)
+			if b == nil {
+				return target, func(outcome breaker.Outcome) {}, nil
+			}
+			if done, ok := b.Allow(); ok {
+				return target, done, nil
+			}
+		}
+	}
+	metrics.BreakerRejections.WithLabelValues(r.name).Inc()
+	return "", nil, errNoHealthyTargets
+}
+
+// routeCounter returns the round robin counter of the route. Counters are keyed by route name(not by targets) so the
+// number of counters doesn't grow as discovered or ingress targets change
+func (p *Proxy) routeCounter(r *route) *uint64 {
+	if val, ok := p.counters.Load(r.name); ok {
+		return val.(*uint64)
+	}
+	val, _ := p.counters.LoadOrStore(r.name, new(uint64))
+	return val.(*uint64)
+}
+
+// breakerIdleTimeout is how long a circuit breaker may go unused before it is removed(ex: its target was removed from a
+// service or the routes), so breakers don't accumulate as targets change
+const breakerIdleTimeout = 10 * time.Minute
+
+// routeBreaker is a targets circuit breaker along with the route config it was created from
+type routeBreaker struct {
+	*breaker.Breaker
+	config *breaker.Config
+	route  string
+	target string
+	// last is when the breaker was last used(unix nanoseconds)
+	last int64
+}
+
+// breaker returns the circuit breaker for the routes target if the route has a circuit breaker config. Breakers are kept
+// per route & target, so routes sharing a target don't share a config, & are replaced if the routes config changes.
+// Concurrent requests always share the same breaker
+func (p *Proxy) breaker(routeName, target string) *breaker.Breaker {
+	p.mu.RLock()
+	config, ok := p.breakerConfigs[routeName]
+	if !ok {
+		config, ok = p.breakerConfigs["*"]
+	}
+	p.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	key := routeName + "|" + target
+	for {
+		val, ok := p.breakers.Load(key)
+		if ok && val.(*routeBreaker).config == config {
+			b := val.(*routeBreaker)
+			atomic.StoreInt64(&b.last, time.Now().UnixNano())
+			return b.Breaker
+		}
+		b := p.newRouteBreaker(routeName, target, config)
+		if ok {
+			// replaces the breaker of the previous config unless another request already replaced it
+			if p.breakers.CompareAndSwap(key, val, b) {
+				return b.Breaker
+			}
+		} else if _, loaded := p.breakers.LoadOrStore(key, b); !loaded {
+			return b.Breaker
+		}
+	}
+}
+
+func (p *Proxy) newRouteBreaker(routeName, target string, config *breaker.Config) *routeBreaker {
+	return &routeBreaker{
+		config: config,
+		route:  routeName,
+		target: target,
+		last:   time.Now().UnixNano(),
+		Breaker: breaker.New(*config, func(from, to breaker.State) {
+			metrics.BreakerState.WithLabelValues(routeName, target).Set(float64(to))
+			metrics.BreakerTransitions.WithLabelValues(routeName, target, from.String(), to.String()).Inc()
+			p.logger.Warn("circuit breaker state change",
+				zap.String("route", routeName),
+				zap.String("target", target),
+				zap.String("from", from.String()),
+				zap.String("to", to.String()),
+			)
+		}),
+	}
+}
+
+// pruneBreakers removes the circuit breakers(& their state metrics) that haven't been used for the breaker idle timeout
+// until the proxy is shut down
+func (p *Proxy) pruneBreakers() {
+	p.mach.Go(func(routine machine.Routine) {
+		ticker := time.NewTicker(breakerIdleTimeout / 10)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-routine.Context().Done():
+				return
+			case now := <-ticker.C:
+				p.breakers.Range(func(key, val interface{}) bool {
+					b := val.(*routeBreaker)
+					if now.Sub(time.Unix(0, atomic.LoadInt64(&b.last))) > breakerIdleTimeout && p.breakers.CompareAndDelete(key, val) {
+						metrics.BreakerState.DeleteLabelValues(b.route, b.target)
+					}
+					return true
+				})
+			}
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net"
+	"sync"
+)
+
+const (
+	// ReasonListener is the reason connections are rejected when the listener has MaxConnections open connections
+	ReasonListener = "listener"
+	// ReasonClientIP is the reason connections are rejected when the client has MaxConnectionsPerIP open connections
+	ReasonClientIP = "client_ip"
+)
+
+// Listener wraps a listener, closing connections that exceed the configs connection limits before they are returned
+// from Accept. onReject is called with the address of each rejected connection & the reason it was rejected(optional)
+func Listener(l net.Listener, config *Config, onReject func(addr net.Addr, reason string)) net.Listener {
+	if config == nil || config.MaxConnections <= 0 && config.MaxConnectionsPerIP <= 0 {
+		return l
+	}
+	return &listener{
+		Listener: l,
+		max:      config.MaxConnections,
+		maxPerIP: config.MaxConnectionsPerIP,
+		onReject: onReject,
+		perIP:    map[string]int{},
+	}
+}
+
+type listener struct {
+	net.Listener
+	max      int
+	maxPerIP int
+	onReject func(addr net.Addr, reason string)
+	mu       sync.Mutex
+	total    int
+	perIP    map[string]int
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := c.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		if reason := l.acquire(ip); reason != "" {
+			if l.onReject != nil {
+				l.onReject(c.RemoteAddr(), reason)
+			}
+			c.Close()
+			continue
+		}
+		return &conn{Conn: c, release: func() { l.release(ip) }}, nil
+	}
+}
+
+// acquire counts the connection against the limits, returning the reason it was rejected if a limit was reached
+func (l *listener) acquire(ip string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.total >= l.max {
+		return ReasonListener
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return ReasonClientIP
+	}
+	l.total++
+	l.perIP[ip]++
+	return ""
+}
+
+func (l *listener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// conn releases its slot once it is closed
+type conn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *conn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,114 @@
+// Package server configures the timeouts, gRPC keepalive enforcement & connection limits that protect the proxies
+// listeners from slow(ex: slowloris) or abusive clients
+package server
+
+import (
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Config configures the proxies http & gRPC servers. Zero values use the defaults & negative timeouts, idle timeouts or
+// keepalive times are disabled
+type Config struct {
+	// ReadHeaderTimeout is how long a client may take to complete the TLS handshake & send its request headers(http) or
+	// connection preface(gRPC)(default: 10s)
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout is the maximum duration for reading an entire http request, including the body(default: disabled)
+	ReadTimeout time.Duration
+	// WriteTimeout is the maximum duration before timing out writes of an http response(default: disabled). Long lived
+	// responses(ex: websockets, event streams) are cut off by write timeouts
+	WriteTimeout time.Duration
+	// IdleTimeout is how long a keep-alive connection without requests(http) or calls(gRPC) is kept open(default: 2m)
+	IdleTimeout time.Duration
+	// KeepaliveTime is how long a gRPC connection may be inactive before the server pings the client(default: 2m)
+	KeepaliveTime time.Duration
+	// KeepaliveTimeout is how long the server waits for a ping acknowledgement before closing the connection(default: 20s)
+	KeepaliveTimeout time.Duration
+	// MinPingInterval is the minimum interval between client pings. Connections of clients that ping more often are
+	// closed(default: 5m)
+	MinPingInterval time.Duration
+	// PermitPingWithoutStream allows clients to ping connections without active calls
+	PermitPingWithoutStream bool
+	// MaxConnections is the maximum number of concurrent connections to each listener(default: 0 = unlimited)
+	MaxConnections int
+	// MaxConnectionsPerIP is the maximum number of concurrent connections from a single client ip to each listener(default: 0 = unlimited)
+	MaxConnectionsPerIP int
+}
+
+// Validate returns an error if the config is invalid
+func (c *Config) Validate() error {
+	if c.MaxConnections < 0 || c.MaxConnectionsPerIP < 0 {
+		return errors.New("server: negative connection limit")
+	}
+	if c.KeepaliveTimeout < 0 || c.MinPingInterval < 0 {
+		return errors.New("server: negative keepalive timeout or min ping interval")
+	}
+	return nil
+}
+
+const infinity = time.Duration(math.MaxInt64)
+
+func durationOr(d, def time.Duration) time.Duration {
+	switch {
+	case d < 0:
+		return 0
+	case d == 0:
+		return def
+	default:
+		return d
+	}
+}
+
+// HandshakeTimeout returns how long a client may take to complete the TLS handshake & send enough of its first request
+// for the protocol(http or gRPC) to be detected. A zero value disables the timeout
+func (c *Config) HandshakeTimeout() time.Duration {
+	if c == nil {
+		return 10 * time.Second
+	}
+	return durationOr(c.ReadHeaderTimeout, 10*time.Second)
+}
+
+// HTTP applies the timeouts to the http server
+func (c *Config) HTTP(srv *http.Server) {
+	if c == nil {
+		c = &Config{}
+	}
+	srv.ReadHeaderTimeout = c.HandshakeTimeout()
+	srv.ReadTimeout = durationOr(c.ReadTimeout, 0)
+	srv.WriteTimeout = durationOr(c.WriteTimeout, 0)
+	srv.IdleTimeout = durationOr(c.IdleTimeout, 2*time.Minute)
+}
+
+// GRPCOptions returns the gRPC server options that apply the connection timeout & keepalive policy
+func (c *Config) GRPCOptions() []grpc.ServerOption {
+	if c == nil {
+		c = &Config{}
+	}
+	var opts []grpc.ServerOption
+	if timeout := c.HandshakeTimeout(); timeout > 0 {
+		opts = append(opts, grpc.ConnectionTimeout(timeout))
+	}
+	// gRPC treats zero values as its own defaults, so disabled keepalives & idle timeouts are set to infinity
+	params := keepalive.ServerParameters{
+		MaxConnectionIdle: durationOr(c.IdleTimeout, 2*time.Minute),
+		Time:              durationOr(c.KeepaliveTime, 2*time.Minute),
+		Timeout:           durationOr(c.KeepaliveTimeout, 20*time.Second),
+	}
+	if params.MaxConnectionIdle == 0 {
+		params.MaxConnectionIdle = infinity
+	}
+	if params.Time == 0 {
+		params.Time = infinity
+	}
+	return append(opts,
+		grpc.KeepaliveParams(params),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             durationOr(c.MinPingInterval, 5*time.Minute),
+			PermitWithoutStream: c.PermitPingWithoutStream,
+		}),
+	)
+}
@@ -0,0 +1,79 @@
+package server_test
+
+import (
+	"github.com/graphikDB/gproxy/server"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHTTP(t *testing.T) {
+	srv := &http.Server{}
+	(*server.Config)(nil).HTTP(srv)
+	if srv.ReadHeaderTimeout != 10*time.Second || srv.IdleTimeout != 2*time.Minute || srv.ReadTimeout != 0 || srv.WriteTimeout != 0 {
+		t.Fatalf("unexpected default timeouts: %v %v %v %v", srv.ReadHeaderTimeout, srv.IdleTimeout, srv.ReadTimeout, srv.WriteTimeout)
+	}
+	(&server.Config{ReadHeaderTimeout: -1, WriteTimeout: time.Minute}).HTTP(srv)
+	if srv.ReadHeaderTimeout != 0 || srv.WriteTimeout != time.Minute {
+		t.Fatalf("unexpected timeouts: %v %v", srv.ReadHeaderTimeout, srv.WriteTimeout)
+	}
+	if err := (&server.Config{MaxConnectionsPerIP: -1}).Validate(); err == nil {
+		t.Fatal("expected negative connection limit to be rejected")
+	}
+}
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rejected := make(chan string, 1)
+	limited := server.Listener(l, &server.Config{MaxConnectionsPerIP: 1}, func(addr net.Addr, reason string) { rejected <- reason })
+	defer limited.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := limited.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return conn
+	}
+	first := dial()
+	defer first.Close()
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("expected connection to be accepted")
+	}
+	second := dial()
+	defer second.Close()
+	select {
+	case reason := <-rejected:
+		if reason != server.ReasonClientIP {
+			t.Fatalf("unexpected reason: %s", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected connection to be rejected")
+	}
+	// closing a connection frees its slot
+	conn.Close()
+	third := dial()
+	defer third.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("expected connection to be accepted once a slot was freed")
+	}
+}
@@ -0,0 +1,115 @@
+package gproxy
+
+import (
+	"github.com/autom8ter/machine"
+	"github.com/graphikDB/gproxy/discovery"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+)
+
+// service is a named set of endpoints that is kept up to date by a discovery provider
+type service struct {
+	mu        sync.RWMutex
+	provider  discovery.Provider
+	endpoints []string
+}
+
+func (s *service) get() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.endpoints
+}
+
+// set replaces the endpoints, returning the endpoints that were removed
+func (s *service) set(endpoints []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := map[string]bool{}
+	for _, e := range endpoints {
+		current[e] = true
+	}
+	var removed []string
+	for _, e := range s.endpoints {
+		if !current[e] {
+			removed = append(removed, e)
+		}
+	}
+	s.endpoints = endpoints
+	return removed
+}
+
+// watchServices keeps each services endpoints up to date in the background
+func (p *Proxy) watchServices() {
+	for name, svc := range p.services {
+		name, svc := name, svc
+		p.mach.Go(func(routine machine.Routine) {
+			p.logger.Debug("watching service", zap.String("service", name))
+			err := svc.provider.Watch(routine.Context(), func(endpoints []string) {
+				removed := svc.set(endpoints)
+				p.logger.Info("service endpoints updated", zap.String("service", name), zap.Strings("endpoints", endpoints))
+				if len(removed) > 0 {
+					p.closeEndpointConns(removed)
+				}
+			})
+			if err != nil {
+				p.logger.Error("service discovery failure", zap.String("service", name), zap.Error(err))
+			}
+		})
+	}
+}
+
+// serviceTargets returns the current endpoints of the named service, prefixed with the scheme if one is given
+func (p *Proxy) serviceTargets(name, scheme string) ([]string, error) {
+	svc, ok := p.services[name]
+	if !ok {
+		return nil, errors.Errorf("unknown service: %s", name)
+	}
+	endpoints := svc.get()
+	if len(endpoints) == 0 {
+		return nil, errors.Errorf("zero endpoints for service: %s", name)
+	}
+	targets := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		if scheme != "" {
+			e = scheme + "://" + e
+		}
+		targets = append(targets, e)
+	}
+	return targets, nil
+}
+
+// closeEndpointConns evicts the cached gRPC connections to endpoints that were removed from a service(unless another
+// service still discovers them) so they don't keep reconnecting to endpoints that are gone. Connections are closed once
+// the calls in flight on them complete
+func (p *Proxy) closeEndpointConns(removed []string) {
+	discovered := map[string]bool{}
+	for _, svc := range p.services {
+		for _, e := range svc.get() {
+			discovered[e] = true
+		}
+	}
+	closed := map[string]bool{}
+	for _, e := range removed {
+		if !discovered[e] {
+			closed[e] = true
+		}
+	}
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	for target, conn := range p.conns {
+		endpoint := target
+		if i := strings.Index(target, "://"); i >= 0 {
+			endpoint = target[i+len("://"):]
+		}
+		if closed[endpoint] {
+			delete(p.conns, target)
+			conn.removed = true
+			if conn.calls == 0 {
+				conn.Close()
+			}
+			p.logger.Debug("evicted connection to removed endpoint", zap.String("target", target), zap.Int("calls", conn.calls))
+		}
+	}
+}
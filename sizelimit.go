@@ -0,0 +1,65 @@
+package gproxy
+
+import (
+	"github.com/graphikDB/gproxy/metrics"
+	"github.com/graphikDB/gproxy/sizelimit"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+)
+
+// defaultMaxRecvMsgSize is the gRPC servers default maximum message size
+const defaultMaxRecvMsgSize = 4 << 20
+
+// sizeLimit returns the size limits registered for the route, falling back to the default("*") limits
+func (p *Proxy) sizeLimit(routeName string) *sizelimit.Limits {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if limits, ok := p.sizeLimits[routeName]; ok {
+		return limits
+	}
+	return p.sizeLimits["*"]
+}
+
+// maxHeaderBytes returns the http servers header limit. Route limits are enforced by the proxy, so the server
+// only needs to accept the largest of them
+func (p *Proxy) maxHeaderBytes() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	max := http.DefaultMaxHeaderBytes
+	for _, limits := range p.sizeLimits {
+		if limits.MaxHeaderBytes > max {
+			max = limits.MaxHeaderBytes
+		}
+	}
+	return max
+}
+
+// maxRecvMsgSize returns the gRPC servers message limit. Route limits are enforced by the proxy, so the server
+// only needs to accept the largest of them
+func (p *Proxy) maxRecvMsgSize() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	max := defaultMaxRecvMsgSize
+	for _, limits := range p.sizeLimits {
+		if limits.MaxMessageBytes > max {
+			max = limits.MaxMessageBytes
+		}
+	}
+	return max
+}
+
+// tooLarge records the rejection of a request that exceeded one of the routes size limits
+func tooLarge(routeName string, err error) error {
+	var terr *sizelimit.TooLargeError
+	if errors.As(err, &terr) {
+		metrics.RejectedTooLarge.WithLabelValues(routeName, terr.Limit).Inc()
+	}
+	return err
+}
+
+// tooLargeStatus converts a size limit error to a gRPC RESOURCE_EXHAUSTED error
+func tooLargeStatus(routeName string, err error) error {
+	return status.Error(codes.ResourceExhausted, tooLarge(routeName, err).Error())
+}
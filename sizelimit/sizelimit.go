@@ -0,0 +1,108 @@
+// Package sizelimit bounds the size of http request headers & bodies & gRPC request messages & streams
+package sizelimit
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+)
+
+// Limits are the maximum sizes of a request. Zero values are unlimited
+type Limits struct {
+	// MaxHeaderBytes is the maximum size of a http requests header names & values
+	MaxHeaderBytes int
+	// MaxBodyBytes is the maximum size of a http request body
+	MaxBodyBytes int64
+	// MaxMessageBytes is the maximum size of a gRPC request message
+	MaxMessageBytes int
+	// MaxStreamBytes is the maximum total size of the request messages of a gRPC stream
+	MaxStreamBytes int64
+}
+
+// Validate returns an error if the limits are invalid
+func (l *Limits) Validate() error {
+	if l.MaxHeaderBytes < 0 || l.MaxBodyBytes < 0 || l.MaxMessageBytes < 0 || l.MaxStreamBytes < 0 {
+		return errors.New("sizelimit: negative limit")
+	}
+	return nil
+}
+
+// TooLargeError is returned when a request exceeds one of its limits
+type TooLargeError struct {
+	// Limit is the exceeded limit(header, body, message or stream)
+	Limit string
+	// Max is the limits value in bytes
+	Max int64
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("request %s exceeds the %v byte limit", e.Limit, e.Max)
+}
+
+// CheckHeader returns a *TooLargeError if the size of the headers exceeds the limit
+func (l *Limits) CheckHeader(header http.Header) error {
+	if l == nil || l.MaxHeaderBytes <= 0 {
+		return nil
+	}
+	var size int
+	for k, values := range header {
+		for _, v := range values {
+			size += len(k) + len(v)
+		}
+	}
+	if size > l.MaxHeaderBytes {
+		return &TooLargeError{Limit: "header", Max: int64(l.MaxHeaderBytes)}
+	}
+	return nil
+}
+
+// LimitBody returns a *TooLargeError if the requests declared content length exceeds the body limit & otherwise wraps
+// the body so reading past the limit fails with a *TooLargeError
+func (l *Limits) LimitBody(req *http.Request) error {
+	if l == nil || l.MaxBodyBytes <= 0 || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if req.ContentLength > l.MaxBodyBytes {
+		return &TooLargeError{Limit: "body", Max: l.MaxBodyBytes}
+	}
+	req.Body = &limitedBody{ReadCloser: req.Body, remaining: l.MaxBodyBytes, max: l.MaxBodyBytes}
+	return nil
+}
+
+// CheckMessage returns a *TooLargeError if the message exceeds the message limit or the streams total(including the message)
+// exceeds the stream limit
+func (l *Limits) CheckMessage(size int, total int64) error {
+	if l == nil {
+		return nil
+	}
+	if l.MaxMessageBytes > 0 && size > l.MaxMessageBytes {
+		return &TooLargeError{Limit: "message", Max: int64(l.MaxMessageBytes)}
+	}
+	if l.MaxStreamBytes > 0 && total > l.MaxStreamBytes {
+		return &TooLargeError{Limit: "stream", Max: l.MaxStreamBytes}
+	}
+	return nil
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	max       int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, &TooLargeError{Limit: "body", Max: b.max}
+	}
+	// read one byte past the limit to detect bodies that are too large
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), &TooLargeError{Limit: "body", Max: b.max}
+	}
+	return n, err
+}
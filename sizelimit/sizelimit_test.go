@@ -0,0 +1,55 @@
+package sizelimit_test
+
+import (
+	"github.com/graphikDB/gproxy/sizelimit"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	limits := &sizelimit.Limits{MaxHeaderBytes: 20, MaxBodyBytes: 10, MaxMessageBytes: 5, MaxStreamBytes: 8}
+	if err := limits.Validate(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := limits.CheckHeader(http.Header{"X-Small": {"1"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := limits.CheckHeader(http.Header{"X-Large": {strings.Repeat("a", 20)}}); err == nil {
+		t.Fatal("expected large header to be rejected")
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost", strings.NewReader(strings.Repeat("a", 11)))
+	if err, ok := limits.LimitBody(req).(*sizelimit.TooLargeError); !ok || err.Limit != "body" {
+		t.Fatal("expected declared content length to be rejected")
+	}
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost", ioutil.NopCloser(strings.NewReader(strings.Repeat("a", 11))))
+	req.ContentLength = -1
+	if err := limits.LimitBody(req); err != nil {
+		t.Fatal(err.Error())
+	}
+	bits, err := ioutil.ReadAll(req.Body)
+	if _, ok := err.(*sizelimit.TooLargeError); !ok || len(bits) != 10 {
+		t.Fatalf("expected streamed body to be rejected after the limit: %v %v", len(bits), err)
+	}
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost", ioutil.NopCloser(strings.NewReader(strings.Repeat("a", 10))))
+	req.ContentLength = -1
+	limits.LimitBody(req)
+	if bits, err := ioutil.ReadAll(req.Body); err != nil || len(bits) != 10 {
+		t.Fatalf("expected body within the limit: %v %v", len(bits), err)
+	}
+
+	if err := limits.CheckMessage(5, 5); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err, ok := limits.CheckMessage(6, 6).(*sizelimit.TooLargeError); !ok || err.Limit != "message" {
+		t.Fatal("expected large message to be rejected")
+	}
+	if err, ok := limits.CheckMessage(5, 10).(*sizelimit.TooLargeError); !ok || err.Limit != "stream" {
+		t.Fatal("expected large stream to be rejected")
+	}
+	if err := (&sizelimit.Limits{MaxBodyBytes: -1}).Validate(); err == nil {
+		t.Fatal("expected negative limit to be rejected")
+	}
+}
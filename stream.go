@@ -0,0 +1,460 @@
+package gproxy
+
+import (
+	"context"
+	"github.com/graphikDB/gproxy/breaker"
+	"github.com/graphikDB/gproxy/codec"
+	"github.com/graphikDB/gproxy/metrics"
+	"github.com/graphikDB/gproxy/retry"
+	"github.com/graphikDB/gproxy/sizelimit"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"sync"
+	"time"
+)
+
+var clientStreamDesc = &grpc.StreamDesc{
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+// gRPCHandler returns a handler that transparently proxies all gRPC requests that are not registered in the server.
+// Calls are retried(or hedged) against other targets according to the routes retry policy as long as
+// no response has been sent to the client & the request messages could be buffered.
+// listener is the name of the listener(this.listener) & secure is true if it serves TLS connections
+func (p *Proxy) gRPCHandler(listener string, secure bool) grpc.StreamHandler {
+	director := p.gRPCDirector(listener, secure)
+	return func(srv interface{}, serverStream grpc.ServerStream) error {
+		fullMethodName, ok := grpc.MethodFromServerStream(serverStream)
+		if !ok {
+			return status.Error(codes.Internal, "lowLevelServerStream not exists in context")
+		}
+		ctx, call, err := director(serverStream.Context(), fullMethodName)
+		if err != nil {
+			return err
+		}
+		policy := p.retryPolicy(call.route.name)
+		if policy == nil {
+			policy = &retry.Policy{}
+		}
+		policy.Request()
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		buf := newStreamBuffer(policy)
+		defer buf.close()
+		mirrorPolicy := p.mirrorPolicy(call.route.name)
+		mirrored := mirrorPolicy.Sample()
+		if mirrored {
+			// keep the request message so it can be sent to the shadow target once the call completes
+			buf.retainUpTo(mirrorPolicy.BodyLimit())
+		}
+		buf.limits = p.sizeLimit(call.route.name)
+		go buf.fill(serverStream)
+		go func() {
+			// abort the call(even if the response is being streamed) once the request exceeds the routes size limits
+			select {
+			case <-buf.failed:
+				if buf.tooLarge() != nil {
+					cancel()
+				}
+			case <-ctx.Done():
+			}
+		}()
+		start := time.Now()
+		err = p.proxyStream(ctx, serverStream, call.method, call, policy, buf)
+		if terr := buf.tooLarge(); terr != nil {
+			err = tooLargeStatus(call.route.name, terr)
+		}
+		if mirrored {
+			if msg, ok := buf.unary(); ok {
+				p.mirrorGRPC(ctx, call, mirrorPolicy, msg, err, time.Since(start))
+			} else {
+				metrics.MirrorRequests.WithLabelValues(call.route.name, "skipped").Inc()
+			}
+		}
+		return err
+	}
+}
+
+type attemptResult struct {
+	target string
+	stream grpc.ClientStream
+	first  *codec.Frame
+	err    error
+	done   func(outcome breaker.Outcome)
+}
+
+func (p *Proxy) proxyStream(ctx context.Context, serverStream grpc.ServerStream, method string, call *grpcCall, policy *retry.Policy, buf *streamBuffer) error {
+	var (
+		results  = make(chan *attemptResult, policy.Attempts())
+		cancels  []context.CancelFunc
+		dones    []func(outcome breaker.Outcome)
+		attempts = 0
+		lastErr  error
+		hedge    <-chan time.Time
+		backoff  <-chan time.Time
+		callOpts = p.grpcCallOptions(call.route.name)
+	)
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+		// release any circuit breaker probes held by attempts that didn't complete(ex: hedges that lost)
+		for _, done := range dones {
+			done(breaker.Ignored)
+		}
+	}()
+	start := func() error {
+		target, done, err := p.nextTarget(call.route, call.attempted)
+		if err != nil {
+			return err
+		}
+		call.attempted[target] = true
+		attempts++
+		attemptCtx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		dones = append(dones, done)
+		go p.attempt(attemptCtx, target, method, buf, results, done, callOpts...)
+		if policy.HedgingDelay > 0 && attempts < policy.Attempts() {
+			hedge = time.After(policy.HedgingDelay)
+		}
+		return nil
+	}
+	if err := start(); err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	pending := 1
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-buf.failed:
+			return status.Errorf(codes.Internal, "failed proxying s2c: %v", buf.error())
+		case <-hedge:
+			hedge = nil
+			if buf.complete() && attempts < policy.Attempts() && policy.AllowRetry() {
+				p.logger.Debug("hedging gRPC request", zap.String("method", method), zap.Int("attempt", attempts+1))
+				if err := start(); err == nil {
+					pending++
+				}
+			}
+		case <-backoff:
+			backoff = nil
+			if err := start(); err != nil {
+				if errors.Is(err, errNoHealthyTargets) {
+					return status.Error(codes.Unavailable, err.Error())
+				}
+				return lastErr
+			}
+			pending++
+		case result := <-results:
+			pending--
+			if result.err == nil || result.err == io.EOF {
+				result.done(breaker.Success)
+				return p.forwardResponse(serverStream, call, result)
+			}
+			lastErr = result.err
+			code := status.Code(result.err)
+			switch code {
+			case codes.Unavailable, codes.DeadlineExceeded, codes.Internal:
+				result.done(breaker.Failure)
+			case codes.Canceled:
+				result.done(breaker.Ignored)
+			default:
+				result.done(breaker.Success)
+			}
+			p.logger.Debug("gRPC attempt failed",
+				zap.String("method", method),
+				zap.String("target", result.target),
+				zap.Int("attempt", attempts),
+				zap.String("code", code.String()),
+			)
+			if policy.RetryableCode(code) {
+				if buf.replayable() && attempts < policy.Attempts() && backoff == nil && policy.AllowRetry() {
+					backoff = time.After(policy.Backoff(attempts))
+					continue
+				}
+				if pending > 0 || backoff != nil {
+					continue
+				}
+			}
+			if result.stream != nil {
+				serverStream.SetTrailer(result.stream.Trailer())
+			}
+			return result.err
+		}
+	}
+}
+
+// attempt sends the buffered request to the target & waits for the first response message
+func (p *Proxy) attempt(ctx context.Context, target, method string, buf *streamBuffer, results chan *attemptResult, done func(outcome breaker.Outcome), opts ...grpc.CallOption) {
+	result := &attemptResult{
+		target: target,
+		done:   done,
+	}
+	conn, err := p.dial(ctx, target)
+	if err != nil {
+		result.err = status.Error(codes.Unavailable, err.Error())
+		results <- result
+		return
+	}
+	clientStream, err := grpc.NewClientStream(ctx, clientStreamDesc, conn, method, opts...)
+	if err != nil {
+		result.err = err
+		results <- result
+		return
+	}
+	result.stream = clientStream
+	go func() {
+		for i := 0; ; i++ {
+			f, err := buf.next(ctx, i)
+			if err == io.EOF {
+				clientStream.CloseSend()
+				return
+			}
+			if err != nil {
+				return
+			}
+			if err := clientStream.SendMsg(f); err != nil {
+				return
+			}
+		}
+	}()
+	f := &codec.Frame{}
+	if err := clientStream.RecvMsg(f); err != nil {
+		result.err = err
+		results <- result
+		return
+	}
+	result.first = f
+	results <- result
+}
+
+// forwardResponse commits the attempt & forwards the remainder of the response stream to the client
+func (p *Proxy) forwardResponse(serverStream grpc.ServerStream, call *grpcCall, result *attemptResult) error {
+	rules := p.headerRules(call.route.name)
+	if result.first == nil {
+		if md, err := result.stream.Header(); err == nil {
+			md = md.Copy()
+			if err := rules.ResponseMetadata(md, call.data); err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			serverStream.SetHeader(md)
+		}
+		serverStream.SetTrailer(result.stream.Trailer())
+		return nil
+	}
+	md, err := result.stream.Header()
+	if err != nil {
+		return err
+	}
+	md = md.Copy()
+	if err := rules.ResponseMetadata(md, call.data); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := serverStream.SendHeader(md); err != nil {
+		return err
+	}
+	f := result.first
+	for {
+		if err := serverStream.SendMsg(f); err != nil {
+			return err
+		}
+		f = &codec.Frame{}
+		if err := result.stream.RecvMsg(f); err != nil {
+			serverStream.SetTrailer(result.stream.Trailer())
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// streamBuffer reads the clients request messages so they may be sent to one or more upstream attempts.
+// Messages are retained for replay until the request exceeds the retry policies buffer size
+type streamBuffer struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	msgs     []*codec.Frame
+	offset   int
+	size     int
+	limit    int
+	retain   bool
+	done     bool
+	err      error
+	consumed int
+	closed   bool
+	failed   chan struct{}
+	limits   *sizelimit.Limits
+}
+
+func newStreamBuffer(policy *retry.Policy) *streamBuffer {
+	b := &streamBuffer{
+		limit:  policy.BufferBytes(),
+		retain: policy.Attempts() > 1,
+		failed: make(chan struct{}),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *streamBuffer) fill(src grpc.ServerStream) {
+	for {
+		f := &codec.Frame{}
+		err := src.RecvMsg(f)
+		b.mu.Lock()
+		if err != nil {
+			if err == io.EOF {
+				b.done = true
+			} else {
+				b.err = err
+				close(b.failed)
+			}
+			b.cond.Broadcast()
+			b.mu.Unlock()
+			return
+		}
+		b.size += len(f.Payload)
+		if err := b.limits.CheckMessage(len(f.Payload), int64(b.size)); err != nil {
+			b.err = err
+			close(b.failed)
+			b.cond.Broadcast()
+			b.mu.Unlock()
+			return
+		}
+		if b.size > b.limit {
+			b.retain = false
+		}
+		b.msgs = append(b.msgs, f)
+		b.trim()
+		b.cond.Broadcast()
+		// apply backpressure to the client once messages are no longer retained for replay
+		for !b.retain && len(b.msgs) > 0 && !b.closed {
+			b.cond.Wait()
+		}
+		closed := b.closed
+		b.mu.Unlock()
+		if closed {
+			return
+		}
+	}
+}
+
+// trim drops messages that have been sent once they no longer need to be replayed
+func (b *streamBuffer) trim() {
+	if b.retain {
+		return
+	}
+	if drop := b.consumed - b.offset; drop > 0 {
+		if drop > len(b.msgs) {
+			drop = len(b.msgs)
+		}
+		b.msgs = b.msgs[drop:]
+		b.offset += drop
+	}
+}
+
+// next blocks until the i'th request message is available. It returns io.EOF once the client has half-closed the stream
+func (b *streamBuffer) next(ctx context.Context, i int) (*codec.Frame, error) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.mu.Lock()
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		case <-stop:
+		}
+	}()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if i < b.offset {
+			return nil, status.Error(codes.Internal, "request message is no longer buffered")
+		}
+		if i-b.offset < len(b.msgs) {
+			if i+1 > b.consumed {
+				b.consumed = i + 1
+			}
+			f := b.msgs[i-b.offset]
+			b.trim()
+			b.cond.Broadcast()
+			return f, nil
+		}
+		if b.err != nil {
+			return nil, b.err
+		}
+		if b.done {
+			return nil, io.EOF
+		}
+		b.cond.Wait()
+	}
+}
+
+// complete returns true if the entire request has been received & buffered
+func (b *streamBuffer) complete() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.done && b.retain && b.offset == 0
+}
+
+// replayable returns true if the request may be sent to another target
+func (b *streamBuffer) replayable() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.retain && b.offset == 0
+}
+
+// close releases the reader once the call has completed
+func (b *streamBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+// retainUpTo retains request messages(up to limit bytes) even if the call isn't retried
+func (b *streamBuffer) retainUpTo(limit int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.retain = true
+	if limit > b.limit {
+		b.limit = limit
+	}
+}
+
+// unary returns the request message if the client sent exactly one message & it was retained
+func (b *streamBuffer) unary() (*codec.Frame, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.done || !b.retain || b.offset != 0 || len(b.msgs) != 1 {
+		return nil, false
+	}
+	return b.msgs[0], true
+}
+
+func (b *streamBuffer) error() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// tooLarge returns the error if the request exceeded its size limits
+func (b *streamBuffer) tooLarge() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var terr *sizelimit.TooLargeError
+	if errors.As(b.err, &terr) {
+		return b.err
+	}
+	return nil
+}
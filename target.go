@@ -0,0 +1,116 @@
+package gproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/resolver"
+	"net"
+	"strings"
+)
+
+// grpcTarget is a parsed gRPC route target. Supported target grammar:
+//
+//	host:port                  plaintext, passthrough resolution(legacy)
+//	grpc://host:port           plaintext
+//	grpcs://host:port          TLS
+//	unix:///path/to/socket     plaintext over a unix socket(also unix:path)
+//	dns:///host:port           plaintext, resolved via DNS(any registered resolver scheme may be used)
+//	grpc+dns:///host:port      plaintext, resolved via the scheme after the +
+//	grpcs+dns:///host:port     TLS, resolved via the scheme after the +
+//
+// http:// & https:// targets are accepted as aliases of grpc:// & grpcs://
+type grpcTarget struct {
+	raw        string
+	dialTarget string
+	tls        bool
+	serverName string
+	unix       string
+}
+
+func parseGRPCTarget(raw string) (*grpcTarget, error) {
+	t := &grpcTarget{
+		raw: raw,
+	}
+	if strings.HasPrefix(raw, "unix:") {
+		path := strings.TrimPrefix(strings.TrimPrefix(raw, "unix:"), "//")
+		if path == "" {
+			return nil, errors.Errorf("gRPC target: empty unix socket path: %s", raw)
+		}
+		t.unix = path
+		t.dialTarget = "passthrough:///" + path
+		return t, nil
+	}
+	split := strings.SplitN(raw, "://", 2)
+	if len(split) == 1 {
+		if raw == "" {
+			return nil, errors.New("gRPC target: empty target")
+		}
+		t.dialTarget = raw
+		return t, nil
+	}
+	scheme, rest := strings.ToLower(split[0]), split[1]
+	if rest == "" {
+		return nil, errors.Errorf("gRPC target: empty address: %s", raw)
+	}
+	switch scheme {
+	case "grpc", "http":
+		t.dialTarget = strings.TrimSuffix(rest, "/")
+		return t, nil
+	case "grpcs", "https":
+		t.tls = true
+		t.dialTarget = strings.TrimSuffix(rest, "/")
+		t.serverName = hostname(t.dialTarget)
+		return t, nil
+	}
+	if strings.HasPrefix(scheme, "grpc+") || strings.HasPrefix(scheme, "grpcs+") {
+		t.tls = strings.HasPrefix(scheme, "grpcs+")
+		scheme = scheme[strings.Index(scheme, "+")+1:]
+	}
+	if resolver.Get(scheme) == nil {
+		return nil, errors.Errorf("gRPC target: unsupported scheme: %s", scheme)
+	}
+	t.dialTarget = scheme + "://" + rest
+	if t.tls {
+		// scheme://authority/endpoint - the endpoint is the name presented to the server
+		endpoint := rest
+		if i := strings.Index(rest, "/"); i >= 0 {
+			endpoint = rest[i+1:]
+		}
+		t.serverName = hostname(endpoint)
+	}
+	return t, nil
+}
+
+func hostname(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// dialOptions returns the dial options that select the targets transport
+func (t *grpcTarget) dialOptions() []grpc.DialOption {
+	var opts []grpc.DialOption
+	if t.tls {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			ServerName: t.serverName,
+		})))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	if t.unix != "" {
+		path := t.unix
+		opts = append(opts,
+			grpc.WithAuthority("localhost"),
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			}),
+		)
+	}
+	return opts
+}
@@ -0,0 +1,284 @@
+package gproxy
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/graphikDB/gproxy/breaker"
+	"github.com/graphikDB/gproxy/retry"
+	"github.com/graphikDB/gproxy/sizelimit"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type httpCall struct {
+	route         *route
+	data          map[string]interface{}
+	inbound       *url.URL
+	attempted     map[string]bool
+	authenticated bool
+	stickyCookie  *http.Cookie
+	target        string
+	// denied is set if the request was rejected by its routes ip filter, authentication requirement, authorization
+	// policies, header limit or rate limiter
+	denied error
+	// rulesFailed is set if the routes request header rules couldn't be applied
+	rulesFailed error
+}
+
+// headerRulesError is returned when a routes request header rules fail to apply to a request
+type headerRulesError struct {
+	route string
+	err   error
+}
+
+func (e *headerRulesError) Error() string {
+	return fmt.Sprintf("route %s: failed to apply header rules: %s", e.route, e.err)
+}
+
+type httpCallCtxKey struct{}
+
+// upstreamTransport sends proxied http requests to their routes targets, retrying against other targets
+// according to the routes retry policy
+type upstreamTransport struct {
+	proxy *Proxy
+	base  http.RoundTripper
+}
+
+func (p *Proxy) httpTransport() http.RoundTripper {
+	return &upstreamTransport{
+		proxy: p,
+		base:  http.DefaultTransport,
+	}
+}
+
+// admitHTTP returns the error a request is rejected with by its routes authentication requirement, ip filter, authorization
+// policies, header limit or rate limiter. The clients headers are measured before the proxy adds its own
+func (p *Proxy) admitHTTP(req *http.Request, rt *route, data map[string]interface{}, authenticated bool) error {
+	if !authenticated && p.authRequired(rt.name) {
+		return errUnauthenticated
+	}
+	if err := p.checkIP(rt, data); err != nil {
+		return err
+	}
+	if err := p.authorize(rt, data); err != nil {
+		return err
+	}
+	if err := p.sizeLimit(rt.name).CheckHeader(req.Header); err != nil {
+		return tooLarge(rt.name, err)
+	}
+	return p.rateLimit(req.Context(), rt, data)
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	call, ok := req.Context().Value(httpCallCtxKey{}).(*httpCall)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	if call.denied != nil {
+		return nil, call.denied
+	}
+	if call.rulesFailed != nil {
+		return nil, call.rulesFailed
+	}
+	if err := t.proxy.sizeLimit(call.route.name).LimitBody(req); err != nil {
+		return nil, tooLarge(call.route.name, err)
+	}
+	shadow := t.proxy.prepareHTTPMirror(req, call)
+	start := time.Now()
+	resp, err := t.fetch(req, call)
+	if shadow != nil {
+		t.proxy.mirrorHTTP(call.route.name, shadow, resp, err, time.Since(start))
+	}
+	return resp, err
+}
+
+// send sends the request to the routes targets, retrying according to the routes retry policy
+func (t *upstreamTransport) send(req *http.Request, call *httpCall) (*http.Response, error) {
+	policy := t.proxy.retryPolicy(call.route.name)
+	policy.Request()
+	attempts := policy.Attempts()
+	if attempts > 1 && !replayable(req, policy) {
+		attempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		target, done, err := t.proxy.nextTarget(call.route, call.attempted)
+		if err != nil {
+			return nil, err
+		}
+		call.attempted[target] = true
+		call.target = target
+		if err := setHTTPTarget(req, target, call.inbound); err != nil {
+			done(breaker.Ignored)
+			return nil, err
+		}
+		resp, err := t.proxy.upstreamTransport(call.route.name, t.base).RoundTrip(req)
+		if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+			done(breaker.Failure)
+		} else {
+			done(breaker.Success)
+		}
+		if attempt >= attempts {
+			return resp, err
+		}
+		if err == nil && !policy.RetryableStatus(resp.StatusCode) {
+			return resp, nil
+		}
+		if !policy.AllowRetry() {
+			return resp, err
+		}
+		fields := []zap.Field{
+			zap.String("route", call.route.name),
+			zap.String("target", target),
+			zap.Int("attempt", attempt),
+		}
+		if err != nil {
+			fields = append(fields, zap.Error(err))
+		} else {
+			fields = append(fields, zap.Int("status", resp.StatusCode))
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		t.proxy.logger.Debug("retrying http request", fields...)
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(policy.Backoff(attempt)):
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+// upstreamTransport returns the transport registered for the route, falling back to the default("*") transport & then base
+func (p *Proxy) upstreamTransport(routeName string, base http.RoundTripper) http.RoundTripper {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if rt, ok := p.transports[routeName]; ok {
+		return rt
+	}
+	if rt, ok := p.transports["*"]; ok {
+		return rt
+	}
+	return base
+}
+
+// modifyResponse applies the routes response header rules & compression to upstream responses & sets newly issued
+// canary sticky & affinity cookies
+func (p *Proxy) modifyResponse() func(resp *http.Response) error {
+	return func(resp *http.Response) error {
+		call, ok := resp.Request.Context().Value(httpCallCtxKey{}).(*httpCall)
+		if !ok {
+			return nil
+		}
+		if call.stickyCookie != nil {
+			resp.Header.Add("Set-Cookie", call.stickyCookie.String())
+		}
+		if cookie := p.affinityCookie(call.route, call.target); cookie != nil {
+			resp.Header.Add("Set-Cookie", cookie.String())
+		}
+		if err := p.headerRules(call.route.name).ResponseHTTP(resp.Header, call.data); err != nil {
+			return err
+		}
+		return p.compressResponse(call.route.name, resp)
+	}
+}
+
+// httpErrorHandler writes a 401 when a route requires authentication, a 403 when a request was denied by an ip filter or authorization policy, a 429 when a request was rate limited, a 500 when a routes header rules failed,
+// a 503 when a request was short-circuited by circuit breakers & a 502 for all other upstream errors
+func (p *Proxy) httpErrorHandler() func(w http.ResponseWriter, r *http.Request, err error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		p.logger.Debug("http proxy error", zap.String("host", r.Host), zap.String("path", r.URL.Path), zap.Error(err))
+		if errors.Is(err, errUnauthenticated) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var aerr *authzError
+		if errors.Is(err, errIPDenied) || errors.As(err, &aerr) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var rerr *rateLimitError
+		if errors.As(err, &rerr) {
+			w.Header().Set("Retry-After", rerr.retryAfter())
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		var terr *sizelimit.TooLargeError
+		if errors.As(err, &terr) {
+			if terr.Limit == "header" {
+				w.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
+			} else {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+			}
+			return
+		}
+		var herr *headerRulesError
+		if errors.As(err, &herr) {
+			p.logger.Error("failed to apply header rules", zap.String("route", herr.route), zap.Error(herr.err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if errors.Is(err, errNoHealthyTargets) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// replayable reports whether the request may be sent more than once. Only idempotent requests are retried, and
+// request bodies are buffered(up to the policies limit) so they may be replayed
+func replayable(req *http.Request, policy *retry.Policy) bool {
+	if !retry.Idempotent(req.Method) && req.Header.Get("Idempotency-Key") == "" {
+		return false
+	}
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return true
+	}
+	limit := policy.BufferBytes()
+	buffered, err := ioutil.ReadAll(io.LimitReader(req.Body, int64(limit)+1))
+	if err != nil || len(buffered) > limit {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{
+			Reader: io.MultiReader(bytes.NewReader(buffered), req.Body),
+			Closer: req.Body,
+		}
+		return false
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(buffered))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buffered)), nil
+	}
+	return true
+}
+
+// setHTTPTarget points the outbound request at the target, joining the targets path & query with the inbound url
+func setHTTPTarget(req *http.Request, target string, inbound *url.URL) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	req.URL.Scheme = u.Scheme
+	req.URL.Host = u.Host
+	req.URL.Path, req.URL.RawPath = joinURLPath(u, inbound)
+	if u.RawQuery == "" || inbound.RawQuery == "" {
+		req.URL.RawQuery = u.RawQuery + inbound.RawQuery
+	} else {
+		req.URL.RawQuery = u.RawQuery + "&" + inbound.RawQuery
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Package upstream builds the http transports used to send proxied requests to route targets
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Protocol is the http protocol spoken to targets
+type Protocol string
+
+const (
+	// Auto speaks HTTP/1.1, negotiating HTTP/2 with TLS targets via ALPN(default)
+	Auto Protocol = "auto"
+	// HTTP1 only speaks HTTP/1.1
+	HTTP1 Protocol = "http1"
+	// HTTP2 speaks HTTP/2 over TLS(https targets)
+	HTTP2 Protocol = "h2"
+	// H2C speaks HTTP/2 cleartext with prior knowledge(http targets). Websocket upgrades are not supported
+	H2C Protocol = "h2c"
+)
+
+// Config configures the transport used to reach a routes targets. Zero values use the defaults of http.DefaultTransport
+type Config struct {
+	// Protocol is the http protocol spoken to targets(default: Auto)
+	Protocol Protocol
+	// DialTimeout is the maximum amount of time a dial will wait for a connection to complete(default: 30s)
+	DialTimeout time.Duration
+	// KeepAlive is the interval of TCP keep-alive probes(default: 30s). Negative values disable keep-alive probes
+	KeepAlive time.Duration
+	// MaxIdleConns is the maximum number of idle connections across all targets(default: 100)
+	MaxIdleConns int
+	// MaxIdleConnsPerHost is the maximum number of idle connections to each target(default: 2)
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits the total number of connections to each target(default: 0 = unlimited)
+	MaxConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept open(default: 90s)
+	IdleConnTimeout time.Duration
+	// ResponseHeaderTimeout is how long to wait for a targets response headers after the request is written(default: 0 = no timeout)
+	ResponseHeaderTimeout time.Duration
+	// TLSHandshakeTimeout is the maximum amount of time to wait for a TLS handshake(default: 10s)
+	TLSHandshakeTimeout time.Duration
+	// ExpectContinueTimeout is how long to wait for a 100-continue response(default: 1s)
+	ExpectContinueTimeout time.Duration
+	// DisableKeepAlives disables connection reuse(HTTP/1.1 only)
+	DisableKeepAlives bool
+	// DisableCompression disables transparent gzip compression of responses
+	DisableCompression bool
+	// PingInterval sends HTTP/2 health check pings on connections that haven't received frames for the interval(default: 0 = disabled)
+	PingInterval time.Duration
+	// PingTimeout closes HTTP/2 connections that don't respond to a health check ping(default: 15s)
+	PingTimeout time.Duration
+	// TLS configures connections to https targets(optional)
+	TLS *tls.Config
+}
+
+// New creates a transport from the config
+func New(config *Config) (http.RoundTripper, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	dialer := &net.Dialer{
+		Timeout:   durationOr(config.DialTimeout, 30*time.Second),
+		KeepAlive: durationOr(config.KeepAlive, 30*time.Second),
+	}
+	switch config.Protocol {
+	case "", Auto, HTTP1, HTTP2:
+	case H2C:
+		return &http2.Transport{
+			AllowHTTP:          true,
+			DisableCompression: config.DisableCompression,
+			ReadIdleTimeout:    config.PingInterval,
+			PingTimeout:        config.PingTimeout,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.Dial(network, addr)
+			},
+		}, nil
+	default:
+		return nil, errors.Errorf("upstream: unsupported protocol: %s", config.Protocol)
+	}
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		MaxIdleConns:          intOr(config.MaxIdleConns, 100),
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		IdleConnTimeout:       durationOr(config.IdleConnTimeout, 90*time.Second),
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		TLSHandshakeTimeout:   durationOr(config.TLSHandshakeTimeout, 10*time.Second),
+		ExpectContinueTimeout: durationOr(config.ExpectContinueTimeout, time.Second),
+		DisableKeepAlives:     config.DisableKeepAlives,
+		DisableCompression:    config.DisableCompression,
+	}
+	if config.TLS != nil {
+		t.TLSClientConfig = config.TLS.Clone()
+	}
+	if config.Protocol == HTTP1 {
+		// a non-nil, empty map disables HTTP/2
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		return t, nil
+	}
+	t2, err := http2.ConfigureTransports(t)
+	if err != nil {
+		return nil, errors.Wrap(err, "upstream")
+	}
+	t2.ReadIdleTimeout = config.PingInterval
+	t2.PingTimeout = config.PingTimeout
+	if config.Protocol == HTTP2 {
+		t.TLSClientConfig.NextProtos = []string{http2.NextProtoTLS}
+	}
+	return t, nil
+}
+
+func durationOr(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+func intOr(i, def int) int {
+	if i == 0 {
+		return def
+	}
+	return i
+}
@@ -0,0 +1,75 @@
+package upstream_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/graphikDB/gproxy/upstream"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var protoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/slow" {
+		time.Sleep(500 * time.Millisecond)
+	}
+	fmt.Fprint(w, r.Proto)
+})
+
+func get(t *testing.T, rt http.RoundTripper, url string) (string, error) {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	bits, err := ioutil.ReadAll(resp.Body)
+	return string(bits), err
+}
+
+func TestNew(t *testing.T) {
+	cleartext := httptest.NewServer(h2c.NewHandler(protoHandler, &http2.Server{}))
+	defer cleartext.Close()
+	secure := httptest.NewUnstartedServer(protoHandler)
+	secure.EnableHTTP2 = true
+	secure.StartTLS()
+	defer secure.Close()
+	insecureTLS := &tls.Config{InsecureSkipVerify: true}
+	for _, tc := range []struct {
+		config   *upstream.Config
+		url      string
+		expected string
+	}{
+		{&upstream.Config{}, cleartext.URL, "HTTP/1.1"},
+		{&upstream.Config{Protocol: upstream.H2C, PingInterval: time.Second}, cleartext.URL, "HTTP/2.0"},
+		{&upstream.Config{TLS: insecureTLS}, secure.URL, "HTTP/2.0"},
+		{&upstream.Config{Protocol: upstream.HTTP2, TLS: insecureTLS}, secure.URL, "HTTP/2.0"},
+		{&upstream.Config{Protocol: upstream.HTTP1, TLS: insecureTLS, DisableKeepAlives: true}, secure.URL, "HTTP/1.1"},
+	} {
+		rt, err := upstream.New(tc.config)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		proto, err := get(t, rt, tc.url)
+		if err != nil {
+			t.Fatalf("%s %s: %s", tc.config.Protocol, tc.url, err.Error())
+		}
+		if proto != tc.expected {
+			t.Fatalf("%s %s: expected %s got %s", tc.config.Protocol, tc.url, tc.expected, proto)
+		}
+	}
+	rt, err := upstream.New(&upstream.Config{ResponseHeaderTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := get(t, rt, cleartext.URL+"/slow"); err == nil {
+		t.Fatal("expected response header timeout")
+	}
+	if _, err := upstream.New(&upstream.Config{Protocol: "spdy"}); err == nil {
+		t.Fatal("expected unsupported protocol error")
+	}
+}